@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// ArrayValueType is the ValueType of conditions on array fields. Their
+// operators are:
+//
+//	"contains"  an element equals Value
+//	"any"       some element satisfies Value, a FilterCondition
+//	"all"       every element satisfies Value (an empty array does)
+//	"length"    the number of elements satisfies Value, a FilterCondition
+//	            such as {ValueType: "int", Operator: ">=", Value: 2}, or equals
+//	            Value when it is an int
+//
+// The Key of a sub-condition is a field (or dotted path) of object
+// elements; an empty Key tests the element itself.
+const ArrayValueType = "array"
+
+// ArrayContains returns a condition matching records whose array field key
+// has an element equal to value
+func ArrayContains(key string, value interface{}) FilterCondition {
+	return FilterCondition{Key: key, ValueType: ArrayValueType, Operator: "contains", Value: value}
+}
+
+// AnyElement returns a condition matching records where some element of the
+// array field key satisfies sub
+func AnyElement(key string, sub FilterCondition) FilterCondition {
+	return FilterCondition{Key: key, ValueType: ArrayValueType, Operator: "any", Value: sub}
+}
+
+// AllElements returns a condition matching records where every element of
+// the array field key satisfies sub
+func AllElements(key string, sub FilterCondition) FilterCondition {
+	return FilterCondition{Key: key, ValueType: ArrayValueType, Operator: "all", Value: sub}
+}
+
+// ArrayLength returns a condition comparing the number of elements of the
+// array field key with n, using one of the int operators
+func ArrayLength(key string, operator string, n int) FilterCondition {
+	return FilterCondition{Key: key, ValueType: ArrayValueType, Operator: "length",
+		Value: FilterCondition{ValueType: "int", Operator: operator, Value: n}}
+}
+
+// applyArrayCondition applies an array condition, testing elements and
+// lengths with match
+func applyArrayCondition(fieldValue interface{}, condition FilterCondition, match func(interface{}, FilterCondition) bool) bool {
+	elements, ok := fieldValue.([]interface{})
+	if !ok {
+		return false
+	}
+
+	switch condition.Operator {
+	case "contains":
+		for _, element := range elements {
+			if elementEqual(element, condition.Value, condition.Collation) {
+				return true
+			}
+		}
+		return false
+	case "length":
+		if n, ok := condition.Value.(int); ok {
+			return len(elements) == n
+		}
+		sub, ok := subCondition(condition.Value)
+		return ok && match(float64(len(elements)), sub) // Counted like a JSON number
+	case "any", "all":
+		sub, ok := subCondition(condition.Value)
+		if !ok {
+			return false
+		}
+		all := condition.Operator == "all"
+		for _, element := range elements {
+			if matchElement(element, sub, match) != all {
+				return !all
+			}
+		}
+		return all
+	default:
+		return false
+	}
+}
+
+// matchElement tests one array element against a sub-condition
+func matchElement(element interface{}, sub FilterCondition, match func(interface{}, FilterCondition) bool) bool {
+	if sub.ValueType == ExprValueType || sub.Key != "" {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if sub.ValueType == ExprValueType {
+			return matchExpr(object, sub)
+		}
+		if element, ok = resolvePath(object, sub.Key); !ok {
+			return false
+		}
+	}
+	return match(element, sub)
+}
+
+// subCondition returns the FilterCondition held by an array condition's
+// Value, decoding the JSON object form
+func subCondition(value interface{}) (FilterCondition, bool) {
+	switch v := value.(type) {
+	case FilterCondition:
+		return v, true
+	case *FilterCondition:
+		return *v, v != nil
+	case map[string]interface{}:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return FilterCondition{}, false
+		}
+		var sub FilterCondition
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return FilterCondition{}, false
+		}
+		return normalizeConditions([]FilterCondition{sub})[0], true
+	}
+	return FilterCondition{}, false
+}
+
+// elementEqual reports whether an array element equals value, comparing
+// numbers by value and strings under collation
+func elementEqual(element, value interface{}, collation Collation) bool {
+	if a, ok := numericValue(element); ok {
+		b, ok := numericValue(value)
+		return ok && a == b
+	}
+	if a, ok := element.(string); ok {
+		b, ok := value.(string)
+		if !ok {
+			return false
+		}
+		if collation == BinaryCollation {
+			return a == b
+		}
+		co, err := collatorFor(collation)
+		return err == nil && co.compare(a, b) == 0
+	}
+	return reflect.DeepEqual(element, value)
+}
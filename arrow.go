@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// Arrow column types produced by ToArrow
+const (
+	ArrowInt64     = "int64"
+	ArrowFloat64   = "float64"
+	ArrowBool      = "bool"
+	ArrowUtf8      = "utf8"
+	ArrowDate32    = "date32"        // Days since 1970-01-01
+	ArrowTimestamp = "timestamp[ms]" // Milliseconds since 1970-01-01 00:00:00, without time zone
+)
+
+// Rows per record batch when ExportOptions.BatchSize is not set
+const defaultArrowBatchSize = 64 * 1024
+
+// ArrowField is a column of an ArrowTable
+type ArrowField struct {
+	Name string
+	Type string // One of the Arrow* type constants
+}
+
+// ArrowColumn holds the values of a column of a record batch in the Arrow
+// columnar layout, ready to be handed to Arrow libraries without conversion
+type ArrowColumn struct {
+	NullCount int
+	Validity  []byte  // Bit i (least significant first) is set when row i is not null; nil without nulls
+	Offsets   []int32 // Start of each row's bytes in Values, then the end of the last (utf8 only)
+	Values    []byte  // Little-endian values, bits for bool, UTF-8 bytes for utf8
+}
+
+// ArrowRecordBatch is a group of rows of an ArrowTable
+type ArrowRecordBatch struct {
+	Rows    int
+	Columns []ArrowColumn // In the order of the table's fields
+}
+
+// ArrowTable is a set of records converted to Apache Arrow record batches
+type ArrowTable struct {
+	Fields  []ArrowField
+	Batches []ArrowRecordBatch
+}
+
+// ToArrow converts results to Arrow record batches of opts.BatchSize rows,
+// with a column per field of opts.Columns (default every field, sorted),
+// typed from the schema inferred from results (see InferSchema): integers
+// as int64, floats as float64, booleans as bool, dates as date32, datetimes
+// as timestamp[ms], and strings as utf8. Objects, arrays and fields of mixed
+// type become utf8 columns of JSON text. Missing fields and values that do
+// not fit the column type are null.
+func ToArrow(results []map[string]interface{}, opts ExportOptions) *ArrowTable {
+	columns := columnsFor(results, opts.Columns)
+	schema := columnSchema(results, columns)
+	table := &ArrowTable{Fields: make([]ArrowField, len(columns))}
+	for i, column := range columns {
+		kind := "mixed"
+		if fs, ok := schema.Fields[column]; ok {
+			kind = fs.Type
+		}
+		table.Fields[i] = ArrowField{Name: column, Type: arrowType(kind)}
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultArrowBatchSize
+	}
+	for start := 0; start < len(results); start += batchSize {
+		rows := results[start:min(start+batchSize, len(results))]
+		batch := ArrowRecordBatch{Rows: len(rows), Columns: make([]ArrowColumn, len(columns))}
+		for i, field := range table.Fields {
+			batch.Columns[i] = arrowColumn(rows, field)
+		}
+		table.Batches = append(table.Batches, batch)
+	}
+	return table
+}
+
+// arrowType maps an inferred schema type to an Arrow type
+func arrowType(kind string) string {
+	switch kind {
+	case "int":
+		return ArrowInt64
+	case "float":
+		return ArrowFloat64
+	case "bool":
+		return ArrowBool
+	case "date":
+		return ArrowDate32
+	case "datetime":
+		return ArrowTimestamp
+	default:
+		return ArrowUtf8
+	}
+}
+
+// arrowColumn builds the buffers of field over rows
+func arrowColumn(rows []map[string]interface{}, field ArrowField) ArrowColumn {
+	var col ArrowColumn
+	validity := make([]byte, (len(rows)+7)/8)
+	switch field.Type {
+	case ArrowBool:
+		col.Values = make([]byte, (len(rows)+7)/8)
+	case ArrowUtf8:
+		col.Offsets = make([]int32, 1, len(rows)+1)
+	default:
+		col.Values = make([]byte, 0, 8*len(rows))
+	}
+
+	for i, record := range rows {
+		value, _ := resolvePath(record, field.Name)
+		valid := value != nil
+		switch field.Type {
+		case ArrowInt64, ArrowFloat64, ArrowDate32, ArrowTimestamp:
+			var bits uint64
+			bits, valid = arrowFixed(value, field.Type)
+			if field.Type == ArrowDate32 {
+				col.Values = binary.LittleEndian.AppendUint32(col.Values, uint32(bits))
+			} else {
+				col.Values = binary.LittleEndian.AppendUint64(col.Values, bits)
+			}
+		case ArrowBool:
+			b, ok := value.(bool)
+			valid = ok
+			if b {
+				col.Values[i/8] |= 1 << (i % 8)
+			}
+		case ArrowUtf8:
+			if s, ok := value.(string); ok {
+				col.Values = append(col.Values, s...)
+			} else if valid {
+				raw, err := json.Marshal(value)
+				valid = err == nil
+				col.Values = append(col.Values, raw...)
+			}
+			col.Offsets = append(col.Offsets, int32(len(col.Values)))
+		}
+		if valid {
+			validity[i/8] |= 1 << (i % 8)
+		} else {
+			col.NullCount++
+		}
+	}
+	if col.NullCount > 0 {
+		col.Validity = validity
+	}
+	return col
+}
+
+// arrowFixed encodes a value of a fixed-width column, reporting whether it fits
+func arrowFixed(value interface{}, kind string) (uint64, bool) {
+	switch kind {
+	case ArrowInt64:
+		switch v := value.(type) {
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return uint64(int64(v)), true
+			}
+		case int:
+			return uint64(int64(v)), true
+		case int64:
+			return uint64(v), true
+		}
+	case ArrowFloat64:
+		switch v := value.(type) {
+		case float64:
+			return math.Float64bits(v), true
+		case int:
+			return math.Float64bits(float64(v)), true
+		case int64:
+			return math.Float64bits(float64(v)), true
+		}
+	case ArrowDate32:
+		if s, ok := value.(string); ok {
+			if t, err := time.Parse("2006-01-02", s); err == nil {
+				return uint64(uint32(int32(t.Unix() / 86400))), true
+			}
+		}
+	case ArrowTimestamp:
+		if s, ok := value.(string); ok {
+			if t, err := time.Parse("2006-01-02 15:04:05", s); err == nil {
+				return uint64(t.UnixMilli()), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// WriteIPCStream writes the table in the Arrow IPC streaming format, read by
+// pyarrow.ipc.open_stream, arrow::read_ipc_stream and DuckDB
+func (t *ArrowTable) WriteIPCStream(w io.Writer) error {
+	aw := &arrowWriter{w: bufio.NewWriter(w)}
+	aw.message(arrowSchemaMessage(t.Fields), nil)
+	for _, batch := range t.Batches {
+		aw.message(arrowBatchMessage(batch))
+	}
+	aw.write(arrowEndOfStream)
+	if aw.err != nil {
+		return aw.err
+	}
+	return aw.w.Flush()
+}
+
+// WriteIPCFile writes the table in the Arrow IPC file format, also known as
+// Feather version 2, read by pyarrow.feather, arrow::read_feather and DuckDB
+func (t *ArrowTable) WriteIPCFile(w io.Writer) error {
+	aw := &arrowWriter{w: bufio.NewWriter(w)}
+	aw.write(arrowMagic[:8])
+	aw.message(arrowSchemaMessage(t.Fields), nil)
+	var blocks []byte
+	for _, batch := range t.Batches {
+		offset := aw.n
+		metaLen, bodyLen := aw.message(arrowBatchMessage(batch))
+		blocks = binary.LittleEndian.AppendUint64(blocks, uint64(offset))
+		blocks = binary.LittleEndian.AppendUint32(blocks, uint32(metaLen))
+		blocks = append(blocks, 0, 0, 0, 0)
+		blocks = binary.LittleEndian.AppendUint64(blocks, uint64(bodyLen))
+	}
+	aw.write(arrowEndOfStream)
+
+	footer := fbFinish(&fbTable{fields: []fbField{
+		{scalar: fbInt16(arrowMetadataV5)},
+		{child: arrowSchema(t.Fields)},
+		{child: fbStructs{size: 24}},
+		{child: fbStructs{data: blocks, size: 24}},
+	}})
+	aw.write(footer)
+	aw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer))))
+	aw.write(arrowMagic[:6])
+	if aw.err != nil {
+		return aw.err
+	}
+	return aw.w.Flush()
+}
+
+var (
+	arrowMagic       = [8]byte{'A', 'R', 'R', 'O', 'W', '1', 0, 0}
+	arrowEndOfStream = []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+)
+
+// Arrow format constants from Schema.fbs and Message.fbs
+const (
+	arrowMetadataV5      = 4
+	arrowHeaderSchema    = 1
+	arrowHeaderBatch     = 3
+	arrowTypeInt         = 2
+	arrowTypeFloat       = 3
+	arrowTypeUtf8        = 5
+	arrowTypeBool        = 6
+	arrowTypeDate        = 8
+	arrowTypeTimestamp   = 10
+	arrowDoublePrecision = 2
+	arrowDateDay         = 0
+	arrowMillisecond     = 1
+)
+
+// arrowWriter writes encapsulated IPC messages, counting the bytes written
+type arrowWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (aw *arrowWriter) write(b []byte) {
+	if aw.err != nil {
+		return
+	}
+	var n int
+	n, aw.err = aw.w.Write(b)
+	aw.n += int64(n)
+}
+
+// message writes a continuation marker, the metadata padded to 8 bytes and
+// the body, returning the sizes recorded in the file footer
+func (aw *arrowWriter) message(metadata, body []byte) (int, int) {
+	padded := len(metadata) + (8-(len(metadata)+8)%8)%8
+	prefix := binary.LittleEndian.AppendUint32([]byte{0xff, 0xff, 0xff, 0xff}, uint32(padded))
+	aw.write(prefix)
+	aw.write(metadata)
+	aw.write(make([]byte, padded-len(metadata)))
+	aw.write(body)
+	return len(prefix) + padded, len(body)
+}
+
+// arrowSchemaMessage encodes the Schema message of fields
+func arrowSchemaMessage(fields []ArrowField) []byte {
+	return fbFinish(&fbTable{fields: []fbField{
+		{scalar: fbInt16(arrowMetadataV5)},
+		{scalar: []byte{arrowHeaderSchema}},
+		{child: arrowSchema(fields)},
+		{scalar: fbInt64(0)},
+	}})
+}
+
+// arrowSchema builds the Schema table of fields
+func arrowSchema(fields []ArrowField) *fbTable {
+	tables := make([]*fbTable, len(fields))
+	for i, field := range fields {
+		var typeID byte
+		var typ *fbTable
+		switch field.Type {
+		case ArrowInt64:
+			typeID, typ = arrowTypeInt, &fbTable{fields: []fbField{{scalar: fbInt32(64)}, {scalar: []byte{1}}}}
+		case ArrowFloat64:
+			typeID, typ = arrowTypeFloat, &fbTable{fields: []fbField{{scalar: fbInt16(arrowDoublePrecision)}}}
+		case ArrowBool:
+			typeID, typ = arrowTypeBool, &fbTable{}
+		case ArrowDate32:
+			typeID, typ = arrowTypeDate, &fbTable{fields: []fbField{{scalar: fbInt16(arrowDateDay)}}}
+		case ArrowTimestamp:
+			typeID, typ = arrowTypeTimestamp, &fbTable{fields: []fbField{{scalar: fbInt16(arrowMillisecond)}}}
+		default:
+			typeID, typ = arrowTypeUtf8, &fbTable{}
+		}
+		tables[i] = &fbTable{fields: []fbField{
+			{child: field.Name},
+			{scalar: []byte{1}}, // nullable
+			{scalar: []byte{typeID}},
+			{child: typ},
+			{}, // dictionary
+			{child: []*fbTable{}},
+		}}
+	}
+	return &fbTable{fields: []fbField{
+		{scalar: fbInt16(0)}, // little endian
+		{child: tables},
+	}}
+}
+
+// arrowBatchMessage encodes the RecordBatch message and body of batch
+func arrowBatchMessage(batch ArrowRecordBatch) ([]byte, []byte) {
+	var nodes, buffers, body []byte
+	addBuffer := func(b []byte) {
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(b)))
+		body = append(body, b...)
+		body = append(body, make([]byte, (8-len(b)%8)%8)...)
+	}
+	for _, col := range batch.Columns {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(batch.Rows))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(col.NullCount))
+		addBuffer(col.Validity)
+		if col.Offsets != nil {
+			offsets := make([]byte, 0, 4*len(col.Offsets))
+			for _, offset := range col.Offsets {
+				offsets = binary.LittleEndian.AppendUint32(offsets, uint32(offset))
+			}
+			addBuffer(offsets)
+		}
+		addBuffer(col.Values)
+	}
+
+	header := &fbTable{fields: []fbField{
+		{scalar: fbInt64(int64(batch.Rows))},
+		{child: fbStructs{data: nodes, size: 16}},
+		{child: fbStructs{data: buffers, size: 16}},
+	}}
+	return fbFinish(&fbTable{fields: []fbField{
+		{scalar: fbInt16(arrowMetadataV5)},
+		{scalar: []byte{arrowHeaderBatch}},
+		{child: header},
+		{scalar: fbInt64(int64(len(body)))},
+	}}), body
+}
+
+// fbTable is a FlatBuffers table whose fields are listed by field id; a
+// zero fbField leaves the field absent
+type fbTable struct {
+	fields []fbField
+}
+
+// fbField is a scalar stored inline, or a child: a *fbTable, a string, a
+// []*fbTable vector or an fbStructs vector
+type fbField struct {
+	scalar []byte
+	child  interface{}
+}
+
+// fbStructs is a vector of structs of size bytes with 8-byte alignment
+type fbStructs struct {
+	data []byte
+	size int
+}
+
+// fbBuilder lays out a FlatBuffers buffer front to back: each table is
+// preceded by its vtable and followed by its children, so every offset
+// points forward as the format requires
+type fbBuilder struct {
+	buf []byte
+}
+
+// fbFinish encodes root as a FlatBuffers buffer
+func fbFinish(root *fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4, 256)}
+	binary.LittleEndian.PutUint32(b.buf, uint32(b.table(root)))
+	return b.buf
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// table appends t and its children, returning its position
+func (b *fbBuilder) table(t *fbTable) int {
+	b.pad(2)
+	vtable := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4+2*len(t.fields))...)
+	b.pad(8)
+	start := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(int32(start-vtable)))
+
+	type slot struct {
+		pos   int
+		child interface{}
+	}
+	var slots []slot
+	for i, f := range t.fields {
+		switch {
+		case f.scalar != nil:
+			b.pad(len(f.scalar))
+			binary.LittleEndian.PutUint16(b.buf[vtable+4+2*i:], uint16(len(b.buf)-start))
+			b.buf = append(b.buf, f.scalar...)
+		case f.child != nil:
+			b.pad(4)
+			binary.LittleEndian.PutUint16(b.buf[vtable+4+2*i:], uint16(len(b.buf)-start))
+			slots = append(slots, slot{len(b.buf), f.child})
+			b.buf = append(b.buf, 0, 0, 0, 0)
+		}
+	}
+	binary.LittleEndian.PutUint16(b.buf[vtable:], uint16(4+2*len(t.fields)))
+	binary.LittleEndian.PutUint16(b.buf[vtable+2:], uint16(len(b.buf)-start))
+
+	for _, s := range slots {
+		b.patch(s.pos, b.child(s.child))
+	}
+	return start
+}
+
+// child appends a table, string or vector, returning its position
+func (b *fbBuilder) child(c interface{}) int {
+	switch v := c.(type) {
+	case *fbTable:
+		return b.table(v)
+	case string:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(append(b.buf, v...), 0)
+		return pos
+	case []*fbTable:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			b.patch(pos+4+4*i, b.table(t))
+		}
+		return pos
+	case fbStructs:
+		// Align the elements, which follow the 4-byte length, to 8 bytes
+		for len(b.buf)%8 != 4 {
+			b.buf = append(b.buf, 0)
+		}
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v.data)/v.size))
+		b.buf = append(b.buf, v.data...)
+		return pos
+	}
+	panic("unsupported FlatBuffers value")
+}
+
+// patch stores at pos the offset to target
+func (b *fbBuilder) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+func fbInt16(v int16) []byte { return binary.LittleEndian.AppendUint16(nil, uint16(v)) }
+func fbInt32(v int32) []byte { return binary.LittleEndian.AppendUint32(nil, uint32(v)) }
+func fbInt64(v int64) []byte { return binary.LittleEndian.AppendUint64(nil, uint64(v)) }
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Permission is a class of operations a role may perform
+type Permission string
+
+const (
+	PermRead  Permission = "read"  // Queries, record lookups and history
+	PermWrite Permission = "write" // Puts, updates and deletes
+	PermAdmin Permission = "admin" // Metrics, and everything read and write allow
+)
+
+// Role grants permissions, optionally limited to the records matching Filter
+type Role struct {
+	Permissions []Permission      `json:"permissions"`
+	Filter      []FilterCondition `json:"filter,omitempty"`    // Records the role may read and write (empty allows all)
+	Redaction   *RedactionPolicy  `json:"redaction,omitempty"` // Applied to the records the role reads
+}
+
+// Principal is an authenticated caller and the roles it holds
+type Principal struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+}
+
+// JWTOptions verifies bearer tokens signed with HS256 (Secret), RS256 or
+// ES256 (PublicKey)
+type JWTOptions struct {
+	Secret        []byte           `json:"-"`
+	SecretEnv     string           `json:"secret_env,omitempty"` // Variable holding Secret
+	PublicKey     crypto.PublicKey `json:"-"`                    // *rsa.PublicKey or *ecdsa.PublicKey
+	PublicKeyFile string           `json:"public_key_file,omitempty"`
+	Issuer        string           `json:"issuer,omitempty"`          // Required "iss" claim
+	Audience      string           `json:"audience,omitempty"`        // Required "aud" claim
+	RolesClaim    string           `json:"roles_claim,omitempty"`     // Claim listing the roles (default "roles")
+	Leeway        Duration         `json:"leeway,omitempty"`          // Clock skew allowed for "exp" and "nbf"
+	AllowNoExpiry bool             `json:"allow_no_expiry,omitempty"` // Accept tokens without an "exp" claim, which never expire
+}
+
+// AccessControl authenticates the callers of the HTTP and gRPC servers and
+// maps them to roles
+type AccessControl struct {
+	Roles   map[string]Role      `json:"roles"`
+	APIKeys map[string]Principal `json:"api_keys,omitempty"` // Principals by API key
+	JWT     *JWTOptions          `json:"jwt,omitempty"`
+}
+
+// LoadAccessControl reads access control settings from a JSON file such as
+//
+//	{"roles": {"reader": {"permissions": ["read"]}},
+//	 "api_keys": {"k3y": {"subject": "dashboard", "roles": ["reader"]}},
+//	 "jwt": {"secret_env": "JWT_SECRET", "issuer": "https://auth.example.com"}}
+func LoadAccessControl(path string) (*AccessControl, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ac AccessControl
+	if err := json.Unmarshal(data, &ac); err != nil {
+		return nil, fmt.Errorf("Invalid access control file %s: %w", path, err)
+	}
+	return &ac, nil
+}
+
+// SetAccessControl requires every request to the HTTP and gRPC servers to
+// carry an API key or a JWT, sent as "Authorization: Bearer <credential>"
+// (or an "X-API-Key" header), and allows it only the operations its roles
+// permit. A caller with several roles gets all their permissions, sees the
+// records matching any of their filters, and the redaction policy of the
+// first of them that has one. Requests without valid credentials fail with
+// ErrUnauthenticated (401/Unauthenticated) and disallowed operations with
+// ErrForbidden (403/PermissionDenied); records outside a caller's filters
+// are reported as not found. A nil ac removes authentication.
+func (dm *DataManager) SetAccessControl(ac *AccessControl) error {
+	if ac == nil {
+		dm.access = nil
+		return nil
+	}
+	if err := ac.prepare(); err != nil {
+		return err
+	}
+	dm.access = ac
+	return nil
+}
+
+// prepare validates the settings and loads the JWT keys they name
+func (ac *AccessControl) prepare() error {
+	for name, role := range ac.Roles {
+		role.Filter = normalizeConditions(role.Filter)
+		ac.Roles[name] = role
+		for _, p := range role.Permissions {
+			if p != PermRead && p != PermWrite && p != PermAdmin {
+				return fmt.Errorf("Role %s has unknown permission %q", name, p)
+			}
+		}
+		if role.Redaction != nil {
+			if err := role.Redaction.validate(); err != nil {
+				return fmt.Errorf("Role %s: %w", name, err)
+			}
+		}
+	}
+	for _, principal := range ac.APIKeys {
+		if err := ac.checkRoles(principal.Roles); err != nil {
+			return fmt.Errorf("API key of %s: %w", principal.Subject, err)
+		}
+	}
+	if ac.JWT == nil {
+		return nil
+	}
+	o := ac.JWT
+	if o.SecretEnv != "" && o.Secret == nil {
+		if o.Secret = []byte(os.Getenv(o.SecretEnv)); len(o.Secret) == 0 {
+			return fmt.Errorf("JWT secret variable %s is not set", o.SecretEnv)
+		}
+	}
+	if o.PublicKeyFile != "" && o.PublicKey == nil {
+		key, err := loadPublicKey(o.PublicKeyFile)
+		if err != nil {
+			return err
+		}
+		o.PublicKey = key
+	}
+	if len(o.Secret) == 0 && o.PublicKey == nil {
+		return errors.New("JWT verification requires a secret or a public key")
+	}
+	return nil
+}
+
+// checkRoles reports roles that are not defined
+func (ac *AccessControl) checkRoles(roles []string) error {
+	for _, name := range roles {
+		if _, ok := ac.Roles[name]; !ok {
+			return fmt.Errorf("Unknown role %q", name)
+		}
+	}
+	return nil
+}
+
+// loadPublicKey reads a PEM-encoded RSA or ECDSA public key
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM data", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// grant is what an authenticated caller may do
+type grant struct {
+	subject   string
+	perms     map[Permission]bool
+	filters   [][]FilterCondition // Records must match one of these; nil allows all
+	redaction *RedactionPolicy
+}
+
+// authenticate resolves a credential to the caller's grant
+func (ac *AccessControl) authenticate(credential string, now time.Time) (*grant, error) {
+	if credential == "" {
+		return nil, ErrUnauthenticated
+	}
+	var principal Principal
+	found := false
+	for key, p := range ac.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(credential)) == 1 {
+			principal, found = p, true
+		}
+	}
+	if !found {
+		if ac.JWT == nil || strings.Count(credential, ".") != 2 {
+			return nil, fmt.Errorf("%w: unknown credential", ErrUnauthenticated)
+		}
+		p, err := ac.JWT.verify(credential, now)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+		}
+		principal = p
+	}
+
+	g := &grant{subject: principal.Subject, perms: make(map[Permission]bool)}
+	unfiltered := false
+	for _, name := range principal.Roles {
+		role, ok := ac.Roles[name]
+		if !ok {
+			continue // Tokens may carry roles this service does not use
+		}
+		for _, p := range role.Permissions {
+			g.perms[p] = true
+		}
+		if len(role.Filter) == 0 {
+			unfiltered = true
+		} else {
+			g.filters = append(g.filters, role.Filter)
+		}
+		if g.redaction == nil {
+			g.redaction = role.Redaction
+		}
+	}
+	if unfiltered {
+		g.filters = nil
+	}
+	return g, nil
+}
+
+// allows reports whether the grant includes permission p
+func (g *grant) allows(p Permission) bool {
+	return g == nil || g.perms[PermAdmin] || g.perms[p]
+}
+
+// check returns ErrForbidden unless the grant includes permission p
+func (g *grant) check(p Permission) error {
+	if !g.allows(p) {
+		return fmt.Errorf("%w: %s may not %s", ErrForbidden, g.subject, p)
+	}
+	return nil
+}
+
+// visible reports whether the caller may see or change record
+func (dm *DataManager) visible(g *grant, record map[string]interface{}) bool {
+	if g == nil || g.filters == nil {
+		return true
+	}
+	for _, filter := range g.filters {
+		if dm.matchConditions(record, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCheck rejects writes replacing or producing records outside the
+// caller's filters
+func (dm *DataManager) writeCheck(g *grant) func(old, record map[string]interface{}) error {
+	return func(old, record map[string]interface{}) error {
+		if old != nil && !dm.visible(g, old) {
+			return fmt.Errorf("%w: the record is outside the filters of %s", ErrForbidden, g.subject)
+		}
+		if record != nil && !dm.visible(g, record) {
+			return fmt.Errorf("%w: the record would be outside the filters of %s", ErrForbidden, g.subject)
+		}
+		return nil
+	}
+}
+
+// grantKey is the context key of the caller's grant
+type grantKey struct{}
+
+// grantFor returns the grant of the caller of a request, or nil without
+// access control
+func grantFor(ctx context.Context) *grant {
+	g, _ := ctx.Value(grantKey{}).(*grant)
+	return g
+}
+
+// bearer extracts the credential of an Authorization or X-API-Key value
+func bearer(authorization, apiKey string) string {
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(apiKey)
+}
+
+// authorize wraps an HTTP handler to authenticate each request and check
+// the permission its route needs
+func (dm *DataManager) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac := dm.access
+		if ac == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g, err := ac.authenticate(bearer(r.Header.Get("Authorization"), r.Header.Get("X-API-Key")), time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err := g.check(routePermission(r)); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grantKey{}, g)))
+	})
+}
+
+// routePermission is the permission an HTTP request needs
+func routePermission(r *http.Request) Permission {
+	path := r.URL.Path
+	if rest, ok := strings.CutPrefix(path, "/collections/"); ok {
+		if _, route, found := strings.Cut(rest, "/"); found {
+			path = "/" + route // The same routes, against a collection
+		}
+	}
+	switch {
+	case path == "/metrics", path == "/describe":
+		// The statistics of /describe cover every record, whatever the role's filter and redaction
+		return PermAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return PermRead
+	case r.Method == http.MethodPost && path == "/query":
+		return PermRead
+	default:
+		return PermWrite
+	}
+}
+
+// verify checks a JWT's signature and claims and returns its principal
+func (o *JWTOptions) verify(token string, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Principal{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, errors.New("malformed token signature")
+	}
+	if err := o.checkSignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return Principal{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Principal{}, err
+	}
+	leeway := time.Duration(o.Leeway)
+	exp, ok := claims["exp"].(float64)
+	if !ok && !o.AllowNoExpiry {
+		return Principal{}, errors.New("token has no expiry")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return Principal{}, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return Principal{}, errors.New("token is not valid yet")
+	}
+	if o.Issuer != "" && claims["iss"] != o.Issuer {
+		return Principal{}, errors.New("token has the wrong issuer")
+	}
+	if o.Audience != "" && !claimHas(claims["aud"], o.Audience) {
+		return Principal{}, errors.New("token has the wrong audience")
+	}
+
+	rolesClaim := o.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	principal := Principal{}
+	principal.Subject, _ = claims["sub"].(string)
+	switch roles := claims[rolesClaim].(type) {
+	case string:
+		principal.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, s)
+			}
+		}
+	}
+	return principal, nil
+}
+
+// checkSignature verifies the signature of a JWT's header and payload with
+// the key matching alg
+func (o *JWTOptions) checkSignature(alg, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "HS256":
+		if len(o.Secret) == 0 {
+			break
+		}
+		mac := hmac.New(sha256.New, o.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "RS256":
+		key, ok := o.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			break
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "ES256":
+		key, ok := o.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			break
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported token algorithm %q", alg)
+}
+
+// decodeJWTPart decodes a base64url JSON part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// claimHas reports whether a string or list claim contains want
+func claimHas(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, item := range v {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// putAs stores record for the caller, within its filters
+func (dm *DataManager) putAs(g *grant, record map[string]interface{}) error {
+	if g == nil {
+		return dm.Put(record)
+	}
+	check := dm.writeCheck(g)
+	return dm.write(record, func(old map[string]interface{}, _ bool) error { return check(old, record) })
+}
+
+// deleteAs deletes the record under key for the caller, within its filters
+func (dm *DataManager) deleteAs(g *grant, key string) (bool, error) {
+	if g == nil {
+		return dm.Delete(key)
+	}
+	return dm.deleteIf(key, func(old map[string]interface{}) error {
+		if !dm.visible(g, old) {
+			return &RecordError{Key: key, Err: ErrRecordNotFound}
+		}
+		return nil
+	})
+}
+
+// updateAs applies update to the record under key for the caller, within
+// its filters
+func (dm *DataManager) updateAs(g *grant, key string, update map[string]interface{}) (map[string]interface{}, error) {
+	if g == nil {
+		return dm.UpdateFields(key, update)
+	}
+	check := dm.writeCheck(g)
+	return dm.updateFields(key, update, func(old, record map[string]interface{}) error {
+		if !dm.visible(g, old) {
+			return &RecordError{Key: key, Err: ErrRecordNotFound}
+		}
+		return check(nil, record)
+	})
+}
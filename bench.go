@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// DatasetOptions shapes a synthetic dataset written by GenerateDataset
+type DatasetOptions struct {
+	Records     int   // Records to write (default 100000)
+	ExtraFields int   // Numeric fields f0, f1, ... added to every record
+	TagCount    int   // Elements of each record's "tags" array (default 3)
+	TextLength  int   // Length of each record's free-text "bio" field (default 64)
+	Nested      bool  // Add an "address" object holding "city" and "zip"
+	Seed        int64 // Seed of the random values; the same seed writes the same data
+}
+
+// Countries, cities and tags of synthetic records; few distinct values, as
+// in real data
+var (
+	benchCountries = []string{"DE", "FR", "GB", "IT", "NL", "PL", "SE", "US", "VN", "JP"}
+	benchCities    = []string{"Berlin", "Paris", "London", "Rome", "Amsterdam", "Warsaw", "Stockholm", "Boston", "Hanoi", "Osaka"}
+	benchTags      = []string{"new", "vip", "churned", "trial", "beta", "partner", "staff", "bulk"}
+)
+
+// GenerateDataset writes opts.Records synthetic NDJSON records to w. Every
+// record has a unique string "id", a "name", an "age" between 18 and 90, a
+// float "score", a bool "active", a "country" among ten, a "created" date
+// and datetime, "tags" and a "bio" of random words.
+func GenerateDataset(w io.Writer, opts DatasetOptions) error {
+	if opts.Records <= 0 {
+		opts.Records = 100000
+	}
+	if opts.TagCount <= 0 {
+		opts.TagCount = 3
+	}
+	if opts.TextLength <= 0 {
+		opts.TextLength = 64
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	for i := 0; i < opts.Records; i++ {
+		country := rng.Intn(len(benchCountries))
+		created := start.Add(time.Duration(rng.Int63n(int64(5 * 365 * 24 * time.Hour))))
+		record := map[string]interface{}{
+			"id":         "u" + strconv.Itoa(i),
+			"name":       "user " + strconv.Itoa(rng.Intn(opts.Records)),
+			"age":        18 + rng.Intn(73),
+			"score":      float64(rng.Intn(100000)) / 100,
+			"active":     rng.Intn(4) != 0,
+			"country":    benchCountries[country],
+			"created":    created.Format("2006-01-02"),
+			"created_at": created.Format("2006-01-02 15:04:05"),
+			"bio":        benchText(rng, opts.TextLength),
+		}
+		tags := make([]string, opts.TagCount)
+		for j := range tags {
+			tags[j] = benchTags[rng.Intn(len(benchTags))]
+		}
+		record["tags"] = tags
+		if opts.Nested {
+			record["address"] = map[string]interface{}{
+				"city": benchCities[country],
+				"zip":  fmt.Sprintf("%05d", rng.Intn(100000)),
+			}
+		}
+		for j := 0; j < opts.ExtraFields; j++ {
+			record["f"+strconv.Itoa(j)] = rng.Intn(1000000)
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// benchText returns n bytes of random lowercase words
+func benchText(rng *rand.Rand, n int) string {
+	text := make([]byte, n)
+	for i := range text {
+		if i > 0 && rng.Intn(6) == 0 {
+			text[i] = ' '
+		} else {
+			text[i] = byte('a' + rng.Intn(26))
+		}
+	}
+	return string(text)
+}
+
+// BenchmarkOptions configures RunBenchmark
+type BenchmarkOptions struct {
+	Dataset    DatasetOptions // Shape of the generated data
+	File       string         // Existing NDJSON file to measure instead of generated data, keyed by "id"
+	Keep       string         // Path to keep the generated dataset at ("" removes it)
+	Queries    int            // Repetitions of each in-memory query (default 100)
+	Decoder    Decoder        // NDJSON decoder measured ("" uses the default)
+	Workers    int            // Goroutines of parallel scans (0 tunes the count)
+	CPUProfile string         // Write a pprof CPU profile of the run to this file
+	MemProfile string         // Write a pprof heap profile after the in-memory load to this file
+}
+
+// BenchmarkResult is the measurement of one operation
+type BenchmarkResult struct {
+	Name        string        `json:"name"`
+	Duration    time.Duration `json:"duration_ns"`
+	Ops         int           `json:"ops"`             // Times the operation ran
+	Matches     int           `json:"matches"`         // Records returned per run
+	Bytes       int64         `json:"bytes"`           // Input bytes read per run (0 for in-memory queries)
+	Allocs      uint64        `json:"allocs"`          // Heap allocations over all runs
+	AllocBytes  uint64        `json:"alloc_bytes"`     // Heap bytes allocated over all runs
+	RecordsPerS float64       `json:"records_per_sec"` // Dataset records processed per second
+	MBPerS      float64       `json:"mb_per_sec"`
+}
+
+// BenchmarkReport holds the results of RunBenchmark
+type BenchmarkReport struct {
+	GoVersion string            `json:"go_version"`
+	CPUs      int               `json:"cpus"`
+	Records   int               `json:"records"`
+	Bytes     int64             `json:"bytes"`
+	HeapBytes uint64            `json:"heap_bytes"` // Live heap after the in-memory load
+	Results   []BenchmarkResult `json:"results"`
+}
+
+// RunBenchmark measures the throughput of the main operations on a
+// synthetic dataset, or on opts.File: an InMemory load, Split-mode scans
+// with and without a fast-path condition, a Split-mode count, and repeated
+// in-memory queries without and with a sorted index. Reports from the same
+// options and seed on different releases are comparable, and the optional
+// pprof profiles show where the time goes.
+func RunBenchmark(opts BenchmarkOptions) (*BenchmarkReport, error) {
+	if opts.Queries <= 0 {
+		opts.Queries = 100
+	}
+	path := opts.File
+	if path == "" {
+		if path = opts.Keep; path == "" {
+			dir, err := os.MkdirTemp("", "jsondm-bench-")
+			if err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(dir)
+			path = filepath.Join(dir, "bench.ndjson")
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		err = GenerateDataset(f, opts.Dataset)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CPUProfile != "" {
+		f, err := os.Create(opts.CPUProfile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return nil, err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	report := &BenchmarkReport{GoVersion: runtime.Version(), CPUs: runtime.NumCPU(), Bytes: info.Size()}
+	newManager := func(mode Mode) *DataManager {
+		dm, _ := New(WithMode(mode), WithMaxRAM(1<<40), WithWorkers(opts.Workers), WithDecoder(opts.Decoder))
+		return dm
+	}
+	adults := []FilterCondition{{Key: "age", ValueType: "int", Operator: ">=", Value: 80}}
+	country := []FilterCondition{{Key: "country", ValueType: "string", Operator: "==", Value: "VN"}}
+
+	memory := newManager(InMemoryMode)
+	load, err := measure("load", 1, 0, info.Size(), func() (int, error) {
+		if err := memory.LoadDataInMemory(path, "id"); err != nil {
+			return 0, err
+		}
+		return memory.snapshot().len(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Records = load.Matches
+	load.RecordsPerS = float64(load.Matches) / load.Duration.Seconds()
+	report.Results = append(report.Results, load)
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	report.HeapBytes = stats.HeapAlloc
+	if opts.MemProfile != "" {
+		if err := writeHeapProfile(opts.MemProfile); err != nil {
+			return nil, err
+		}
+	}
+
+	split := newManager(SplitMode)
+	split.setSourcePath(path)
+	fast := newManager(SplitMode)
+	fast.SetFastScan(true)
+	steps := []struct {
+		name  string
+		ops   int
+		size  int64
+		setup func() error
+		run   func() (int, error)
+	}{
+		{"scan", 1, info.Size(), nil, func() (int, error) {
+			results, err := split.LoadDataInSplitMode(path, adults)
+			return len(results), err
+		}},
+		{"scan-fast", 1, info.Size(), nil, func() (int, error) {
+			results, err := fast.LoadDataInSplitMode(path, country)
+			return len(results), err
+		}},
+		{"count", 1, info.Size(), nil, func() (int, error) {
+			return split.CountWhere(adults)
+		}},
+		{"query", opts.Queries, 0, nil, func() (int, error) {
+			results, err := memory.Query(adults)
+			return len(results), err
+		}},
+		{"query-indexed", opts.Queries, 0, func() error {
+			return memory.CreateIndex("age", SortedIndex)
+		}, func() (int, error) {
+			results, err := memory.Query(adults)
+			return len(results), err
+		}},
+	}
+	for _, step := range steps {
+		if step.setup != nil {
+			if err := step.setup(); err != nil {
+				return nil, fmt.Errorf("%s: %w", step.name, err)
+			}
+		}
+		result, err := measure(step.name, step.ops, report.Records, step.size, step.run)
+		if err != nil {
+			return nil, err
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// measure runs fn ops times, each over records records and size bytes of
+// input, and records its time and allocations
+func measure(name string, ops, records int, size int64, fn func() (int, error)) (BenchmarkResult, error) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	result := BenchmarkResult{Name: name, Ops: ops, Bytes: size}
+	started := time.Now()
+	for i := 0; i < ops; i++ {
+		matches, err := fn()
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", name, err)
+		}
+		result.Matches = matches
+	}
+	result.Duration = time.Since(started)
+	runtime.ReadMemStats(&after)
+	result.Allocs = after.Mallocs - before.Mallocs
+	result.AllocBytes = after.TotalAlloc - before.TotalAlloc
+	if seconds := result.Duration.Seconds(); seconds > 0 {
+		result.RecordsPerS = float64(records*ops) / seconds
+		result.MBPerS = float64(size*int64(ops)) / (1 << 20) / seconds
+	}
+	return result, nil
+}
+
+// writeHeapProfile writes a pprof heap profile to path
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// BloomFilterSuffix is appended to the path of a file to name its Bloom filters
+const BloomFilterSuffix = ".bloom"
+
+// Default share of absent values a Bloom filter lets through
+const defaultFalsePositiveRate = 0.01
+
+// A Bloom filter file starts with the magic and the size and modification
+// time (Unix nanoseconds) of the filtered file, followed by one filter per
+// field: the field name's length (uint16) and bytes, the number of hash
+// functions (uint32), the number of 64-bit words (uint32) and the words,
+// all little-endian.
+var bloomMagic = [8]byte{'J', 'D', 'M', 'B', 'L', 'M', '1', 0}
+
+// BloomOptions configures BuildBloomFilters
+type BloomOptions struct {
+	Fields            []string // Fields to filter on; a comma-separated list is a composite key (default: the key field)
+	FalsePositiveRate float64  // Share of absent values a filter lets through (default 0.01)
+}
+
+// bloomFilter is a Bloom filter over the canonical text of field values
+type bloomFilter struct {
+	k    uint32
+	bits []uint64
+}
+
+// newBloomFilter sizes a filter for n values at the false positive rate p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(max(n, 1)) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := max(uint32(math.Round(m/float64(max(n, 1))*math.Ln2)), 1)
+	return &bloomFilter{k: k, bits: make([]uint64, (int(m)+63)/64)}
+}
+
+// bloomHash hashes a value once; the filter derives its k positions from it
+func bloomHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+// positions calls fn with the bit positions of a hashed value
+func (f *bloomFilter) positions(hash uint64, fn func(bit uint64) bool) bool {
+	m := uint64(len(f.bits)) * 64
+	h1, h2 := hash&math.MaxUint32, hash>>32|1
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !fn((h1 + i*h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+// add inserts a hashed value
+func (f *bloomFilter) add(hash uint64) {
+	f.positions(hash, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain reports whether value may have been added; false is certain
+func (f *bloomFilter) mayContain(value string) bool {
+	return f.positions(bloomHash(value), func(bit uint64) bool {
+		return f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+// fileBlooms holds the Bloom filters of one file
+type fileBlooms struct {
+	size    int64     // File size when filtered
+	modTime time.Time // File modification time when filtered
+	filters map[string]*bloomFilter
+}
+
+// BuildBloomFilters writes a Bloom filter file next to each of paths, named
+// with BloomFilterSuffix, over the values each record holds in the chosen
+// fields. LoadFilesInSplitMode and ScanShards then skip the files whose
+// filters rule out an == condition on one of these fields (with string,
+// int, float or bool values compared without a collation), and
+// GetFromFiles reads only the files that may hold the key, so a selective
+// query over many shards opens few of them. A filter never rules out a file
+// holding a match; at the default rate, one file in a hundred lacking the
+// value is read anyway. Filters of a file that changed since are ignored,
+// and filters are built from records as scans read them, after coercion
+// and computed fields. Filter files are encrypted under SetEncryption, and
+// existing ones are replaced.
+func (dm *DataManager) BuildBloomFilters(paths []string, opts BloomOptions) error {
+	fields := opts.Fields
+	if len(fields) == 0 {
+		if dm.keyName == "" {
+			return fmt.Errorf("%w; name the fields of the Bloom filters", ErrNoKeyField)
+		}
+		fields = []string{dm.keyName}
+	}
+	rate := opts.FalsePositiveRate
+	if rate == 0 {
+		rate = defaultFalsePositiveRate
+	}
+	if rate <= 0 || rate >= 1 {
+		return fmt.Errorf("False positive rate %g is outside (0, 1)", rate)
+	}
+	for _, path := range paths {
+		if err := dm.buildBloomFile(path, fields, rate); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// buildBloomFile reads the records of path and writes its filter file
+func (dm *DataManager) buildBloomFile(path string, fields []string, rate float64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	reader, closer, err := dm.openRecords(path)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	hashes := make([][]uint64, len(fields))
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, field := range fields {
+			if key, ok := recordKey(record, field); ok {
+				hashes[i] = append(hashes[i], bloomHash(key))
+			}
+		}
+	}
+
+	dm.mu.Lock()
+	delete(dm.blooms, path) // Read again by bloomsOf
+	dm.mu.Unlock()
+	return replaceFile(path+BloomFilterSuffix, dm.encryption, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		header := append([]byte(nil), bloomMagic[:]...)
+		header = binary.LittleEndian.AppendUint64(header, uint64(info.Size()))
+		header = binary.LittleEndian.AppendUint64(header, uint64(info.ModTime().UnixNano()))
+		bw.Write(header)
+		for i, field := range fields {
+			filter := newBloomFilter(len(hashes[i]), rate)
+			for _, hash := range hashes[i] {
+				filter.add(hash)
+			}
+			b := binary.LittleEndian.AppendUint16(nil, uint16(len(field)))
+			b = append(b, field...)
+			b = binary.LittleEndian.AppendUint32(b, filter.k)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(filter.bits)))
+			for _, word := range filter.bits {
+				b = binary.LittleEndian.AppendUint64(b, word)
+			}
+			bw.Write(b)
+		}
+		return bw.Flush()
+	})
+}
+
+// readBloomFile reads the filter file of path, decrypting it with c
+func readBloomFile(path string, c *fileCipher) (*fileBlooms, error) {
+	data, err := c.readFile(path + BloomFilterSuffix)
+	if err != nil {
+		return nil, err
+	}
+	invalid := fmt.Errorf("%s is not a Bloom filter file", path+BloomFilterSuffix)
+	if len(data) < 24 || !bytes.Equal(data[:8], bloomMagic[:]) {
+		return nil, invalid
+	}
+	blooms := &fileBlooms{
+		size:    int64(binary.LittleEndian.Uint64(data[8:])),
+		modTime: time.Unix(0, int64(binary.LittleEndian.Uint64(data[16:]))),
+		filters: make(map[string]*bloomFilter),
+	}
+	for rest := data[24:]; len(rest) > 0; {
+		if len(rest) < 2 {
+			return nil, invalid
+		}
+		n := int(binary.LittleEndian.Uint16(rest))
+		if len(rest) < 2+n+8 {
+			return nil, invalid
+		}
+		field := string(rest[2 : 2+n])
+		rest = rest[2+n:]
+		filter := &bloomFilter{k: binary.LittleEndian.Uint32(rest)}
+		words := int(binary.LittleEndian.Uint32(rest[4:]))
+		rest = rest[8:]
+		if words == 0 || len(rest) < words*8 {
+			return nil, invalid
+		}
+		filter.bits = make([]uint64, words)
+		for i := range filter.bits {
+			filter.bits[i] = binary.LittleEndian.Uint64(rest[i*8:])
+		}
+		rest = rest[words*8:]
+		blooms.filters[field] = filter
+	}
+	return blooms, nil
+}
+
+// bloomsOf returns the filters of path while they match the file, caching
+// them, or nil when it has none
+func (dm *DataManager) bloomsOf(path string) *fileBlooms {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	dm.mu.RLock()
+	blooms := dm.blooms[path]
+	dm.mu.RUnlock()
+	if blooms == nil || blooms.size != info.Size() || !blooms.modTime.Equal(info.ModTime()) {
+		if blooms, err = readBloomFile(path, dm.encryption); err != nil {
+			return nil
+		}
+		dm.mu.Lock()
+		if dm.blooms == nil {
+			dm.blooms = make(map[string]*fileBlooms)
+		}
+		dm.blooms[path] = blooms
+		dm.mu.Unlock()
+	}
+	if blooms.size != info.Size() || !blooms.modTime.Equal(info.ModTime()) {
+		return nil // Built before the file last changed
+	}
+	return blooms
+}
+
+// ruledOut reports whether the filters of path prove that no record matches
+// conditions
+func (dm *DataManager) ruledOut(path string, conditions []FilterCondition) bool {
+	var blooms *fileBlooms
+	for _, condition := range conditions {
+		if condition.Operator != "==" || condition.Collation != BinaryCollation || dm.isComputed(condition.Key) {
+			continue
+		}
+		switch condition.ValueType {
+		case "string", "int", "float", "bool":
+		default:
+			continue
+		}
+		value, ok := canonicalKey(condition.Value)
+		if !ok {
+			continue
+		}
+		if blooms == nil {
+			if blooms = dm.bloomsOf(path); blooms == nil {
+				return false
+			}
+		}
+		if filter, ok := blooms.filters[condition.Key]; ok && !filter.mayContain(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetFromFiles returns the record stored under key in the files of paths,
+// read as one dataset keyed by the current key field, so the last file
+// holding the key wins, as in LoadFilesInMemory. Files whose Bloom filters
+// (see BuildBloomFilters) rule the key out are not opened; the others are
+// read from the last one back until the key is found. A missing key is
+// reported as a RecordError matching ErrRecordNotFound.
+func (dm *DataManager) GetFromFiles(paths []string, key string) (map[string]interface{}, error) {
+	if dm.keyName == "" {
+		return nil, ErrNoKeyField
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if blooms := dm.bloomsOf(paths[i]); blooms != nil {
+			if filter, ok := blooms.filters[dm.keyName]; ok && !filter.mayContain(key) {
+				continue
+			}
+		}
+		record, err := dm.findKey(paths[i], key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", paths[i], err)
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+	return nil, &RecordError{Key: key, Err: ErrRecordNotFound}
+}
+
+// findKey returns the last record of path stored under key, or nil
+func (dm *DataManager) findKey(path, key string) (map[string]interface{}, error) {
+	reader, closer, err := dm.openRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	var found map[string]interface{}
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			return found, nil
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if k, ok := recordKey(record, dm.keyName); ok && k == key {
+			found = record
+		}
+	}
+}
+
+// pruneBlooms drops the files of a multi-file scan whose Bloom filters rule
+// out their conditions
+func (dm *DataManager) pruneBlooms(paths []string, perFile [][]FilterCondition, partitions []map[string]string) ([]string, [][]FilterCondition, []map[string]string) {
+	kept := 0
+	for i, path := range paths {
+		if dm.ruledOut(path, perFile[i]) {
+			continue
+		}
+		paths[kept], perFile[kept], partitions[kept] = path, perFile[i], partitions[i]
+		kept++
+	}
+	return paths[:kept], perFile[:kept], partitions[:kept]
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxBSONDocumentSize bounds a single document, matching MongoDB's 16MB limit
+// with headroom for mongodump output
+const maxBSONDocumentSize = 64 << 20
+
+// bsonCodec reads and writes a stream of BSON documents, as produced by mongodump
+type bsonCodec struct{}
+
+func (bsonCodec) NewDecoder(r io.Reader) RecordDecoder {
+	return &bsonDecoder{r: bufio.NewReader(r)}
+}
+
+func (bsonCodec) NewEncoder(w io.Writer) RecordEncoder {
+	return &bsonEncoder{w: bufio.NewWriter(w)}
+}
+
+// bsonDecoder decodes consecutive top-level documents
+type bsonDecoder struct {
+	r *bufio.Reader
+}
+
+// Next decodes the next document
+func (d *bsonDecoder) Next() (map[string]interface{}, int, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("Truncated BSON document")
+		}
+		return nil, 0, err
+	}
+	size := int(int32(binary.LittleEndian.Uint32(header)))
+	if size < 5 || size > maxBSONDocumentSize {
+		return nil, 0, fmt.Errorf("Invalid BSON document size %d", size)
+	}
+
+	doc := make([]byte, size)
+	copy(doc, header)
+	if _, err := io.ReadFull(d.r, doc[4:]); err != nil {
+		return nil, 4, errors.New("Truncated BSON document")
+	}
+	record, err := parseBSONDocument(doc, false)
+	if err != nil {
+		return nil, size, err
+	}
+	return record.(map[string]interface{}), size, nil
+}
+
+// parseBSONDocument decodes a complete document; arrays are documents keyed "0", "1", ...
+func parseBSONDocument(doc []byte, array bool) (interface{}, error) {
+	if len(doc) < 5 || doc[len(doc)-1] != 0 {
+		return nil, errors.New("Malformed BSON document")
+	}
+	body := doc[4 : len(doc)-1]
+
+	record := make(map[string]interface{})
+	var items []interface{}
+	for len(body) > 0 {
+		kind := body[0]
+		end := bytes.IndexByte(body[1:], 0)
+		if end < 0 {
+			return nil, errors.New("Malformed BSON element name")
+		}
+		name := string(body[1 : 1+end])
+		body = body[2+end:]
+
+		value, n, err := parseBSONValue(kind, body)
+		if err != nil {
+			return nil, fmt.Errorf("BSON field %q: %w", name, err)
+		}
+		body = body[n:]
+		if array {
+			items = append(items, value)
+		} else {
+			record[name] = value
+		}
+	}
+	if array {
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items, nil
+	}
+	return record, nil
+}
+
+// parseBSONValue decodes one element value and returns the bytes it used
+func parseBSONValue(kind byte, b []byte) (interface{}, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return errors.New("truncated value")
+		}
+		return nil
+	}
+	int32At := func(off int) int {
+		return int(int32(binary.LittleEndian.Uint32(b[off:])))
+	}
+
+	switch kind {
+	case 0x01: // double
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), 8, nil
+	case 0x02, 0x0D, 0x0E: // string, JavaScript, symbol
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		n := int32At(0)
+		if n < 1 || need(4+n) != nil {
+			return nil, 0, errors.New("invalid string length")
+		}
+		return string(b[4 : 4+n-1]), 4 + n, nil
+	case 0x03, 0x04: // document, array
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		n := int32At(0)
+		if n < 5 || need(n) != nil {
+			return nil, 0, errors.New("invalid document length")
+		}
+		value, err := parseBSONDocument(b[:n], kind == 0x04)
+		return value, n, err
+	case 0x05: // binary
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		n := int32At(0)
+		if n < 0 || need(5+n) != nil {
+			return nil, 0, errors.New("invalid binary length")
+		}
+		return base64.StdEncoding.EncodeToString(b[5 : 5+n]), 5 + n, nil
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max key, min key
+		return nil, 0, nil
+	case 0x07: // ObjectId
+		if err := need(12); err != nil {
+			return nil, 0, err
+		}
+		return hex.EncodeToString(b[:12]), 12, nil
+	case 0x08: // bool
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		return b[0] != 0, 1, nil
+	case 0x09: // UTC datetime in milliseconds
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		ms := int64(binary.LittleEndian.Uint64(b))
+		return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04:05"), 8, nil
+	case 0x0B: // regular expression: pattern and options cstrings
+		pattern := bytes.IndexByte(b, 0)
+		if pattern < 0 {
+			return nil, 0, errors.New("invalid regex")
+		}
+		options := bytes.IndexByte(b[pattern+1:], 0)
+		if options < 0 {
+			return nil, 0, errors.New("invalid regex")
+		}
+		return string(b[:pattern]), pattern + options + 2, nil
+	case 0x10: // int32
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return float64(int32At(0)), 4, nil
+	case 0x11, 0x12: // timestamp, int64
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		v := binary.LittleEndian.Uint64(b)
+		if kind == 0x11 {
+			return float64(v), 8, nil
+		}
+		return float64(int64(v)), 8, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported BSON type 0x%02x", kind)
+	}
+}
+
+// bsonEncoder writes records as BSON documents
+type bsonEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *bsonEncoder) Encode(record map[string]interface{}) error {
+	doc, err := appendBSONDocument(nil, record)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(doc)
+	return err
+}
+
+func (e *bsonEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+// appendBSONDocument encodes a map or slice as a BSON document with sorted keys
+func appendBSONDocument(dst []byte, v interface{}) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	var err error
+	switch val := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if dst, err = appendBSONElement(dst, key, val[key]); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			if dst, err = appendBSONElement(dst, strconv.Itoa(i), item); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	dst = append(dst, 0)
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst, nil
+}
+
+// appendBSONElement encodes one named value; integral numbers are stored as int64
+func appendBSONElement(dst []byte, name string, v interface{}) ([]byte, error) {
+	if bytes.IndexByte([]byte(name), 0) >= 0 {
+		return nil, fmt.Errorf("BSON field name %q contains a NUL byte", name)
+	}
+	header := func(kind byte) {
+		dst = append(dst, kind)
+		dst = append(dst, name...)
+		dst = append(dst, 0)
+	}
+
+	switch val := v.(type) {
+	case nil:
+		header(0x0A)
+	case bool:
+		header(0x08)
+		if val {
+			dst = append(dst, 1)
+		} else {
+			dst = append(dst, 0)
+		}
+	case int:
+		header(0x12)
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(val))
+	case int64:
+		header(0x12)
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(val))
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<63 {
+			header(0x12)
+			dst = binary.LittleEndian.AppendUint64(dst, uint64(int64(val)))
+		} else {
+			header(0x01)
+			dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(val))
+		}
+	case string:
+		header(0x02)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(val)+1))
+		dst = append(dst, val...)
+		dst = append(dst, 0)
+	case map[string]interface{}:
+		header(0x03)
+		return appendBSONDocument(dst, val)
+	case []interface{}:
+		header(0x04)
+		return appendBSONDocument(dst, val)
+	default:
+		return nil, fmt.Errorf("Cannot encode %T as BSON", v)
+	}
+	return dst, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// bulkBatchSize is how many records BulkInsert and ImportFile apply per
+// write-lock acquisition and log entry
+const bulkBatchSize = 10000
+
+// BulkInsert writes records in batches, replacing existing records with the
+// same key as Put does. Each batch is validated in parallel, logged to the
+// WAL as one entry with a single fsync, and applied under one write lock with
+// incremental index updates, so a batch is visible all at once. On error the
+// batches before the failing one stay applied; the count of records written
+// is returned either way.
+func (dm *DataManager) BulkInsert(records []map[string]interface{}) (int, error) {
+	if dm.mode != InMemoryMode {
+		return 0, ErrInvalidMode
+	}
+	written := 0
+	for start := 0; start < len(records); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		if err := dm.writeBatch(records[start:end], start); err != nil {
+			return written, err
+		}
+		written += end - start
+	}
+	return written, nil
+}
+
+// writeBatch validates a batch concurrently, then logs and applies it; base
+// is the position of its first record in the caller's slice
+func (dm *DataManager) writeBatch(records []map[string]interface{}, base int) error {
+	dm.mu.RLock()
+	keyName := dm.keyName
+	dm.mu.RUnlock()
+	if keyName == "" {
+		return fmt.Errorf("%w; load data or call SetKeyField before writing", ErrNoKeyField)
+	}
+
+	entries := make([]walEntry, len(records))
+	errs := make([]error, len(records))
+	dm.parallelEach(len(records), func(i int) {
+		record := records[i]
+		dm.assignSurrogateKey(record, keyName, nil)
+		key, ok := recordKey(record, keyName)
+		if !ok {
+			errs[i] = fmt.Errorf("Record %d is missing key field %q", base+i, keyName)
+			return
+		}
+		if err := dm.checkSchema(record); err != nil {
+			errs[i] = err
+			return
+		}
+		entries[i] = walEntry{Op: walPut, Key: key, Record: record}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	batch := walEntry{Op: walBatch, Batch: entries}
+	if err := dm.logWrite(batch); err != nil {
+		return err
+	}
+	dm.applyLocked(batch)
+	return nil
+}
+
+// parallelEach calls fn for every index below n, spread over the scan workers
+func (dm *DataManager) parallelEach(n int, fn func(i int)) {
+	workers := dm.parallelism()
+	if workers > n {
+		workers = n
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt64(&next, 1)); i < n; i = int(atomic.AddInt64(&next, 1)) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ImportFile inserts every record of the input at path (any location and
+// format the loaders accept) through BulkInsert, keyed by the current key
+// field. Newline-delimited JSON lines are decoded by several goroutines in
+// parallel. Malformed records are handled by the error policy. It returns the
+// number of records written.
+func (dm *DataManager) ImportFile(path string) (written int, err error) {
+	if dm.mode != InMemoryMode {
+		return 0, ErrInvalidMode
+	}
+	src, err := dm.resolveSource(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer dm.beginOperation("load", sourceName(src), func() int64 { return sourceSize(src) })(&err)
+	dm.parseErrors.reset()
+	if dm.formatFor(sourceName(src)) == "json" {
+		input, err := src.Open()
+		if err != nil {
+			return 0, err
+		}
+		defer input.Close()
+		text, err := dm.transcode(input)
+		if err != nil {
+			return 0, err
+		}
+		br := dm.chunkReader(text)
+		defer dm.releaseChunkReader(br)
+		if first, err := peekNonSpace(br); err == nil && first != '[' {
+			return dm.importLines(br)
+		}
+		reader, err := dm.newJSONReader(br)
+		if err != nil {
+			return 0, err
+		}
+		return dm.importRecords(dm.deriving(reader))
+	}
+
+	reader, closer, err := dm.openRecords(path)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	return dm.importRecords(reader)
+}
+
+// importRecords inserts the records of reader in batches
+func (dm *DataManager) importRecords(reader recordReader) (int, error) {
+	written := 0
+	batch := make([]map[string]interface{}, 0, bulkBatchSize)
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		dm.track(size)
+		atomic.AddInt64(&dm.dataUsage, int64(size))
+		if usage := atomic.AddInt64(dm.currentUsage, int64(size)); usage > dm.maxRAMUsage {
+			return written, dm.memoryLimitError(usage)
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if batch = append(batch, record); len(batch) == bulkBatchSize {
+			n, err := dm.BulkInsert(batch)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			batch = batch[:0]
+		}
+	}
+	n, err := dm.BulkInsert(batch)
+	return written + n, err
+}
+
+// importLines reads NDJSON lines in batches and decodes each batch in parallel
+func (dm *DataManager) importLines(br *bufio.Reader) (int, error) {
+	written := 0
+	var pos int64
+	lineNo := 0
+	lines := make([][]byte, 0, bulkBatchSize)
+	offsets := make([]int64, 0, bulkBatchSize)
+	numbers := make([]int, 0, bulkBatchSize)
+
+	flush := func() error {
+		records := make([]map[string]interface{}, len(lines))
+		errs := make([]error, len(lines))
+		dm.parallelEach(len(lines), func(i int) {
+			line, err := dm.preprocessLine(lines[i])
+			if err != nil {
+				errs[i] = &ParseError{Line: numbers[i], Offset: offsets[i], Snippet: snippet(lines[i]), Err: err}
+				return
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				return
+			}
+			if records[i], err = dm.decodeRecord(line); err != nil {
+				errs[i] = &ParseError{Line: numbers[i], Offset: offsets[i], Snippet: snippet(lines[i]), Err: err}
+				return
+			}
+			dm.derive(records[i])
+		})
+		kept := records[:0]
+		for i, record := range records {
+			if errs[i] != nil {
+				if err := dm.tolerate(errs[i]); err != nil {
+					return err
+				}
+				continue
+			}
+			if record != nil || dm.preprocess == nil {
+				kept = append(kept, record)
+			}
+		}
+		n, err := dm.BulkInsert(kept)
+		written += n
+		lines, offsets, numbers = lines[:0], offsets[:0], numbers[:0]
+		return err
+	}
+
+	for {
+		line, n, tooLong, err := readLine(br, nil, dm.recordLimit)
+		lineNo++
+		start := pos
+		pos += int64(n)
+		if err != nil && err != io.EOF {
+			return written, err
+		}
+		dm.track(n)
+		atomic.AddInt64(&dm.dataUsage, int64(n))
+		if usage := atomic.AddInt64(dm.currentUsage, int64(n)); usage > dm.maxRAMUsage {
+			return written, dm.memoryLimitError(usage)
+		}
+		if tooLong {
+			parseErr := &ParseError{Line: lineNo, Offset: start, Snippet: snippet(line), Err: fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, dm.recordLimit)}
+			if err := dm.tolerate(parseErr); err != nil {
+				return written, err
+			}
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			lines, offsets, numbers = append(lines, line), append(offsets, start), append(numbers, lineNo)
+			if len(lines) == bulkBatchSize {
+				if err := flush(); err != nil {
+					return written, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(lines) > 0 {
+		return written, flush()
+	}
+	return written, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// RecordCacheStats reports the activity of the Split mode record cache
+type RecordCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
+}
+
+// recordCache is an LRU cache of decoded records bounded by count and size
+type recordCache struct {
+	mu         sync.Mutex
+	maxEntries int   // 0 means unbounded
+	maxBytes   int64 // 0 means unbounded
+	order      *list.List
+	entries    map[string]*list.Element
+	stats      RecordCacheStats
+}
+
+// cacheEntry is a single cached record
+type cacheEntry struct {
+	key    string
+	record map[string]interface{}
+	size   int64
+}
+
+// newRecordCache creates an empty cache
+func newRecordCache(maxEntries int, maxBytes int64) *recordCache {
+	return &recordCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// get returns a cached record and marks it most recently used
+func (c *recordCache) get(key string) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		c.stats.Hits++
+		return elem.Value.(*cacheEntry).record, true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// put stores a record, evicting the least recently used ones to stay within bounds
+func (c *recordCache) put(key string, record map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := estimateRecordSize(record)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, record: record, size: size})
+	c.stats.Bytes += size
+
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.stats.Bytes > c.maxBytes) {
+		c.removeElement(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops key from the cache
+func (c *recordCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// removeElement unlinks an entry; the caller holds c.mu
+func (c *recordCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= entry.size
+}
+
+// SetRecordCache enables an LRU cache for LookupInSplitMode holding at most
+// maxEntries records and maxBytes of estimated record size (0 disables a
+// bound). The byte bound is capped at the manager's maxRAMUsage.
+func (dm *DataManager) SetRecordCache(maxEntries int, maxBytes int64) {
+	if maxBytes <= 0 || maxBytes > dm.maxRAMUsage {
+		maxBytes = dm.maxRAMUsage
+	}
+	dm.cache = newRecordCache(maxEntries, maxBytes)
+}
+
+// LookupInSplitMode returns the record of filePath whose keyName field equals
+// key, serving repeated lookups from the record cache when it is enabled
+func (dm *DataManager) LookupInSplitMode(filePath string, keyName string, key string) (map[string]interface{}, bool, error) {
+	if dm.mode != SplitMode {
+		return nil, false, ErrInvalidMode
+	}
+
+	cacheKey := filePath + "\x00" + keyName + "\x00" + key
+	if dm.cache != nil {
+		record, ok := dm.cache.get(cacheKey)
+		if dm.metrics != nil {
+			dm.metrics.ObserveCache(ok)
+		}
+		if ok {
+			return record, true, nil
+		}
+	}
+
+	var results []map[string]interface{}
+	var err error
+	if !strings.Contains(keyName, ",") {
+		results, err = dm.LoadDataInSplitMode(filePath, []FilterCondition{
+			{Key: keyName, ValueType: "string", Operator: "==", Value: key},
+		})
+	}
+	if err == nil && len(results) == 0 && (strings.Contains(keyName, ",") || !plainStringKey(key)) {
+		// Composite keys and keys that may be stored as numbers or bools
+		// are compared in their canonical form
+		results, err = dm.Pipeline().From(filePath).Map(func(record map[string]interface{}) (map[string]interface{}, error) {
+			if k, ok := recordKey(record, keyName); ok && k == key {
+				return record, nil
+			}
+			return nil, nil
+		}).Collect()
+	}
+	if err != nil || len(results) == 0 {
+		return nil, false, err
+	}
+	if dm.cache != nil {
+		dm.cache.put(cacheKey, results[0])
+	}
+	return results[0], true, nil
+}
+
+// InvalidateCache removes the cached record of filePath stored under key
+func (dm *DataManager) InvalidateCache(filePath string, keyName string, key string) {
+	if dm.cache != nil {
+		dm.cache.remove(filePath + "\x00" + keyName + "\x00" + key)
+	}
+}
+
+// ClearCache empties the record cache, e.g. after the underlying file changed
+func (dm *DataManager) ClearCache() {
+	if dm.cache != nil {
+		dm.cache.mu.Lock()
+		dm.cache.order.Init()
+		dm.cache.entries = make(map[string]*list.Element)
+		dm.cache.stats.Bytes = 0
+		dm.cache.mu.Unlock()
+	}
+}
+
+// CacheStats returns hit, miss and eviction counts and the current cache size
+func (dm *DataManager) CacheStats() RecordCacheStats {
+	if dm.cache == nil {
+		return RecordCacheStats{}
+	}
+	dm.cache.mu.Lock()
+	defer dm.cache.mu.Unlock()
+	stats := dm.cache.stats
+	stats.Entries = dm.cache.order.Len()
+	return stats
+}
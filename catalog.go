@@ -0,0 +1,549 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets of the equi-depth histograms of the statistics catalog
+const histogramBuckets = 16
+
+// Fields tracked by the statistics catalog; further fields are ignored
+const maxCatalogFields = 1024
+
+// Numbers of each field sampled for its histogram
+const histogramSample = 1024
+
+// DatasetDescription holds the statistics catalog of a dataset
+type DatasetDescription struct {
+	Records  int               `json:"records"`
+	Fields   []FieldStatistics `json:"fields"`   // By field name; nested objects are described with dotted paths
+	Gathered time.Time         `json:"gathered"` // When the statistics were gathered
+	Changes  int               `json:"changes"`  // Writes and deletes applied since (see FieldStatistics.Histogram)
+}
+
+// Field returns the statistics of field, or nil when no record holds it
+func (d *DatasetDescription) Field(field string) *FieldStatistics {
+	i := sort.Search(len(d.Fields), func(i int) bool { return d.Fields[i].Field >= field })
+	if i < len(d.Fields) && d.Fields[i].Field == field {
+		return &d.Fields[i]
+	}
+	return nil
+}
+
+// FieldStatistics summarizes the values of one field
+type FieldStatistics struct {
+	Field     string            `json:"field"`
+	Count     int               `json:"count"`           // Records holding a value other than null
+	Nulls     int               `json:"nulls"`           // Records holding null or lacking the field
+	Distinct  int               `json:"distinct"`        // Estimated distinct strings, numbers and bools (HyperLogLog, within about 2%)
+	Trues     int               `json:"trues,omitempty"` // Values that are true
+	Types     map[string]int    `json:"types"`           // Values by JSON type: "string", "number", "bool", "object" or "array"
+	Min       interface{}       `json:"min,omitempty"`   // Smallest number, or smallest string when the field holds no numbers
+	Max       interface{}       `json:"max,omitempty"`
+	Histogram []HistogramBucket `json:"histogram,omitempty"` // Equi-depth buckets of the numbers
+}
+
+// HistogramBucket counts the numbers between two bounds
+type HistogramBucket struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Count int     `json:"count"`
+}
+
+// WithStatistics enables or disables the statistics catalog (see SetStatistics)
+func WithStatistics(enabled bool) Option {
+	return func(dm *DataManager) { dm.noStatistics = !enabled }
+}
+
+// SetStatistics enables or disables gathering the statistics catalog during
+// InMemory loads (enabled by default). The catalog records the null count,
+// an estimate of the distinct values, the range and a histogram of every
+// field; DescribeDataset returns it and the query planner estimates from it
+// how many records each condition keeps, checking the most selective
+// conditions first. Writes and deletes keep the counts, ranges and distinct
+// estimates current; histograms are only rebuilt by the next load. Disabling
+// it saves some load time and memory on wide records. The setting applies
+// from the next load on.
+func (dm *DataManager) SetStatistics(enabled bool) {
+	dm.noStatistics = !enabled
+}
+
+// DescribeDataset returns the statistics catalog of the in-memory data, or,
+// in Split mode, gathers it in one pass over the most recently loaded or
+// scanned input. When gathering is disabled in InMemory mode, the catalog is
+// computed from the records on each call.
+func (dm *DataManager) DescribeDataset() (*DatasetDescription, error) {
+	if dm.mode == InMemoryMode {
+		ds := dm.snapshot()
+		catalog := ds.stats
+		if catalog == nil {
+			catalog = newStatsCatalog()
+			for _, record := range ds.all() {
+				catalog.add(record)
+			}
+		}
+		return catalog.describe(), nil
+	}
+
+	source := dm.loadedPath()
+	if source == "" {
+		return nil, errors.New("No data source has been scanned yet")
+	}
+	catalog := newStatsCatalog()
+	err := dm.Pipeline().From(source).ForEach(func(record map[string]interface{}) error {
+		catalog.add(record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return catalog.describe(), nil
+}
+
+// statsCatalog gathers the statistics of a dataset
+type statsCatalog struct {
+	mu        sync.Mutex
+	records   int
+	fields    map[string]*fieldCollector // Top-level fields
+	tracked   int                        // Fields tracked, including nested ones
+	gathered  time.Time
+	changes   int
+	described *DatasetDescription // Result of describe until the next change
+}
+
+// JSON types counted by the statistics catalog, indexed by valueKind
+var valueKinds = [...]string{"string", "number", "bool", "object", "array"}
+
+// valueKind returns the index in valueKinds of the type of a value other
+// than null
+func valueKind(value interface{}) int {
+	switch value.(type) {
+	case string:
+		return 0
+	case bool:
+		return 2
+	case map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// fieldCollector gathers the statistics of one field
+type fieldCollector struct {
+	path                 string // Dotted path of the field
+	count                int
+	kinds                [len(valueKinds)]int
+	sketch               hyperLogLog
+	sample               []float64 // Uniform sample of the numbers (reservoir sampling)
+	rng                  uint64    // State of the xorshift generator picking the sample
+	numbers              int
+	minNumber, maxNumber float64
+	strings              int
+	minString, maxString string
+	trues                int
+	nested               map[string]*fieldCollector // Fields of object values
+}
+
+func newStatsCatalog() *statsCatalog {
+	return &statsCatalog{fields: make(map[string]*fieldCollector), gathered: time.Now()}
+}
+
+// add counts a record
+func (c *statsCatalog) add(record map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records++
+	c.described = nil
+	c.addObject(c.fields, "", record)
+}
+
+// addObject counts the fields of an object, whose collectors are in fields
+// and whose path is prefix; the caller holds c.mu
+func (c *statsCatalog) addObject(fields map[string]*fieldCollector, prefix string, object map[string]interface{}) {
+	for field, value := range object {
+		if value == nil {
+			continue
+		}
+		f := fields[field]
+		if f == nil {
+			if c.tracked >= maxCatalogFields {
+				continue
+			}
+			f = &fieldCollector{path: field}
+			if prefix != "" {
+				f.path = prefix + "." + field
+			}
+			fields[field] = f
+			c.tracked++
+		}
+		f.add(value)
+		if nested, ok := value.(map[string]interface{}); ok {
+			if f.nested == nil {
+				f.nested = make(map[string]*fieldCollector)
+			}
+			c.addObject(f.nested, f.path, nested)
+		}
+	}
+}
+
+// remove uncounts a record deleted or replaced since the statistics were
+// gathered. Ranges, distinct estimates and histograms cannot shrink and keep
+// covering its values.
+func (c *statsCatalog) remove(record map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records--
+	c.described = nil
+	removeObject(c.fields, record)
+}
+
+// removeObject uncounts the fields of an object; the caller holds c.mu
+func removeObject(fields map[string]*fieldCollector, object map[string]interface{}) {
+	for field, value := range object {
+		f := fields[field]
+		if value == nil || f == nil {
+			continue
+		}
+		f.count--
+		f.kinds[valueKind(value)]--
+		if value == true {
+			f.trues--
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			removeObject(f.nested, nested)
+		}
+	}
+}
+
+// change applies a write or delete of a record from old to record (either
+// may be nil)
+func (c *statsCatalog) change(old, record map[string]interface{}) {
+	if old != nil {
+		c.remove(old)
+	}
+	if record != nil {
+		c.add(record)
+	}
+	c.mu.Lock()
+	c.changes++
+	c.described = nil
+	c.mu.Unlock()
+}
+
+// add counts one value other than null
+func (f *fieldCollector) add(value interface{}) {
+	f.count++
+	switch v := value.(type) {
+	case string:
+		f.kinds[0]++
+		f.sketch.add(hashString(v))
+		if f.strings == 0 || v < f.minString {
+			f.minString = v
+		}
+		if f.strings == 0 || v > f.maxString {
+			f.maxString = v
+		}
+		f.strings++
+	case bool:
+		f.kinds[2]++
+		if v {
+			f.trues++
+			f.sketch.add(hashUint64(1))
+		} else {
+			f.sketch.add(hashUint64(2))
+		}
+	case map[string]interface{}:
+		f.kinds[3]++
+	case []interface{}:
+		f.kinds[4]++
+	default:
+		x, ok := numericValue(v)
+		if !ok {
+			return
+		}
+		f.kinds[1]++
+		f.sketch.add(hashUint64(math.Float64bits(x)))
+		f.sampleNumber(x)
+		if f.numbers == 0 || x < f.minNumber {
+			f.minNumber = x
+		}
+		if f.numbers == 0 || x > f.maxNumber {
+			f.maxNumber = x
+		}
+		f.numbers++
+	}
+}
+
+// sampleNumber keeps x in the sample with the probability that leaves every
+// number seen so far equally likely to be in it; f.numbers counts the
+// numbers before x
+func (f *fieldCollector) sampleNumber(x float64) {
+	if len(f.sample) < histogramSample {
+		f.sample = append(f.sample, x)
+		return
+	}
+	if f.rng == 0 {
+		f.rng = 0x9e3779b97f4a7c15
+	}
+	f.rng ^= f.rng << 13
+	f.rng ^= f.rng >> 7
+	f.rng ^= f.rng << 17
+	if i := f.rng % uint64(f.numbers+1); i < histogramSample {
+		f.sample[i] = x
+	}
+}
+
+// describe returns the statistics gathered so far. The description is
+// shared by callers until the next change and must not be modified.
+func (c *statsCatalog) describe() *DatasetDescription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.described != nil {
+		return c.described
+	}
+	d := &DatasetDescription{Records: c.records, Gathered: c.gathered, Changes: c.changes}
+	var collect func(fields map[string]*fieldCollector)
+	collect = func(fields map[string]*fieldCollector) {
+		for _, f := range fields {
+			d.Fields = append(d.Fields, f.statistics(c.records))
+			collect(f.nested)
+		}
+	}
+	collect(c.fields)
+	sort.Slice(d.Fields, func(i, j int) bool { return d.Fields[i].Field < d.Fields[j].Field })
+	c.described = d
+	return d
+}
+
+// statistics summarizes the collector over records records
+func (f *fieldCollector) statistics(records int) FieldStatistics {
+	s := FieldStatistics{
+		Field:    f.path,
+		Count:    f.count,
+		Nulls:    records - f.count,
+		Distinct: int(math.Round(f.sketch.estimate())),
+		Types:    make(map[string]int),
+		Trues:    f.trues,
+	}
+	for kind, n := range f.kinds {
+		if n > 0 {
+			s.Types[valueKinds[kind]] = n
+		}
+	}
+	if s.Distinct > s.Count {
+		s.Distinct = s.Count
+	}
+	switch {
+	case f.numbers > 0:
+		s.Min, s.Max = f.minNumber, f.maxNumber
+		s.Histogram = f.histogram()
+	case f.strings > 0:
+		s.Min, s.Max = f.minString, f.maxString
+	}
+	return s
+}
+
+// histogram splits the numbers into buckets of equal counts at the
+// quantiles of the sample
+func (f *fieldCollector) histogram() []HistogramBucket {
+	n := histogramBuckets
+	if len(f.sample) < n {
+		n = len(f.sample)
+	}
+	sample := append([]float64(nil), f.sample...)
+	sort.Float64s(sample)
+	buckets := make([]HistogramBucket, n)
+	lower := f.minNumber
+	assigned := 0
+	for i := range buckets {
+		upper := f.maxNumber
+		if i < n-1 {
+			upper = sample[len(sample)*(i+1)/n]
+		}
+		count := f.numbers * (i + 1) / n
+		buckets[i] = HistogramBucket{Lower: lower, Upper: upper, Count: count - assigned}
+		lower, assigned = upper, count
+	}
+	return buckets
+}
+
+// selectivity estimates the fraction of records matching condition, and
+// whether the statistics could tell
+func (d *DatasetDescription) selectivity(condition FilterCondition) (float64, bool) {
+	if d.Records == 0 {
+		return 0, false
+	}
+	switch condition.ValueType {
+	case ExprValueType, GeoValueType, ArrayValueType:
+		return 0, false
+	}
+	s := d.Field(condition.Key)
+	if s == nil {
+		// No record holds the field, so none can match
+		return 0, true
+	}
+	present := float64(s.Count) / float64(d.Records)
+	equal := present
+	if s.Distinct > 1 {
+		equal /= float64(s.Distinct)
+	}
+
+	switch condition.Operator {
+	case "==":
+		if b, ok := condition.Value.(bool); ok && condition.ValueType == "bool" {
+			if b {
+				return float64(s.Trues) / float64(d.Records), true
+			}
+			return float64(s.Types["bool"]-s.Trues) / float64(d.Records), true
+		}
+		if !s.covers(condition.Value) {
+			return 0, true
+		}
+		return equal, true
+	case "!=":
+		return present - equal, true
+	case "<", "<=", ">", ">=":
+	default:
+		return 0, false
+	}
+
+	if x, ok := numericValue(condition.Value); ok && condition.ValueType == "int" && len(s.Histogram) > 0 {
+		numbers := 0
+		for _, b := range s.Histogram {
+			numbers += b.Count
+		}
+		fraction := histogramFraction(s.Histogram, x) // Share of the numbers below x
+		if condition.Operator == ">" || condition.Operator == ">=" {
+			fraction = 1 - fraction
+		}
+		return fraction * float64(numbers) / float64(d.Records), true
+	}
+	// Strings beyond the range of the field match all or none of them;
+	// within it, guess a third
+	bound, ok := condition.Value.(string)
+	min, okMin := s.Min.(string)
+	max, okMax := s.Max.(string)
+	if ok && okMin && okMax && condition.Collation == BinaryCollation {
+		less := condition.Operator == "<" || condition.Operator == "<="
+		switch {
+		case bound < min || (bound == min && condition.Operator == "<"):
+			if less {
+				return 0, true
+			}
+			return present, true
+		case bound > max || (bound == max && condition.Operator == ">"):
+			if less {
+				return present, true
+			}
+			return 0, true
+		}
+	}
+	return present / 3, true
+}
+
+// covers reports whether value lies within the range of the field, as far
+// as the statistics tell
+func (s *FieldStatistics) covers(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		min, okMin := s.Min.(string)
+		max, okMax := s.Max.(string)
+		return !okMin || !okMax || (v >= min && v <= max)
+	default:
+		x, ok := numericValue(v)
+		min, okMin := s.Min.(float64)
+		max, okMax := s.Max.(float64)
+		return !ok || !okMin || !okMax || (x >= min && x <= max)
+	}
+}
+
+// histogramFraction estimates the share of the numbers below x, assuming
+// they spread evenly within each bucket
+func histogramFraction(buckets []HistogramBucket, x float64) float64 {
+	total, below := 0, 0.0
+	for _, b := range buckets {
+		total += b.Count
+		switch {
+		case x >= b.Upper:
+			below += float64(b.Count)
+		case x > b.Lower:
+			below += float64(b.Count) * (x - b.Lower) / (b.Upper - b.Lower)
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return below / float64(total)
+}
+
+// Registers of the HyperLogLog sketches, as a power of two; 4096 registers
+// estimate within about 1.6%
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct hashes added to it
+type hyperLogLog struct {
+	registers []uint8
+}
+
+// add records a 64-bit hash
+func (h *hyperLogLog) add(hash uint64) {
+	if h.registers == nil {
+		h.registers = make([]uint8, 1<<hllPrecision)
+	}
+	index := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct hashes, switching to
+// linear counting while many registers are empty
+func (h *hyperLogLog) estimate() float64 {
+	if h.registers == nil {
+		return 0
+	}
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// hashString returns a 64-bit hash of s (FNV-1a, mixed)
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return mix64(h)
+}
+
+// hashUint64 returns a 64-bit hash of x
+func hashUint64(x uint64) uint64 {
+	return mix64(x + 0x9e3779b97f4a7c15)
+}
+
+// mix64 spreads the bits of x over the whole word (the SplitMix64 finalizer)
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Charset names the character encoding of text input
+type Charset string
+
+const (
+	CharsetAuto        Charset = ""             // Detected from the first bytes of the input (default)
+	CharsetUTF8        Charset = "utf-8"        // A leading byte order mark is dropped
+	CharsetUTF16LE     Charset = "utf-16le"     // Little-endian UTF-16, as written by Windows tools
+	CharsetUTF16BE     Charset = "utf-16be"     // Big-endian UTF-16
+	CharsetLatin1      Charset = "latin-1"      // ISO 8859-1
+	CharsetWindows1252 Charset = "windows-1252" // Latin-1 with typographic quotes, dashes and € in 0x80-0x9F
+)
+
+// Bytes of input examined to detect its charset
+const charsetSampleSize = 64 * 1024
+
+// WithCharset sets the charset of text input (see SetCharset)
+func WithCharset(c Charset) Option {
+	return func(dm *DataManager) { dm.charset = c }
+}
+
+// SetCharset sets the character encoding of JSON, CSV and TSV input, which
+// is transcoded to UTF-8 as it is read by loads, scans, counts, imports and
+// pipelines. CharsetAuto, the default, detects it: a byte order mark
+// selects UTF-8 or UTF-16 and is dropped, input starting with an ASCII
+// character followed or preceded by a zero byte is UTF-16 without a mark,
+// and input whose first read (up to 64KB) is not valid UTF-8 is read as
+// Windows-1252, which agrees with Latin-1 on every printable character.
+// Anything else is read as the UTF-8 it already is, at no extra cost. Input
+// in another charset is read sequentially, since parallel scans split files
+// at byte offsets of UTF-8 lines. Features that seek into files by offset,
+// such as key indexes and lookups, memory-mapped scans, page tokens,
+// checkpoints and watches, expect UTF-8 input.
+func (dm *DataManager) SetCharset(c Charset) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	dm.charset = c
+	return nil
+}
+
+// validate checks that c is a known charset
+func (c Charset) validate() error {
+	switch c {
+	case CharsetAuto, CharsetUTF8, CharsetUTF16LE, CharsetUTF16BE, CharsetLatin1, CharsetWindows1252:
+		return nil
+	}
+	return fmt.Errorf("Unknown charset %q", c)
+}
+
+// DetectCharset returns the charset of input starting with sample, as
+// CharsetAuto detects it, and whether sample starts with a byte order mark
+func DetectCharset(sample []byte) (Charset, bool) {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return CharsetUTF8, true
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return CharsetUTF16LE, true
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return CharsetUTF16BE, true
+	case len(sample) >= 2 && sample[0] != 0 && sample[0] < utf8.RuneSelf && sample[1] == 0:
+		return CharsetUTF16LE, false
+	case len(sample) >= 2 && sample[0] == 0 && sample[1] != 0 && sample[1] < utf8.RuneSelf:
+		return CharsetUTF16BE, false
+	}
+	// A character cut off at the end of the sample is not an error
+	for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(sample[i]) {
+			if !utf8.FullRune(sample[i:]) {
+				sample = sample[:i]
+			}
+			break
+		}
+	}
+	if !utf8.Valid(sample) {
+		return CharsetWindows1252, false
+	}
+	return CharsetUTF8, false
+}
+
+// transcode returns r as UTF-8 without a byte order mark, decoding it from
+// the manager's charset. Detection looks at the bytes of the first read
+// only, so a stream such as stdin is not held up.
+func (dm *DataManager) transcode(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, charsetSampleSize)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return nil, err
+	}
+	sample, _ := br.Peek(br.Buffered())
+	charset, bom := DetectCharset(sample)
+	if dm.charset != CharsetAuto && dm.charset != charset {
+		charset, bom = dm.charset, false
+	}
+
+	var decoding encoding.Encoding
+	switch charset {
+	case CharsetUTF8:
+		if bom {
+			br.Discard(3)
+		}
+		return br, nil
+	case CharsetUTF16LE:
+		decoding = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	case CharsetUTF16BE:
+		decoding = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	case CharsetLatin1:
+		decoding = charmap.ISO8859_1
+	case CharsetWindows1252:
+		decoding = charmap.Windows1252
+	}
+	return decoding.NewDecoder().Reader(br), nil
+}
+
+// transcodesText reports whether format is read through transcode
+func transcodesText(format string) bool {
+	return format == "json" || format == "csv" || format == "tsv"
+}
+
+// plainUTF8 reports whether input starting with sample is read as it is,
+// which lets scans split it at byte offsets
+func (dm *DataManager) plainUTF8(sample []byte) bool {
+	charset, bom := DetectCharset(sample)
+	if dm.charset != CharsetAuto {
+		charset = dm.charset
+	}
+	return charset == CharsetUTF8 && !bom
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CheckpointOptions configures a resumable scan (see ScanWithCheckpoints)
+type CheckpointOptions struct {
+	Path     string        // Checkpoint file, replaced atomically on every save
+	Interval time.Duration // How often to save a checkpoint (default 10s)
+	State    interface{}   // Pointer to the aggregate state the handler updates, saved as JSON with each checkpoint (optional)
+}
+
+// checkpointFingerprint is how many leading bytes of the input a checkpoint
+// hashes to recognize the file on resume
+const checkpointFingerprint = 64 * 1024
+
+// scanCheckpoint is the content of a checkpoint file
+type scanCheckpoint struct {
+	Path           string            `json:"path"`
+	Conditions     []FilterCondition `json:"conditions"`
+	Offset         int64             `json:"offset"`      // Bytes of the input fully processed
+	Fingerprint    uint32            `json:"fingerprint"` // CRC-32 of the first FingerprintLen bytes of the input
+	FingerprintLen int64             `json:"fingerprint_len"`
+	Matched        int64             `json:"matched"` // Records passed to the handler so far
+	State          json.RawMessage   `json:"state,omitempty"`
+	Done           bool              `json:"done"`
+	SavedAt        time.Time         `json:"saved_at"`
+}
+
+// ScanWithCheckpoints streams the records of an uncompressed NDJSON file
+// matching conditions to handler, like LoadDataInSplitMode without
+// collecting them, and saves the byte offset reached and opts.State to
+// opts.Path every opts.Interval. If the process dies or ctx is cancelled,
+// ResumeScan continues from the last checkpoint, so a long scan only
+// repeats the records after it. Checkpoints are saved between records, so
+// the state saved always reflects exactly the records before the offset.
+// Resumable scans do not deduplicate records (see SetDeduplicate).
+func (dm *DataManager) ScanWithCheckpoints(ctx context.Context, filePath string, conditions []FilterCondition, opts CheckpointOptions, handler func(record map[string]interface{}) error) error {
+	if opts.Path == "" {
+		return errors.New("Resumable scans require a checkpoint path")
+	}
+	fingerprint, n, err := fingerprintFile(filePath, checkpointFingerprint)
+	if err != nil {
+		return err
+	}
+	cp := &scanCheckpoint{Path: filePath, Conditions: conditions, Fingerprint: fingerprint, FingerprintLen: n}
+	return dm.runCheckpointed(ctx, cp, opts, handler)
+}
+
+// ResumeScan continues the scan saved in the checkpoint at checkpointPath,
+// first restoring the saved aggregate state into state (a pointer, or nil when
+// the scan kept none). It fails with ErrCheckpointMismatch if the input was
+// replaced or truncated since, and returns at once if the scan had finished.
+func (dm *DataManager) ResumeScan(ctx context.Context, checkpointPath string, state interface{}, handler func(record map[string]interface{}) error) error {
+	raw, err := os.ReadFile(checkpointPath)
+	if err != nil {
+		return err
+	}
+	var cp scanCheckpoint
+	if err := json.Unmarshal(raw, &cp); err != nil {
+		return fmt.Errorf("Reading checkpoint %s: %w", checkpointPath, err)
+	}
+	cp.Conditions = normalizeConditions(cp.Conditions)
+	if state != nil && len(cp.State) > 0 {
+		if err := json.Unmarshal(cp.State, state); err != nil {
+			return fmt.Errorf("Restoring checkpoint state: %w", err)
+		}
+	}
+	if cp.Done {
+		return nil
+	}
+
+	fingerprint, n, err := fingerprintFile(cp.Path, cp.FingerprintLen)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(cp.Path); err != nil {
+		return err
+	} else if info.Size() < cp.Offset || n != cp.FingerprintLen || fingerprint != cp.Fingerprint {
+		return fmt.Errorf("%w: %s changed since the checkpoint was saved", ErrCheckpointMismatch, cp.Path)
+	}
+	return dm.runCheckpointed(ctx, &cp, CheckpointOptions{Path: checkpointPath, State: state}, handler)
+}
+
+// runCheckpointed scans cp.Path from cp.Offset, saving cp as it goes
+func (dm *DataManager) runCheckpointed(ctx context.Context, cp *scanCheckpoint, opts CheckpointOptions, handler func(map[string]interface{}) error) (err error) {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	file, err := os.Open(cp.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(cp.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	dm.parseErrors.reset()
+	defer dm.beginOperation("scan", cp.Path, func() int64 {
+		info, err := file.Stat()
+		if err != nil {
+			return -1
+		}
+		return info.Size() - cp.Offset
+	})(&err)
+
+	counted := &countingReader{r: file}
+	br := dm.chunkReader(counted)
+	defer dm.releaseChunkReader(br)
+	if first, err := peekNonSpace(br); err == nil && (first == '[' || first == 0x1f) {
+		return errors.New("Resumable scans require an uncompressed NDJSON file")
+	}
+
+	start, lastSave := cp.Offset, time.Now()
+	ls := dm.newLineScanner(cp.Conditions)
+	ls.projected = nil
+	err = ls.eachLine(br, start, math.MaxInt64, func(record map[string]interface{}, _ int) error {
+		if record != nil {
+			if err := handler(record); err != nil {
+				return err
+			}
+			cp.Matched++
+		}
+		// Everything read from the file but still buffered is not processed yet
+		cp.Offset = start + counted.n - int64(br.Buffered())
+		if ctx.Err() != nil {
+			if err := cp.save(opts); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		if time.Since(lastSave) >= interval {
+			lastSave = time.Now()
+			return cp.save(opts)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cp.Offset = start + counted.n - int64(br.Buffered())
+	cp.Done = true
+	return cp.save(opts)
+}
+
+// save writes the checkpoint and the current state to opts.Path atomically
+func (cp *scanCheckpoint) save(opts CheckpointOptions) error {
+	if opts.State != nil {
+		state, err := json.Marshal(opts.State)
+		if err != nil {
+			return fmt.Errorf("Saving checkpoint state: %w", err)
+		}
+		cp.State = state
+	}
+	cp.SavedAt = time.Now().UTC()
+	raw, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(opts.Path), filepath.Base(opts.Path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), opts.Path)
+}
+
+// fingerprintFile returns the CRC-32 of up to the first limit bytes of a
+// file and how many bytes it covers
+func fingerprintFile(path string, limit int64) (uint32, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, io.LimitReader(file, limit))
+	if err != nil {
+		return 0, 0, err
+	}
+	return h.Sum32(), n, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
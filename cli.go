@@ -0,0 +1,1669 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes follow grep: 0 on success (query matched), 1 when a query
+// matched nothing, 2 on usage or runtime errors
+const (
+	exitOK      = 0
+	exitNoMatch = 1
+	exitError   = 2
+)
+
+const cliUsage = `Usage: jsondm <command> [flags]
+
+Commands:
+  query         Filter records        jsondm query --file users.json --where 'age>30' --limit 100
+  index create  Build an index        jsondm index create --file users.json --key username --field age --type sorted
+  index offsets Index line offsets   jsondm index offsets --file events.ndjson --line 1000000
+  index bloom   Build Bloom filters  jsondm index bloom --field user_id --field email shards/*.json
+  index zones   Build zone maps      jsondm index zones --file events.ndjson --field ts --field latency_ms
+  convert       Convert formats       jsondm convert --file users.json --out users.csv --to csv
+  stats         Summarize a dataset   jsondm stats --file users.json
+  describe      Catalog field stats   jsondm describe --file users.json --histograms
+  profile       Report on a dump      jsondm profile --file dump.ndjson --out profile.html
+  serve         Run the HTTP server   jsondm serve --file users.json --key username --addr :8080
+  watch         Follow appended lines jsondm watch --file events.ndjson --where 'level==error'
+  schema        Infer a schema        jsondm schema --file users.json --sample 10000
+  decoders      Compare JSON decoders jsondm decoders --file events.ndjson --lines 100000
+  bench         Measure throughput    jsondm bench --records 1000000 --cpuprofile cpu.prof --format json
+  join          Join two datasets     jsondm join --left users.json --right orders.csv --on id=user_id
+  split         Shard a large file    jsondm split --file events.json --by user_id --shards 16 --out shards/
+  merge         Merge keyed files     jsondm merge --key id --timestamp updated_at --out all.json a.json b.json
+  diff          Compare two datasets  jsondm diff --key id --fields price,stock yesterday.json today.json
+  fetch         Snapshot a JSON API   jsondm fetch --url https://api.example.com/items --records data --next next --out items.json
+  synth         Generate fake data    jsondm synth --file users.json --records 1000000 --out fixture.ndjson
+  anonymize     Replace PII by fakes  jsondm anonymize --file users.json --policy policy.json --out fixture.ndjson
+
+Run 'jsondm <command> -h' for the flags of a command.
+`
+
+// parseErrorPolicy maps the --on-error flag to an ErrorPolicy
+func parseErrorPolicy(name string) (ErrorPolicy, error) {
+	switch name {
+	case "fail":
+		return FailFast, nil
+	case "skip":
+		return Skip, nil
+	case "collect":
+		return Collect, nil
+	default:
+		return FailFast, &cliError{fmt.Sprintf("unknown --on-error value %q", name)}
+	}
+}
+
+// multiFlag collects a repeatable string flag
+type multiFlag []string
+
+func (m *multiFlag) String() string     { return strings.Join(*m, " AND ") }
+func (m *multiFlag) Set(v string) error { *m = append(*m, v); return nil }
+
+// cliError is a usage error that should print the command's help
+type cliError struct{ msg string }
+
+func (e *cliError) Error() string { return e.msg }
+
+// runCLI executes the command line and returns the process exit code
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, cliUsage)
+		if len(args) == 0 {
+			return exitError
+		}
+		return exitOK
+	}
+
+	var code int
+	var err error
+	switch args[0] {
+	case "query":
+		code, err = runQueryCommand(args[1:], stdout, stderr)
+	case "index":
+		switch {
+		case len(args) >= 2 && args[1] == "create":
+			code, err = runIndexCommand(args[2:], stdout, stderr)
+		case len(args) >= 2 && args[1] == "offsets":
+			code, err = runOffsetIndexCommand(args[2:], stdout, stderr)
+		case len(args) >= 2 && args[1] == "bloom":
+			code, err = runBloomCommand(args[2:], stdout, stderr)
+		case len(args) >= 2 && args[1] == "zones":
+			code, err = runZoneMapCommand(args[2:], stdout, stderr)
+		default:
+			err = &cliError{"expected 'index create', 'index offsets', 'index bloom' or 'index zones'"}
+		}
+	case "convert":
+		code, err = runConvertCommand(args[1:], stdout, stderr)
+	case "stats":
+		code, err = runStatsCommand(args[1:], stdout, stderr)
+	case "describe":
+		code, err = runDescribeCommand(args[1:], stdout, stderr)
+	case "profile":
+		code, err = runProfileCommand(args[1:], stdout, stderr)
+	case "serve":
+		code, err = runServeCommand(args[1:], stdout, stderr)
+	case "watch":
+		code, err = runWatchCommand(args[1:], stdout, stderr)
+	case "schema":
+		code, err = runSchemaCommand(args[1:], stdout, stderr)
+	case "decoders":
+		code, err = runDecodersCommand(args[1:], stdout, stderr)
+	case "bench":
+		code, err = runBenchCommand(args[1:], stdout, stderr)
+	case "join":
+		code, err = runJoinCommand(args[1:], stdout, stderr)
+	case "split":
+		code, err = runSplitCommand(args[1:], stdout, stderr)
+	case "merge":
+		code, err = runMergeCommand(args[1:], stdout, stderr)
+	case "diff":
+		code, err = runDiffCommand(args[1:], stdout, stderr)
+	case "fetch":
+		code, err = runFetchCommand(args[1:], stdout, stderr)
+	case "synth":
+		code, err = runSynthCommand(args[1:], stdout, stderr)
+	case "anonymize":
+		code, err = runAnonymizeCommand(args[1:], stdout, stderr)
+	default:
+		err = &cliError{fmt.Sprintf("unknown command %q", args[0])}
+	}
+
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		fmt.Fprintln(stderr, "jsondm:", err)
+		var usageErr *cliError
+		if errors.As(err, &usageErr) {
+			fmt.Fprint(stderr, cliUsage)
+		}
+		return exitError
+	}
+	return code
+}
+
+// newFlagSet creates a flag set that reports errors instead of exiting
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("jsondm "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func runQueryCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("query", stderr)
+	file := fs.String("file", "", "input file, URL, object location, or - for stdin")
+	var where multiFlag
+	fs.Var(&where, "where", "condition such as 'age>30' or 'fullname contains James' (repeatable, or join with &&)")
+	expr := fs.String("expr", "", "expression every record must also satisfy, such as 'age > 30 && (city == \"Hanoi\" || vip)'")
+	collation := fs.String("collation", "", "collation of string conditions and --index indexes, such as ci or de,ai")
+	var computed multiFlag
+	fs.Var(&computed, "compute", "computed field such as 'age_bucket = floor(age/10)*10' (repeatable)")
+	limit := fs.Int("limit", 0, "maximum number of records to output (0 means all)")
+	format := fs.String("format", "json", "output format: json, ndjson, csv, xlsx, msgpack, bson, arrow, arrows, or table")
+	fields := fs.String("fields", "", "comma-separated fields to output (default all)")
+	key := fs.String("key", "", "key field; loads the data in memory instead of streaming it")
+	surrogate := fs.String("surrogate-keys", "", "without --key, load the data in memory keyed by generated _id values: line or uuid")
+	duplicates := fs.String("duplicates", "last", "record kept for a repeated --key value: last, first, or error (fail listing their lines)")
+	indexFlag := fs.String("index", "", "comma-separated field:type indexes to build in memory (e.g. age:sorted)")
+	explain := fs.Bool("explain", false, "print the query plan to stderr (requires --key)")
+	count := fs.Bool("count", false, "print the number of matching records instead of the records")
+	orderBy := fs.String("order-by", "", "sort the output, such as 'timestamp desc, id'; large inputs are sorted through temporary files")
+	partitionBy := fs.String("partition-by", "", "write the records to one NDJSON file per value of this field (requires --out)")
+	out := fs.String("out", "", "output path pattern with --partition-by, such as 'out/{value}.ndjson' or 'out/{value:2006-01-02}.ndjson'")
+	pageSize := fs.Int("page-size", 0, "output one page of this many records and print the next page's token to stderr")
+	pageToken := fs.String("page-token", "", "continue after the page that printed this token (with --page-size)")
+	onError := fs.String("on-error", "fail", "malformed records: fail, skip, or collect (report them on stderr)")
+	redact := fs.String("redact", "", "JSON redaction policy applied to the output records")
+	trimPrefix := fs.Bool("trim-prefix", false, "ignore everything before the first { of each line, such as syslog headers")
+	unwrap := fs.String("unwrap", "", "read each line's record from the JSON string held in this field")
+	decoder := fs.String("decoder", "", "NDJSON decoder: standard or fast (default standard, or fast when built with -tags fastjson)")
+	var coerce multiFlag
+	fs.Var(&coerce, "coerce", "field:type normalizing the field's values, such as age:int (repeatable)")
+	lenient := fs.Bool("lenient", false, "turn strings holding a plain number or true/false into numbers and bools")
+	charset := fs.String("charset", "", "input charset: utf-8, utf-16le, utf-16be, latin-1 or windows-1252 (default detected from the first bytes)")
+	repair := fs.Bool("repair", false, "fix trailing commas, NaN/Infinity, single quotes, byte order marks and concatenated objects in malformed lines")
+	workers := fs.Int("workers", 0, "goroutines of parallel scans (0 tunes the count)")
+	chunkSize := fs.Int64("chunk-size", 0, "bytes per chunk of parallel scans (0 tunes the size)")
+	pinWorkers := fs.Bool("pin-workers", false, "bind the workers of parallel scans to CPUs, spread across NUMA nodes")
+	maxRAM := fs.Int64("max-ram", 2*1024*1024*1024, "memory limit in bytes")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"query requires --file"}
+	}
+	if (*partitionBy == "") != (*out == "") {
+		return exitError, &cliError{"--partition-by and --out go together"}
+	}
+	policy, err := parseErrorPolicy(*onError)
+	if err != nil {
+		return exitError, err
+	}
+	var redaction *RedactionPolicy
+	if *redact != "" {
+		if redaction, err = LoadRedactionPolicy(*redact); err != nil {
+			return exitError, err
+		}
+	}
+
+	conditions, err := parseWhere(where)
+	if err != nil {
+		return exitError, err
+	}
+	if err := ValidateCollation(Collation(*collation)); err != nil {
+		return exitError, err
+	}
+	for i := range conditions {
+		if conditions[i].ValueType == "string" {
+			conditions[i].Collation = Collation(*collation)
+		}
+	}
+	if *expr != "" {
+		condition, err := ExprCondition(*expr)
+		if err != nil {
+			return exitError, err
+		}
+		conditions = append(conditions, condition)
+	}
+	var order []SortField
+	if *orderBy != "" {
+		if order, err = ParseOrderBy(*orderBy); err != nil {
+			return exitError, &cliError{err.Error()}
+		}
+	}
+
+	var results []map[string]interface{}
+	var dm *DataManager
+	var partitioned *PartitionedExport
+	matches, streamed := -1, -1
+	setup := func(mode Mode) error {
+		dm = NewDataManager(*maxRAM, mode)
+		dm.SetErrorPolicy(policy)
+		dm.workers = *workers
+		if err := dm.SetChunkSize(*chunkSize); err != nil {
+			return &cliError{err.Error()}
+		}
+		dm.SetPinnedWorkers(*pinWorkers)
+		if *decoder != "" {
+			if err := dm.SetDecoder(Decoder(*decoder)); err != nil {
+				return &cliError{err.Error()}
+			}
+		}
+		switch {
+		case *unwrap != "" && *trimPrefix:
+			unwrapField := UnwrapJSONField(*unwrap)
+			dm.SetLinePreprocessor(func(line []byte) ([]byte, error) {
+				if line, _ = TrimLinePrefix(line); len(line) == 0 {
+					return nil, nil
+				}
+				return unwrapField(line)
+			})
+		case *unwrap != "":
+			dm.SetLinePreprocessor(UnwrapJSONField(*unwrap))
+		case *trimPrefix:
+			dm.SetLinePreprocessor(TrimLinePrefix)
+		}
+		for _, definition := range computed {
+			if err := dm.DefineComputedField(definition); err != nil {
+				return err
+			}
+		}
+		coercion := CoercionOptions{Lenient: *lenient}
+		for _, s := range coerce {
+			rule, err := ParseCoercionRule(s)
+			if err != nil {
+				return &cliError{err.Error()}
+			}
+			coercion.Rules = append(coercion.Rules, rule)
+		}
+		if err := dm.SetCoercion(coercion); err != nil {
+			return &cliError{err.Error()}
+		}
+		if err := dm.SetCharset(Charset(*charset)); err != nil {
+			return &cliError{err.Error()}
+		}
+		dm.SetRepair(*repair)
+		return nil
+	}
+	if *key == "" && *surrogate == "" {
+		if err := setup(SplitMode); err != nil {
+			return exitError, err
+		}
+		switch {
+		case *count:
+			dm.setSourcePath(*file)
+			matches, err = dm.CountWhere(conditions)
+		case *pageSize > 0:
+			dm.setSourcePath(*file)
+			results, err = queryPage(dm, conditions, *pageSize, *pageToken, stderr)
+		case order != nil && *limit == 0 && *format == "ndjson" && *fields == "" && redaction == nil:
+			// Without a limit every match is output, so sort runs spill to
+			// disk and stream out instead of being held for writeRecords
+			streamed, err = dm.SortTo(*file, conditions, order, stdout)
+		case order != nil:
+			results, err = querySorted(dm, conditions, FindOptions{Source: *file, Limit: *limit, OrderBy: order})
+		case *partitionBy != "":
+			dm.setSourcePath(*file)
+			partitioned, err = dm.ExportPartitioned(conditions, *partitionBy, *out)
+		default:
+			results, err = dm.LoadDataInSplitMode(*file, conditions)
+		}
+	} else {
+		if err := setup(InMemoryMode); err != nil {
+			return exitError, err
+		}
+		strategy, err := parseKeepPolicy("duplicates", *duplicates, "")
+		if err != nil {
+			return exitError, err
+		}
+		dm.SetDuplicateKeys(strategy)
+		if err := dm.SetSurrogateKeys(SurrogateKeys(*surrogate)); err != nil {
+			return exitError, &cliError{err.Error()}
+		}
+		if err = dm.LoadDataInMemory(*file, *key); err != nil {
+			return exitError, err
+		}
+		if n := dm.DuplicateKeyCount(); n > 0 {
+			fmt.Fprintf(stderr, "jsondm: %d records repeated the %s of an earlier record\n", n, *key)
+		}
+		if err = createIndexes(dm, *indexFlag, Collation(*collation)); err != nil {
+			return exitError, err
+		}
+		if *explain {
+			plan, _ := dm.Explain(conditions)
+			fmt.Fprintln(stderr, plan)
+		}
+		switch {
+		case *count:
+			matches, err = dm.CountWhere(conditions)
+		case *pageSize > 0:
+			results, err = queryPage(dm, conditions, *pageSize, *pageToken, stderr)
+		case order != nil:
+			results, err = querySorted(dm, conditions, FindOptions{Limit: *limit, OrderBy: order})
+		case *partitionBy != "":
+			partitioned, err = dm.ExportPartitioned(conditions, *partitionBy, *out)
+		default:
+			results, err = dm.Query(conditions)
+		}
+	}
+	if err != nil {
+		return exitError, err
+	}
+	for _, parseErr := range dm.ParseErrors() {
+		fmt.Fprintln(stderr, "jsondm: skipped:", parseErr.Error())
+	}
+	if n := dm.ParseErrorCount(); n > 0 {
+		fmt.Fprintf(stderr, "jsondm: skipped %d malformed records\n", n)
+	}
+	if report := dm.CoercionReport(); report.Failed > 0 {
+		fields := make([]string, 0, len(report.Fields))
+		for field, stats := range report.Fields {
+			if stats.Failed > 0 {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			stats := report.Fields[field]
+			fmt.Fprintf(stderr, "jsondm: %d values of %s could not be coerced, such as %v\n", stats.Failed, field, stats.Samples[0])
+		}
+	}
+	if report := dm.RepairReport(); report.Lines > 0 {
+		kinds := make([]string, 0, len(report.Fixes))
+		for kind, n := range report.Fixes {
+			kinds = append(kinds, fmt.Sprintf("%s %d", kind, n))
+		}
+		sort.Strings(kinds)
+		fmt.Fprintf(stderr, "jsondm: repaired %d lines into %d records (%s)\n", report.Lines, report.Records, strings.Join(kinds, ", "))
+	}
+
+	if partitioned != nil {
+		fmt.Fprintf(stderr, "jsondm: wrote %d records to %d files\n", partitioned.Records, len(partitioned.Partitions))
+		if partitioned.Records == 0 {
+			return exitNoMatch, nil
+		}
+		return exitOK, nil
+	}
+	if matches >= 0 {
+		fmt.Fprintln(stdout, matches)
+		if matches == 0 {
+			return exitNoMatch, nil
+		}
+		return exitOK, nil
+	}
+	if streamed >= 0 {
+		if streamed == 0 {
+			return exitNoMatch, nil
+		}
+		return exitOK, nil
+	}
+	if *limit > 0 && len(results) > *limit {
+		results = results[:*limit]
+	}
+	if results, err = dm.Redact(results, redaction); err != nil {
+		return exitError, err
+	}
+	if err := writeRecords(stdout, results, splitList(*fields), *format); err != nil {
+		return exitError, err
+	}
+	if len(results) == 0 {
+		return exitNoMatch, nil
+	}
+	return exitOK, nil
+}
+
+func runWatchCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("watch", stderr)
+	file := fs.String("file", "", "NDJSON file to follow")
+	var where multiFlag
+	fs.Var(&where, "where", "condition such as 'level==error' (repeatable, or join with &&)")
+	fromStart := fs.Bool("from-start", false, "process the existing content before following appends")
+	interval := fs.Duration("interval", 500*time.Millisecond, "polling interval")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"watch requires --file"}
+	}
+
+	conditions, err := parseWhere(where)
+	if err != nil {
+		return exitError, err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	encoder := json.NewEncoder(stdout)
+	dm := NewDataManager(0, "Split")
+	err = dm.Watch(ctx, *file, WatchOptions{Conditions: conditions, PollInterval: *interval, FromStart: *fromStart}, func(record map[string]interface{}) {
+		encoder.Encode(record)
+	})
+	if err != nil {
+		return exitError, err
+	}
+	return exitOK, nil
+}
+
+func runSchemaCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("schema", stderr)
+	file := fs.String("file", "", "input file, URL, object location, or - for stdin")
+	sample := fs.Int("sample", 0, "number of records to inspect (0 means all)")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"schema requires --file"}
+	}
+
+	dm := NewDataManager(0, "Split")
+	schema, err := dm.InferSchema(*file, *sample)
+	if err != nil {
+		return exitError, err
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(schema); err != nil {
+		return exitError, err
+	}
+	return exitOK, nil
+}
+
+func runDecodersCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("decoders", stderr)
+	file := fs.String("file", "", "NDJSON input file")
+	lines := fs.Int("lines", 0, "number of lines to decode (0 means all)")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"decoders requires --file"}
+	}
+
+	dm := NewDataManager(0, "Split")
+	report, err := dm.CompareDecoders(*file, *lines)
+	if err != nil {
+		return exitError, err
+	}
+	mb := float64(report.Bytes) / (1 << 20)
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "decoder\ttime\tMB/s\n")
+	fmt.Fprintf(tw, "standard\t%s\t%.1f\n", report.StandardTime.Round(time.Millisecond), mb/report.StandardTime.Seconds())
+	fmt.Fprintf(tw, "fast\t%s\t%.1f\n", report.FastTime.Round(time.Millisecond), mb/report.FastTime.Seconds())
+	tw.Flush()
+	fmt.Fprintf(stdout, "%d lines, %.2fx faster, %d mismatches\n", report.Lines, report.Speedup(), report.Mismatches)
+	if report.Mismatches > 0 {
+		fmt.Fprintf(stdout, "first mismatch on line %d\n", report.FirstMismatch)
+		return exitNoMatch, nil
+	}
+	return exitOK, nil
+}
+
+func runBenchCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("bench", stderr)
+	var opts BenchmarkOptions
+	fs.IntVar(&opts.Dataset.Records, "records", 100000, "records of the generated dataset")
+	fs.IntVar(&opts.Dataset.ExtraFields, "extra-fields", 0, "numeric fields added to every generated record")
+	fs.IntVar(&opts.Dataset.TagCount, "tags", 3, "elements of each generated record's tags array")
+	fs.IntVar(&opts.Dataset.TextLength, "text", 64, "length of each generated record's free-text field")
+	fs.BoolVar(&opts.Dataset.Nested, "nested", false, "add a nested address object to generated records")
+	fs.Int64Var(&opts.Dataset.Seed, "seed", 1, "seed of the generated data")
+	fs.StringVar(&opts.File, "file", "", "measure this NDJSON file, keyed by id, instead of generated data")
+	fs.StringVar(&opts.Keep, "keep", "", "keep the generated dataset at this path")
+	fs.IntVar(&opts.Queries, "queries", 100, "repetitions of each in-memory query")
+	decoder := fs.String("decoder", "", "NDJSON decoder: standard or fast")
+	fs.IntVar(&opts.Workers, "workers", 0, "goroutines of parallel scans (0 tunes the count)")
+	fs.StringVar(&opts.CPUProfile, "cpuprofile", "", "write a pprof CPU profile to this file")
+	fs.StringVar(&opts.MemProfile, "memprofile", "", "write a pprof heap profile to this file")
+	format := fs.String("format", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	opts.Decoder = Decoder(*decoder)
+	if opts.Decoder != "" && opts.Decoder != StandardDecoder && opts.Decoder != FastDecoder {
+		return exitError, &cliError{fmt.Sprintf("unknown --decoder value %q", *decoder)}
+	}
+
+	report, err := RunBenchmark(opts)
+	if err != nil {
+		return exitError, err
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return exitError, err
+		}
+		return exitOK, nil
+	}
+	fmt.Fprintf(stdout, "%d records, %.1f MB, %s, %d CPUs, heap %.1f MB after load\n",
+		report.Records, float64(report.Bytes)/(1<<20), report.GoVersion, report.CPUs, float64(report.HeapBytes)/(1<<20))
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "operation\tops\ttime/op\trecords/s\tMB/s\tallocs/op\tmatches\t\n")
+	for _, r := range report.Results {
+		perOp := r.Duration / time.Duration(r.Ops)
+		mbps := "-"
+		if r.Bytes > 0 {
+			mbps = fmt.Sprintf("%.1f", r.MBPerS)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.0f\t%s\t%d\t%d\t\n", r.Name, r.Ops, perOp.Round(time.Microsecond), r.RecordsPerS, mbps, r.Allocs/uint64(r.Ops), r.Matches)
+	}
+	tw.Flush()
+	return exitOK, nil
+}
+
+func runSplitCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("split", stderr)
+	file := fs.String("file", "", "input file, URL or object location")
+	by := fs.String("by", "", "field whose hash picks each record's shard (requires --shards)")
+	shards := fs.Int("shards", 0, "number of shards with --by")
+	records := fs.Int64("records", 0, "records per shard")
+	size := fs.Int64("size", 0, "target shard size in bytes")
+	out := fs.String("out", "", "output directory (default: the input's)")
+	prefix := fs.String("prefix", "", "shard file name prefix (default: the input's base name)")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"split requires --file"}
+	}
+	strategy := ShardStrategy{Key: *by, Shards: *shards, Records: *records, Bytes: *size, Dir: *out, Prefix: *prefix}
+	if err := strategy.validate(); err != nil {
+		return exitError, &cliError{err.Error()}
+	}
+
+	dm := NewDataManager(2*1024*1024*1024, "Split")
+	manifest, err := dm.SplitFile(*file, strategy)
+	if err != nil {
+		return exitError, err
+	}
+	for _, shard := range manifest.Shards {
+		fmt.Fprintf(stdout, "%s\t%d records\t%d bytes\n", shard.Path, shard.Records, shard.Bytes)
+	}
+	return exitOK, nil
+}
+
+func runSynthCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("synth", stderr)
+	file := fs.String("file", "", "dataset to profile and imitate")
+	profilePath := fs.String("profile", "", "imitate the profile written by 'jsondm profile --format json' instead")
+	schemaPath := fs.String("schema", "", "imitate the schema written by 'jsondm schema' instead")
+	sample := fs.Int("sample", 0, "records of --file to profile (0 means all)")
+	var opts SyntheticOptions
+	fs.IntVar(&opts.Records, "records", 1000, "records to generate")
+	fs.Int64Var(&opts.Seed, "seed", 1, "seed of the generated data")
+	var fakes multiFlag
+	fs.Var(&fakes, "fake", "field:kind fake of a string field, such as contact:email (repeatable)")
+	out := fs.String("out", "-", "NDJSON output file, or - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	sources := 0
+	for _, source := range []string{*file, *profilePath, *schemaPath} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return exitError, &cliError{"synth requires one of --file, --profile or --schema"}
+	}
+	for _, f := range fakes {
+		field, kind, ok := strings.Cut(f, ":")
+		if !ok || FakeKind(kind).validate() != nil {
+			return exitError, &cliError{fmt.Sprintf("invalid --fake value %q", f)}
+		}
+		if opts.Fakes == nil {
+			opts.Fakes = make(map[string]FakeKind)
+		}
+		opts.Fakes[field] = FakeKind(kind)
+	}
+
+	var profile *DataProfile
+	switch {
+	case *file != "":
+		dm := NewDataManager(0, "Split")
+		var err error
+		if profile, err = dm.Profile(*file, ProfileOptions{TopValues: 50, Sample: *sample}); err != nil {
+			return exitError, err
+		}
+	case *profilePath != "":
+		data, err := os.ReadFile(*profilePath)
+		if err != nil {
+			return exitError, err
+		}
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return exitError, fmt.Errorf("Invalid profile %s: %w", *profilePath, err)
+		}
+	default:
+		data, err := os.ReadFile(*schemaPath)
+		if err != nil {
+			return exitError, err
+		}
+		var schema Schema
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return exitError, fmt.Errorf("Invalid schema %s: %w", *schemaPath, err)
+		}
+		profile = SchemaProfile(&schema)
+	}
+
+	w := stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return exitError, err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := GenerateSynthetic(w, profile, opts); err != nil {
+		return exitError, err
+	}
+	return exitOK, nil
+}
+
+func runAnonymizeCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("anonymize", stderr)
+	file := fs.String("file", "", "input file, URL or object location")
+	policyPath := fs.String("policy", "", "JSON redaction policy; \"fake\" rules replace values by consistent fakes")
+	var fields multiFlag
+	fs.Var(&fields, "fake", "field, or field:kind, replaced by consistent fakes without a policy (repeatable)")
+	salt := fs.String("salt", "", "secret making the fakes impossible to reproduce from guessed values")
+	out := fs.String("out", "", "NDJSON output file")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" || *out == "" {
+		return exitError, &cliError{"anonymize requires --file and --out"}
+	}
+	if (*policyPath == "") == (len(fields) == 0) {
+		return exitError, &cliError{"anonymize requires one of --policy or --fake"}
+	}
+	policy := &RedactionPolicy{Salt: *salt}
+	if *policyPath != "" {
+		var err error
+		if policy, err = LoadRedactionPolicy(*policyPath); err != nil {
+			return exitError, err
+		}
+		if *salt != "" {
+			policy.Salt = *salt
+		}
+	}
+	for _, f := range fields {
+		field, kind, _ := strings.Cut(f, ":")
+		policy.Rules = append(policy.Rules, RedactionRule{Field: field, Action: RedactFake, Fake: FakeKind(kind)})
+	}
+
+	dm := NewDataManager(0, "Split")
+	n, err := dm.Anonymize(*file, *out, policy)
+	if err != nil {
+		return exitError, err
+	}
+	fmt.Fprintf(stderr, "jsondm: wrote %d records to %s\n", n, *out)
+	return exitOK, nil
+}
+
+func runFetchCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("fetch", stderr)
+	endpoint := fs.String("url", "", "first page of the JSON endpoint")
+	var headers multiFlag
+	fs.Var(&headers, "header", "request header such as 'Authorization: Bearer $TOKEN' (repeatable)")
+	records := fs.String("records", "", "dotted path of the record array in each page (default: the page is the array)")
+	next := fs.String("next", "", "dotted path of the next page's URL, or of a cursor with --cursor-param")
+	cursorParam := fs.String("cursor-param", "", "query parameter carrying the cursor found at --next")
+	pageParam := fs.String("page-param", "", "query parameter numbering the pages from 1")
+	maxPages := fs.Int("max-pages", 0, "stop after this many pages (0 means all)")
+	retries := fs.Int("retries", 3, "retries of a failed request")
+	out := fs.String("out", "", "NDJSON file the records are stored in")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *endpoint == "" || *out == "" {
+		return exitError, &cliError{"fetch requires --url and --out"}
+	}
+	opts := APIOptions{
+		URL:         *endpoint,
+		Headers:     make(map[string]string),
+		RecordsPath: *records,
+		NextPath:    *next,
+		CursorParam: *cursorParam,
+		PageParam:   *pageParam,
+		MaxPages:    *maxPages,
+		Retries:     *retries,
+		CachePath:   *out,
+	}
+	if *retries == 0 {
+		opts.Retries = -1
+	}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return exitError, &cliError{fmt.Sprintf("invalid --header %q (want 'Name: value')", header)}
+		}
+		opts.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	dm := NewDataManager(2*1024*1024*1024, "Split")
+	n, err := dm.FetchAPI(opts)
+	if err != nil {
+		return exitError, err
+	}
+	fmt.Fprintf(stdout, "%s\t%d records\n", *out, n)
+	return exitOK, nil
+}
+
+func runMergeCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("merge", stderr)
+	key := fs.String("key", "", "field identifying a record across the inputs")
+	keep := fs.String("keep", "last", "record kept for a duplicated key: last, first, or error (fail listing their lines)")
+	timestamp := fs.String("timestamp", "", "with --keep last, keep the record with the newest value of this field")
+	out := fs.String("out", "-", "output file, or - for stdout")
+	format := fs.String("format", "ndjson", "output format: json, ndjson, csv, xlsx, msgpack, bson, arrow, arrows, or table")
+	maxRAM := fs.Int64("max-ram", 2*1024*1024*1024, "memory limit in bytes")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *key == "" || fs.NArg() == 0 {
+		return exitError, &cliError{"merge requires --key and at least one input"}
+	}
+	strategy, err := parseKeepPolicy("keep", *keep, *timestamp)
+	if err != nil {
+		return exitError, err
+	}
+
+	dm := NewDataManager(*maxRAM, "Split")
+	records, err := dm.MergeFiles(fs.Args(), *key, strategy)
+	if err != nil {
+		return exitError, err
+	}
+
+	w := stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return exitError, err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeRecords(w, records, nil, *format); err != nil {
+		return exitError, err
+	}
+	return exitOK, nil
+}
+
+// queryPage returns one page of the matching records, printing the token of
+// the next one to stderr
+func queryPage(dm *DataManager, conditions []FilterCondition, size int, token string, stderr io.Writer) ([]map[string]interface{}, error) {
+	page, err := dm.QueryPage(conditions, size, token)
+	if err != nil {
+		return nil, err
+	}
+	if page.NextToken != "" {
+		fmt.Fprintf(stderr, "jsondm: next page: --page-token %s\n", page.NextToken)
+	}
+	return page.Records, nil
+}
+
+// querySorted returns the matching records in the order of opts.OrderBy,
+// including those the result set spilled to disk
+func querySorted(dm *DataManager, conditions []FilterCondition, opts FindOptions) ([]map[string]interface{}, error) {
+	rs, err := dm.Find(conditions, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	it := rs.Iterator()
+	defer it.Close()
+	records := make([]map[string]interface{}, 0, rs.Len())
+	for {
+		record, err := it.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// parseKeepPolicy maps the value of a --keep style flag to a merge strategy
+func parseKeepPolicy(flag, value, timestamp string) (MergeStrategy, error) {
+	switch value {
+	case "last":
+		return LastWriteWins(timestamp), nil
+	case "first":
+		return FirstWriteWins(), nil
+	case "error":
+		return RejectDuplicateKeys(), nil
+	}
+	return MergeStrategy{}, &cliError{fmt.Sprintf("unknown --%s value %q", flag, value)}
+}
+
+func runDiffCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("diff", stderr)
+	key := fs.String("key", "", "field matching records across the two inputs")
+	fields := fs.String("fields", "", "comma-separated fields to compare and output (default all)")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *key == "" || fs.NArg() != 2 {
+		return exitError, &cliError{"diff requires --key and two inputs"}
+	}
+
+	dm := NewDataManager(2*1024*1024*1024, "Split")
+	bw := bufio.NewWriter(stdout)
+	if err := dm.DiffFeed(fs.Arg(0), fs.Arg(1), *key, bw, splitList(*fields)...); err != nil {
+		return exitError, err
+	}
+	return exitOK, bw.Flush()
+}
+
+func runJoinCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("join", stderr)
+	left := fs.String("left", "", "left input")
+	right := fs.String("right", "", "right input")
+	on := fs.String("on", "", "join fields as leftField=rightField, or one field name shared by both")
+	kind := fs.String("type", "inner", "join type: inner or left")
+	format := fs.String("format", "ndjson", "output format: json, ndjson, csv, xlsx, msgpack, bson, arrow, arrows, or table")
+	maxRAM := fs.Int64("max-ram", 2*1024*1024*1024, "memory limit in bytes")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *left == "" || *right == "" || *on == "" {
+		return exitError, &cliError{"join requires --left, --right and --on"}
+	}
+
+	leftKey, rightKey, found := strings.Cut(*on, "=")
+	if !found {
+		rightKey = leftKey
+	}
+	joinType := InnerJoin
+	switch *kind {
+	case "inner":
+	case "left":
+		joinType = LeftJoin
+	default:
+		return exitError, &cliError{fmt.Sprintf("unknown join type %q", *kind)}
+	}
+
+	dm := NewDataManager(*maxRAM, "Split")
+	results, err := dm.Join(*left, *right, strings.TrimSpace(leftKey), strings.TrimSpace(rightKey), joinType)
+	if err != nil {
+		return exitError, err
+	}
+	if err := writeRecords(stdout, results, nil, *format); err != nil {
+		return exitError, err
+	}
+	if len(results) == 0 {
+		return exitNoMatch, nil
+	}
+	return exitOK, nil
+}
+
+func runIndexCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("index create", stderr)
+	file := fs.String("file", "", "input file")
+	key := fs.String("key", "", "key field of the records")
+	field := fs.String("field", "", "field to index")
+	kind := fs.String("type", "hash", "index type: hash, sorted, text or trigram")
+	var where multiFlag
+	fs.Var(&where, "where", "optional conditions to explain against the new index")
+	maxRAM := fs.Int64("max-ram", 2*1024*1024*1024, "memory limit in bytes")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" || *key == "" || *field == "" {
+		return exitError, &cliError{"index create requires --file, --key and --field"}
+	}
+
+	dm := NewDataManager(*maxRAM, "InMemory")
+	if err := dm.LoadDataInMemory(*file, *key); err != nil {
+		return exitError, err
+	}
+	if err := createIndexes(dm, *field+":"+*kind, BinaryCollation); err != nil {
+		return exitError, err
+	}
+
+	ds := dm.snapshot()
+	name := *field
+	switch *kind {
+	case "text":
+		name = textIndexName(name)
+	case "trigram":
+		name = trigramIndexName(name)
+	}
+	idx := ds.indexes[name]
+	entries, distinct := idx.stats()
+	fmt.Fprintf(stdout, "Created %s index on %s: %d records, %d entries, %d distinct values\n",
+		idx.kind, *field, ds.len(), entries, distinct)
+
+	if len(where) > 0 {
+		conditions, err := parseWhere(where)
+		if err != nil {
+			return exitError, err
+		}
+		plan, _ := dm.Explain(conditions)
+		fmt.Fprintln(stdout, plan)
+	}
+	return exitOK, nil
+}
+
+func runOffsetIndexCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("index offsets", stderr)
+	file := fs.String("file", "", "NDJSON file to index")
+	line := fs.Int("line", -1, "print the record on this line (numbered from 0, blank lines not counted) through the index")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"index offsets requires --file"}
+	}
+
+	dm := NewDataManager(2*1024*1024*1024, "Split")
+	idx, err := dm.OpenOffsetIndex(*file)
+	if err != nil || *line < 0 {
+		if idx != nil {
+			idx.Close()
+		}
+		if idx, err = dm.BuildOffsetIndex(*file); err != nil {
+			return exitError, err
+		}
+		fmt.Fprintf(stderr, "jsondm: indexed %d lines in %s\n", idx.Lines, *file+OffsetIndexSuffix)
+	}
+	defer idx.Close()
+	if *line < 0 {
+		return exitOK, nil
+	}
+	record, err := dm.RecordAt(idx, *line)
+	if err != nil {
+		return exitError, err
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return exitOK, encoder.Encode(record)
+}
+
+func runBloomCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("index bloom", stderr)
+	var fields multiFlag
+	fs.Var(&fields, "field", "field to filter on, or comma-separated fields of a composite key (repeatable)")
+	rate := fs.Float64("rate", defaultFalsePositiveRate, "share of files lacking a value that are read anyway")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if len(fields) == 0 || fs.NArg() == 0 {
+		return exitError, &cliError{"index bloom requires --field and at least one file"}
+	}
+
+	dm := NewDataManager(2*1024*1024*1024, "Split")
+	if err := dm.BuildBloomFilters(fs.Args(), BloomOptions{Fields: fields, FalsePositiveRate: *rate}); err != nil {
+		return exitError, err
+	}
+	fmt.Fprintf(stderr, "jsondm: built Bloom filters for %d files\n", fs.NArg())
+	return exitOK, nil
+}
+
+func runZoneMapCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("index zones", stderr)
+	file := fs.String("file", "", "NDJSON file to summarize")
+	var fields multiFlag
+	fs.Var(&fields, "field", "numeric or date field to summarize (repeatable)")
+	blockLines := fs.Int("block-lines", defaultZoneBlockLines, "lines per block")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" || len(fields) == 0 {
+		return exitError, &cliError{"index zones requires --file and --field"}
+	}
+
+	dm := NewDataManager(2*1024*1024*1024, "Split")
+	zm, err := dm.BuildZoneMaps(*file, ZoneMapOptions{Fields: fields, BlockLines: *blockLines})
+	if err != nil {
+		return exitError, err
+	}
+	fmt.Fprintf(stderr, "jsondm: built zone maps of %d blocks in %s\n", len(zm.Blocks), *file+ZoneMapSuffix)
+	return exitOK, nil
+}
+
+func runConvertCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("convert", stderr)
+	file := fs.String("file", "", "input file, URL, object location, or - for stdin")
+	out := fs.String("out", "-", "output file, or - for stdout")
+	to := fs.String("to", "ndjson", "output format: json, ndjson, csv, xlsx, msgpack, bson, arrow, arrows, or table")
+	fields := fs.String("fields", "", "comma-separated fields to output (default all)")
+	maxRAM := fs.Int64("max-ram", 2*1024*1024*1024, "memory limit in bytes")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"convert requires --file"}
+	}
+
+	dm := NewDataManager(*maxRAM, "Split")
+	records, err := dm.LoadDataInSplitMode(*file, nil)
+	if err != nil {
+		return exitError, err
+	}
+
+	w := stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return exitError, err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeRecords(w, records, splitList(*fields), *to); err != nil {
+		return exitError, err
+	}
+	return exitOK, nil
+}
+
+// fieldStats summarizes one field for the stats command
+type fieldStats struct {
+	Field   string         `json:"field"`
+	Present int            `json:"present"`
+	Types   map[string]int `json:"types"`
+	Min     *float64       `json:"min,omitempty"`
+	Max     *float64       `json:"max,omitempty"`
+}
+
+func runStatsCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("stats", stderr)
+	file := fs.String("file", "", "input file, URL, object location, or - for stdin")
+	format := fs.String("format", "table", "output format: table or json")
+	field := fs.String("field", "", "summarize one field: numeric statistics and most frequent values")
+	top := fs.Int("top", 10, "number of most frequent values shown with --field")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"stats requires --file"}
+	}
+	if *field != "" {
+		return runFieldStats(*file, *field, *top, *format, stdout)
+	}
+
+	dm := NewDataManager(0, "Split")
+	src, err := dm.resolveSource(*file)
+	if err != nil {
+		return exitError, err
+	}
+	input, err := src.Open()
+	if err != nil {
+		return exitError, err
+	}
+	defer input.Close()
+	reader, err := dm.newReaderFor(input, *file)
+	if err != nil {
+		return exitError, err
+	}
+
+	records, bytesRead := 0, 0
+	byField := make(map[string]*fieldStats)
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return exitError, err
+		}
+		records++
+		bytesRead += size
+		for field, value := range record {
+			fstats, exists := byField[field]
+			if !exists {
+				fstats = &fieldStats{Field: field, Types: make(map[string]int)}
+				byField[field] = fstats
+			}
+			fstats.Present++
+			fstats.Types[jsonTypeName(value)]++
+			if n, ok := value.(float64); ok {
+				if fstats.Min == nil || n < *fstats.Min {
+					fstats.Min = &n
+				}
+				if fstats.Max == nil || n > *fstats.Max {
+					fstats.Max = &n
+				}
+			}
+		}
+	}
+
+	summary := make([]*fieldStats, 0, len(byField))
+	for _, fstats := range byField {
+		summary = append(summary, fstats)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Field < summary[j].Field })
+
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return exitOK, encoder.Encode(map[string]interface{}{
+			"records": records,
+			"bytes":   bytesRead,
+			"fields":  summary,
+		})
+	}
+
+	fmt.Fprintf(stdout, "Records: %d\nBytes: %d\n\n", records, bytesRead)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tPRESENT\tTYPES\tMIN\tMAX")
+	for _, fstats := range summary {
+		types := make([]string, 0, len(fstats.Types))
+		for name, count := range fstats.Types {
+			types = append(types, fmt.Sprintf("%s:%d", name, count))
+		}
+		sort.Strings(types)
+		min, max := "", ""
+		if fstats.Min != nil {
+			min = strconv.FormatFloat(*fstats.Min, 'f', -1, 64)
+			max = strconv.FormatFloat(*fstats.Max, 'f', -1, 64)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", fstats.Field, fstats.Present, strings.Join(types, ","), min, max)
+	}
+	return exitOK, tw.Flush()
+}
+
+func runDescribeCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("describe", stderr)
+	file := fs.String("file", "", "input file, URL, object location or glob")
+	format := fs.String("format", "table", "output format: table or json")
+	histograms := fs.Bool("histograms", false, "also print the histogram of each numeric field")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"describe requires --file"}
+	}
+
+	dm := NewDataManager(0, "Split")
+	dm.setSourcePath(*file)
+	desc, err := dm.DescribeDataset()
+	if err != nil {
+		return exitError, err
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return exitOK, encoder.Encode(desc)
+	}
+
+	fmt.Fprintf(stdout, "Records: %d\n\n", desc.Records)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tCOUNT\tNULLS\tDISTINCT\tTYPES\tMIN\tMAX")
+	for _, field := range desc.Fields {
+		types := make([]string, 0, len(field.Types))
+		for name, count := range field.Types {
+			types = append(types, fmt.Sprintf("%s:%d", name, count))
+		}
+		sort.Strings(types)
+		min, max := "", ""
+		if field.Min != nil {
+			min, max = abbreviate(fmt.Sprint(field.Min), 24), abbreviate(fmt.Sprint(field.Max), 24)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t~%d\t%s\t%s\t%s\n", field.Field, field.Count, field.Nulls, field.Distinct, strings.Join(types, ","), min, max)
+	}
+	if err := tw.Flush(); err != nil || !*histograms {
+		return exitOK, err
+	}
+	for _, field := range desc.Fields {
+		if len(field.Histogram) == 0 {
+			continue
+		}
+		fmt.Fprintf(stdout, "\n%s:\n", field.Field)
+		for _, bucket := range field.Histogram {
+			fmt.Fprintf(stdout, "  %g .. %g\t%d\n", bucket.Lower, bucket.Upper, bucket.Count)
+		}
+	}
+	return exitOK, nil
+}
+
+func runProfileCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("profile", stderr)
+	file := fs.String("file", "", "input file, URL, object location or glob")
+	format := fs.String("format", "html", "report format: html or json")
+	out := fs.String("out", "-", "report file, or - for stdout")
+	var opts ProfileOptions
+	fs.IntVar(&opts.TopValues, "top", 10, "most frequent values listed per field")
+	fs.IntVar(&opts.Sample, "sample", 0, "number of records to read (0 means all)")
+	onError := fs.String("on-error", "fail", "malformed records: fail, skip or collect")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"profile requires --file"}
+	}
+	if *format != "html" && *format != "json" {
+		return exitError, &cliError{fmt.Sprintf("unknown --format value %q", *format)}
+	}
+	policy, err := parseErrorPolicy(*onError)
+	if err != nil {
+		return exitError, err
+	}
+
+	dm := NewDataManager(0, "Split")
+	dm.SetErrorPolicy(policy)
+	profile, err := dm.Profile(*file, opts)
+	if err != nil {
+		return exitError, err
+	}
+
+	w := stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return exitError, err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(profile)
+	} else {
+		err = profile.WriteHTML(w)
+	}
+	if err != nil {
+		return exitError, err
+	}
+	for _, anomaly := range profile.Anomalies {
+		fmt.Fprintf(stderr, "%s: %s\n", anomaly.Field, anomaly.Message)
+	}
+	return exitOK, nil
+}
+
+// abbreviate shortens s to at most n runes, marking the cut with "..."
+func abbreviate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-3]) + "..."
+	}
+	return s
+}
+
+// runFieldStats prints the numeric statistics and most frequent values of one field
+func runFieldStats(file, field string, top int, format string, stdout io.Writer) (int, error) {
+	dm := NewDataManager(0, "Split")
+	stats, err := dm.Stats(file, field)
+	if err != nil {
+		return exitError, err
+	}
+	frequent, err := dm.TopK(file, field, top)
+	if err != nil {
+		return exitError, err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return exitOK, encoder.Encode(map[string]interface{}{
+			"stats": stats,
+			"top":   frequent,
+		})
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Field:\t%s\nCount:\t%d\nMissing:\t%d\n", field, stats.Count, stats.Missing)
+	if stats.Count > 0 {
+		for _, row := range []struct {
+			name  string
+			value float64
+		}{{"Min", stats.Min}, {"Max", stats.Max}, {"Mean", stats.Mean}, {"StdDev", stats.StdDev},
+			{"P50", stats.P50}, {"P90", stats.P90}, {"P95", stats.P95}, {"P99", stats.P99}} {
+			fmt.Fprintf(tw, "%s:\t%s\n", row.name, strconv.FormatFloat(row.value, 'g', 6, 64))
+		}
+	}
+	fmt.Fprintln(tw, "\nVALUE\tCOUNT")
+	for _, vc := range frequent {
+		fmt.Fprintf(tw, "%s\t%d\n", formatValue(vc.Value), vc.Count)
+	}
+	return exitOK, tw.Flush()
+}
+
+func runServeCommand(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("serve", stderr)
+	file := fs.String("file", "", "input file, URL, object location, or - for stdin")
+	key := fs.String("key", "", "key field; loads the data in memory (otherwise queries stream the file)")
+	addr := fs.String("addr", ":8080", "HTTP listen address")
+	grpcAddr := fs.String("grpc", "", "optional gRPC listen address")
+	maxRAM := fs.Int64("max-ram", 2*1024*1024*1024, "memory limit in bytes")
+	metrics := fs.Bool("metrics", false, "expose Prometheus metrics on /metrics")
+	auto := fs.Bool("auto", false, "with --key, stream the file instead when it does not fit in --max-ram")
+	redact := fs.String("redact", "", "JSON redaction policy applied to every record served")
+	reload := fs.Duration("reload", 0, "with --key, check the file this often and reload it in the background when it changes")
+	auth := fs.String("auth", "", "JSON access control file with the roles, API keys and JWT settings of callers")
+	var collections multiFlag
+	fs.Var(&collections, "collection", "serve another dataset under /collections/<name>/, as name=file or name:key=file (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return exitError, err
+	}
+	if *file == "" {
+		return exitError, &cliError{"serve requires --file"}
+	}
+	var redaction *RedactionPolicy
+	if *redact != "" {
+		var err error
+		if redaction, err = LoadRedactionPolicy(*redact); err != nil {
+			return exitError, err
+		}
+	}
+	var access *AccessControl
+	if *auth != "" {
+		var err error
+		if access, err = LoadAccessControl(*auth); err != nil {
+			return exitError, err
+		}
+	}
+
+	var dm *DataManager
+	if *key != "" {
+		mode := InMemoryMode
+		if *auto {
+			mode = AutoMode
+		}
+		dm = NewDataManager(*maxRAM, mode)
+		if *metrics {
+			dm.SetMetrics(NewPrometheusMetrics())
+		}
+		load := dm.LoadDataInMemory
+		if *auto {
+			load = dm.Load
+		}
+		if err := load(*file, *key); err != nil {
+			return exitError, err
+		}
+	} else {
+		dm = NewDataManager(*maxRAM, "Split")
+		dm.setSourcePath(*file)
+		if *metrics {
+			dm.SetMetrics(NewPrometheusMetrics())
+		}
+	}
+
+	if *reload > 0 && *key != "" {
+		if err := dm.EnableAutoReload(ReloadOptions{Interval: *reload}); err != nil {
+			return exitError, err
+		}
+	}
+	for _, spec := range collections {
+		if err := serveCollection(dm, spec, *auto); err != nil {
+			return exitError, err
+		}
+	}
+
+	if err := dm.SetRedaction(redaction); err != nil {
+		return exitError, err
+	}
+	if err := dm.SetAccessControl(access); err != nil {
+		return exitError, err
+	}
+
+	errs := make(chan error, 2)
+	if *grpcAddr != "" {
+		go func() { errs <- dm.ServeGRPC(*grpcAddr) }()
+	}
+	go func() { errs <- dm.Serve(*addr) }()
+	fmt.Fprintf(stdout, "Serving %s on %s\n", *file, *addr)
+	return exitError, <-errs
+}
+
+// serveCollection creates the collection described by a "name=file" or
+// "name:key=file" flag, loading it when it has a key and streaming it otherwise
+func serveCollection(dm *DataManager, spec string, auto bool) error {
+	name, file, ok := strings.Cut(spec, "=")
+	if !ok || file == "" {
+		return &cliError{fmt.Sprintf("invalid --collection %q (want name=file or name:key=file)", spec)}
+	}
+	name, key, _ := strings.Cut(name, ":")
+	if key == "" {
+		c, err := dm.CreateCollection(name, WithMode(SplitMode))
+		if err != nil {
+			return err
+		}
+		c.setSourcePath(file)
+		return nil
+	}
+
+	mode := InMemoryMode
+	if auto {
+		mode = AutoMode
+	}
+	c, err := dm.CreateCollection(name, WithMode(mode))
+	if err != nil {
+		return err
+	}
+	if auto {
+		return c.Load(file, key)
+	}
+	return c.LoadDataInMemory(file, key)
+}
+
+// createIndexes builds the indexes described by a "field:type,field:type" list,
+// comparing strings under collation
+func createIndexes(dm *DataManager, spec string, collation Collation) error {
+	for _, item := range splitList(spec) {
+		field, kindName, _ := strings.Cut(item, ":")
+		kind := HashIndex
+		switch kindName {
+		case "", "hash":
+		case "sorted":
+			kind = SortedIndex
+		case "text":
+			if err := dm.CreateTextIndex([]string{field}, TextIndexOptions{Stem: true}); err != nil {
+				return err
+			}
+			continue
+		case "trigram":
+			if err := dm.CreateTrigramIndex(field, collation); err != nil {
+				return err
+			}
+			continue
+		default:
+			return &cliError{fmt.Sprintf("unknown index type %q", kindName)}
+		}
+		if err := dm.CreateCollatedIndex(field, kind, collation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var (
+	whereSplitter = regexp.MustCompile(`(?i)\s*(?:&&|\s+and\s+)\s*`)
+	wherePattern  = regexp.MustCompile(`^\s*([^\s:<>=!~]+)(?::(\w+))?\s*(>=|<=|==|=|>|<|~|\s+contains\s+|\s+has\s+)\s*(.*?)\s*$`)
+	datetimeValue = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}$`)
+	dateValue     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+// parseWhere turns expressions such as "age>30", "fullname contains James",
+// "tags has go", "fullname~Jmaes" (fuzzy) or "id:string==42" into filter conditions. The value type is inferred from
+// the literal unless given explicitly after the field name.
+func parseWhere(exprs []string) ([]FilterCondition, error) {
+	var conditions []FilterCondition
+	for _, expr := range exprs {
+		for _, part := range whereSplitter.Split(expr, -1) {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			m := wherePattern.FindStringSubmatch(part)
+			if m == nil {
+				return nil, &cliError{fmt.Sprintf("cannot parse condition %q", part)}
+			}
+			condition, err := buildCondition(m[1], m[2], strings.TrimSpace(m[3]), m[4])
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions, nil
+}
+
+// buildCondition converts the parts of a where expression into a FilterCondition
+func buildCondition(field, valueType, operator, literal string) (FilterCondition, error) {
+	if operator == "=" {
+		operator = "=="
+	}
+	if operator == "~" {
+		operator = "fuzzy"
+	}
+	if operator == "has" {
+		element, err := buildCondition(field, valueType, "==", literal)
+		return ArrayContains(field, element.Value), err
+	}
+	quoted := len(literal) >= 2 && (literal[0] == '"' || literal[0] == '\'') && literal[len(literal)-1] == literal[0]
+	if quoted {
+		literal = literal[1 : len(literal)-1]
+	}
+
+	if valueType == "" {
+		switch {
+		case quoted || operator == "contains" || operator == "fuzzy":
+			valueType = "string"
+		case literal == "true" || literal == "false":
+			valueType = "bool"
+		case datetimeValue.MatchString(literal):
+			valueType = "datetime"
+		case dateValue.MatchString(literal):
+			valueType = "date"
+		default:
+			if _, err := strconv.Atoi(literal); err == nil {
+				valueType = "int"
+			} else {
+				valueType = "string"
+			}
+		}
+	}
+
+	condition := FilterCondition{Key: field, ValueType: valueType, Operator: operator}
+	switch valueType {
+	case "int":
+		n, err := strconv.Atoi(literal)
+		if err != nil {
+			return condition, &cliError{fmt.Sprintf("invalid int value %q for %s", literal, field)}
+		}
+		condition.Value = n
+	case "bool":
+		b, err := strconv.ParseBool(literal)
+		if err != nil {
+			return condition, &cliError{fmt.Sprintf("invalid bool value %q for %s", literal, field)}
+		}
+		condition.Value = b
+	case "string", "datetime", "date":
+		condition.Value = literal
+	default:
+		return condition, &cliError{fmt.Sprintf("unknown value type %q for %s", valueType, field)}
+	}
+	return condition, nil
+}
+
+// writeRecords writes records in the given output format
+func writeRecords(w io.Writer, records []map[string]interface{}, fields []string, format string) error {
+	if format == "table" {
+		columns := columnsFor(records, fields)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, record := range records {
+			fmt.Fprintln(tw, strings.Join(recordRow(record, columns), "\t"))
+		}
+		return tw.Flush()
+	}
+
+	exportFormat, err := ParseExportFormat(format)
+	if err != nil {
+		return &cliError{err.Error()}
+	}
+	return Export(records, w, exportFormat, ExportOptions{Columns: fields})
+}
+
+// columnsFor returns fields, or the sorted union of record keys when empty
+func columnsFor(records []map[string]interface{}, fields []string) []string {
+	if len(fields) > 0 {
+		return fields
+	}
+	seen := make(map[string]bool)
+	var columns []string
+	for _, record := range records {
+		for field := range record {
+			if !seen[field] {
+				seen[field] = true
+				columns = append(columns, field)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// recordRow renders the given columns of a record as strings
+func recordRow(record map[string]interface{}, columns []string) []string {
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = formatValue(record[column])
+	}
+	return row
+}
+
+// formatValue renders a decoded JSON value as a flat string
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// jsonTypeName names the JSON type of a decoded value
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectSource reads a cloud storage object over HTTP, authorizing each
+// request with a provider-specific signer
+type objectSource struct {
+	url       string
+	client    *http.Client
+	authorize func(req *http.Request) error
+}
+
+func (s *objectSource) Open() (io.ReadCloser, error) {
+	return s.OpenRange(0)
+}
+
+func (s *objectSource) Size() (int64, error) {
+	resp, err := s.do(http.MethodHead, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, errors.New("Object size is unknown")
+	}
+	return resp.ContentLength, nil
+}
+
+func (s *objectSource) OpenRange(offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := s.do(http.MethodGet, header)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.New("Object store ignored the range request")
+	}
+	return resp.Body, nil
+}
+
+// ReadAt reads len(p) bytes at off with a bounded range request
+func (s *objectSource) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	resp, err := s.do(http.MethodGet, header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *objectSource) name() string {
+	return s.url
+}
+
+// do sends a signed request and checks for a successful status
+func (s *objectSource) do(method string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.authorize != nil {
+		if err := s.authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected HTTP status fetching %s: %s", s.url, resp.Status)
+	}
+	return resp, nil
+}
+
+// httpClientOrDefault returns client, or a client without an overall timeout
+// so that multi-gigabyte objects can be streamed
+func httpClientOrDefault(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return &http.Client{}
+}
+
+// splitBucketURL splits "<scheme>://bucket/path/to/object"
+func splitBucketURL(location string) (bucket, object string, err error) {
+	_, rest, _ := strings.Cut(location, "://")
+	bucket, object, ok := strings.Cut(rest, "/")
+	if !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("Invalid object location: %s", location)
+	}
+	return bucket, object, nil
+}
+
+// S3Config holds S3 connection settings; empty fields fall back to the
+// standard AWS_* environment variables
+type S3Config struct {
+	Region          string
+	Endpoint        string // Custom endpoint for S3-compatible stores (path-style addressing)
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	HTTPClient      *http.Client
+}
+
+// NewS3Source returns a Source for an S3 object, signed with AWS Signature Version 4
+func NewS3Source(bucket, key string, cfg S3Config) RangeSource {
+	if cfg.Region == "" {
+		cfg.Region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	}
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("AWS_ENDPOINT_URL_S3")
+	}
+
+	var objectURL string
+	if cfg.Endpoint != "" {
+		objectURL = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + bucket + "/" + awsURIEncode(key)
+	} else {
+		objectURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, cfg.Region, awsURIEncode(key))
+	}
+
+	src := &objectSource{url: objectURL, client: httpClientOrDefault(cfg.HTTPClient)}
+	if cfg.AccessKeyID != "" {
+		src.authorize = func(req *http.Request) error {
+			signS3Request(req, cfg, time.Now().UTC())
+			return nil
+		}
+	}
+	return src
+}
+
+// s3SourceFromURL resolves "s3://bucket/key"
+func s3SourceFromURL(location string) (Source, error) {
+	bucket, key, err := splitBucketURL(location)
+	if err != nil {
+		return nil, err
+	}
+	return NewS3Source(bucket, key, S3Config{}), nil
+}
+
+// signS3Request adds AWS Signature Version 4 headers to req
+func signS3Request(req *http.Request, cfg S3Config, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if cfg.SessionToken != "" {
+		headers["x-amz-security-token"] = cfg.SessionToken
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		headers["range"] = r
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsURIEncode escapes an object key the way SigV4 canonical URIs expect
+func awsURIEncode(key string) string {
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+// GCSConfig holds Google Cloud Storage settings. Without AccessToken or
+// TokenFunc, the GOOGLE_OAUTH_ACCESS_TOKEN environment variable and then the
+// GCE metadata server are tried; if neither is available requests are anonymous.
+type GCSConfig struct {
+	AccessToken string
+	TokenFunc   func() (string, error)
+	HTTPClient  *http.Client
+}
+
+// NewGCSSource returns a Source for a Google Cloud Storage object
+func NewGCSSource(bucket, object string, cfg GCSConfig) RangeSource {
+	tokenFunc := cfg.TokenFunc
+	if tokenFunc == nil {
+		token := firstNonEmpty(cfg.AccessToken, os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"))
+		tokenFunc = func() (string, error) {
+			if token != "" {
+				return token, nil
+			}
+			return gceMetadataToken()
+		}
+	}
+
+	return &objectSource{
+		url:    "https://storage.googleapis.com/" + bucket + "/" + awsURIEncode(object),
+		client: httpClientOrDefault(cfg.HTTPClient),
+		authorize: func(req *http.Request) error {
+			token, err := tokenFunc()
+			if err != nil {
+				return err
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			return nil
+		},
+	}
+}
+
+// gcsSourceFromURL resolves "gs://bucket/object"
+func gcsSourceFromURL(location string) (Source, error) {
+	bucket, object, err := splitBucketURL(location)
+	if err != nil {
+		return nil, err
+	}
+	return NewGCSSource(bucket, object, GCSConfig{}), nil
+}
+
+// gceMetadataToken fetches an access token from the GCE metadata server,
+// returning an empty token when not running on Google Cloud
+func gceMetadataToken() (string, error) {
+	req, err := http.NewRequest(http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.AccessToken, nil
+}
+
+// AzureBlobConfig holds Azure Blob Storage settings; empty fields fall back to
+// the AZURE_STORAGE_KEY and AZURE_STORAGE_SAS_TOKEN environment variables
+type AzureBlobConfig struct {
+	AccountKey string // Base64 shared key
+	SASToken   string // Shared access signature query string
+	Endpoint   string // Defaults to https://<account>.blob.core.windows.net
+	HTTPClient *http.Client
+}
+
+// NewAzureBlobSource returns a Source for an Azure blob, authorized by SAS
+// token or Shared Key
+func NewAzureBlobSource(account, container, blob string, cfg AzureBlobConfig) RangeSource {
+	if cfg.AccountKey == "" && cfg.SASToken == "" {
+		cfg.AccountKey = os.Getenv("AZURE_STORAGE_KEY")
+		cfg.SASToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+
+	blobURL := strings.TrimSuffix(cfg.Endpoint, "/") + "/" + container + "/" + awsURIEncode(blob)
+	src := &objectSource{url: blobURL, client: httpClientOrDefault(cfg.HTTPClient)}
+
+	switch {
+	case cfg.SASToken != "":
+		src.url += "?" + strings.TrimPrefix(cfg.SASToken, "?")
+	case cfg.AccountKey != "":
+		key, err := base64.StdEncoding.DecodeString(cfg.AccountKey)
+		src.authorize = func(req *http.Request) error {
+			if err != nil {
+				return errors.New("Invalid Azure storage account key")
+			}
+			signAzureRequest(req, account, key, time.Now().UTC())
+			return nil
+		}
+	}
+	return src
+}
+
+// azureSourceFromURL resolves "azblob://account/container/blob"
+func azureSourceFromURL(location string) (Source, error) {
+	account, rest, err := splitBucketURL(location)
+	if err != nil {
+		return nil, err
+	}
+	container, blob, ok := strings.Cut(rest, "/")
+	if !ok || container == "" || blob == "" {
+		return nil, fmt.Errorf("Invalid object location: %s", location)
+	}
+	return NewAzureBlobSource(account, container, blob, AzureBlobConfig{}), nil
+}
+
+// signAzureRequest adds a Shared Key Authorization header to req
+func signAzureRequest(req *http.Request, account string, key []byte, now time.Time) {
+	req.Header.Set("x-ms-date", now.Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", "2020-10-02")
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+req.Header.Get(name))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		"", // Content-Encoding
+		"", // Content-Language
+		"", // Content-Length
+		"", // Content-MD5
+		"", // Content-Type
+		"", // Date (x-ms-date is used instead)
+		"", // If-Modified-Since
+		"", // If-Match
+		"", // If-None-Match
+		"", // If-Unmodified-Since
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+signature)
+}
+
+// hmacSHA256 computes HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// firstNonEmpty returns the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// RecordDecoder reads records from a stream one at a time, returning the
+// record, the number of input bytes it occupied, and io.EOF at the end
+type RecordDecoder interface {
+	Next() (record map[string]interface{}, size int, err error)
+}
+
+// RecordEncoder writes records to a stream
+type RecordEncoder interface {
+	Encode(record map[string]interface{}) error
+	Flush() error
+}
+
+// RecordCodec reads and writes a file format made of a sequence of records
+type RecordCodec interface {
+	NewDecoder(r io.Reader) RecordDecoder
+	NewEncoder(w io.Writer) RecordEncoder
+}
+
+// registeredCodec is a codec together with the file extensions it claims
+type registeredCodec struct {
+	codec      RecordCodec
+	extensions []string
+}
+
+var (
+	recordCodecsMu sync.RWMutex
+	recordCodecs   = map[string]registeredCodec{
+		"msgpack": {codec: msgpackCodec{}, extensions: []string{".msgpack", ".mpk"}},
+		"bson":    {codec: bsonCodec{}, extensions: []string{".bson"}},
+	}
+)
+
+// RegisterRecordCodec makes a codec available under name and for files with
+// the given extensions (e.g. ".avro")
+func RegisterRecordCodec(name string, extensions []string, codec RecordCodec) {
+	recordCodecsMu.Lock()
+	recordCodecs[name] = registeredCodec{codec: codec, extensions: extensions}
+	recordCodecsMu.Unlock()
+}
+
+// lookupRecordCodec returns the codec registered under name
+func lookupRecordCodec(name string) (RecordCodec, bool) {
+	recordCodecsMu.RLock()
+	defer recordCodecsMu.RUnlock()
+	registered, ok := recordCodecs[name]
+	return registered.codec, ok
+}
+
+// codecForExtension returns the name of the codec claiming ext
+func codecForExtension(ext string) (string, bool) {
+	recordCodecsMu.RLock()
+	defer recordCodecsMu.RUnlock()
+	for name, registered := range recordCodecs {
+		for _, candidate := range registered.extensions {
+			if strings.EqualFold(candidate, ext) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// WriteRecords encodes records to w with the codec registered under name
+func WriteRecords(w io.Writer, codecName string, records []map[string]interface{}) error {
+	codec, ok := lookupRecordCodec(codecName)
+	if !ok {
+		return fmt.Errorf("Unknown record codec: %s", codecName)
+	}
+	encoder := codec.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return encoder.Flush()
+}
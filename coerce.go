@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values kept per field as samples of failed coercions
+const maxCoercionSamples = 5
+
+// CoercionRule declares the type the values of a field are normalized to
+type CoercionRule struct {
+	Field string // Field name, or dotted path through nested objects
+	Type  string // "int", "float", "string", "bool", "date" or "datetime"
+}
+
+// CoercionOptions configures type coercion (see SetCoercion)
+type CoercionOptions struct {
+	Rules      []CoercionRule
+	Lenient    bool // Turn strings holding a plain number or true/false into numbers and bools in fields without a rule
+	DropFailed bool // Remove values that cannot be coerced instead of keeping them as read
+}
+
+// FieldCoercion counts the values of one field handled by type coercion
+type FieldCoercion struct {
+	Coerced int           `json:"coerced"` // Values converted to the declared type
+	Failed  int           `json:"failed"`  // Values that could not be converted
+	Samples []interface{} `json:"samples"` // First values that could not be converted
+}
+
+// CoercionReport summarizes the work of type coercion since it was set up
+// or last reset
+type CoercionReport struct {
+	Coerced int                      `json:"coerced"`
+	Failed  int                      `json:"failed"`
+	Fields  map[string]FieldCoercion `json:"fields"`
+}
+
+// coercion normalizes the values of decoded records
+type coercion struct {
+	opts  CoercionOptions
+	rules map[string]string   // Declared type by field
+	paths map[string][]string // Dotted rule fields, split
+	mu    sync.Mutex
+	stats map[string]*FieldCoercion
+}
+
+// WithCoercion sets up type coercion (see SetCoercion)
+func WithCoercion(opts CoercionOptions) Option {
+	return func(dm *DataManager) { dm.coercion = &coercion{opts: opts} }
+}
+
+// SetCoercion normalizes the values of records as they are decoded by
+// loads, scans, counts, imports, lookups and watches, before computed
+// fields, validation and conditions see them. A dump holding "age": "42" in
+// some lines and "age": 42 in others then matches int conditions on age in
+// both. Each rule declares the type of one field; Lenient additionally turns
+// strings that hold nothing but a number or true/false into numbers and
+// bools everywhere else, leaving strings such as "007" or "+49" alone, since
+// they are usually identifiers. Values that cannot be converted are kept as
+// read, or removed with DropFailed, and counted by CoercionReport.
+//
+// int and float accept numbers and numeric strings; int rejects fractions.
+// string formats numbers and bools. bool accepts "true", "false", "yes",
+// "no", "1", "0" and the numbers 1 and 0. date and datetime accept their own
+// layouts, RFC 3339 times (converted to UTC), the layouts of WithDateLayouts
+// and Unix times in seconds, and write them as "2006-01-02" and
+// "2006-01-02 15:04:05", the layouts conditions compare. Fast scans convert
+// the fields they parse without counting them; records they fully decode
+// are counted. Records written with Put and its variants are stored as given.
+// Empty options disable coercion.
+func (dm *DataManager) SetCoercion(opts CoercionOptions) error {
+	if len(opts.Rules) == 0 && !opts.Lenient {
+		dm.coercion = nil
+		return nil
+	}
+	c := &coercion{opts: opts}
+	if err := c.init(); err != nil {
+		return err
+	}
+	dm.coercion = c
+	return nil
+}
+
+// CoercionReport returns how many values of each field coercion converted
+// or failed to convert
+func (dm *DataManager) CoercionReport() CoercionReport {
+	report := CoercionReport{Fields: make(map[string]FieldCoercion)}
+	c := dm.coercion
+	if c == nil {
+		return report
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for field, stats := range c.stats {
+		report.Coerced += stats.Coerced
+		report.Failed += stats.Failed
+		copied := *stats
+		copied.Samples = append([]interface{}(nil), stats.Samples...)
+		report.Fields[field] = copied
+	}
+	return report
+}
+
+// ResetCoercionReport clears the counts of CoercionReport
+func (dm *DataManager) ResetCoercionReport() {
+	if c := dm.coercion; c != nil {
+		c.mu.Lock()
+		c.stats = nil
+		c.mu.Unlock()
+	}
+}
+
+// ParseCoercionRule parses a rule written as "field:type", such as "age:int"
+func ParseCoercionRule(s string) (CoercionRule, error) {
+	field, kind, ok := strings.Cut(s, ":")
+	if !ok || field == "" {
+		return CoercionRule{}, fmt.Errorf("Invalid coercion rule %q: want \"field:type\"", s)
+	}
+	return CoercionRule{Field: field, Type: kind}, nil
+}
+
+// init checks the rules and indexes them by field
+func (c *coercion) init() error {
+	c.rules = make(map[string]string, len(c.opts.Rules))
+	c.paths = make(map[string][]string)
+	for _, rule := range c.opts.Rules {
+		switch rule.Type {
+		case "int", "float", "string", "bool", "date", "datetime":
+		default:
+			return fmt.Errorf("Unknown coercion type %q for field %q", rule.Type, rule.Field)
+		}
+		if rule.Field == "" {
+			return fmt.Errorf("Coercion rule for type %q has no field", rule.Type)
+		}
+		c.rules[rule.Field] = rule.Type
+		if strings.Contains(rule.Field, ".") {
+			c.paths[rule.Field] = strings.Split(rule.Field, ".")
+		}
+	}
+	return nil
+}
+
+// coerce normalizes the values of a freshly decoded record in place,
+// counting them in the report when tally is set
+func (dm *DataManager) coerce(record map[string]interface{}, tally bool) {
+	c := dm.coercion
+	if c == nil {
+		return
+	}
+	for field, kind := range c.rules {
+		parent, name := record, field
+		if path, nested := c.paths[field]; nested {
+			if _, topLevel := record[field]; !topLevel {
+				if parent = nestedParent(record, path); parent == nil {
+					continue
+				}
+				name = path[len(path)-1]
+			}
+		}
+		value, exists := parent[name]
+		if !exists || value == nil {
+			continue
+		}
+		converted, changed, ok := coerceValue(value, kind, dm.dateLayouts)
+		switch {
+		case !ok:
+			if c.opts.DropFailed {
+				delete(parent, name)
+			}
+			if tally {
+				c.count(field, false, value)
+			}
+		case changed:
+			parent[name] = converted
+			if tally {
+				c.count(field, true, nil)
+			}
+		}
+	}
+	if c.opts.Lenient {
+		c.lenientObject(record, "", tally)
+	}
+}
+
+// nestedParent returns the object holding the last field of path, or nil
+func nestedParent(record map[string]interface{}, path []string) map[string]interface{} {
+	parent := record
+	for _, part := range path[:len(path)-1] {
+		child, ok := parent[part].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		parent = child
+	}
+	return parent
+}
+
+// lenientObject converts the plain numeric and boolean strings of an object
+// whose path is prefix, skipping fields with a rule
+func (c *coercion) lenientObject(object map[string]interface{}, prefix string, tally bool) {
+	for field, value := range object {
+		path := field
+		if prefix != "" {
+			path = prefix + "." + field
+		}
+		if _, ruled := c.rules[path]; ruled {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			if converted, ok := lenientValue(v); ok {
+				object[field] = converted
+				if tally {
+					c.count(path, true, nil)
+				}
+			}
+		case map[string]interface{}:
+			c.lenientObject(v, path, tally)
+		case []interface{}:
+			for i, item := range v {
+				if s, ok := item.(string); ok {
+					if converted, ok := lenientValue(s); ok {
+						v[i] = converted
+						if tally {
+							c.count(path, true, nil)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// count records a coerced or, with its value, a failed value of field
+func (c *coercion) count(field string, coerced bool, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*FieldCoercion)
+	}
+	stats := c.stats[field]
+	if stats == nil {
+		stats = &FieldCoercion{}
+		c.stats[field] = stats
+	}
+	if coerced {
+		stats.Coerced++
+		return
+	}
+	stats.Failed++
+	if len(stats.Samples) < maxCoercionSamples {
+		stats.Samples = append(stats.Samples, value)
+	}
+}
+
+// lenientValue converts a string holding nothing but a JSON number without
+// a leading zero or plus sign, or true or false
+func lenientValue(s string) (interface{}, bool) {
+	switch s {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "":
+		return nil, false
+	}
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' || (len(digits) > 1 && digits[0] == '0' && digits[1] != '.') {
+		return nil, false
+	}
+	x, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(x, 0) {
+		return nil, false
+	}
+	return x, true
+}
+
+// coerceValue converts value to kind, reporting whether it changed and
+// whether it conforms to kind afterwards
+func coerceValue(value interface{}, kind string, layouts []string) (interface{}, bool, bool) {
+	switch kind {
+	case "int", "float":
+		x, ok := numericValue(value)
+		changed := false
+		if s, isString := value.(string); isString {
+			var err error
+			x, err = strconv.ParseFloat(strings.TrimSpace(s), 64)
+			ok, changed = err == nil && !math.IsInf(x, 0) && !math.IsNaN(x), true
+		} else if ok {
+			_, isFloat := value.(float64)
+			changed = !isFloat
+		}
+		if !ok || (kind == "int" && x != math.Trunc(x)) {
+			return value, false, false
+		}
+		return x, changed, true
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, false, true
+		case bool:
+			return strconv.FormatBool(v), true, true
+		}
+		if x, ok := numericValue(value); ok {
+			return strconv.FormatFloat(x, 'f', -1, 64), true, true
+		}
+		return value, false, false
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, false, true
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "yes", "1":
+				return true, true, true
+			case "false", "no", "0":
+				return false, true, true
+			}
+			return value, false, false
+		}
+		if x, ok := numericValue(value); ok && (x == 0 || x == 1) {
+			return x == 1, true, true
+		}
+		return value, false, false
+	case "date", "datetime":
+		layout := "2006-01-02"
+		if kind == "datetime" {
+			layout = "2006-01-02 15:04:05"
+		}
+		if x, ok := numericValue(value); ok {
+			return time.Unix(int64(x), 0).UTC().Format(layout), true, true
+		}
+		s, ok := value.(string)
+		if !ok {
+			return value, false, false
+		}
+		if _, err := time.Parse(layout, s); err == nil {
+			return s, false, true
+		}
+		for _, candidate := range coercionLayouts(layouts) {
+			if t, err := time.Parse(candidate, strings.TrimSpace(s)); err == nil {
+				return t.UTC().Format(layout), true, true
+			}
+		}
+		return value, false, false
+	}
+	return value, false, false
+}
+
+// coercionLayouts returns the layouts date and datetime coercion accept
+func coercionLayouts(extra []string) []string {
+	layouts := []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+	return append(layouts, extra...)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Collation selects how string conditions and indexes compare text. It is a
+// comma-separated list of a BCP 47 locale whose alphabet orders the strings
+// (such as "de", "sv" or "vi") and the flags "ci" (ignore case), "ai" (ignore
+// accents) and "nfc" (treat canonically equivalent forms, such as a
+// precomposed "é" and "e" followed by a combining accent, as equal); "ci" and
+// "ai" imply "nfc". The empty collation compares bytes.
+type Collation string
+
+const (
+	BinaryCollation          Collation = ""
+	CaseInsensitiveCollation Collation = "ci"
+)
+
+// collator is a parsed Collation
+type collator struct {
+	normalize bool
+	fold      bool       // Ignore case
+	strip     bool       // Ignore accents
+	locale    *sync.Pool // *collate.Collator for the locale (nil orders the folded bytes)
+}
+
+// collators caches parsed collations
+var collators sync.Map
+
+// collatorFor returns the parsed form of c
+func collatorFor(c Collation) (*collator, error) {
+	if cached, ok := collators.Load(c); ok {
+		return cached.(*collator), nil
+	}
+
+	co := &collator{}
+	var tag *language.Tag
+	for _, part := range strings.Split(string(c), ",") {
+		switch part = strings.TrimSpace(part); strings.ToLower(part) {
+		case "":
+		case "ci":
+			co.fold, co.normalize = true, true
+		case "ai":
+			co.strip, co.normalize = true, true
+		case "nfc":
+			co.normalize = true
+		default:
+			t, err := language.Parse(part)
+			if err != nil || tag != nil {
+				return nil, fmt.Errorf("Invalid collation %q: unknown option %q", c, part)
+			}
+			tag = &t
+		}
+	}
+	if tag != nil {
+		var opts []collate.Option
+		if co.fold {
+			opts = append(opts, collate.IgnoreCase)
+		}
+		if co.strip {
+			opts = append(opts, collate.IgnoreDiacritics)
+		}
+		t := *tag
+		co.locale = &sync.Pool{New: func() interface{} { return collate.New(t, opts...) }}
+	}
+
+	actual, _ := collators.LoadOrStore(c, co)
+	return actual.(*collator), nil
+}
+
+// ValidateCollation reports whether c is a valid collation
+func ValidateCollation(c Collation) error {
+	_, err := collatorFor(c)
+	return err
+}
+
+// folded maps s to the text it is compared as for equality and substring matches
+func (co *collator) folded(s string) string {
+	if !co.normalize {
+		return s
+	}
+	if isASCII(s) {
+		if co.fold {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	if co.strip {
+		stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), s)
+		if err == nil {
+			s = stripped
+		}
+	} else {
+		s = norm.NFC.String(s)
+	}
+	if co.fold {
+		s = cases.Fold().String(s)
+	}
+	return s
+}
+
+// compare orders a and b, returning 0 when the collation considers them equal
+func (co *collator) compare(a, b string) int {
+	if co.locale == nil {
+		return strings.Compare(co.folded(a), co.folded(b))
+	}
+	c := co.locale.Get().(*collate.Collator)
+	defer co.locale.Put(c)
+	return c.CompareString(a, b)
+}
+
+// key returns a string whose byte order is the collation order of s, as
+// stored in collated indexes
+func (co *collator) key(s string) string {
+	if co.locale == nil {
+		return co.folded(s)
+	}
+	c := co.locale.Get().(*collate.Collator)
+	defer co.locale.Put(c)
+	var buf collate.Buffer
+	return string(c.KeyFromString(&buf, s))
+}
+
+// isASCII reports whether s holds only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// applyCollatedCondition applies a string condition under its collation; an
+// invalid collation matches nothing
+func applyCollatedCondition(fieldValue interface{}, condition FilterCondition) bool {
+	fieldVal, ok := fieldValue.(string)
+	if !ok {
+		return false
+	}
+	compareVal, ok := condition.Value.(string)
+	if !ok {
+		return false
+	}
+	co, err := collatorFor(condition.Collation)
+	if err != nil {
+		return false
+	}
+
+	switch condition.Operator {
+	case "contains":
+		return strings.Contains(co.folded(fieldVal), co.folded(compareVal))
+	case "==":
+		return co.compare(fieldVal, compareVal) == 0
+	case ">":
+		return co.compare(fieldVal, compareVal) > 0
+	case ">=":
+		return co.compare(fieldVal, compareVal) >= 0
+	case "<":
+		return co.compare(fieldVal, compareVal) < 0
+	case "<=":
+		return co.compare(fieldVal, compareVal) <= 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// CreateCollection adds a named dataset to the manager and returns the
+// DataManager holding it. The collection starts with the manager's mode,
+// memory limit, workers, chunk size, worker pinning, logger, metrics, date
+// layouts, buffer and record size limits, HTTP timeout, concurrency,
+// throttle and encryption settings, which opts may override, and loads,
+// queries and writes it like any other manager. Collections share the
+// manager's tracked memory, so a memory limit bounds the usage of the
+// manager and all its collections together.
+// Names may not be empty or contain "/"; creating a name twice fails with
+// ErrCollectionExists.
+func (dm *DataManager) CreateCollection(name string, opts ...Option) (*DataManager, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("Invalid collection name %q", name)
+	}
+	c, err := New(append([]Option{dm.inherited()}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, exists := dm.collections[name]; exists {
+		return nil, fmt.Errorf("%w: %q", ErrCollectionExists, name)
+	}
+	if dm.collections == nil {
+		dm.collections = make(map[string]*DataManager)
+	}
+	c.parent = dm
+	dm.collections[name] = c
+	return c, nil
+}
+
+// inherited copies the manager's settings to a new collection
+func (dm *DataManager) inherited() Option {
+	return func(c *DataManager) {
+		c.maxRAMUsage = dm.maxRAMUsage
+		c.currentUsage = dm.currentUsage
+		c.mode = dm.mode
+		if dm.auto {
+			c.mode = AutoMode
+		}
+		c.workers = dm.workers
+		c.chunkSize = dm.chunkSize
+		c.pinWorkers = dm.pinWorkers
+		c.tuner = dm.tuner
+		c.logger = dm.logger
+		c.metrics = dm.metrics
+		c.slowQuery = dm.slowQuery
+		c.resultLimit = dm.resultLimit
+		c.dateLayouts = append([]string(nil), dm.dateLayouts...)
+		c.bufferSize = dm.bufferSize
+		c.recordLimit = dm.recordLimit
+		c.preprocess = dm.preprocess
+		c.interning = dm.interning
+		c.decoder = dm.decoder
+		c.coercion = dm.coercion
+		c.repair = dm.repair
+		c.charset = dm.charset
+		c.keyStrategy = dm.keyStrategy
+		c.surrogate = dm.surrogate
+		c.noStatistics = dm.noStatistics
+		c.httpTimeout = dm.httpTimeout
+		c.scheduler = dm.scheduler
+		c.throttle = dm.throttle
+		c.encryption = dm.encryption
+	}
+}
+
+// Collection returns the collection created under name, or
+// ErrCollectionNotFound
+func (dm *DataManager) Collection(name string) (*DataManager, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	c, ok := dm.collections[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrCollectionNotFound, name)
+	}
+	return c, nil
+}
+
+// Collections returns the names of the manager's collections in order
+func (dm *DataManager) Collections() []string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	names := make([]string, 0, len(dm.collections))
+	for name := range dm.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropCollection removes the collection created under name, reporting
+// whether it existed. Its expiry sweeper, auto-reload and scheduled jobs are
+// stopped, its in-memory records are discarded, releasing their share of the
+// memory limit, and its write-ahead log, if enabled, is closed; callers
+// still holding it should stop using it.
+func (dm *DataManager) DropCollection(name string) (bool, error) {
+	dm.mu.Lock()
+	c, ok := dm.collections[name]
+	delete(dm.collections, name)
+	dm.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	// Stopped first, so that no sweep or reload changes the data once discarded
+	c.DisableExpiry()
+	c.DisableAutoReload()
+	c.StopJobs()
+	c.mu.Lock()
+	c.current = newDataset()
+	atomic.AddInt64(dm.currentUsage, -atomic.SwapInt64(&c.dataUsage, 0))
+	c.mu.Unlock()
+	return true, c.CloseWAL()
+}
+
+// handleCollections lists the names of the manager's collections
+func (dm *DataManager) handleCollections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, dm.Collections())
+}
+
+// handleCollection serves a request under /collections/{name}/ with the
+// routes of the named collection
+func (dm *DataManager) handleCollection(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	c, err := dm.Collection(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	http.StripPrefix("/collections/"+name, c.routes()).ServeHTTP(w, r)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// columnKind is the storage used by a column
+type columnKind int
+
+const (
+	columnFloat  columnKind = iota // Numbers as []float64
+	columnString                   // Dictionary-encoded strings
+	columnBool                     // Booleans as []bool
+	columnMixed                    // Anything else, or a field holding several types
+)
+
+// bitmap is a growable set of row numbers
+type bitmap []uint64
+
+func (b bitmap) get(i int) bool { return b[i/64]&(1<<(i%64)) != 0 }
+
+func (b *bitmap) set(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+func (b bitmap) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+
+// column holds one field of every row in typed storage. Rows lacking the
+// field are absent; rows holding null are present and null.
+type column struct {
+	kind    columnKind
+	settled bool // Whether kind was taken from a non-null value
+	present bitmap
+	nulls   bitmap
+	floats  []float64
+	codes   []uint32
+	dict    []string
+	lookup  map[string]uint32
+	bools   []bool
+	values  []interface{}
+}
+
+// kindOf returns the column kind that stores v
+func kindOf(v interface{}) columnKind {
+	switch v.(type) {
+	case float64, int, int64:
+		return columnFloat
+	case string:
+		return columnString
+	case bool:
+		return columnBool
+	default:
+		return columnMixed
+	}
+}
+
+// newColumn returns an empty column for values like v
+func newColumn(v interface{}) *column {
+	c := &column{kind: kindOf(v), settled: v != nil}
+	if c.kind == columnString {
+		c.lookup = make(map[string]uint32)
+	}
+	return c
+}
+
+// rows returns how many rows the column has storage for
+func (c *column) rows() int {
+	switch c.kind {
+	case columnFloat:
+		return len(c.floats)
+	case columnString:
+		return len(c.codes)
+	case columnBool:
+		return len(c.bools)
+	default:
+		return len(c.values)
+	}
+}
+
+// pad extends the column with absent rows up to n
+func (c *column) pad(n int) {
+	for c.rows() < n {
+		switch c.kind {
+		case columnFloat:
+			c.floats = append(c.floats, 0)
+		case columnString:
+			c.codes = append(c.codes, 0)
+		case columnBool:
+			c.bools = append(c.bools, false)
+		default:
+			c.values = append(c.values, nil)
+		}
+	}
+}
+
+// set stores v as row n, which must be the next row of the column
+func (c *column) set(n int, v interface{}) {
+	c.pad(n)
+	c.present.set(n)
+	if v == nil {
+		c.nulls.set(n)
+		c.pad(n + 1)
+		return
+	}
+	if !c.settled {
+		// Only nulls so far: adopt the kind of the first real value
+		rows, present, nulls := c.rows(), c.present, c.nulls
+		*c = *newColumn(v)
+		c.present, c.nulls = present, nulls
+		c.pad(rows)
+	}
+	if c.kind != columnMixed && kindOf(v) != c.kind {
+		c.toMixed()
+	}
+	switch c.kind {
+	case columnFloat:
+		f, _ := numericValue(v)
+		c.floats = append(c.floats, f)
+	case columnString:
+		s := v.(string)
+		code, ok := c.lookup[s]
+		if !ok {
+			code = uint32(len(c.dict))
+			c.dict = append(c.dict, s)
+			c.lookup[s] = code
+		}
+		c.codes = append(c.codes, code)
+	case columnBool:
+		c.bools = append(c.bools, v.(bool))
+	default:
+		c.values = append(c.values, v)
+	}
+}
+
+// toMixed converts a typed column to generic storage once it sees a second type
+func (c *column) toMixed() {
+	n := c.rows()
+	values := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		values[i] = c.value(i)
+	}
+	*c = column{kind: columnMixed, settled: true, present: c.present, nulls: c.nulls, values: values}
+}
+
+// has reports whether row i holds the field
+func (c *column) has(i int) bool {
+	return i/64 < len(c.present) && c.present.get(i)
+}
+
+// isNull reports whether row i holds null
+func (c *column) isNull(i int) bool {
+	return i/64 < len(c.nulls) && c.nulls.get(i)
+}
+
+// value returns row i as a decoded JSON value
+func (c *column) value(i int) interface{} {
+	if !c.has(i) || c.isNull(i) {
+		return nil
+	}
+	switch c.kind {
+	case columnFloat:
+		return c.floats[i]
+	case columnString:
+		return c.dict[c.codes[i]]
+	case columnBool:
+		return c.bools[i]
+	default:
+		return c.values[i]
+	}
+}
+
+// memoryUsage estimates the bytes held by the column
+func (c *column) memoryUsage() int64 {
+	size := int64(len(c.present)+len(c.nulls)) * 8
+	size += int64(len(c.floats))*8 + int64(len(c.codes))*4 + int64(len(c.bools))
+	for _, s := range c.dict {
+		size += int64(len(s)) + 16 + 24 // string data, header, lookup entry
+	}
+	for _, v := range c.values {
+		size += 16 + int64(estimateValueSize(v))
+	}
+	return size
+}
+
+// estimateValueSize roughly sizes a decoded JSON value beyond its interface header
+func estimateValueSize(v interface{}) int {
+	switch val := v.(type) {
+	case string:
+		return len(val)
+	case map[string]interface{}:
+		size := 48
+		for key, item := range val {
+			size += len(key) + 32 + estimateValueSize(item)
+		}
+		return size
+	case []interface{}:
+		size := 24
+		for _, item := range val {
+			size += 16 + estimateValueSize(item)
+		}
+		return size
+	default:
+		return 8
+	}
+}
+
+// match clears the rows of sel that do not satisfy condition
+func (c *column) match(condition FilterCondition, sel bitmap, n int) {
+	switch c.kind {
+	case columnFloat:
+		if compare, ok := condition.Value.(int); ok && condition.ValueType == "int" {
+			v := float64(compare)
+			test := map[string]func(float64) bool{
+				">":  func(f float64) bool { return f > v },
+				">=": func(f float64) bool { return f >= v },
+				"<":  func(f float64) bool { return f < v },
+				"<=": func(f float64) bool { return f <= v },
+				"==": func(f float64) bool { return f == v },
+			}[condition.Operator]
+			forSelected(sel, n, func(i int) {
+				if test == nil || !c.has(i) || c.isNull(i) || !test(c.floats[i]) {
+					sel.clear(i)
+				}
+			})
+			return
+		}
+	case columnString:
+		// Evaluate each distinct string once rather than once per row
+		matches := make([]bool, len(c.dict))
+		for code, s := range c.dict {
+			matches[code] = matchValue(s, condition)
+		}
+		forSelected(sel, n, func(i int) {
+			if !c.has(i) || c.isNull(i) || !matches[c.codes[i]] {
+				sel.clear(i)
+			}
+		})
+		return
+	}
+	forSelected(sel, n, func(i int) {
+		if !c.has(i) || !matchValue(c.value(i), condition) {
+			sel.clear(i)
+		}
+	})
+}
+
+// forSelected calls fn with each row number set in sel, in order
+func forSelected(sel bitmap, n int, fn func(i int)) {
+	for w, word := range sel {
+		for word != 0 {
+			i := w*64 + bits.TrailingZeros64(word)
+			word &= word - 1
+			if i >= n {
+				return
+			}
+			fn(i)
+		}
+	}
+}
+
+// ColumnStore holds a dataset column by column: numbers in float64 slices,
+// strings dictionary-encoded and booleans in bool slices. It uses far less
+// memory than a map per record and filters numeric and string fields
+// without decoding rows. A ColumnStore is read-only and safe for concurrent use.
+type ColumnStore struct {
+	rows    int
+	columns map[string]*column
+	fields  []string // Field names in order of first appearance
+	usage   *int64   // Memory usage counter of the manager that loaded the store
+	charged int64    // Bytes of the store counted in usage
+}
+
+// LoadColumnar reads every record of filePath into a new ColumnStore. The
+// DataManager's memory limit applies to the columns built, which count
+// against it until the store is closed.
+func (dm *DataManager) LoadColumnar(filePath string) (*ColumnStore, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+	var reader recordReader
+	if isGlob(filePath) {
+		paths, err := expandGlob(filePath)
+		if err != nil {
+			return nil, err
+		}
+		multi := &multiFileReader{dm: dm, paths: paths}
+		defer multi.close()
+		reader = multi
+	} else {
+		single, closer, err := dm.openRecords(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		reader = single
+	}
+
+	dm.parseErrors.reset()
+	duplicates := newDuplicateFilter(dm.dedupFields)
+	store := &ColumnStore{columns: make(map[string]*column), usage: dm.currentUsage}
+	fail := func(err error) (*ColumnStore, error) {
+		store.Close()
+		return nil, err
+	}
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		valid, err := dm.conforms(record)
+		if err != nil {
+			return fail(err)
+		}
+		if !valid {
+			continue
+		}
+		if dup, err := duplicates.duplicate(record); err != nil {
+			return fail(err)
+		} else if dup {
+			continue
+		}
+		store.append(record)
+
+		// Estimating column sizes walks every column, so charge usage periodically
+		if store.rows%1024 == 0 {
+			if err := store.charge(dm.maxRAMUsage); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	for _, c := range store.columns {
+		c.pad(store.rows)
+	}
+	if err := store.charge(dm.maxRAMUsage); err != nil {
+		return fail(err)
+	}
+	return store, nil
+}
+
+// charge counts the store's current size in the manager's usage, failing
+// when the usage exceeds limit
+func (s *ColumnStore) charge(limit int64) error {
+	size := s.MemoryUsage()
+	usage := atomic.AddInt64(s.usage, size-s.charged)
+	s.charged = size
+	if usage > limit {
+		return &MemoryLimitError{Usage: usage, Limit: limit}
+	}
+	return nil
+}
+
+// Close gives the memory of the store back to the limit of the manager that
+// loaded it; the store must not be queried afterwards
+func (s *ColumnStore) Close() error {
+	if s.usage != nil {
+		atomic.AddInt64(s.usage, -atomic.SwapInt64(&s.charged, 0))
+	}
+	return nil
+}
+
+// append adds a record as the next row
+func (s *ColumnStore) append(record map[string]interface{}) {
+	for field, value := range record {
+		c, ok := s.columns[field]
+		if !ok {
+			c = newColumn(value)
+			s.columns[field] = c
+			s.fields = append(s.fields, field)
+		}
+		c.set(s.rows, value)
+	}
+	s.rows++
+}
+
+// Len returns the number of rows
+func (s *ColumnStore) Len() int {
+	return s.rows
+}
+
+// Fields returns the field names in order of first appearance
+func (s *ColumnStore) Fields() []string {
+	return append([]string{}, s.fields...)
+}
+
+// MemoryUsage estimates the bytes held by the store
+func (s *ColumnStore) MemoryUsage() int64 {
+	var size int64
+	for field, c := range s.columns {
+		size += int64(len(field)) + c.memoryUsage()
+	}
+	return size
+}
+
+// Row returns row i as a record
+func (s *ColumnStore) Row(i int) map[string]interface{} {
+	record := make(map[string]interface{})
+	for field, c := range s.columns {
+		if c.has(i) {
+			record[field] = c.value(i)
+		}
+	}
+	return record
+}
+
+// selection returns the rows matching every condition as a bitmap
+func (s *ColumnStore) selection(conditions []FilterCondition) bitmap {
+	sel := make(bitmap, (s.rows+63)/64)
+	for i := range sel {
+		sel[i] = math.MaxUint64
+	}
+	if extra := len(sel)*64 - s.rows; extra > 0 {
+		sel[len(sel)-1] >>= uint(extra)
+	}
+	for _, condition := range conditions {
+		if condition.ValueType == ExprValueType || condition.ValueType == GeoValueType {
+			match := matchExpr
+			if condition.ValueType == GeoValueType {
+				match = matchGeo
+			}
+			forSelected(sel, s.rows, func(i int) {
+				if !match(s.Row(i), condition) {
+					sel.clear(i)
+				}
+			})
+			continue
+		}
+		c, ok := s.columns[condition.Key]
+		if !ok && pathHead(condition.Key) != condition.Key {
+			forSelected(sel, s.rows, func(i int) {
+				if v, found := resolvePath(s.Row(i), condition.Key); !found || !matchValue(v, condition) {
+					sel.clear(i)
+				}
+			})
+			continue
+		}
+		if !ok {
+			return make(bitmap, len(sel))
+		}
+		c.match(condition, sel, s.rows)
+	}
+	return sel
+}
+
+// Query returns the rows matching every condition as records
+func (s *ColumnStore) Query(conditions []FilterCondition) []map[string]interface{} {
+	var results []map[string]interface{}
+	forSelected(s.selection(conditions), s.rows, func(i int) {
+		results = append(results, s.Row(i))
+	})
+	return results
+}
+
+// Count returns how many rows match every condition
+func (s *ColumnStore) Count(conditions []FilterCondition) int {
+	count := 0
+	for _, word := range s.selection(conditions) {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// Aggregate summarizes the numeric values of field over the rows matching
+// conditions, reading only the field's column
+func (s *ColumnStore) Aggregate(field string, conditions []FilterCondition) *NumericStats {
+	stats := newNumericStats(field)
+	c := s.columns[field]
+	forSelected(s.selection(conditions), s.rows, func(i int) {
+		switch {
+		case c == nil || !c.has(i) || c.isNull(i):
+			stats.Missing++
+		case c.kind == columnFloat:
+			stats.observe(c.floats[i])
+		default:
+			stats.observeValue(c.value(i))
+		}
+	})
+	stats.finish()
+	return stats
+}
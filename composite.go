@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// compositeKey is the value of a record in a composite index: the normalized
+// values of the indexed fields in order, up to the first one it lacks
+type compositeKey []interface{}
+
+// indexMaxValue sorts after every other index value; it bounds prefix scans
+type indexMaxValue struct{}
+
+// indexMax is the single indexMaxValue
+var indexMax = indexMaxValue{}
+
+// compositeValue builds the composite index value of record over fields
+func compositeValue(record map[string]interface{}, fields []string) (interface{}, bool) {
+	var key compositeKey
+	for _, field := range fields {
+		value, _ := resolvePath(record, field)
+		normalized, ok := normalizeIndexValue(value)
+		if !ok {
+			break
+		}
+		key = append(key, normalized)
+	}
+	// Records lacking the leading field cannot match any indexed lookup
+	if len(key) == 0 {
+		return nil, false
+	}
+	return key, true
+}
+
+// compareCompositeKeys orders keys component by component; a key sorts
+// before the longer keys it is a prefix of
+func compareCompositeKeys(a, b compositeKey) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareIndexValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compositeName returns the name a composite index over fields is stored under
+func compositeName(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+// newCompositeIndex creates an empty sorted index over fields
+func newCompositeIndex(fields []string) *fieldIndex {
+	return &fieldIndex{
+		field:  compositeName(fields),
+		fields: append([]string{}, fields...),
+		kind:   SortedIndex,
+		sorted: newSkipList(),
+	}
+}
+
+// CreateCompositeIndex builds a sorted index over an ordered list of fields.
+// It answers queries with equality conditions on a leading run of the fields,
+// optionally followed by range conditions on the next one, e.g. an index on
+// ("tenant", "created_dt") serves tenant == X AND created_dt > Y. The index
+// is named after its fields joined by commas, which is the name DropIndex takes.
+func (dm *DataManager) CreateCompositeIndex(fields ...string) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if len(fields) < 2 {
+		return errors.New("A composite index needs at least two fields")
+	}
+
+	idx := newCompositeIndex(fields)
+	started := time.Now()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	ds := dm.writable()
+	for key, record := range ds.all() {
+		idx.add(key, record)
+	}
+	ds.setIndex(idx.field, idx)
+	dm.logIndexBuilt(idx.field, idx, started)
+	return nil
+}
+
+// compositeMatch picks the conditions a composite index can answer: an
+// equality on each leading field, then up to one lower and one upper bound
+// on the following field. It returns nil when the first field is unconstrained.
+func (idx *fieldIndex) compositeMatch(conditions []FilterCondition) []int {
+	var used []int
+	for _, field := range idx.fields {
+		equality, lower, upper := -1, -1, -1
+		for i, condition := range conditions {
+			if condition.Key != field {
+				continue
+			}
+			if _, ok := conditionIndexValue(condition); !ok {
+				continue
+			}
+			switch condition.Operator {
+			case "==":
+				equality = i
+			case ">", ">=":
+				lower = i
+			case "<", "<=":
+				upper = i
+			}
+		}
+		if equality >= 0 {
+			used = append(used, equality)
+			continue
+		}
+		if lower >= 0 {
+			used = append(used, lower)
+		}
+		if upper >= 0 {
+			used = append(used, upper)
+		}
+		break
+	}
+	return used
+}
+
+// compositeBounds turns the conditions chosen by compositeMatch into the
+// scan bounds of the index
+func compositeBounds(drivers []FilterCondition) (lo interface{}, loInclusive bool, hi interface{}, hiInclusive bool) {
+	var prefix compositeKey
+	lo, loInclusive = compositeKey(nil), true
+	hi, hiInclusive = compositeKey{indexMax}, true
+	for _, condition := range drivers {
+		value, _ := conditionIndexValue(condition)
+		with := func(extra ...interface{}) compositeKey {
+			return append(append(compositeKey{}, prefix...), extra...)
+		}
+		switch condition.Operator {
+		case "==":
+			prefix = with(value)
+			lo, hi = with(), with(indexMax)
+		case ">":
+			// Skip the value itself along with every longer key extending it
+			lo, loInclusive = with(value, indexMax), true
+		case ">=":
+			lo, loInclusive = with(value), true
+		case "<":
+			hi, hiInclusive = with(value), false
+		case "<=":
+			hi, hiInclusive = with(value, indexMax), true
+		}
+	}
+	return lo, loInclusive, hi, hiInclusive
+}
+
+// lookupComposite returns the keys of records that may satisfy drivers
+func (idx *fieldIndex) lookupComposite(drivers []FilterCondition, limit int) []string {
+	var keys []string
+	lo, loInclusive, hi, hiInclusive := compositeBounds(drivers)
+	idx.sorted.scan(lo, loInclusive, hi, hiInclusive, func(n *skipNode) bool {
+		keys = append(keys, n.key)
+		return limit < 0 || len(keys) <= limit
+	})
+	return keys
+}
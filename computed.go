@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ComputeFunc derives a field value from a record; returning false leaves
+// the field unset
+type ComputeFunc func(record map[string]interface{}) (interface{}, bool)
+
+// computedField is a field added to every record as it is read
+type computedField struct {
+	name string
+	expr *Expr       // Set for expression fields
+	fn   ComputeFunc // Set for function fields
+}
+
+// AddComputedField adds a field computed by expression (see Expr) to every
+// record read by loads, scans, imports and watches, so conditions, indexes
+// and statistics can use it like a stored field. Fields are computed in the
+// order they were added, so later ones may use earlier ones. A field whose
+// expression fails or yields null for a record is left out of that record.
+// Records written with Put and its variants are stored as given.
+func (dm *DataManager) AddComputedField(name, expression string) error {
+	expr, err := CompileExpr(expression)
+	if err != nil {
+		return err
+	}
+	return dm.addComputed(computedField{name: name, expr: expr})
+}
+
+// AddComputedFunc adds a field computed by fn (see AddComputedField). fn may
+// be called from several goroutines at once. Fast scans decode whole records
+// while a function field is set, since the fields it reads are unknown.
+func (dm *DataManager) AddComputedFunc(name string, fn ComputeFunc) error {
+	return dm.addComputed(computedField{name: name, fn: fn})
+}
+
+// DefineComputedField adds a field from a definition such as
+// `full_name = first + " " + last` (see AddComputedField)
+func (dm *DataManager) DefineComputedField(definition string) error {
+	name, expression, ok := strings.Cut(definition, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.HasPrefix(expression, "=") {
+		return fmt.Errorf("Invalid computed field %q: want \"name = expression\"", definition)
+	}
+	return dm.AddComputedField(name, expression)
+}
+
+// ClearComputedFields removes every computed field
+func (dm *DataManager) ClearComputedFields() {
+	dm.computed = nil
+}
+
+func (dm *DataManager) addComputed(field computedField) error {
+	if field.name == "" {
+		return fmt.Errorf("Computed field needs a name")
+	}
+	for _, existing := range dm.computed {
+		if existing.name == field.name {
+			return fmt.Errorf("Computed field %q already exists", field.name)
+		}
+	}
+	dm.computed = append(dm.computed, field)
+	return nil
+}
+
+// derive normalizes the values of record (see SetCoercion) and adds the
+// computed fields to it
+func (dm *DataManager) derive(record map[string]interface{}) {
+	dm.coerce(record, true)
+	dm.compute(record)
+}
+
+// compute adds the computed fields to record
+func (dm *DataManager) compute(record map[string]interface{}) {
+	for _, field := range dm.computed {
+		var value interface{}
+		var ok bool
+		if field.fn != nil {
+			value, ok = field.fn(record)
+		} else {
+			var err error
+			value, err = field.expr.Eval(record)
+			ok = err == nil
+		}
+		if ok && value != nil {
+			record[field.name] = value
+		} else {
+			delete(record, field.name)
+		}
+	}
+}
+
+// isComputed reports whether field is a computed field
+func (dm *DataManager) isComputed(field string) bool {
+	for _, c := range dm.computed {
+		if c.name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// computedInputs returns the stored fields the computed fields read, and
+// false if a function field makes them unknown
+func (dm *DataManager) computedInputs() ([]string, bool) {
+	var inputs []string
+	for _, c := range dm.computed {
+		if c.fn != nil {
+			return nil, false
+		}
+		inputs = append(inputs, c.expr.Fields()...)
+	}
+	return inputs, true
+}
+
+// derivingReader coerces the records of another reader and adds the
+// computed fields to them
+type derivingReader struct {
+	recordReader
+	dm *DataManager
+}
+
+// Next returns the next record with its computed fields
+func (r derivingReader) Next() (map[string]interface{}, int, error) {
+	record, size, err := r.recordReader.Next()
+	if err == nil {
+		r.dm.derive(record)
+	}
+	return record, size, err
+}
+
+// deriving wraps reader so its records are coerced and gain the computed
+// fields, if any
+func (dm *DataManager) deriving(reader recordReader) recordReader {
+	if len(dm.computed) == 0 && dm.coercion == nil {
+		return reader
+	}
+	return derivingReader{recordReader: reader, dm: dm}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds DataManager settings in a form that can be read from a JSON
+// or YAML file (see LoadConfig) and overridden from the environment (see
+// Config.LoadEnv). Zero values keep the defaults of New.
+type Config struct {
+	MaxRAM              int64    `json:"max_ram"`      // Memory limit in bytes
+	Mode                Mode     `json:"mode"`         // "InMemory", "Split" or "Auto"
+	Workers             int      `json:"workers"`      // Goroutines used by parallel scans
+	ChunkSize           int64    `json:"chunk_size"`   // Bytes per chunk of parallel scans
+	PinWorkers          bool     `json:"pin_workers"`  // Binds the workers of parallel scans to CPUs
+	DateLayouts         []string `json:"date_layouts"` // Extra layouts for date and datetime conditions
+	ScannerBufferSize   int      `json:"scanner_buffer_size"`
+	MaxRecordSize       int      `json:"max_record_size"`
+	HTTPTimeout         Duration `json:"http_timeout"`         // e.g. "30s"
+	SlowQueryThreshold  Duration `json:"slow_query_threshold"` // e.g. "250ms"
+	MaxBytesPerSecond   int64    `json:"max_bytes_per_second"` // Throughput limits of loads and scans
+	MaxRecordsPerSecond int64    `json:"max_records_per_second"`
+	MaxConcurrentScans  int      `json:"max_concurrent_scans"` // Split-mode scans running at once
+	MaxQueuedScans      int      `json:"max_queued_scans"`
+	ScanMemory          int64    `json:"scan_memory"`        // Memory budget of each scan in bytes
+	EncryptionKeyEnv    string   `json:"encryption_key_env"` // Variable holding the hex or base64 key that files are encrypted with
+}
+
+// Duration is a time.Duration written as a string such as "1m30s" in configuration
+type Duration time.Duration
+
+// UnmarshalText parses a duration such as "1m30s"
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText formats the duration like time.Duration.String
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Options returns the options applying the settings of c
+func (c *Config) Options() []Option {
+	var opts []Option
+	if c.MaxRAM != 0 {
+		opts = append(opts, WithMaxRAM(c.MaxRAM))
+	}
+	if c.Mode != "" {
+		opts = append(opts, WithMode(c.Mode))
+	}
+	if c.Workers != 0 {
+		opts = append(opts, WithWorkers(c.Workers))
+	}
+	if c.ChunkSize != 0 {
+		opts = append(opts, WithChunkSize(c.ChunkSize))
+	}
+	if c.PinWorkers {
+		opts = append(opts, WithPinnedWorkers())
+	}
+	if len(c.DateLayouts) > 0 {
+		opts = append(opts, WithDateLayouts(c.DateLayouts...))
+	}
+	if c.ScannerBufferSize != 0 {
+		opts = append(opts, WithScannerBufferSize(c.ScannerBufferSize))
+	}
+	if c.MaxRecordSize != 0 {
+		opts = append(opts, WithMaxRecordSize(c.MaxRecordSize))
+	}
+	if c.HTTPTimeout != 0 {
+		opts = append(opts, WithHTTPTimeout(time.Duration(c.HTTPTimeout)))
+	}
+	if c.SlowQueryThreshold != 0 {
+		opts = append(opts, WithSlowQueryThreshold(time.Duration(c.SlowQueryThreshold)))
+	}
+	if c.MaxBytesPerSecond != 0 || c.MaxRecordsPerSecond != 0 {
+		opts = append(opts, WithThrottle(ThrottleOptions{BytesPerSecond: c.MaxBytesPerSecond, RecordsPerSecond: c.MaxRecordsPerSecond}))
+	}
+	if c.MaxConcurrentScans != 0 || c.MaxQueuedScans != 0 || c.ScanMemory != 0 {
+		opts = append(opts, WithConcurrency(ConcurrencyOptions{MaxScans: c.MaxConcurrentScans, MaxQueued: c.MaxQueuedScans, ScanMemory: c.ScanMemory}))
+	}
+	if c.EncryptionKeyEnv != "" {
+		opts = append(opts, WithEncryption(EncryptionOptions{Key: KeyFromEnv(c.EncryptionKeyEnv)}))
+	}
+	return opts
+}
+
+// LoadConfig reads a Config from a JSON file, or a YAML file when path ends
+// in .yaml or .yml. The YAML reader handles the flat "key: value" documents
+// Config needs, with lists written as [a, b] or as "- item" lines.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err := parseFlatYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for key, value := range values {
+			if err := cfg.set(key, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// LoadEnv overrides settings from environment variables named after the JSON
+// keys, upper-cased and prefixed, e.g. JSONDM_MAX_RAM for prefix "JSONDM_".
+// Lists are comma-separated.
+func (c *Config) LoadEnv(prefix string) error {
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		key := configKey(t.Field(i))
+		raw, ok := os.LookupEnv(prefix + strings.ToUpper(key))
+		if !ok {
+			continue
+		}
+		if err := c.set(key, raw); err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, strings.ToUpper(key), err)
+		}
+	}
+	return nil
+}
+
+// configKey returns the configuration key of a Config field
+func configKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name
+}
+
+// set assigns a string or list value to the field with the given key
+func (c *Config) set(key string, value interface{}) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if configKey(v.Type().Field(i)) != key {
+			continue
+		}
+		field := v.Field(i)
+		if list, ok := value.([]string); ok {
+			if field.Kind() != reflect.Slice {
+				return fmt.Errorf("%s does not take a list", key)
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+
+		raw := value.(string)
+		if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(raw))
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+// parseFlatYAML reads a YAML mapping of scalars and lists of scalars, the
+// only shapes a Config holds. Values are strings or []string.
+func parseFlatYAML(data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	var listKey string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item outside a list", lineNo)
+			}
+			item := yamlScalar(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			values[listKey] = append(values[listKey].([]string), item)
+			continue
+		}
+		if line != trimmed && line[0] == ' ' {
+			return nil, fmt.Errorf("line %d: nested mappings are not supported", lineNo)
+		}
+
+		key, value, found := strings.Cut(trimmed, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		listKey = ""
+		switch {
+		case value == "":
+			// A block list follows
+			listKey = key
+			values[key] = []string{}
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			items := []string{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, yamlScalar(item))
+				}
+			}
+			values[key] = items
+		default:
+			values[key] = yamlScalar(value)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// stripYAMLComment removes a "#" comment that is not inside quotes
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar unquotes a quoted YAML scalar
+func yamlScalar(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"') {
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			return unquoted
+		}
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Count returns the number of records (see CountWhere)
+func (dm *DataManager) Count() (int, error) {
+	return dm.CountWhere(nil)
+}
+
+// CountWhere returns the number of records matching all conditions without
+// collecting them. In InMemory mode it uses the query planner, so indexed
+// conditions are counted from the index. In Split mode it streams the most
+// recently scanned or loaded input (see LoadDataInSplitMode and Load), holding
+// one record at a time, so counts are not limited by the memory limit.
+func (dm *DataManager) CountWhere(conditions []FilterCondition) (int, error) {
+	switch dm.mode {
+	case InMemoryMode:
+		defer dm.timeOperation("query")()
+		started := time.Now()
+		ds := dm.snapshot()
+		plan := dm.plan(ds, conditions)
+		count := 0
+		dm.visit(ds, plan, func(map[string]interface{}) bool {
+			count++
+			return true
+		})
+		dm.logSlowQuery(plan, conditions, time.Since(started), count)
+		return count, nil
+	case SplitMode:
+		path := dm.loadedPath()
+		if path == "" {
+			return 0, fmt.Errorf("%w: nothing has been scanned or loaded", ErrNoInput)
+		}
+		return dm.countPath(path, conditions)
+	}
+	return 0, ErrInvalidMode
+}
+
+// countPath counts the matching records of a location or glob
+func (dm *DataManager) countPath(location string, conditions []FilterCondition) (count int, err error) {
+	paths := []string{location}
+	if isGlob(location) {
+		if paths, err = expandGlob(location); err != nil {
+			return 0, err
+		}
+	}
+
+	dm.parseErrors.reset()
+	paths, perFile, partitions := dm.prunePartitions(paths, conditions)
+	defer dm.beginOperation("scan", describePaths(paths), func() int64 { return dm.filesSize(paths) })(&err)
+	duplicates := newDuplicateFilter(dm.dedupFields)
+	for i, path := range paths {
+		src, err := dm.resolveSource(path)
+		if err != nil {
+			return 0, err
+		}
+		n, err := dm.countSource(src, perFile[i], func(record map[string]interface{}) (bool, error) {
+			if duplicates == nil {
+				return true, nil
+			}
+			addPartitionValues([]map[string]interface{}{record}, partitions[i])
+			dup, err := duplicates.duplicate(record)
+			return !dup, err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// countSource counts the records of src matching conditions that keep accepts
+func (dm *DataManager) countSource(src Source, conditions []FilterCondition, keep func(map[string]interface{}) (bool, error)) (int, error) {
+	count := 0
+	accept := func(record map[string]interface{}) error {
+		ok, err := keep(record)
+		if ok {
+			count++
+		}
+		return err
+	}
+
+	if dm.formatFor(sourceName(src)) == "parquet" {
+		records, err := dm.scanParquetSource(src, conditions, nil, dm.sharedBudget())
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			if err := accept(record); err != nil {
+				return 0, err
+			}
+		}
+		return count, nil
+	}
+
+	input, err := src.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	if dm.formatFor(sourceName(src)) == "json" {
+		text, err := dm.transcode(input)
+		if err != nil {
+			return 0, err
+		}
+		br := dm.chunkReader(text)
+		defer dm.releaseChunkReader(br)
+		if first, err := peekNonSpace(br); err == nil && first != '[' {
+			ls := dm.newLineScanner(conditions)
+			ls.projected = nil
+			err := ls.eachLine(br, 0, math.MaxInt64, func(record map[string]interface{}, _ int) error {
+				if record == nil {
+					return nil
+				}
+				return accept(record)
+			})
+			return count, err
+		}
+		reader, err := dm.newJSONReader(br)
+		if err != nil {
+			return 0, err
+		}
+		return count, dm.eachMatch(dm.deriving(reader), conditions, accept)
+	}
+
+	reader, err := dm.newReaderFor(input, sourceName(src))
+	if err != nil {
+		return 0, err
+	}
+	return count, dm.eachMatch(reader, conditions, accept)
+}
+
+// eachMatch streams every record of reader and calls fn with those matching conditions
+func (dm *DataManager) eachMatch(reader recordReader, conditions []FilterCondition, fn func(map[string]interface{}) error) error {
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		valid, err := dm.conforms(record)
+		if err != nil {
+			return err
+		}
+		if valid && dm.matchConditions(record, conditions) {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+}
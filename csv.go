@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVOptions configures how CSV and TSV input is mapped to records
+type CSVOptions struct {
+	Delimiter   rune              // Field separator; defaults to ',' for CSV and '\t' for TSV
+	Schema      map[string]string // Optional column types: "int", "float", "bool", "string", "date", "datetime"
+	NoInference bool              // Keep columns missing from Schema as strings instead of inferring types
+}
+
+// SetCSVOptions configures CSV and TSV ingestion
+func (dm *DataManager) SetCSVOptions(opts CSVOptions) {
+	dm.csvOptions = opts
+}
+
+// SetInputFormat forces the input format: "json", "csv", "tsv", "parquet", the name of
+// a record codec such as "msgpack" or "bson", or "auto" (the default) to detect it
+// from the file extension and content
+func (dm *DataManager) SetInputFormat(format string) error {
+	switch format {
+	case "", "auto":
+		dm.inputFormat = ""
+	case "json", "csv", "tsv", "parquet":
+		dm.inputFormat = format
+	default:
+		if _, ok := lookupRecordCodec(format); !ok {
+			return fmt.Errorf("Unknown input format: %s", format)
+		}
+		dm.inputFormat = format
+	}
+	return nil
+}
+
+// formatFor returns the input format for a location
+func (dm *DataManager) formatFor(location string) string {
+	if dm.inputFormat != "" {
+		return dm.inputFormat
+	}
+	location, _, _ = strings.Cut(location, "?")
+	ext := strings.ToLower(path.Ext(location))
+	switch ext {
+	case ".csv":
+		return "csv"
+	case ".tsv", ".tab":
+		return "tsv"
+	case ".parquet":
+		return "parquet"
+	}
+	if name, ok := codecForExtension(ext); ok {
+		return name
+	}
+	return "json"
+}
+
+// newReaderFor returns a record reader for r in the format of location,
+// adding the computed fields to its records
+func (dm *DataManager) newReaderFor(r io.Reader, location string) (recordReader, error) {
+	var reader recordReader
+	var err error
+	format := dm.formatFor(location)
+	if transcodesText(format) {
+		if r, err = dm.transcode(r); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case "csv":
+		reader, err = newCSVReader(r, ',', dm.csvOptions)
+	case "tsv":
+		reader, err = newCSVReader(r, '\t', dm.csvOptions)
+	case "parquet":
+		return nil, errors.New("Parquet input requires a local file or cloud object, not a stream")
+	case "json":
+		reader, err = dm.newJSONReader(r)
+	default:
+		codec, ok := lookupRecordCodec(format)
+		if !ok {
+			return nil, fmt.Errorf("Unknown input format: %s", format)
+		}
+		reader = codec.NewDecoder(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dm.deriving(reader), nil
+}
+
+// Rows read ahead of the first record to infer the type of each column
+const csvSampleRows = 1000
+
+// csvReader maps delimited rows to records keyed by the header columns
+type csvReader struct {
+	reader  *csv.Reader
+	header  []string
+	opts    CSVOptions
+	offset  int64
+	types   map[string]string // Inferred type of each column, once the sample has been read
+	pending []csvRow          // Sampled rows not returned yet
+	line    int               // Line of the row returned last
+}
+
+// csvRow is a row as read from the input
+type csvRow struct {
+	cells []string
+	start int64 // Offset of the row in the input
+	size  int   // Bytes the row spans
+	line  int   // Line the row starts on
+	err   error // Error reading the row
+}
+
+// newCSVReader reads the header row of delimited input
+func newCSVReader(r io.Reader, delimiter rune, opts CSVOptions) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = reader.Comma == '\t'
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV input has no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	return &csvReader{reader: reader, header: header, opts: opts, offset: reader.InputOffset()}, nil
+}
+
+// Next converts the next row into a record
+func (cr *csvReader) Next() (map[string]interface{}, int, error) {
+	if cr.types == nil && !cr.opts.NoInference {
+		cr.sample()
+	}
+	var row csvRow
+	if len(cr.pending) > 0 {
+		row, cr.pending = cr.pending[0], cr.pending[1:]
+	} else {
+		row = cr.read()
+	}
+	cr.line = row.line
+	if row.err != nil {
+		var csvErr *csv.ParseError
+		if errors.As(row.err, &csvErr) {
+			return nil, row.size, &ParseError{Line: csvErr.Line, Offset: row.start, Err: csvErr.Err}
+		}
+		return nil, 0, row.err
+	}
+
+	record := make(map[string]interface{}, len(cr.header))
+	for i, column := range cr.header {
+		if i >= len(row.cells) {
+			record[column] = nil
+			continue
+		}
+		value, err := cr.convert(column, row.cells[i])
+		if err != nil {
+			return nil, row.size, &ParseError{Line: row.line, Offset: row.start, Snippet: snippet([]byte(strings.Join(row.cells, string(cr.reader.Comma)))), Err: err}
+		}
+		record[column] = value
+	}
+	return record, row.size, nil
+}
+
+// read reads the next row from the input
+func (cr *csvReader) read() csvRow {
+	row := csvRow{start: cr.offset}
+	row.cells, row.err = cr.reader.Read()
+	row.size = int(cr.reader.InputOffset() - cr.offset)
+	cr.offset = cr.reader.InputOffset()
+	var csvErr *csv.ParseError
+	switch {
+	case row.err == nil:
+		row.line, _ = cr.reader.FieldPos(0)
+	case errors.As(row.err, &csvErr):
+		row.line = csvErr.Line
+	}
+	return row
+}
+
+// sample reads up to csvSampleRows rows ahead and infers the type of each
+// column from them. A column takes the type all of its sampled values share;
+// when any value disagrees, or the column has no values, it stays text.
+func (cr *csvReader) sample() {
+	for len(cr.pending) < csvSampleRows {
+		row := cr.read()
+		cr.pending = append(cr.pending, row)
+		if row.err != nil && !errors.As(row.err, new(*csv.ParseError)) {
+			break // The end of the input or a read error
+		}
+	}
+	cr.types = make(map[string]string, len(cr.header))
+	for _, row := range cr.pending {
+		if row.err != nil {
+			continue
+		}
+		for i, column := range cr.header {
+			if i >= len(row.cells) {
+				continue
+			}
+			kind := csvKind(row.cells[i])
+			if kind == "" {
+				continue
+			}
+			if seen, ok := cr.types[column]; ok && seen != kind {
+				kind = "string"
+			}
+			cr.types[column] = kind
+		}
+	}
+}
+
+// convert types a cell using the schema or, failing that, inference
+func (cr *csvReader) convert(column, cell string) (interface{}, error) {
+	valueType, declared := cr.opts.Schema[column]
+	if !declared {
+		if cr.opts.NoInference {
+			return cell, nil
+		}
+		return inferCSVValue(cell, cr.types[column]), nil
+	}
+
+	if cell == "" && valueType != "string" {
+		return nil, nil
+	}
+	switch valueType {
+	case "string":
+		return cell, nil
+	case "int":
+		n, err := strconv.ParseInt(strings.TrimSpace(cell), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: cannot parse %q as int", column, cell)
+		}
+		// Stored as float64, like JSON numbers, so the same filters apply
+		return float64(n), nil
+	case "float":
+		f, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: cannot parse %q as float", column, cell)
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(cell))
+		if err != nil {
+			return nil, fmt.Errorf("column %q: cannot parse %q as bool", column, cell)
+		}
+		return b, nil
+	case "date":
+		if _, err := time.Parse("2006-01-02", cell); err != nil {
+			return nil, fmt.Errorf("column %q: cannot parse %q as date", column, cell)
+		}
+		return cell, nil
+	case "datetime":
+		if _, err := time.Parse("2006-01-02 15:04:05", cell); err != nil {
+			return nil, fmt.Errorf("column %q: cannot parse %q as datetime", column, cell)
+		}
+		return cell, nil
+	default:
+		return nil, fmt.Errorf("column %q: unknown schema type %q", column, valueType)
+	}
+}
+
+// inferCSVValue types a cell of a column inferred as columnType: empty cells
+// become null, numbers become float64 and true/false become bool. Cells of
+// text columns, and cells past the sample that do not fit the column's type,
+// keep their text; so do dates, which is how the date and datetime filters
+// expect them.
+func inferCSVValue(cell, columnType string) interface{} {
+	trimmed := strings.TrimSpace(cell)
+	if trimmed == "" {
+		return nil
+	}
+	if csvKind(cell) != columnType {
+		return cell
+	}
+	switch columnType {
+	case "bool":
+		return strings.EqualFold(trimmed, "true")
+	case "number":
+		f, _ := strconv.ParseFloat(trimmed, 64)
+		return f
+	}
+	return cell
+}
+
+// csvKind returns the type a cell reads as: "bool", "number", "string", or
+// "" when it is empty. Numbers with leading zeros, such as zip codes, read
+// as strings so the zeros are kept.
+func csvKind(cell string) string {
+	trimmed := strings.TrimSpace(cell)
+	switch {
+	case trimmed == "":
+		return ""
+	case strings.EqualFold(trimmed, "true"), strings.EqualFold(trimmed, "false"):
+		return "bool"
+	}
+	digits := strings.TrimLeft(trimmed, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return "string"
+	}
+	if _, err := strconv.ParseFloat(trimmed, 64); err == nil && !strings.ContainsAny(trimmed, "nNiIxX") {
+		return "number"
+	}
+	return "string"
+}
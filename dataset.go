@@ -0,0 +1,297 @@
+package main
+
+import (
+	"iter"
+	"math"
+	"sync/atomic"
+)
+
+// minChanges is the number of changed records a version may carry over a
+// shared base, however small, before a write folds them into a new one
+const minChanges = 256
+
+// dataset is one version of the in-memory data. Readers obtain it with
+// snapshot() and iterate it without holding dm.mu, so once it has been shared
+// it is never modified again. A version is a base of records and indexes,
+// shared with the versions derived from it, plus the records written since
+// and indexes of those alone: deriving a writable version from a shared one
+// copies only the changes, and a write folds them into a new base once they
+// outgrow the square root of the old one, so writes interleaved with reads
+// cost O(√N) amortized rather than a copy of every record and index.
+type dataset struct {
+	base    map[string]map[string]interface{} // Records, shared with other versions unless owned
+	changes map[string]map[string]interface{} // Records written over base, nil for deleted ones
+	size    int                               // Number of records
+	indexes map[string]*fieldIndex            // Secondary indexes of base by name
+	deltas  map[string]*fieldIndex            // Secondary indexes of changes by name (nil when owned)
+	stats   *statsCatalog                     // Statistics of the records, shared by later versions (nil when not gathered)
+	owned   bool                              // Whether base and indexes belong to this version alone, so writes change them in place
+	shared  atomic.Bool                       // Set once a reader may hold this version
+}
+
+// newDataset creates an empty dataset
+func newDataset() *dataset {
+	return loadedDataset(make(map[string]map[string]interface{}), make(map[string]*fieldIndex), nil)
+}
+
+// loadedDataset creates a dataset owning data and its indexes
+func loadedDataset(data map[string]map[string]interface{}, indexes map[string]*fieldIndex, stats *statsCatalog) *dataset {
+	return &dataset{base: data, size: len(data), indexes: indexes, stats: stats, owned: true}
+}
+
+// get returns the record stored under key
+func (ds *dataset) get(key string) (map[string]interface{}, bool) {
+	if record, changed := ds.changes[key]; changed {
+		return record, record != nil
+	}
+	record, exists := ds.base[key]
+	return record, exists
+}
+
+// all iterates over the records and their keys
+func (ds *dataset) all() iter.Seq2[string, map[string]interface{}] {
+	return func(yield func(string, map[string]interface{}) bool) {
+		for key, record := range ds.changes {
+			if record != nil && !yield(key, record) {
+				return
+			}
+		}
+		for key, record := range ds.base {
+			if _, changed := ds.changes[key]; !changed && !yield(key, record) {
+				return
+			}
+		}
+	}
+}
+
+// len returns the number of records
+func (ds *dataset) len() int {
+	return ds.size
+}
+
+// records returns the records by key. Without changes over the base it is
+// the base itself, which must not be modified.
+func (ds *dataset) records() map[string]map[string]interface{} {
+	if len(ds.changes) == 0 {
+		return ds.base
+	}
+	data := make(map[string]map[string]interface{}, ds.size)
+	for key, record := range ds.all() {
+		data[key] = record
+	}
+	return data
+}
+
+// clone returns a writable version with the records and indexes of ds. It
+// shares the base of ds and copies only the changes made over it; records
+// themselves are never modified in place and are shared between versions.
+func (ds *dataset) clone() *dataset {
+	c := &dataset{
+		base:    ds.base,
+		changes: make(map[string]map[string]interface{}, len(ds.changes)),
+		size:    ds.size,
+		indexes: ds.indexes,
+		deltas:  make(map[string]*fieldIndex, len(ds.indexes)),
+		stats:   ds.stats,
+	}
+	for key, record := range ds.changes {
+		c.changes[key] = record
+	}
+	for name, idx := range ds.indexes {
+		if delta, ok := ds.deltas[name]; ok {
+			c.deltas[name] = delta.clone()
+		} else {
+			c.deltas[name] = idx.empty()
+		}
+	}
+	return c
+}
+
+// compacted copies the dataset into right-sized maps, dropping the space
+// deleted records left behind, and builds its indexes anew
+func (ds *dataset) compacted() *dataset {
+	data := make(map[string]map[string]interface{}, ds.size)
+	for key, record := range ds.all() {
+		data[key] = record
+	}
+	return loadedDataset(data, rebuildIndexes(ds.indexes, data), ds.stats)
+}
+
+// put stores record under key and returns the record it replaces; ds must
+// not be shared
+func (ds *dataset) put(key string, record map[string]interface{}) (map[string]interface{}, bool) {
+	old, exists := ds.get(key)
+	if !exists {
+		ds.size++
+	}
+	if !ds.owned {
+		ds.change(key, record)
+		return old, exists
+	}
+	for _, idx := range ds.indexes {
+		if exists {
+			idx.remove(key, old)
+		}
+		idx.add(key, record)
+	}
+	ds.base[key] = record
+	return old, exists
+}
+
+// remove deletes the record under key and returns it; ds must not be shared
+func (ds *dataset) remove(key string) (map[string]interface{}, bool) {
+	old, exists := ds.get(key)
+	if !exists {
+		return nil, false
+	}
+	ds.size--
+	if !ds.owned {
+		ds.change(key, nil)
+		return old, true
+	}
+	for _, idx := range ds.indexes {
+		idx.remove(key, old)
+	}
+	delete(ds.base, key)
+	return old, true
+}
+
+// change writes record, or a deletion when nil, over the shared base
+func (ds *dataset) change(key string, record map[string]interface{}) {
+	if old := ds.changes[key]; old != nil {
+		for _, delta := range ds.deltas {
+			delta.remove(key, old)
+		}
+	}
+	if _, inBase := ds.base[key]; record == nil && !inBase {
+		delete(ds.changes, key)
+	} else {
+		ds.changes[key] = record
+	}
+	if record != nil {
+		for _, delta := range ds.deltas {
+			delta.add(key, record)
+		}
+	}
+	if len(ds.changes) > max(minChanges, int(math.Sqrt(float64(len(ds.base))))) {
+		ds.flatten()
+	}
+}
+
+// flatten folds the changes into a base of the version's own, which later
+// writes change in place; ds must not be shared
+func (ds *dataset) flatten() {
+	if ds.owned {
+		return
+	}
+	data := make(map[string]map[string]interface{}, ds.size)
+	for key, record := range ds.all() {
+		data[key] = record
+	}
+	indexes := make(map[string]*fieldIndex, len(ds.indexes))
+	for name, idx := range ds.indexes {
+		folded := idx.clone()
+		for key, record := range ds.changes {
+			if old, exists := ds.base[key]; exists {
+				folded.remove(key, old)
+			}
+			if record != nil {
+				folded.add(key, record)
+			}
+		}
+		indexes[name] = folded
+	}
+	ds.base, ds.changes, ds.indexes, ds.deltas, ds.owned = data, nil, indexes, nil, true
+}
+
+// setIndex adds idx, which indexes every record of ds, under name; ds must
+// not be shared
+func (ds *dataset) setIndex(name string, idx *fieldIndex) {
+	ds.flatten()
+	ds.indexes[name] = idx
+}
+
+// dropIndex removes the index called name; ds must not be shared
+func (ds *dataset) dropIndex(name string) {
+	indexes := make(map[string]*fieldIndex, len(ds.indexes))
+	for other, idx := range ds.indexes {
+		if other != name {
+			indexes[other] = idx
+		}
+	}
+	ds.indexes = indexes
+	delete(ds.deltas, name)
+}
+
+// lookup returns the keys of records that may satisfy condition, found by
+// the index called name
+func (ds *dataset) lookup(name string, condition FilterCondition) []string {
+	keys := ds.indexes[name].lookup(condition)
+	if delta, ok := ds.deltas[name]; ok {
+		keys = ds.overlay(keys, delta.lookup(condition))
+	}
+	return keys
+}
+
+// lookupComposite returns the keys of records that may satisfy drivers,
+// found by the composite index called name, stopping past limit when not
+// negative
+func (ds *dataset) lookupComposite(name string, drivers []FilterCondition, limit int) []string {
+	keys := ds.indexes[name].lookupComposite(drivers, limit)
+	if delta, ok := ds.deltas[name]; ok {
+		keys = ds.overlay(keys, delta.lookupComposite(drivers, limit))
+	}
+	return keys
+}
+
+// estimate returns about how many records the index called name finds for
+// condition, counting no further than limit
+func (ds *dataset) estimate(name string, condition FilterCondition, limit int) int {
+	rows := ds.indexes[name].estimate(condition, limit)
+	if delta, ok := ds.deltas[name]; ok {
+		rows += delta.estimate(condition, limit)
+	}
+	return rows
+}
+
+// score adds the BM25 score of the records matching query in the text
+// index called name to scores
+func (ds *dataset) score(name string, query string, scores map[string]float64) {
+	var delta *invertedIndex
+	if d, ok := ds.deltas[name]; ok {
+		delta = d.text
+	}
+	ds.indexes[name].text.score(query, delta, ds.changes, scores)
+}
+
+// overlay returns the keys found in the base index that the changes left
+// alone, followed by those found in the index of the changes
+func (ds *dataset) overlay(base, changed []string) []string {
+	keys := base[:0]
+	for _, key := range base {
+		if _, ok := ds.changes[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return append(keys, changed...)
+}
+
+// snapshot returns the current dataset for lock-free reading. Later writes
+// and reloads produce new versions and never affect the returned one.
+func (dm *DataManager) snapshot() *dataset {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	ds := dm.current
+	ds.shared.Store(true)
+	return ds
+}
+
+// writable returns a dataset that may be mutated in place, deriving a new
+// version from the current one first if readers may hold it; the caller
+// holds dm.mu
+func (dm *DataManager) writable() *dataset {
+	if dm.current.shared.Load() {
+		dm.current = dm.current.clone()
+	}
+	return dm.current
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Decoder selects how lines of NDJSON input are decoded into records
+type Decoder string
+
+const (
+	StandardDecoder Decoder = "standard" // encoding/json
+	FastDecoder     Decoder = "fast"     // Single-pass decoder without reflection
+)
+
+// WithDecoder selects the NDJSON decoder (see SetDecoder)
+func WithDecoder(d Decoder) Option {
+	return func(dm *DataManager) { dm.decoder = d }
+}
+
+// SetDecoder selects the decoder of NDJSON lines in loads, scans, counts,
+// imports, lookups and watches. FastDecoder parses records in a single pass
+// without reflection, typically two to three times as fast as encoding/json, and
+// produces the same records: anything it does not handle itself, such as
+// escaped strings or malformed input, is handed to encoding/json, so errors
+// are reported identically. Building with -tags fastjson makes it the
+// default. CompareDecoders measures and checks it against the standard
+// decoder on a file.
+func (dm *DataManager) SetDecoder(d Decoder) error {
+	if d != StandardDecoder && d != FastDecoder {
+		return fmt.Errorf("Unknown decoder %q", d)
+	}
+	dm.decoder = d
+	return nil
+}
+
+// decodeRecord decodes a line holding a JSON object with the selected
+// decoder, repairing it when it is malformed and SetRepair is on
+func (dm *DataManager) decodeRecord(line []byte) (map[string]interface{}, error) {
+	record, err := dm.decodeJSON(line)
+	if err != nil && dm.repair != nil {
+		if records, ok := dm.repair.fix(line, dm.decodeJSON, false); ok {
+			return records[0], nil
+		}
+	}
+	return record, err
+}
+
+// decodeJSON decodes a line holding a JSON object with the selected decoder
+func (dm *DataManager) decodeJSON(line []byte) (map[string]interface{}, error) {
+	if dm.decoder == FastDecoder || (dm.decoder == "" && defaultDecoder == FastDecoder) {
+		return decodeObjectFast(line)
+	}
+	var record map[string]interface{}
+	err := json.Unmarshal(line, &record)
+	return record, err
+}
+
+// DecoderComparison reports how the decoders fared on the same lines
+type DecoderComparison struct {
+	Lines          int           // Lines decoded
+	Bytes          int64         // Bytes of those lines
+	StandardTime   time.Duration // Time spent by encoding/json
+	FastTime       time.Duration // Time spent by FastDecoder
+	Mismatches     int           // Lines decoded differently, or failing with only one decoder
+	FirstMismatch  int           // Line number of the first mismatch (0 when none)
+	StandardErrors int           // Lines encoding/json rejected
+}
+
+// Speedup returns how many times faster FastDecoder was
+func (c *DecoderComparison) Speedup() float64 {
+	if c.FastTime <= 0 {
+		return 0
+	}
+	return float64(c.StandardTime) / float64(c.FastTime)
+}
+
+// CompareDecoders decodes the first maxLines lines of the NDJSON file at
+// path (0 means all) with both decoders, timing each and checking that they
+// return the same records and reject the same lines
+func (dm *DataManager) CompareDecoders(path string, maxLines int) (*DecoderComparison, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := dm.chunkReader(f)
+	defer dm.releaseChunkReader(br)
+
+	report := &DecoderComparison{}
+	var buf []byte
+	number := 0
+	for maxLines <= 0 || report.Lines < maxLines {
+		line, n, _, err := readLine(br, buf[:0], 0)
+		buf = line
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		number++
+		if line, err = dm.preprocessLine(line); err != nil || len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		report.Lines++
+		report.Bytes += int64(len(line))
+
+		started := time.Now()
+		var standard map[string]interface{}
+		standardErr := json.Unmarshal(line, &standard)
+		report.StandardTime += time.Since(started)
+		started = time.Now()
+		fast, fastErr := decodeObjectFast(line)
+		report.FastTime += time.Since(started)
+
+		if standardErr != nil {
+			report.StandardErrors++
+		}
+		if (standardErr == nil) != (fastErr == nil) || !reflect.DeepEqual(standard, fast) {
+			report.Mismatches++
+			if report.FirstMismatch == 0 {
+				report.FirstMismatch = number
+			}
+		}
+	}
+	return report, nil
+}
+
+// Deepest nesting FastDecoder handles itself, matching encoding/json
+const maxDecodeDepth = 10000
+
+// errFastDecode makes decodeObjectFast hand a line to encoding/json
+var errFastDecode = errors.New("not handled by the fast decoder")
+
+// decodeObjectFast decodes a line holding one JSON object, falling back to
+// encoding/json for whatever the fast path does not accept
+func decodeObjectFast(line []byte) (map[string]interface{}, error) {
+	d := fastDecoder{b: line}
+	d.i = skipSpace(line, 0)
+	if d.i < len(line) && line[d.i] == '{' {
+		record, err := d.object(0)
+		if err == nil && skipSpace(line, d.i) == len(line) {
+			return record, nil
+		}
+	}
+	var record map[string]interface{}
+	err := json.Unmarshal(line, &record)
+	return record, err
+}
+
+// fastDecoder is a recursive descent parser over one line
+type fastDecoder struct {
+	b []byte
+	i int
+}
+
+// value decodes the value at d.i
+func (d *fastDecoder) value(depth int) (interface{}, error) {
+	if d.i >= len(d.b) {
+		return nil, errFastDecode
+	}
+	switch c := d.b[d.i]; {
+	case c == '{':
+		return d.object(depth)
+	case c == '[':
+		return d.array(depth)
+	case c == '"':
+		return d.string()
+	case c == 't':
+		return true, d.literal("true")
+	case c == 'f':
+		return false, d.literal("false")
+	case c == 'n':
+		return nil, d.literal("null")
+	case c == '-' || (c >= '0' && c <= '9'):
+		return d.number()
+	}
+	return nil, errFastDecode
+}
+
+// object decodes the object at d.i
+func (d *fastDecoder) object(depth int) (map[string]interface{}, error) {
+	if depth++; depth > maxDecodeDepth {
+		return nil, errFastDecode
+	}
+	record := make(map[string]interface{})
+	d.i = skipSpace(d.b, d.i+1)
+	if d.i < len(d.b) && d.b[d.i] == '}' {
+		d.i++
+		return record, nil
+	}
+	for {
+		if d.i >= len(d.b) || d.b[d.i] != '"' {
+			return nil, errFastDecode
+		}
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		d.i = skipSpace(d.b, d.i)
+		if d.i >= len(d.b) || d.b[d.i] != ':' {
+			return nil, errFastDecode
+		}
+		d.i = skipSpace(d.b, d.i+1)
+		value, err := d.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		record[key] = value
+		d.i = skipSpace(d.b, d.i)
+		if d.i >= len(d.b) {
+			return nil, errFastDecode
+		}
+		switch d.b[d.i] {
+		case ',':
+			d.i = skipSpace(d.b, d.i+1)
+		case '}':
+			d.i++
+			return record, nil
+		default:
+			return nil, errFastDecode
+		}
+	}
+}
+
+// array decodes the array at d.i
+func (d *fastDecoder) array(depth int) ([]interface{}, error) {
+	if depth++; depth > maxDecodeDepth {
+		return nil, errFastDecode
+	}
+	items := []interface{}{}
+	d.i = skipSpace(d.b, d.i+1)
+	if d.i < len(d.b) && d.b[d.i] == ']' {
+		d.i++
+		return items, nil
+	}
+	for {
+		item, err := d.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		d.i = skipSpace(d.b, d.i)
+		if d.i >= len(d.b) {
+			return nil, errFastDecode
+		}
+		switch d.b[d.i] {
+		case ',':
+			d.i = skipSpace(d.b, d.i+1)
+		case ']':
+			d.i++
+			return items, nil
+		default:
+			return nil, errFastDecode
+		}
+	}
+}
+
+// string decodes the string at d.i. Strings with escapes, control
+// characters or invalid UTF-8 go through encoding/json, which unescapes them
+// and replaces invalid bytes exactly as the standard decoder would.
+func (d *fastDecoder) string() (string, error) {
+	start := d.i
+	end, escaped := scanString(d.b, start)
+	if end < 0 {
+		return "", errFastDecode
+	}
+	d.i = end
+	raw := d.b[start+1 : end-1]
+	plain := !escaped
+	for _, c := range raw {
+		if c < 0x20 {
+			plain = false
+			break
+		}
+	}
+	if plain && utf8.Valid(raw) {
+		return string(raw), nil
+	}
+	var s string
+	if err := json.Unmarshal(d.b[start:end], &s); err != nil {
+		return "", errFastDecode
+	}
+	return s, nil
+}
+
+// literal consumes word, the literal starting at d.i
+func (d *fastDecoder) literal(word string) error {
+	if !bytes.HasPrefix(d.b[d.i:], []byte(word)) {
+		return errFastDecode
+	}
+	d.i += len(word)
+	return nil
+}
+
+// number decodes the number at d.i, accepting only the JSON grammar
+// -?(0|[1-9][0-9]*)(.[0-9]+)?([eE][+-]?[0-9]+)?
+func (d *fastDecoder) number() (float64, error) {
+	b, start := d.b, d.i
+	i := start
+	if b[i] == '-' {
+		i++
+	}
+	switch {
+	case i < len(b) && b[i] == '0':
+		i++
+	case i < len(b) && b[i] >= '1' && b[i] <= '9':
+		i = skipDigits(b, i)
+	default:
+		return 0, errFastDecode
+	}
+	if i < len(b) && b[i] == '.' {
+		if next := skipDigits(b, i+1); next > i+1 {
+			i = next
+		} else {
+			return 0, errFastDecode
+		}
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		i++
+		if i < len(b) && (b[i] == '+' || b[i] == '-') {
+			i++
+		}
+		if next := skipDigits(b, i); next > i {
+			i = next
+		} else {
+			return 0, errFastDecode
+		}
+	}
+	f, err := strconv.ParseFloat(string(b[start:i]), 64)
+	if err != nil || math.IsInf(f, 0) {
+		return 0, errFastDecode
+	}
+	d.i = i
+	return f, nil
+}
+
+// skipDigits returns the index of the first non-digit at or after i
+func skipDigits(b []byte, i int) int {
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,6 @@
+//go:build !fastjson
+
+package main
+
+// defaultDecoder decodes NDJSON lines when no decoder is selected
+const defaultDecoder = StandardDecoder
@@ -0,0 +1,7 @@
+//go:build fastjson
+
+package main
+
+// defaultDecoder decodes NDJSON lines when no decoder is selected; building
+// with -tags fastjson makes it the fast decoder
+const defaultDecoder = FastDecoder
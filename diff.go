@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// Change operations reported by Diff
+const (
+	ChangeAdded   = "add"
+	ChangeRemoved = "remove"
+	ChangeUpdated = "change"
+)
+
+// Change is one difference between two datasets
+type Change struct {
+	Op     string                 `json:"op"`               // ChangeAdded, ChangeRemoved or ChangeUpdated
+	Key    string                 `json:"key"`              // Key value, as text
+	Before map[string]interface{} `json:"before,omitempty"` // Record in the first dataset (removed and changed)
+	After  map[string]interface{} `json:"after,omitempty"`  // Record in the second dataset (added and changed)
+	Fields []string               `json:"fields,omitempty"` // Compared fields whose values differ (changed)
+}
+
+// DiffResult holds the differences found by Diff
+type DiffResult struct {
+	Added   []Change
+	Removed []Change
+	Changed []Change
+}
+
+// Diff compares the records of fileA and fileB, matched by keyField, and
+// returns those only in fileB (added), only in fileA (removed), and in both
+// with different values (changed). When fields are given, only they are
+// compared and reported. Key values match by their text across formats; when
+// a key repeats within a file, its last record counts, and records without
+// the key are ignored. Only the keys and a hash of each record are held in
+// memory, plus the records that differ, so fileA is read twice and must be
+// a file or object rather than stdin.
+func (dm *DataManager) Diff(fileA, fileB, keyField string, fields ...string) (*DiffResult, error) {
+	result := &DiffResult{}
+	err := dm.diff(fileA, fileB, keyField, fields, func(change Change) error {
+		switch change.Op {
+		case ChangeAdded:
+			result.Added = append(result.Added, change)
+		case ChangeRemoved:
+			result.Removed = append(result.Removed, change)
+		default:
+			result.Changed = append(result.Changed, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DiffFeed writes the differences between fileA and fileB (see Diff) to w as
+// an NDJSON change feed, one Change per line: additions and changes in
+// fileB's order, then removals in fileA's order
+func (dm *DataManager) DiffFeed(fileA, fileB, keyField string, w io.Writer, fields ...string) error {
+	encoder := json.NewEncoder(w)
+	return dm.diff(fileA, fileB, keyField, fields, func(change Change) error {
+		return encoder.Encode(change)
+	})
+}
+
+// diff finds the differences in three passes: hashing fileA, comparing
+// fileB's hashes against them, and reading fileA again for the records that
+// were removed or changed
+func (dm *DataManager) diff(fileA, fileB, keyField string, fields []string, emit func(Change) error) (err error) {
+	if keyField == "" {
+		return ErrNoKeyField
+	}
+	defer dm.beginOperation("diff", describePaths([]string{fileA, fileB}), func() int64 { return dm.filesSize([]string{fileA, fileB}) })(&err)
+	budget := dm.sharedBudget()
+
+	hashesA := make(map[string]uint64)
+	var orderA []string
+	err = dm.eachKeyed(fileA, keyField, func(key string, record map[string]interface{}) error {
+		if _, seen := hashesA[key]; !seen {
+			orderA = append(orderA, key)
+		}
+		hashesA[key] = recordHash(record, fields)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	seenB := make(map[string]bool)
+	after := make(map[string]map[string]interface{})
+	var orderB []string
+	err = dm.eachKeyed(fileB, keyField, func(key string, record map[string]interface{}) error {
+		if !seenB[key] {
+			orderB = append(orderB, key)
+			seenB[key] = true
+		}
+		if hash, inA := hashesA[key]; inA && hash == recordHash(record, fields) {
+			delete(after, key)
+			return nil
+		}
+		after[key] = record
+		return budget.charge(estimateRecordSize(record))
+	})
+	if err != nil {
+		return err
+	}
+
+	before := make(map[string]map[string]interface{})
+	err = dm.eachKeyed(fileA, keyField, func(key string, record map[string]interface{}) error {
+		if _, changed := after[key]; !changed && seenB[key] {
+			return nil
+		}
+		before[key] = record
+		return budget.charge(estimateRecordSize(record))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range orderB {
+		record, differs := after[key]
+		if !differs {
+			continue
+		}
+		change := Change{Op: ChangeAdded, Key: key, After: project(record, fields)}
+		if old, inA := before[key]; inA {
+			change.Op, change.Before = ChangeUpdated, project(old, fields)
+			change.Fields = changedFields(old, record, fields)
+		}
+		if err := emit(change); err != nil {
+			return err
+		}
+	}
+	for _, key := range orderA {
+		if !seenB[key] {
+			if err := emit(Change{Op: ChangeRemoved, Key: key, Before: project(before[key], fields)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachKeyed calls fn with every record of location that has keyField
+func (dm *DataManager) eachKeyed(location, keyField string, fn func(key string, record map[string]interface{}) error) error {
+	reader, closer, err := dm.openRecords(location)
+	if err != nil {
+		return fmt.Errorf("%s: %w", location, err)
+	}
+	defer closer.Close()
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return fmt.Errorf("%s: %w", location, err)
+			}
+			continue
+		}
+		if key, ok := recordKey(record, keyField); ok {
+			if err := fn(key, record); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// recordHash hashes the compared fields of a record; encoding/json sorts map
+// keys, so equal records hash alike
+func recordHash(record map[string]interface{}, fields []string) uint64 {
+	encoded, _ := json.Marshal(project(record, fields))
+	h := fnv.New64a()
+	h.Write(encoded)
+	return h.Sum64()
+}
+
+// changedFields lists, sorted, the compared fields whose values differ
+func changedFields(a, b map[string]interface{}, fields []string) []string {
+	names := fields
+	if len(names) == 0 {
+		union := make(map[string]bool, len(a))
+		for name := range a {
+			union[name] = true
+		}
+		for name := range b {
+			union[name] = true
+		}
+		for name := range union {
+			names = append(names, name)
+		}
+	}
+	var changed []string
+	for _, name := range names {
+		x, inA := a[name]
+		y, inB := b[name]
+		if inA != inB || !reflect.DeepEqual(x, y) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
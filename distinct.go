@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultSpillThreshold bounds in-memory working sets when no RAM limit is configured
+const defaultSpillThreshold = 64 << 20
+
+// spillThreshold returns how many bytes Distinct keeps in memory before
+// spilling a sorted run to disk
+func (dm *DataManager) spillThreshold() int {
+	if dm.maxRAMUsage > 0 {
+		return int(dm.maxRAMUsage / 4)
+	}
+	return defaultSpillThreshold
+}
+
+// Distinct returns the unique values of field across the records of
+// filePath, ordered by their JSON encoding. Records lacking the field or
+// holding null are ignored.
+func (dm *DataManager) Distinct(filePath, field string) ([]interface{}, error) {
+	var values []interface{}
+	err := dm.distinct(filePath, field, func(encoded string) error {
+		var value interface{}
+		if err := json.Unmarshal([]byte(encoded), &value); err != nil {
+			return err
+		}
+		values = append(values, value)
+		return nil
+	})
+	return values, err
+}
+
+// DistinctTo streams the unique values of field to w as one JSON value per
+// line and returns how many were written. Memory stays bounded however many
+// values there are: sorted runs are spilled to temporary files and merged.
+func (dm *DataManager) DistinctTo(filePath, field string, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	count := 0
+	err := dm.distinct(filePath, field, func(encoded string) error {
+		count++
+		_, err := bw.WriteString(encoded + "\n")
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// distinct calls emit with the JSON encoding of each unique value in order
+func (dm *DataManager) distinct(filePath, field string, emit func(encoded string) error) error {
+	reader, closer, err := dm.openRecords(filePath)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	seen := make(map[string]struct{})
+	var runs []string
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+
+	held, limit := 0, dm.spillThreshold()
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		value, exists := record[field]
+		if !exists || value == nil {
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if _, dup := seen[string(encoded)]; dup {
+			continue
+		}
+		seen[string(encoded)] = struct{}{}
+		held += len(encoded)
+		if held >= limit {
+			run, err := spillRun(seen, dm.encryption)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			seen, held = make(map[string]struct{}), 0
+		}
+	}
+
+	if len(runs) == 0 {
+		for _, encoded := range sortedKeys(seen) {
+			if err := emit(encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(seen) > 0 {
+		run, err := spillRun(seen, dm.encryption)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	return mergeRuns(runs, dm.encryption, emit)
+}
+
+// sortedKeys returns the members of a set in ascending order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// spillRun writes the members of set to a temporary file, one per line in
+// ascending order and encrypted when c is set, and returns its path
+func spillRun(set map[string]struct{}, c *fileCipher) (string, error) {
+	f, err := os.CreateTemp("", "distinct-run-*")
+	if err != nil {
+		return "", err
+	}
+	w := c.writer(f)
+	bw := bufio.NewWriter(w)
+	for _, key := range sortedKeys(set) {
+		bw.WriteString(key)
+		bw.WriteByte('\n')
+	}
+	err = bw.Flush()
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// runCursor is the next unread line of a sorted run
+type runCursor struct {
+	reader *bufio.Reader
+	head   string
+}
+
+// runHeap orders run cursors by their next line
+type runHeap []*runCursor
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].head < h[j].head }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// advance reads the next line of the run, reporting false at its end
+func (c *runCursor) advance() (bool, error) {
+	line, err := c.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	c.head = strings.TrimSuffix(line, "\n")
+	return true, nil
+}
+
+// mergeRuns merges sorted run files, emitting each distinct line once
+func mergeRuns(runs []string, c *fileCipher, emit func(string) error) error {
+	h := &runHeap{}
+	for _, run := range runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := c.reader(bufio.NewReader(f), run)
+		if err != nil {
+			return err
+		}
+		cursor := &runCursor{reader: bufio.NewReader(r)}
+		ok, err := cursor.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			*h = append(*h, cursor)
+		}
+	}
+	heap.Init(h)
+
+	last, emitted := "", false
+	for h.Len() > 0 {
+		cursor := (*h)[0]
+		if !emitted || cursor.head != last {
+			if err := emit(cursor.head); err != nil {
+				return err
+			}
+			last, emitted = cursor.head, true
+		}
+		ok, err := cursor.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// SetDeduplicate makes loads drop records whose keyFields repeat those of an
+// earlier record, keeping the first. An empty keyFields compares whole
+// records; nil disables deduplication.
+func (dm *DataManager) SetDeduplicate(keyFields []string) {
+	if keyFields == nil {
+		dm.dedupFields = nil
+		return
+	}
+	dm.dedupFields = append([]string{}, keyFields...)
+}
+
+// duplicateFilter remembers the keys of records seen so far as 128-bit hashes
+type duplicateFilter struct {
+	fields []string
+	seen   map[[16]byte]struct{}
+}
+
+// newDuplicateFilter returns a filter over keyFields, or nil when
+// deduplication is disabled
+func newDuplicateFilter(keyFields []string) *duplicateFilter {
+	if keyFields == nil {
+		return nil
+	}
+	return &duplicateFilter{fields: keyFields, seen: make(map[[16]byte]struct{})}
+}
+
+// duplicate reports whether record repeats an earlier record's key
+func (f *duplicateFilter) duplicate(record map[string]interface{}) (bool, error) {
+	if f == nil {
+		return false, nil
+	}
+	var key interface{} = record
+	if len(f.fields) > 0 {
+		values := make([]interface{}, len(f.fields))
+		for i, field := range f.fields {
+			values[i] = record[field]
+		}
+		key = values
+	}
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return false, err
+	}
+	h := fnv.New128a()
+	h.Write(encoded)
+	var sum [16]byte
+	copy(sum[:], h.Sum(nil))
+	if _, dup := f.seen[sum]; dup {
+		return true, nil
+	}
+	f.seen[sum] = struct{}{}
+	return false, nil
+}
+
+// dropDuplicates removes records repeating an earlier record's key, in place
+func (dm *DataManager) dropDuplicates(records []map[string]interface{}) ([]map[string]interface{}, error) {
+	filter := newDuplicateFilter(dm.dedupFields)
+	if filter == nil {
+		return records, nil
+	}
+	kept := records[:0]
+	for _, record := range records {
+		dup, err := filter.duplicate(record)
+		if err != nil {
+			return nil, err
+		}
+		if !dup {
+			kept = append(kept, record)
+		}
+	}
+	return kept, nil
+}
+
+// Deduplicate copies the records of inputPath to outputPath as NDJSON,
+// dropping those whose keyFields repeat an earlier record (whole records are
+// compared when keyFields is empty). It returns how many records were kept
+// and dropped.
+func (dm *DataManager) Deduplicate(inputPath, outputPath string, keyFields []string) (kept, dropped int, err error) {
+	if inputPath == outputPath {
+		return 0, 0, errors.New("Deduplicate cannot overwrite its input")
+	}
+	reader, closer, err := dm.openRecords(inputPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closer.Close()
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+	bw := bufio.NewWriter(out)
+	encoder := json.NewEncoder(bw)
+
+	filter := newDuplicateFilter(append([]string{}, keyFields...))
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return kept, dropped, err
+			}
+			continue
+		}
+		dup, err := filter.duplicate(record)
+		if err != nil {
+			return kept, dropped, err
+		}
+		if dup {
+			dropped++
+			continue
+		}
+		if err := encoder.Encode(record); err != nil {
+			return kept, dropped, fmt.Errorf("%s: %w", outputPath, err)
+		}
+		kept++
+	}
+	if err := bw.Flush(); err != nil {
+		return kept, dropped, err
+	}
+	return kept, dropped, out.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Duplicated keys, and records of each, listed by a DuplicateKeyError
+const (
+	maxReportedDuplicateKeys = 10
+	maxReportedPositions     = 10
+)
+
+// RecordPosition locates a record in the input it was read from
+type RecordPosition struct {
+	File   string // Input the record came from, in multi-file loads and merges
+	Line   int    // 1-based line number; 0 when unknown (JSON arrays, Parquet, binary formats)
+	Record int    // 1-based number of the record among those read
+}
+
+// String formats the position as "file line N", or "record N" without a line
+func (p RecordPosition) String() string {
+	position := fmt.Sprintf("record %d", p.Record)
+	if p.Line > 0 {
+		position = fmt.Sprintf("line %d", p.Line)
+	}
+	if p.File != "" {
+		position = p.File + " " + position
+	}
+	return position
+}
+
+// DuplicateKey lists the records sharing one key value
+type DuplicateKey struct {
+	Key     string
+	Records []RecordPosition // The first records holding the key, in the order they were read
+}
+
+// DuplicateKeyError reports the records of a load or merge that repeat the
+// key of an earlier record, under the RejectDuplicates policy
+type DuplicateKeyError struct {
+	Field string
+	Count int            // Records repeating an earlier key
+	Keys  []DuplicateKey // The first duplicated keys
+}
+
+// Error lists the duplicated keys with the positions of their records
+func (e *DuplicateKeyError) Error() string {
+	parts := make([]string, len(e.Keys))
+	for i, key := range e.Keys {
+		positions := make([]string, len(key.Records))
+		for j, position := range key.Records {
+			positions[j] = position.String()
+		}
+		parts[i] = fmt.Sprintf("%q at %s", key.Key, strings.Join(positions, ", "))
+	}
+	message := fmt.Sprintf("%d records repeat the %s of an earlier record: %s", e.Count, e.Field, strings.Join(parts, "; "))
+	if len(e.Keys) == maxReportedDuplicateKeys {
+		message += "; ..."
+	}
+	return message
+}
+
+// WithDuplicateKeys sets how loads resolve records sharing a key (see SetDuplicateKeys)
+func WithDuplicateKeys(strategy MergeStrategy) Option {
+	return func(dm *DataManager) { dm.keyStrategy = strategy }
+}
+
+// SetDuplicateKeys sets how InMemory loads resolve records sharing the value
+// of the key field. By default the record read last replaces the earlier
+// ones, as LastWriteWins(""); LastWriteWins with a timestamp field keeps the
+// newest, FirstWriteWins the first, and MergeWith combines them with a
+// callback, dropping the key when it returns nil. RejectDuplicateKeys reads
+// the whole input and then fails the load with a *DuplicateKeyError giving
+// the lines of the records of the first duplicated keys, leaving the
+// previously loaded data in place. DuplicateKeyCount reports how many
+// records repeated a key under any policy.
+func (dm *DataManager) SetDuplicateKeys(strategy MergeStrategy) error {
+	if err := strategy.validate(); err != nil {
+		return err
+	}
+	dm.keyStrategy = strategy
+	return nil
+}
+
+// DuplicateKeyCount returns how many records of the most recent load or
+// merge repeated the key of an earlier record
+func (dm *DataManager) DuplicateKeyCount() int {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.duplicates
+}
+
+// setDuplicateKeyCount records the duplicates of a load or merge
+func (dm *DataManager) setDuplicateKeyCount(n int) {
+	dm.mu.Lock()
+	dm.duplicates = n
+	dm.mu.Unlock()
+}
+
+// duplicateKeys counts the records repeating an earlier key and, when
+// rejecting them, remembers where each key was first read
+type duplicateKeys struct {
+	count  int
+	seen   map[string]RecordPosition // First record of each key (nil unless rejecting)
+	listed map[string]int            // Index of the key in keys
+	keys   []DuplicateKey
+}
+
+// newDuplicateKeys returns a tracker that remembers positions when reject is set
+func newDuplicateKeys(reject bool) *duplicateKeys {
+	d := &duplicateKeys{}
+	if reject {
+		d.seen = make(map[string]RecordPosition)
+		d.listed = make(map[string]int)
+	}
+	return d
+}
+
+// first notes the first record holding key
+func (d *duplicateKeys) first(key string, position RecordPosition) {
+	if d.seen != nil {
+		d.seen[key] = position
+	}
+}
+
+// repeat notes a later record holding key
+func (d *duplicateKeys) repeat(key string, position RecordPosition) {
+	d.count++
+	if d.seen == nil {
+		return
+	}
+	i, ok := d.listed[key]
+	if !ok {
+		if len(d.keys) == maxReportedDuplicateKeys {
+			return
+		}
+		i = len(d.keys)
+		d.listed[key] = i
+		d.keys = append(d.keys, DuplicateKey{Key: key, Records: []RecordPosition{d.seen[key]}})
+	}
+	if records := d.keys[i].Records; len(records) < maxReportedPositions {
+		d.keys[i].Records = append(records, position)
+	}
+}
+
+// err returns a *DuplicateKeyError when rejecting and a key repeated
+func (d *duplicateKeys) err(field string) error {
+	if d.seen == nil || d.count == 0 {
+		return nil
+	}
+	return &DuplicateKeyError{Field: field, Count: d.count, Keys: d.keys}
+}
+
+// positionedReader is implemented by readers that know the line of the
+// record they returned last
+type positionedReader interface {
+	position() RecordPosition
+}
+
+// readerPosition locates the number-th record, just returned by reader from file
+func readerPosition(reader recordReader, file string, number int) RecordPosition {
+	position := RecordPosition{File: file}
+	if p, ok := reader.(positionedReader); ok {
+		position = p.position()
+		if position.File == "" {
+			position.File = file
+		}
+	}
+	position.Record = number
+	return position
+}
+
+// position returns the line of the record read last
+func (lr *lineReader) position() RecordPosition {
+	return RecordPosition{Line: lr.line}
+}
+
+// position returns the line of the row read last
+func (cr *csvReader) position() RecordPosition {
+	return RecordPosition{Line: cr.line}
+}
+
+// position returns the position within the wrapped reader
+func (r derivingReader) position() RecordPosition {
+	return readerPosition(r.recordReader, "", 0)
+}
+
+// position returns the file and line of the record read last
+func (mr *multiFileReader) position() RecordPosition {
+	position := RecordPosition{File: mr.path}
+	if mr.current != nil {
+		position.Line = readerPosition(mr.current, "", 0).Line
+	}
+	return position
+}
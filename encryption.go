@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeyProvider returns the AES key (16, 24 or 32 bytes) that files are
+// encrypted with. It is called once, so it can fetch or unwrap the key with a
+// key management service.
+type KeyProvider func() ([]byte, error)
+
+// EncryptionOptions configures encryption at rest
+type EncryptionOptions struct {
+	Key            KeyProvider
+	AllowPlaintext bool // Read snapshots and log entries written before encryption was enabled
+}
+
+// encryptedMagic starts every encrypted file
+var encryptedMagic = []byte("JDMAES1\n")
+
+// encryptedChunk is the plaintext size of each sealed frame of a file
+const encryptedChunk = 64 << 10
+
+// fileCipher seals and opens the files the manager writes
+type fileCipher struct {
+	opts EncryptionOptions
+	aead cipher.AEAD // nil until init
+}
+
+// StaticKey provides a fixed key
+func StaticKey(key []byte) KeyProvider {
+	return func() ([]byte, error) { return key, nil }
+}
+
+// KeyFromEnv reads a base64 or hex encoded key from the environment variable name
+func KeyFromEnv(name string) KeyProvider {
+	return func() ([]byte, error) {
+		raw := strings.TrimSpace(os.Getenv(name))
+		if raw == "" {
+			return nil, fmt.Errorf("Encryption key variable %s is not set", name)
+		}
+		if key, err := hex.DecodeString(raw); err == nil {
+			return key, nil
+		}
+		if key, err := base64.StdEncoding.DecodeString(raw); err == nil {
+			return key, nil
+		}
+		return nil, fmt.Errorf("Encryption key variable %s is neither hex nor base64", name)
+	}
+}
+
+// SetEncryption encrypts the snapshots, write-ahead log entries, spill files,
+// zone maps, Bloom filters and offset indexes the manager writes with
+// AES-GCM, so the records they hold or describe are not readable on disk
+// without the key. Encrypted files are recognized when
+// read; plaintext ones are rejected unless opts.AllowPlaintext is set, which
+// lets data written before encryption was enabled be loaded and then
+// rewritten encrypted by SaveSnapshot or Compact. Set it before EnableWAL.
+// The zero EncryptionOptions turns encryption off.
+func (dm *DataManager) SetEncryption(opts EncryptionOptions) error {
+	if dm.wal != nil {
+		return fmt.Errorf("%w; set encryption before enabling it", ErrWALEnabled)
+	}
+	if opts.Key == nil {
+		dm.encryption = nil
+		return nil
+	}
+	c := &fileCipher{opts: opts}
+	if err := c.init(); err != nil {
+		return err
+	}
+	dm.encryption = c
+	return nil
+}
+
+// WithEncryption encrypts files written by the manager (see SetEncryption)
+func WithEncryption(opts EncryptionOptions) Option {
+	return func(dm *DataManager) { dm.encryption = &fileCipher{opts: opts} }
+}
+
+// init fetches the key and sets up AES-GCM
+func (c *fileCipher) init() error {
+	if c.opts.Key == nil {
+		return errors.New("Encryption requires a key provider")
+	}
+	key, err := c.opts.Key()
+	if err != nil {
+		return fmt.Errorf("Fetching encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("Invalid encryption key: %w", err)
+	}
+	c.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// frameData returns the additional data binding a frame to its position, so
+// frames cannot be reordered and a file cannot be cut short unnoticed
+func frameData(index uint64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// encryptWriter seals what is written to it in frames of encryptedChunk bytes:
+// a 4-byte length, then the nonce and ciphertext
+type encryptWriter struct {
+	c       *fileCipher
+	w       io.Writer
+	buf     []byte
+	index   uint64
+	started bool // The header has been written
+	err     error
+}
+
+// writer returns a writer encrypting into w, or w itself when c is nil. Close
+// must be called to write the final frame.
+func (c *fileCipher) writer(w io.Writer) io.WriteCloser {
+	if c == nil {
+		return nopWriteCloser{w}
+	}
+	return &encryptWriter{c: c, w: w, buf: make([]byte, 0, encryptedChunk)}
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err = e.start(); e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		// Keep a full chunk buffered until more arrives, so Close can mark it final
+		if len(e.buf) == cap(e.buf) && len(p) > 0 {
+			if e.err = e.flush(false); e.err != nil {
+				return written, e.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals the buffered data as the final frame
+func (e *encryptWriter) Close() error {
+	if e.err = e.start(); e.err != nil {
+		return e.err
+	}
+	return e.flush(true)
+}
+
+// start writes the header before the first frame
+func (e *encryptWriter) start() error {
+	if e.err != nil || e.started {
+		return e.err
+	}
+	e.started = true
+	_, err := e.w.Write(encryptedMagic)
+	return err
+}
+
+// flush seals and writes the buffered data as one frame
+func (e *encryptWriter) flush(final bool) error {
+	sealed, err := e.c.seal(e.buf, frameData(e.index, final))
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := e.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	e.index++
+	return nil
+}
+
+// seal encrypts plaintext under a random nonce, returning nonce and ciphertext
+func (c *fileCipher) seal(plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts the output of seal
+func (c *fileCipher) open(sealed, ad []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(sealed) < size+c.aead.Overhead() {
+		return nil, fmt.Errorf("%w: frame too short", ErrDecryption)
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:size], sealed[size:], ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong key or corrupt data", ErrDecryption)
+	}
+	return plaintext, nil
+}
+
+// decryptReader opens the frames written by encryptWriter
+type decryptReader struct {
+	c     *fileCipher
+	r     *bufio.Reader
+	buf   []byte
+	index uint64
+	done  bool
+	err   error // Sticky, so later reads do not resume mid-file
+}
+
+// reader returns a reader of the plaintext of r. Encrypted data is
+// recognized by its header; plaintext passes through when c is nil or allows
+// it. The name of the file is used in errors.
+func (c *fileCipher) reader(r *bufio.Reader, name string) (io.Reader, error) {
+	magic, _ := r.Peek(len(encryptedMagic))
+	if !bytes.Equal(magic, encryptedMagic) {
+		if c != nil && !c.opts.AllowPlaintext {
+			return nil, fmt.Errorf("%w: %s is not encrypted", ErrDecryption, name)
+		}
+		return r, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%w: %s is encrypted and no key is set", ErrDecryption, name)
+	}
+	r.Discard(len(encryptedMagic))
+	return &decryptReader{c: c, r: r}, nil
+}
+
+// readFile returns the plaintext of the file at path, decrypting it as
+// reader does
+func (c *fileCipher) readFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := c.reader(bufio.NewReader(f), path)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the following frame
+func (d *decryptReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: encrypted file is truncated", ErrDecryption)
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > encryptedChunk+1024 {
+		return fmt.Errorf("%w: invalid frame size %d", ErrDecryption, n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("%w: encrypted file is truncated", ErrDecryption)
+	}
+	plaintext, err := d.c.open(sealed, frameData(d.index, false))
+	if err != nil {
+		// Only the last frame is sealed as final
+		if plaintext, err = d.c.open(sealed, frameData(d.index, true)); err != nil {
+			return err
+		}
+		d.done = true
+		if _, err := d.r.Peek(1); err != io.EOF {
+			return fmt.Errorf("%w: data after the final frame", ErrDecryption)
+		}
+	}
+	d.buf = plaintext
+	d.index++
+	return nil
+}
+
+// walData is the additional data of encrypted log entries
+var walData = []byte("wal")
+
+// sealLine encrypts one log entry into a base64 line, keeping the log line
+// oriented so a torn final write is still detected
+func (c *fileCipher) sealLine(line []byte) ([]byte, error) {
+	if c == nil {
+		return line, nil
+	}
+	sealed, err := c.seal(line, walData)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+// openLine decrypts a log line written by sealLine. JSON lines are
+// plaintext entries, accepted when c is nil or allows them.
+func (c *fileCipher) openLine(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if bytes.HasPrefix(line, []byte("{")) {
+		if c != nil && !c.opts.AllowPlaintext {
+			return nil, fmt.Errorf("%w: plaintext log entry", ErrDecryption)
+		}
+		return line, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%w: encrypted log entry and no key is set", ErrDecryption)
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed log entry", ErrDecryption)
+	}
+	return c.open(sealed[:n], walData)
+}
+
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by DataManager operations. Errors carrying more context
+// wrap them, so check for them with errors.Is.
+var (
+	ErrInvalidMode         = errors.New("Invalid mode for this operation")
+	ErrMemoryLimitExceeded = errors.New("Memory usage exceeds the maximum allowed limit")
+	ErrNoKeyField          = errors.New("No key field configured")
+	ErrRecordExists        = errors.New("Record already exists")
+	ErrRecordNotFound      = errors.New("Record not found")
+	ErrTxDone              = errors.New("Transaction already committed or rolled back")
+	ErrUnknownIndexType    = errors.New("Unknown index type")
+	ErrNoInput             = errors.New("No input files")
+	ErrWALNotEnabled       = errors.New("Write-ahead log is not enabled")
+	ErrWALEnabled          = errors.New("Write-ahead log is already enabled")
+	ErrClosed              = errors.New("Mapped file is closed")
+	ErrInvalidExpr         = errors.New("Invalid expression")
+	ErrCheckpointMismatch  = errors.New("Checkpoint does not match its input")
+	ErrTooManyScans        = errors.New("Too many concurrent scans")
+	ErrDecryption          = errors.New("Cannot decrypt file")
+	ErrUnauthenticated     = errors.New("Authentication required")
+	ErrForbidden           = errors.New("Permission denied")
+	ErrCollectionNotFound  = errors.New("Collection not found")
+	ErrCollectionExists    = errors.New("Collection already exists")
+	ErrInvalidPageToken    = errors.New("Invalid page token")
+	ErrStaleIndex          = errors.New("Index is out of date")
+)
+
+// MemoryLimitError reports a load, scan or write that pushed tracked memory
+// usage past the manager's limit, a scan that outgrew its budget (see
+// SetConcurrency), or a query whose results outgrew its result limit (see
+// SetResultLimit). It matches ErrMemoryLimitExceeded.
+type MemoryLimitError struct {
+	Usage int64 // Tracked usage in bytes when the limit was hit
+	Limit int64 // The manager's maxRAMUsage, the scan's budget, or the result limit
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("%v (%d of %d bytes)", ErrMemoryLimitExceeded, e.Usage, e.Limit)
+}
+
+func (e *MemoryLimitError) Is(target error) bool {
+	return target == ErrMemoryLimitExceeded
+}
+
+// memoryLimitError returns the error for tracked usage exceeding the limit
+func (dm *DataManager) memoryLimitError(usage int64) error {
+	return &MemoryLimitError{Usage: usage, Limit: dm.maxRAMUsage}
+}
+
+// RecordError reports a write rejected because of its record's key. Err is
+// ErrRecordExists or ErrRecordNotFound.
+type RecordError struct {
+	Key string
+	Err error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Key)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
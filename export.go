@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ExportFormat selects the output format of Export
+type ExportFormat int
+
+const (
+	ExportCSV         ExportFormat = iota // Comma-separated values with a header row
+	ExportNDJSON                          // One JSON object per line
+	ExportJSON                            // Indented JSON array
+	ExportXLSX                            // Excel workbook with a single worksheet
+	ExportMsgPack                         // Concatenated MessagePack maps
+	ExportBSON                            // Concatenated BSON documents, as written by mongodump
+	ExportArrow                           // Arrow IPC file, also known as Feather version 2
+	ExportArrowStream                     // Arrow IPC stream
+)
+
+// ExportOptions tunes the output of Export
+type ExportOptions struct {
+	Columns   []string // Column order (CSV/XLSX) or fields kept (JSON formats); empty means every field, sorted
+	NoHeader  bool     // Omit the header row in CSV/XLSX
+	Delimiter rune     // CSV field separator (default ',')
+	Indent    string   // Indentation for ExportJSON (default two spaces)
+	SheetName string   // XLSX worksheet name (default "Sheet1")
+	BatchSize int      // Rows per Arrow record batch (default 65536)
+}
+
+// ParseExportFormat maps a name such as "csv" or "xlsx" to an ExportFormat
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch name {
+	case "csv":
+		return ExportCSV, nil
+	case "ndjson", "jsonl":
+		return ExportNDJSON, nil
+	case "json":
+		return ExportJSON, nil
+	case "xlsx", "excel":
+		return ExportXLSX, nil
+	case "msgpack":
+		return ExportMsgPack, nil
+	case "bson":
+		return ExportBSON, nil
+	case "arrow", "feather":
+		return ExportArrow, nil
+	case "arrows", "arrow-stream":
+		return ExportArrowStream, nil
+	default:
+		return 0, fmt.Errorf("Unknown export format: %s", name)
+	}
+}
+
+// Export writes results to w in the given format
+func Export(results []map[string]interface{}, w io.Writer, format ExportFormat, opts ExportOptions) error {
+	switch format {
+	case ExportCSV:
+		return exportCSV(results, w, opts)
+	case ExportNDJSON:
+		bw := bufio.NewWriter(w)
+		encoder := json.NewEncoder(bw)
+		for _, record := range results {
+			if err := encoder.Encode(project(record, opts.Columns)); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	case ExportJSON:
+		projected := make([]map[string]interface{}, len(results))
+		for i, record := range results {
+			projected[i] = project(record, opts.Columns)
+		}
+		indent := opts.Indent
+		if indent == "" {
+			indent = "  "
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", indent)
+		return encoder.Encode(projected)
+	case ExportXLSX:
+		return exportXLSX(results, w, opts)
+	case ExportMsgPack, ExportBSON:
+		codec := "msgpack"
+		if format == ExportBSON {
+			codec = "bson"
+		}
+		projected := make([]map[string]interface{}, len(results))
+		for i, record := range results {
+			projected[i] = project(record, opts.Columns)
+		}
+		return WriteRecords(w, codec, projected)
+	case ExportArrow:
+		return ToArrow(results, opts).WriteIPCFile(w)
+	case ExportArrowStream:
+		return ToArrow(results, opts).WriteIPCStream(w)
+	default:
+		return fmt.Errorf("Unknown export format: %d", format)
+	}
+}
+
+// exportCSV writes results as delimited text
+func exportCSV(results []map[string]interface{}, w io.Writer, opts ExportOptions) error {
+	columns := columnsFor(results, opts.Columns)
+	cw := csv.NewWriter(w)
+	if opts.Delimiter != 0 {
+		cw.Comma = opts.Delimiter
+	}
+	if !opts.NoHeader {
+		cw.Write(columns)
+	}
+	for _, record := range results {
+		if err := cw.Write(recordRow(record, columns)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// xlsxParts holds the static parts of a single-sheet workbook
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+// exportXLSX writes results as an Excel workbook using inline strings
+func exportXLSX(results []map[string]interface{}, w io.Writer, opts ExportOptions) error {
+	columns := columnsFor(results, opts.Columns)
+	sheetName := opts.SheetName
+	if sheetName == "" {
+		sheetName = "Sheet1"
+	}
+
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return err
+		}
+	}
+
+	f, err := zw.Create("xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`)
+	xml.EscapeText(f, []byte(sheetName))
+	fmt.Fprint(f, `" sheetId="1" r:id="rId1"/></sheets></workbook>`)
+
+	f, err = zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	bw.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	row := 1
+	if !opts.NoHeader {
+		header := make([]interface{}, len(columns))
+		for i, column := range columns {
+			header[i] = column
+		}
+		writeXLSXRow(bw, row, header)
+		row++
+	}
+	for _, record := range results {
+		values := make([]interface{}, len(columns))
+		for i, column := range columns {
+			values[i] = record[column]
+		}
+		writeXLSXRow(bw, row, values)
+		row++
+	}
+	bw.WriteString(`</sheetData></worksheet>`)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeXLSXRow writes one worksheet row; numbers and booleans keep their type
+func writeXLSXRow(bw *bufio.Writer, row int, values []interface{}) {
+	fmt.Fprintf(bw, `<row r="%d">`, row)
+	for i, value := range values {
+		ref := xlsxColumnName(i) + strconv.Itoa(row)
+		switch v := value.(type) {
+		case nil:
+			continue
+		case float64:
+			fmt.Fprintf(bw, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			fmt.Fprintf(bw, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+		default:
+			fmt.Fprintf(bw, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(bw, []byte(formatValue(v)))
+			bw.WriteString(`</t></is></c>`)
+		}
+	}
+	bw.WriteString(`</row>`)
+}
+
+// xlsxColumnName converts a zero-based column index to letters (0 -> A, 26 -> AA)
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expr is a compiled expression over the fields of a record, such as
+// `first + " " + last` or `floor(age / 10) * 10`. It supports numbers,
+// strings, true, false and null; field references (dotted paths reach into
+// nested objects, and `backquotes` allow any field name); the operators
+// + - * / % (+ also joins strings), == != < <= > >=, && || and !; and the
+// functions listed in exprFuncs. A field missing from the record is null,
+// and arithmetic involving null yields null. date("2024-01-01") yields a
+// time, and comparing a time with a string field parses the field as a date.
+type Expr struct {
+	source string
+	root   exprNode
+	fields []string // Top-level record fields the expression reads
+}
+
+// CompileExpr parses an expression once so it can be evaluated against many records
+func CompileExpr(source string) (*Expr, error) {
+	p := &exprParser{lexer: exprLexer{src: source}}
+	root, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidExpr, source, err)
+	}
+
+	e := &Expr{source: source, root: root}
+	seen := make(map[string]bool)
+	walkExpr(root, func(n exprNode) {
+		if f, ok := n.(*fieldNode); ok && !seen[f.path[0]] {
+			seen[f.path[0]] = true
+			e.fields = append(e.fields, f.path[0])
+		}
+	})
+	return e, nil
+}
+
+// Eval evaluates the expression against record
+func (e *Expr) Eval(record map[string]interface{}) (interface{}, error) {
+	return e.root.eval(record)
+}
+
+// Fields returns the top-level record fields the expression reads
+func (e *Expr) Fields() []string {
+	return e.fields
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp // Operators and punctuation
+)
+
+type token struct {
+	kind tokenKind
+	text string // Operator, identifier or unquoted string
+	num  float64
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// exprLexer splits an expression into tokens
+type exprLexer struct {
+	src string
+	pos int
+}
+
+// operators lists the multi-character operators before their prefixes
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ","}
+
+func (l *exprLexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		var b strings.Builder
+		for l.pos++; l.pos < len(l.src); l.pos++ {
+			ch := l.src[l.pos]
+			if ch == c {
+				l.pos++
+				return token{kind: tokString, text: b.String(), pos: start}, nil
+			}
+			if ch == '\\' && l.pos+1 < len(l.src) {
+				l.pos++
+				switch esc := l.src[l.pos]; esc {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(esc)
+				}
+				continue
+			}
+			b.WriteByte(ch)
+		}
+		return token{}, fmt.Errorf("unterminated string at offset %d", start)
+	case c == '`':
+		end := strings.IndexByte(l.src[l.pos+1:], '`')
+		if end < 0 {
+			return token{}, fmt.Errorf("unterminated field name at offset %d", start)
+		}
+		l.pos += end + 2
+		return token{kind: tokIdent, text: l.src[start+1 : l.pos-1], pos: start}, nil
+	case c >= '0' && c <= '9' || c == '.' && l.pos+1 < len(l.src) && l.src[l.pos+1] >= '0' && l.src[l.pos+1] <= '9':
+		for l.pos < len(l.src) && (l.src[l.pos] >= '0' && l.src[l.pos] <= '9' || l.src[l.pos] == '.' || l.src[l.pos] == 'e' || l.src[l.pos] == 'E' ||
+			(l.src[l.pos] == '-' || l.src[l.pos] == '+') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E')) {
+			l.pos++
+		}
+		num, err := strconv.ParseFloat(l.src[start:l.pos], 64)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid number %q at offset %d", l.src[start:l.pos], start)
+		}
+		return token{kind: tokNumber, num: num, text: l.src[start:l.pos], pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || l.src[l.pos] == '.' || unicode.IsLetter(rune(l.src[l.pos])) || unicode.IsDigit(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+	for _, op := range exprOperators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+// Parser
+
+// exprParser is a recursive-descent parser with one token of lookahead
+type exprParser struct {
+	lexer exprLexer
+	tok   token
+}
+
+// parse parses the whole expression
+func (p *exprParser) parse() (exprNode, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return root, nil
+}
+
+func (p *exprParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), p.tok.pos)
+}
+
+// isOp reports whether the current token is one of ops
+func (p *exprParser) isOp(ops ...string) bool {
+	return p.tok.kind == tokOp && containsString(ops, p.tok.text)
+}
+
+// parseBinary parses operands joined by any of ops, left to right
+func (p *exprParser) parseBinary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(ops...) {
+		op := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		op := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("-", "!") {
+		op := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		return &literalNode{value: tok.num}, p.advance()
+	case tokString:
+		return &literalNode{value: tok.text}, p.advance()
+	case tokIdent:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null", "nil":
+			return &literalNode{value: nil}, nil
+		}
+		if p.isOp("(") {
+			return p.parseCall(tok)
+		}
+		return &fieldNode{path: strings.Split(tok.text, ".")}, nil
+	case tokOp:
+		if tok.text == "(" {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				return nil, p.errorf("expected \")\", found %s", p.tok)
+			}
+			return inner, p.advance()
+		}
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// parseCall parses the arguments of a function call after its name
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+	fn, ok := exprFuncs[strings.ToLower(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	call := &callNode{name: strings.ToLower(name.text), fn: fn}
+	for !p.isOp(")") {
+		if len(call.args) > 0 {
+			if !p.isOp(",") {
+				return nil, p.errorf("expected \",\" or \")\", found %s", p.tok)
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	if len(call.args) < fn.minArgs || fn.maxArgs >= 0 && len(call.args) > fn.maxArgs {
+		return nil, fmt.Errorf("%s takes %s", call.name, fn.arity())
+	}
+	return call, p.advance()
+}
+
+// Syntax tree
+
+type exprNode interface {
+	eval(record map[string]interface{}) (interface{}, error)
+}
+
+// walkExpr calls fn for n and every node below it
+func walkExpr(n exprNode, fn func(exprNode)) {
+	fn(n)
+	switch n := n.(type) {
+	case *unaryNode:
+		walkExpr(n.operand, fn)
+	case *binaryNode:
+		walkExpr(n.left, fn)
+		walkExpr(n.right, fn)
+	case *callNode:
+		for _, arg := range n.args {
+			walkExpr(arg, fn)
+		}
+	}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type fieldNode struct {
+	path []string
+}
+
+func (n *fieldNode) eval(record map[string]interface{}) (interface{}, error) {
+	var value interface{} = record
+	for _, field := range n.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		value = object[field]
+	}
+	return value, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(record map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(record)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !truthy(v), nil
+	}
+	f, ok := numericValue(v)
+	if !ok {
+		return nil, fmt.Errorf("Cannot negate %T", v)
+	}
+	return -f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(record map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(record)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short-circuit
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(record)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(record)
+		return truthy(right), err
+	}
+
+	right, err := n.right.eval(record)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		cmp, ok := exprCompare(left, right)
+		if !ok {
+			return false, nil
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	if n.op == "+" {
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok || rok {
+			if !lok {
+				ls = exprString(left)
+			}
+			if !rok {
+				rs = exprString(right)
+			}
+			return ls + rs, nil
+		}
+	}
+	a, aok := numericValue(left)
+	b, bok := numericValue(right)
+	if !aok || !bok {
+		return nil, fmt.Errorf("Cannot apply %s to %T and %T", n.op, left, right)
+	}
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, nil
+		}
+		return a / b, nil
+	default:
+		if b == 0 {
+			return nil, nil
+		}
+		return math.Mod(a, b), nil
+	}
+}
+
+type callNode struct {
+	name string
+	fn   exprFunc
+	args []exprNode
+}
+
+func (n *callNode) eval(record map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(record)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return v, nil
+}
+
+// Values
+
+// truthy reports whether v counts as true in && || ! and if()
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	default:
+		if f, ok := numericValue(v); ok {
+			return f != 0
+		}
+		return true
+	}
+}
+
+// exprEqual compares two values, treating all numeric types alike
+func exprEqual(a, b interface{}) bool {
+	if cmp, ok := exprCompare(a, b); ok {
+		return cmp == 0
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ab, aok := a.(bool)
+	bb, bok := b.(bool)
+	return aok && bok && ab == bb
+}
+
+// exprCompare orders two numbers, two strings or two times; a string
+// compared with a time is parsed as a date (see exprTime)
+func exprCompare(a, b interface{}) (int, bool) {
+	_, at := a.(time.Time)
+	_, bt := b.(time.Time)
+	if at || bt {
+		x, ok := exprTime(a)
+		if !ok {
+			return 0, false
+		}
+		y, ok := exprTime(b)
+		if !ok {
+			return 0, false
+		}
+		return x.Compare(y), true
+	}
+	if x, ok := numericValue(a); ok {
+		if y, ok := numericValue(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+// exprString formats a value for string concatenation and string()
+func exprString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// exprTimeLayouts are the layouts date() and time comparisons accept
+var exprTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+// exprTime converts a time, a date string or a Unix timestamp in seconds to a time
+func exprTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range exprTimeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}
+	if f, ok := numericValue(v); ok {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// Functions
+
+// exprFunc is a function callable from expressions
+type exprFunc struct {
+	minArgs, maxArgs int // maxArgs < 0 means variadic
+	call             func(args []interface{}) (interface{}, error)
+}
+
+func (f exprFunc) arity() string {
+	switch {
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("%d argument(s)", f.minArgs)
+	case f.maxArgs < 0:
+		return fmt.Sprintf("at least %d argument(s)", f.minArgs)
+	default:
+		return fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
+	}
+}
+
+// mathFunc wraps a one-argument numeric function; null stays null
+func mathFunc(fn func(float64) float64) exprFunc {
+	return exprFunc{1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		f, ok := numericValue(args[0])
+		if !ok {
+			return nil, fmt.Errorf("needs a number, got %T", args[0])
+		}
+		return fn(f), nil
+	}}
+}
+
+// stringFunc wraps a one-argument string function; null stays null
+func stringFunc(fn func(string) string) exprFunc {
+	return exprFunc{1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return fn(exprString(args[0])), nil
+	}}
+}
+
+// exprFuncs are the functions available to expressions
+var exprFuncs = map[string]exprFunc{
+	"abs":   mathFunc(math.Abs),
+	"ceil":  mathFunc(math.Ceil),
+	"floor": mathFunc(math.Floor),
+	"round": mathFunc(math.Round),
+	"sqrt":  mathFunc(math.Sqrt),
+	"lower": stringFunc(strings.ToLower),
+	"upper": stringFunc(strings.ToUpper),
+	"trim":  stringFunc(strings.TrimSpace),
+	"min": {1, -1, func(args []interface{}) (interface{}, error) {
+		return extremum(args, -1)
+	}},
+	"max": {1, -1, func(args []interface{}) (interface{}, error) {
+		return extremum(args, 1)
+	}},
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("needs a string, list or object, got %T", args[0])
+	}},
+	"concat": {1, -1, func(args []interface{}) (interface{}, error) {
+		var b strings.Builder
+		for _, arg := range args {
+			b.WriteString(exprString(arg))
+		}
+		return b.String(), nil
+	}},
+	"substr": {2, 3, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		runes := []rune(exprString(args[0]))
+		start, ok := numericValue(args[1])
+		if !ok {
+			return nil, fmt.Errorf("needs a numeric start, got %T", args[1])
+		}
+		from := clampIndex(int(start), len(runes))
+		to := len(runes)
+		if len(args) == 3 {
+			n, ok := numericValue(args[2])
+			if !ok {
+				return nil, fmt.Errorf("needs a numeric length, got %T", args[2])
+			}
+			to = clampIndex(from+int(n), len(runes))
+		}
+		return string(runes[from:to]), nil
+	}},
+	"contains": {2, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil || args[1] == nil {
+			return false, nil
+		}
+		if list, ok := args[0].([]interface{}); ok {
+			for _, item := range list {
+				if exprEqual(item, args[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return strings.Contains(exprString(args[0]), exprString(args[1])), nil
+	}},
+	"startswith": {2, 2, func(args []interface{}) (interface{}, error) {
+		return args[0] != nil && strings.HasPrefix(exprString(args[0]), exprString(args[1])), nil
+	}},
+	"endswith": {2, 2, func(args []interface{}) (interface{}, error) {
+		return args[0] != nil && strings.HasSuffix(exprString(args[0]), exprString(args[1])), nil
+	}},
+	"date": {1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		t, ok := exprTime(args[0])
+		if !ok {
+			return nil, fmt.Errorf("cannot parse %v as a date", args[0])
+		}
+		return t, nil
+	}},
+	"now": {0, 0, func(args []interface{}) (interface{}, error) {
+		return time.Now(), nil
+	}},
+	"distance_km": {4, 4, func(args []interface{}) (interface{}, error) {
+		var c [4]float64
+		for i, arg := range args {
+			f, ok := numericValue(arg)
+			if !ok {
+				return nil, nil
+			}
+			c[i] = f
+		}
+		return HaversineKm(c[0], c[1], c[2], c[3]), nil
+	}},
+	"coalesce": {1, -1, func(args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+	"if": {3, 3, func(args []interface{}) (interface{}, error) {
+		if truthy(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	}},
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return exprString(args[0]), nil
+	}},
+	"number": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, nil
+			}
+			return f, nil
+		case bool:
+			if v {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		}
+		if f, ok := numericValue(args[0]); ok {
+			return f, nil
+		}
+		return nil, nil
+	}},
+}
+
+// extremum returns the smallest (sign -1) or largest (sign 1) non-null argument
+func extremum(args []interface{}, sign int) (interface{}, error) {
+	var best interface{}
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+		if best == nil {
+			best = arg
+			continue
+		}
+		cmp, ok := exprCompare(arg, best)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %T and %T", arg, best)
+		}
+		if cmp*sign > 0 {
+			best = arg
+		}
+	}
+	return best, nil
+}
+
+// clampIndex limits i to [0, n]
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > n {
+		return n
+	}
+	return i
+}
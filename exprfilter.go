@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ExprValueType is the ValueType of a condition holding a whole expression
+// (see ExprCondition)
+const ExprValueType = "expr"
+
+// compiledExprs caches compiled filter expressions by source, so a condition
+// is parsed once however many records it is evaluated against
+var compiledExprs sync.Map
+
+// compileCached returns the compiled form of expression, compiling it on first use
+func compileCached(expression string) (*Expr, error) {
+	if e, ok := compiledExprs.Load(expression); ok {
+		return e.(*Expr), nil
+	}
+	e, err := CompileExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+	compiledExprs.Store(expression, e)
+	return e, nil
+}
+
+// ExprCondition returns a condition matching the records for which
+// expression (see Expr) is true, such as
+//
+//	age > 30 && (city == "Hanoi" || vip == true) && created_at >= date("2024-01-01")
+//
+// It combines with other conditions and works wherever they do: queries,
+// Split-mode scans, counts, subscriptions and watches. Its JSON form is
+// {"type": "expr", "value": "<expression>"}.
+func ExprCondition(expression string) (FilterCondition, error) {
+	if _, err := compileCached(expression); err != nil {
+		return FilterCondition{}, err
+	}
+	return FilterCondition{ValueType: ExprValueType, Operator: ExprValueType, Value: expression}, nil
+}
+
+// QueryExpr returns the records matching expression: the loaded data in
+// InMemory mode, or a scan of the latest scanned or loaded input in Split mode
+func (dm *DataManager) QueryExpr(expression string) ([]map[string]interface{}, error) {
+	condition, err := ExprCondition(expression)
+	if err != nil {
+		return nil, err
+	}
+	conditions := []FilterCondition{condition}
+	switch dm.mode {
+	case InMemoryMode:
+		return dm.Query(conditions)
+	case SplitMode:
+		path := dm.loadedPath()
+		if path == "" {
+			return nil, fmt.Errorf("%w: nothing has been scanned or loaded", ErrNoInput)
+		}
+		return dm.LoadDataInSplitMode(path, conditions)
+	}
+	return nil, ErrInvalidMode
+}
+
+// matchExpr evaluates an expression condition against record; an invalid
+// expression or one that fails on the record does not match
+func matchExpr(record map[string]interface{}, condition FilterCondition) bool {
+	expression, ok := condition.Value.(string)
+	if !ok {
+		return false
+	}
+	e, err := compileCached(expression)
+	if err != nil {
+		return false
+	}
+	v, err := e.Eval(record)
+	return err == nil && truthy(v)
+}
+
+// conditionFields returns the top-level record fields a condition reads
+func conditionFields(condition FilterCondition) []string {
+	if condition.ValueType == ExprValueType {
+		if expression, ok := condition.Value.(string); ok {
+			if e, err := compileCached(expression); err == nil {
+				return e.Fields()
+			}
+		}
+		return nil
+	}
+	if condition.ValueType == GeoValueType {
+		var fields []string
+		for _, field := range strings.Split(condition.Key, ",") {
+			fields = append(fields, pathHead(strings.TrimSpace(field)))
+		}
+		return fields
+	}
+	if head := pathHead(condition.Key); head != condition.Key {
+		return []string{condition.Key, head}
+	}
+	return []string{condition.Key}
+}
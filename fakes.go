@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FakeKind selects the kind of fake value replacing a field
+type FakeKind string
+
+const (
+	FakeText      FakeKind = "text"       // Letters replaced by letters and digits by digits, keeping the shape
+	FakeName      FakeKind = "name"       // "Jane Smith"
+	FakeFirstName FakeKind = "first_name" // "Jane"
+	FakeLastName  FakeKind = "last_name"  // "Smith"
+	FakeEmail     FakeKind = "email"      // "jane.smith42@example.com"
+	FakeUsername  FakeKind = "username"   // "jsmith42"
+	FakePhone     FakeKind = "phone"      // "+1 555 014 2371"
+	FakeAddress   FakeKind = "address"    // "12 Oak Street"
+	FakeCity      FakeKind = "city"       // "Springfield"
+	FakeZip       FakeKind = "zip"        // "40213"
+	FakeCompany   FakeKind = "company"    // "Northwind Labs"
+	FakeIP        FakeKind = "ip"         // An address of the 198.51.100.0/24 documentation range
+	FakeUUID      FakeKind = "uuid"       // A version 4 UUID
+)
+
+// Values fake names and places are drawn from
+var (
+	fakeFirstNames = []string{"James", "Mary", "John", "Linh", "Robert", "Patricia", "Michael", "Jennifer", "David", "Elizabeth", "Minh", "Susan", "Thomas", "Sarah", "Daniel", "Karen", "Paul", "Nancy", "Mark", "Lisa", "Anh", "Emma", "Lukas", "Sofia", "Hiro", "Yuki", "Pierre", "Camille", "Jan", "Anna"}
+	fakeLastNames  = []string{"Smith", "Johnson", "Nguyen", "Williams", "Brown", "Tran", "Garcia", "Miller", "Davis", "Wilson", "Le", "Anderson", "Taylor", "Thomas", "Moore", "Martin", "Jackson", "Pham", "White", "Harris", "Clark", "Lewis", "Walker", "Young", "Müller", "Schmidt", "Dubois", "Rossi", "Kowalski", "Tanaka"}
+	fakeStreets    = []string{"Oak", "Maple", "Cedar", "Pine", "Elm", "Lake", "Hill", "Park", "River", "Main", "Church", "Mill"}
+	fakeStreetKind = []string{"Street", "Avenue", "Road", "Lane", "Drive", "Way"}
+	fakeCities     = []string{"Springfield", "Riverton", "Fairview", "Lakewood", "Greenville", "Franklin", "Clinton", "Madison", "Georgetown", "Salem", "Ashford", "Brookside"}
+	fakeCompanies  = []string{"Northwind", "Contoso", "Globex", "Initech", "Umbrella", "Acme", "Vandelay", "Stark", "Wayne", "Tyrell", "Cyberdyne", "Soylent"}
+	fakeSuffixes   = []string{"Labs", "Inc.", "Group", "Systems", "Partners", "Industries", "Holdings", "Logistics"}
+	fakeDomains    = []string{"example.com", "example.org", "example.net"}
+)
+
+// GuessFakeKind returns the fake kind suggested by a field name, such as
+// FakeEmail for "contact.email", or FakeText when the name suggests none
+func GuessFakeKind(field string) FakeKind {
+	name := strings.ToLower(field[strings.LastIndex(field, ".")+1:])
+	has := func(parts ...string) bool {
+		for _, part := range parts {
+			if strings.Contains(name, part) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("mail"):
+		return FakeEmail
+	case has("first", "given", "forename"):
+		return FakeFirstName
+	case has("last", "surname", "family"):
+		return FakeLastName
+	case has("user", "login", "handle"):
+		return FakeUsername
+	case has("phone", "mobile", "tel", "fax"):
+		return FakePhone
+	case has("company", "employer", "organization", "organisation"):
+		return FakeCompany
+	case has("name"):
+		return FakeName
+	case has("street", "address"):
+		return FakeAddress
+	case has("city", "town"):
+		return FakeCity
+	case has("zip", "postal", "postcode"):
+		return FakeZip
+	case name == "ip" || has("_ip", "ip_", "ipaddr"):
+		return FakeIP
+	case has("uuid", "guid"):
+		return FakeUUID
+	}
+	return FakeText
+}
+
+// validate checks that kind is known
+func (kind FakeKind) validate() error {
+	switch kind {
+	case "", FakeText, FakeName, FakeFirstName, FakeLastName, FakeEmail, FakeUsername, FakePhone,
+		FakeAddress, FakeCity, FakeZip, FakeCompany, FakeIP, FakeUUID:
+		return nil
+	}
+	return fmt.Errorf("Unknown fake kind %q", kind)
+}
+
+// fakeValue returns a fake of the given kind drawn from rng. original,
+// when set, gives FakeText the shape to keep.
+func fakeValue(rng *rand.Rand, kind FakeKind, original string) string {
+	pick := func(values []string) string { return values[rng.Intn(len(values))] }
+	switch kind {
+	case FakeName:
+		return pick(fakeFirstNames) + " " + pick(fakeLastNames)
+	case FakeFirstName:
+		return pick(fakeFirstNames)
+	case FakeLastName:
+		return pick(fakeLastNames)
+	case FakeEmail:
+		first, last := pick(fakeFirstNames), pick(fakeLastNames)
+		return asciiLower(first) + "." + asciiLower(last) + strconv.Itoa(rng.Intn(100)) + "@" + pick(fakeDomains)
+	case FakeUsername:
+		return asciiLower(pick(fakeFirstNames)[:1]+pick(fakeLastNames)) + strconv.Itoa(rng.Intn(1000))
+	case FakePhone:
+		// 555-01xx numbers are reserved for fiction
+		return fmt.Sprintf("+1 555 01%d %04d", rng.Intn(10), rng.Intn(10000))
+	case FakeAddress:
+		return fmt.Sprintf("%d %s %s", 1+rng.Intn(999), pick(fakeStreets), pick(fakeStreetKind))
+	case FakeCity:
+		return pick(fakeCities)
+	case FakeZip:
+		return fmt.Sprintf("%05d", rng.Intn(100000))
+	case FakeCompany:
+		return pick(fakeCompanies) + " " + pick(fakeSuffixes)
+	case FakeIP:
+		return fmt.Sprintf("198.51.100.%d", 1+rng.Intn(254))
+	case FakeUUID:
+		var b [16]byte
+		rng.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	runes := []rune(original)
+	for i, r := range runes {
+		switch {
+		case unicode.IsDigit(r):
+			runes[i] = rune('0' + rng.Intn(10))
+		case unicode.IsUpper(r):
+			runes[i] = rune('A' + rng.Intn(26))
+		case unicode.IsLetter(r):
+			runes[i] = rune('a' + rng.Intn(26))
+		}
+	}
+	return string(runes)
+}
+
+// asciiLower lowercases s and drops what is not an ASCII letter, for use
+// in emails and user names
+func asciiLower(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// fake returns the consistent fake of value: the same value, kind and salt
+// always yield the same fake, so anonymized records still join and group
+// alike. Numbers are replaced by numbers with as many digits before and
+// after the point, and other non-string values by a fake of their JSON text.
+func (p *RedactionPolicy) fake(value interface{}, kind FakeKind) interface{} {
+	text := redactionText(value)
+	mac := hmac.New(sha256.New, []byte(p.Salt))
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(text))
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(mac.Sum(nil)))))
+	if n, ok := numericValue(value); ok {
+		digits := fakeValue(rng, FakeText, strconv.FormatFloat(math.Abs(n), 'f', -1, 64))
+		if len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+			digits = strconv.Itoa(1+rng.Intn(9)) + digits[1:]
+		}
+		f, _ := strconv.ParseFloat(digits, 64)
+		if n < 0 {
+			f = -f
+		}
+		if n == math.Trunc(n) {
+			return int64(f)
+		}
+		return f
+	}
+	return fakeValue(rng, kind, text)
+}
+
+// Anonymize copies the records of inputPath to outputPath as NDJSON with
+// policy applied, as Redact does, and returns how many were written. With
+// RedactFake rules it turns a production extract into a fixture of the same
+// shape whose personal data is replaced by consistent fakes.
+func (dm *DataManager) Anonymize(inputPath, outputPath string, policy *RedactionPolicy) (_ int, err error) {
+	if policy == nil {
+		return 0, fmt.Errorf("Anonymize needs a redaction policy")
+	}
+	if err := policy.validate(); err != nil {
+		return 0, err
+	}
+	rules := dm.redactionRules(policy)
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	reader, closer, err := dm.openRecords(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+
+	bw := bufio.NewWriter(out)
+	encoder := json.NewEncoder(bw)
+	written := 0
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			return written, bw.Flush()
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := encoder.Encode(policy.apply(record, rules)); err != nil {
+			return written, err
+		}
+		written++
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// SetFastScan enables the fast path for NDJSON scans in Split mode: lines
+// are read into pooled buffers and only the fields referenced by the
+// conditions (and the projection, see SetProjection) are parsed, so lines
+// that do not match are never fully decoded. It is bypassed while a
+// validator is set, since validation needs whole records. Malformed values
+// in fields that are not parsed go unnoticed on lines that do not match.
+//
+// Fast scan also pre-filters raw lines: a line lacking the bytes that a
+// string "=="/"contains" or bool condition needs is skipped before any
+// parsing. Values written with \u escapes in the file are not recognized by
+// this pre-check.
+func (dm *DataManager) SetFastScan(enabled bool) {
+	dm.fastScan = enabled
+}
+
+// SetProjection limits the fields of Split-mode results to fields (nil
+// returns whole records). With fast scan and no deduplication, only these
+// fields are decoded from matching lines.
+func (dm *DataManager) SetProjection(fields []string) {
+	dm.projection = append([]string(nil), fields...)
+}
+
+// finishScan applies deduplication and the projection to Split-mode results
+func (dm *DataManager) finishScan(results []map[string]interface{}) ([]map[string]interface{}, error) {
+	results, err := dm.dropDuplicates(results)
+	if err != nil || len(dm.projection) == 0 {
+		return results, err
+	}
+	for i, record := range results {
+		results[i] = project(record, dm.projection)
+	}
+	return results, nil
+}
+
+// defaultChunkBuffer is the read buffer size of line scans
+const defaultChunkBuffer = 1024 * 1024
+
+// chunkReaders recycles the large buffered readers used by line scans
+var chunkReaders = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, defaultChunkBuffer) },
+}
+
+// lineScanner holds the reusable state of one goroutine's line scan
+type lineScanner struct {
+	dm         *DataManager
+	conditions []FilterCondition
+	needles    [][]byte        // Byte strings every matching line contains
+	wanted     map[string]bool // Fields parsed for the conditions
+	projected  map[string]bool // Fields parsed from matching lines (nil decodes everything)
+	scratch    map[string]interface{}
+	buf        []byte
+	extra      []map[string]interface{} // Further matching records of the line last matched, split by repair
+}
+
+// newLineScanner prepares a scan filtering lines by conditions
+func (dm *DataManager) newLineScanner(conditions []FilterCondition) *lineScanner {
+	ls := &lineScanner{dm: dm, conditions: conditions}
+	inputs, known := dm.computedInputs()
+	if dm.fastScan && dm.validator == nil && dm.repair == nil && known {
+		ls.wanted = make(map[string]bool)
+		for _, condition := range conditions {
+			for _, field := range conditionFields(condition) {
+				ls.wanted[field] = true
+			}
+			if dm.isComputed(condition.Key) || dm.coercion != nil {
+				continue // Not present in the raw line, or not as written
+			}
+			if needle := rawNeedle(condition); needle != nil {
+				ls.needles = append(ls.needles, needle)
+			}
+		}
+		for _, field := range inputs {
+			ls.wanted[field] = true
+		}
+		ls.scratch = make(map[string]interface{}, len(ls.wanted))
+		if len(dm.projection) > 0 && dm.dedupFields == nil && len(dm.computed) == 0 && dm.coercion == nil {
+			ls.projected = make(map[string]bool)
+			for _, field := range dm.projection {
+				ls.projected[field] = true
+			}
+		}
+	}
+	return ls
+}
+
+// scanLines filters the lines read from br that start before end, where pos
+// is the offset of br's next byte within the source, charging them to budget
+func (ls *lineScanner) scanLines(br *bufio.Reader, pos, end int64, budget *scanBudget) ([]map[string]interface{}, error) {
+	var filteredData []map[string]interface{}
+	err := ls.eachLine(br, pos, end, func(record map[string]interface{}, n int) error {
+		if record != nil {
+			filteredData = append(filteredData, record)
+		}
+		return budget.charge(int64(n))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filteredData, nil
+}
+
+// eachLine reads the lines from br that start before end, where pos is the
+// offset of br's next byte within the source, and calls fn with each
+// non-blank line's matching record (nil when it does not match) and length
+func (ls *lineScanner) eachLine(br *bufio.Reader, pos, end int64, fn func(record map[string]interface{}, n int) error) error {
+	dm := ls.dm
+	for pos < end {
+		line, n, tooLong, err := readLine(br, ls.buf[:0], dm.recordLimit)
+		ls.buf = line[:0]
+		lineStart := pos
+		pos += int64(n)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n > 0 {
+			dm.track(n)
+		}
+
+		if tooLong {
+			parseErr := &ParseError{Offset: lineStart, Snippet: snippet(line), Err: fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, dm.recordLimit)}
+			if err := dm.tolerate(parseErr); err != nil {
+				return err
+			}
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			record, err := ls.matchLine(line, lineStart)
+			if err != nil {
+				return err
+			}
+			if err := fn(record, n); err != nil {
+				return err
+			}
+			for _, record := range ls.extra {
+				if err := fn(record, 0); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+// matchLine returns the record on line if it matches the conditions, or nil
+func (ls *lineScanner) matchLine(line []byte, offset int64) (map[string]interface{}, error) {
+	ls.extra = ls.extra[:0]
+	if ls.dm.preprocess != nil {
+		raw := line
+		var err error
+		if line, err = ls.dm.preprocess(raw); err != nil {
+			return nil, ls.dm.tolerate(&ParseError{Offset: offset, Snippet: snippet(raw), Err: err})
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil, nil
+		}
+	}
+	if ls.wanted != nil {
+		for _, needle := range ls.needles {
+			if !bytes.Contains(line, needle) {
+				return nil, nil
+			}
+		}
+		clear(ls.scratch)
+		if extractFields(line, ls.wanted, ls.scratch) == nil {
+			// Matching lines are decoded again below, where coercions are counted
+			ls.dm.coerce(ls.scratch, false)
+			ls.dm.compute(ls.scratch)
+			if !ls.dm.matchConditions(ls.scratch, ls.conditions) {
+				return nil, nil
+			}
+			if ls.projected != nil {
+				record := make(map[string]interface{}, len(ls.projected))
+				if extractFields(line, ls.projected, record) == nil {
+					return record, nil
+				}
+			}
+		}
+		// Malformed lines take the full decode path so they are reported consistently
+	}
+	if ls.dm.repair != nil {
+		return ls.matchRepaired(line, offset)
+	}
+	record, err := ls.dm.scanLine(line, offset)
+	if err != nil || record == nil || !ls.dm.matchConditions(record, ls.conditions) {
+		return nil, err
+	}
+	return record, nil
+}
+
+// rawNeedle returns bytes that must appear in the raw JSON of any record
+// satisfying condition, or nil when no such bytes are known. Strings are only
+// used when JSON encodes them verbatim, so the needle cannot miss a match
+// written without escapes.
+func rawNeedle(condition FilterCondition) []byte {
+	switch condition.ValueType {
+	case "string":
+		s, ok := condition.Value.(string)
+		if !ok || s == "" || condition.Collation != BinaryCollation {
+			return nil
+		}
+		for _, r := range s {
+			if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '/' || r == '<' || r == '>' || r == '&' {
+				return nil
+			}
+		}
+		switch condition.Operator {
+		case "==":
+			return []byte(`"` + s + `"`)
+		case "contains":
+			return []byte(s)
+		}
+	case ArrayValueType:
+		if condition.Operator == "contains" {
+			return rawNeedle(FilterCondition{ValueType: "string", Operator: "==", Value: condition.Value, Collation: condition.Collation})
+		}
+	case "bool":
+		if b, ok := condition.Value.(bool); ok && condition.Operator == "==" {
+			return []byte(strconv.FormatBool(b))
+		}
+	}
+	return nil
+}
+
+// errMalformed reports JSON the field extractor cannot walk
+var errMalformed = errors.New("malformed JSON object")
+
+// extractFields walks the top-level object on line and decodes only the
+// members named in wanted into into, skipping the bytes of every other value
+func extractFields(line []byte, wanted map[string]bool, into map[string]interface{}) error {
+	i := skipSpace(line, 0)
+	if i >= len(line) || line[i] != '{' {
+		return errMalformed
+	}
+	i = skipSpace(line, i+1)
+	if i < len(line) && line[i] == '}' {
+		if skipSpace(line, i+1) != len(line) {
+			return errMalformed
+		}
+		return nil
+	}
+	for {
+		if i >= len(line) || line[i] != '"' {
+			return errMalformed
+		}
+		keyEnd, escaped := scanString(line, i)
+		if keyEnd < 0 {
+			return errMalformed
+		}
+		var key string
+		if escaped {
+			if err := json.Unmarshal(line[i:keyEnd], &key); err != nil {
+				return err
+			}
+		} else {
+			key = string(line[i+1 : keyEnd-1])
+		}
+		i = skipSpace(line, keyEnd)
+		if i >= len(line) || line[i] != ':' {
+			return errMalformed
+		}
+		i = skipSpace(line, i+1)
+		valueEnd := skipValue(line, i)
+		if valueEnd < 0 {
+			return errMalformed
+		}
+		if wanted[key] {
+			value, err := decodeValue(line[i:valueEnd])
+			if err != nil {
+				return err
+			}
+			into[key] = value
+		}
+		i = skipSpace(line, valueEnd)
+		if i >= len(line) {
+			return errMalformed
+		}
+		if line[i] == '}' {
+			if skipSpace(line, i+1) != len(line) {
+				return errMalformed
+			}
+			return nil
+		}
+		if line[i] != ',' {
+			return errMalformed
+		}
+		i = skipSpace(line, i+1)
+	}
+}
+
+// skipSpace returns the index of the first non-whitespace byte at or after i
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\r' || b[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// scanString returns the index just past the string starting at b[i] and
+// whether it contains escapes, or -1 if it is unterminated
+func scanString(b []byte, i int) (int, bool) {
+	escaped := false
+	for j := i + 1; j < len(b); j++ {
+		switch b[j] {
+		case '\\':
+			escaped = true
+			j++
+		case '"':
+			return j + 1, escaped
+		}
+	}
+	return -1, false
+}
+
+// skipValue returns the index just past the JSON value starting at b[i], or -1
+func skipValue(b []byte, i int) int {
+	if i >= len(b) {
+		return -1
+	}
+	switch b[i] {
+	case '"':
+		end, _ := scanString(b, i)
+		return end
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(b); j++ {
+			switch b[j] {
+			case '"':
+				end, _ := scanString(b, j)
+				if end < 0 {
+					return -1
+				}
+				j = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return -1
+	default:
+		j := i
+		for j < len(b) && b[j] != ',' && b[j] != '}' && b[j] != ']' && b[j] != ' ' && b[j] != '\t' && b[j] != '\r' && b[j] != '\n' {
+			j++
+		}
+		if j == i {
+			return -1
+		}
+		return j
+	}
+}
+
+// decodeValue decodes one JSON value, handling scalars without encoding/json
+func decodeValue(raw []byte) (interface{}, error) {
+	switch raw[0] {
+	case '"':
+		if bytes.IndexByte(raw, '\\') < 0 {
+			return string(raw[1 : len(raw)-1]), nil
+		}
+	case 't':
+		if string(raw) == "true" {
+			return true, nil
+		}
+	case 'f':
+		if string(raw) == "false" {
+			return false, nil
+		}
+	case 'n':
+		if string(raw) == "null" {
+			return nil, nil
+		}
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		// ParseFloat also accepts forms JSON does not, such as hex and underscores
+		if bytes.IndexFunc(raw, func(r rune) bool { return !bytes.ContainsRune([]byte("0123456789+-.eE"), r) }) < 0 {
+			if f, err := strconv.ParseFloat(string(raw), 64); err == nil && !math.IsInf(f, 0) {
+				return f, nil
+			}
+		}
+	}
+	var value interface{}
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
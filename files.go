@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SetSourceFileField makes multi-file loads and scans record the path each
+// record came from in the named field (e.g. "_source_file"); empty disables it
+func (dm *DataManager) SetSourceFileField(field string) {
+	dm.sourceField = field
+}
+
+// isGlob reports whether path is a local glob pattern rather than a single location
+func isGlob(path string) bool {
+	return !strings.Contains(path, "://") && strings.ContainsAny(path, "*?[")
+}
+
+// expandGlob returns the files matching pattern in lexical order
+func expandGlob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("No files match %s", pattern)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// LoadFilesInMemory loads every record of several inputs into memory as one
+// dataset. Files are read in order, so a key present in several files keeps
+// the record from the last one.
+func (dm *DataManager) LoadFilesInMemory(paths []string, keyName string) (err error) {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if len(paths) == 0 {
+		return ErrNoInput
+	}
+
+	defer dm.beginOperation("load", describePaths(paths), func() int64 { return dm.filesSize(paths) })(&err)
+	reader := &multiFileReader{dm: dm, paths: paths}
+	defer reader.close()
+	return dm.loadRecords(reader, keyName)
+}
+
+// LoadFilesInSplitMode filters several inputs as one dataset, scanning up to
+// one file per worker (see WithWorkers) concurrently. Results follow the order of paths.
+// Files ruled out by the partition scheme (see SetPartitionScheme) or by
+// their Bloom filters (see BuildBloomFilters) are skipped.
+func (dm *DataManager) LoadFilesInSplitMode(paths []string, conditions []FilterCondition) (_ []map[string]interface{}, err error) {
+	if dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+	if len(paths) == 0 {
+		return nil, ErrNoInput
+	}
+
+	budget, err := dm.beginScan()
+	if err != nil {
+		return nil, err
+	}
+	defer budget.done()
+	dm.parseErrors.reset()
+	paths, perFile, partitions := dm.prunePartitions(paths, conditions)
+	paths, perFile, partitions = dm.pruneBlooms(paths, perFile, partitions)
+	defer dm.beginOperation("scan", describePaths(paths), func() int64 { return dm.filesSize(paths) })(&err)
+	results := make([][]map[string]interface{}, len(paths))
+	errs := make([]error, len(paths))
+	sem := make(chan struct{}, dm.parallelism())
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			src, err := dm.resolveSource(path)
+			if err == nil {
+				results[i], err = dm.scanSource(src, perFile[i], budget)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", path, err)
+				return
+			}
+			addPartitionValues(results[i], partitions[i])
+			dm.tagSourceFile(results[i], path)
+		}(i, path)
+	}
+	wg.Wait()
+
+	var filteredData []map[string]interface{}
+	for i := range paths {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		filteredData = append(filteredData, results[i]...)
+	}
+	return dm.finishScan(filteredData)
+}
+
+// tagSourceFile stores path in each record's source file field, if configured
+func (dm *DataManager) tagSourceFile(records []map[string]interface{}, path string) {
+	if dm.sourceField == "" {
+		return
+	}
+	for _, record := range records {
+		record[dm.sourceField] = path
+	}
+}
+
+// multiFileReader reads the records of several inputs one after another
+type multiFileReader struct {
+	dm        *DataManager
+	paths     []string
+	current   recordReader
+	closer    io.Closer
+	path      string
+	partition map[string]string // Partition values of the current file
+}
+
+// Next returns the next record, opening the following file when one is exhausted
+func (mr *multiFileReader) Next() (map[string]interface{}, int, error) {
+	for {
+		if mr.current == nil {
+			if len(mr.paths) == 0 {
+				return nil, 0, io.EOF
+			}
+			mr.path, mr.paths = mr.paths[0], mr.paths[1:]
+			mr.partition = mr.dm.partitionValues(mr.path)
+			reader, closer, err := mr.dm.openRecords(mr.path)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %w", mr.path, err)
+			}
+			mr.current, mr.closer = reader, closer
+		}
+
+		record, size, err := mr.current.Next()
+		if err == io.EOF {
+			mr.close()
+			continue
+		}
+		if err != nil {
+			var parseErr *ParseError
+			if errors.As(err, &parseErr) {
+				parseErr.File = mr.path
+			} else {
+				err = fmt.Errorf("%s: %w", mr.path, err)
+			}
+			return nil, size, err
+		}
+		addPartitionValues([]map[string]interface{}{record}, mr.partition)
+		if mr.dm.sourceField != "" {
+			record[mr.dm.sourceField] = mr.path
+		}
+		return record, size, nil
+	}
+}
+
+// close releases the file being read
+func (mr *multiFileReader) close() {
+	if mr.closer != nil {
+		mr.closer.Close()
+	}
+	mr.current, mr.closer = nil, nil
+}
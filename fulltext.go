@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TextIndexOptions configures how a text index splits field values into terms
+type TextIndexOptions struct {
+	Stem      bool     // Reduce English words to a common stem ("running" -> "run")
+	StopWords []string // Terms left out of the index and of queries
+}
+
+// SearchResult is a record matched by Search with its relevance score
+type SearchResult struct {
+	Key    string                 `json:"key"`
+	Score  float64                `json:"score"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// BM25 parameters: term frequency saturation and document length normalization
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// invertedIndex maps the terms of one text field to the records holding them
+type invertedIndex struct {
+	opts     TextIndexOptions
+	stop     map[string]bool
+	postings map[string]map[string]int // Term -> record key -> term frequency
+	lengths  map[string]int            // Record key -> number of terms
+	total    int                       // Sum of lengths
+}
+
+// newInvertedIndex creates an empty text index
+func newInvertedIndex(opts TextIndexOptions) *invertedIndex {
+	inv := &invertedIndex{
+		opts:     opts,
+		stop:     make(map[string]bool, len(opts.StopWords)),
+		postings: make(map[string]map[string]int),
+		lengths:  make(map[string]int),
+	}
+	for _, word := range opts.StopWords {
+		inv.stop[strings.ToLower(word)] = true
+	}
+	return inv
+}
+
+// clone returns an independent copy of the index
+func (inv *invertedIndex) clone() *invertedIndex {
+	c := newInvertedIndex(inv.opts)
+	for term, docs := range inv.postings {
+		copied := make(map[string]int, len(docs))
+		for key, tf := range docs {
+			copied[key] = tf
+		}
+		c.postings[term] = copied
+	}
+	for key, n := range inv.lengths {
+		c.lengths[key] = n
+	}
+	c.total = inv.total
+	return c
+}
+
+// analyze splits text into lower-cased terms, dropping stop words and
+// stemming when enabled
+func (inv *invertedIndex) analyze(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		word = strings.ToLower(word)
+		if inv.stop[word] {
+			continue
+		}
+		if inv.opts.Stem {
+			word = stem(word)
+		}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// textOf returns the searchable text of a field value; arrays of strings are joined
+func textOf(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		var parts []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, " "), len(parts) > 0
+	default:
+		return "", false
+	}
+}
+
+// add indexes the terms of a record's field value
+func (inv *invertedIndex) add(key string, value interface{}) {
+	text, ok := textOf(value)
+	if !ok {
+		return
+	}
+	terms := inv.analyze(text)
+	for _, term := range terms {
+		docs, exists := inv.postings[term]
+		if !exists {
+			docs = make(map[string]int)
+			inv.postings[term] = docs
+		}
+		docs[key]++
+	}
+	inv.lengths[key] = len(terms)
+	inv.total += len(terms)
+}
+
+// remove drops a record indexed with the given field value
+func (inv *invertedIndex) remove(key string, value interface{}) {
+	if _, indexed := inv.lengths[key]; !indexed {
+		return
+	}
+	text, _ := textOf(value)
+	for _, term := range inv.analyze(text) {
+		if docs, exists := inv.postings[term]; exists {
+			delete(docs, key)
+			if len(docs) == 0 {
+				delete(inv.postings, term)
+			}
+		}
+	}
+	inv.total -= inv.lengths[key]
+	delete(inv.lengths, key)
+}
+
+// score adds the BM25 score of every record matching a query term to scores.
+// The records of inv under the keys of changed are replaced by those of
+// delta, which indexes the records written since (nil when none were).
+func (inv *invertedIndex) score(query string, delta *invertedIndex, changed map[string]map[string]interface{}, scores map[string]float64) {
+	n, total := len(inv.lengths), inv.total
+	for key := range changed {
+		if length, ok := inv.lengths[key]; ok {
+			n--
+			total -= length
+		}
+	}
+	if delta != nil {
+		n += len(delta.lengths)
+		total += delta.total
+	}
+	if n == 0 {
+		return
+	}
+	avgLen := float64(total) / float64(n)
+	for _, term := range inv.analyze(query) {
+		docs := inv.postings[term]
+		df := len(docs)
+		for key := range changed {
+			if _, ok := docs[key]; ok {
+				df--
+			}
+		}
+		var changedDocs map[string]int
+		if delta != nil {
+			changedDocs = delta.postings[term]
+			df += len(changedDocs)
+		}
+		if df == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(n)-float64(df)+0.5)/(float64(df)+0.5))
+		for key, tf := range docs {
+			if _, ok := changed[key]; !ok {
+				scores[key] += bm25(idf, tf, inv.lengths[key], avgLen)
+			}
+		}
+		for key, tf := range changedDocs {
+			scores[key] += bm25(idf, tf, delta.lengths[key], avgLen)
+		}
+	}
+}
+
+// bm25 returns the BM25 weight of a term occurring tf times in a record of
+// length terms, given its idf and the average record length
+func bm25(idf float64, tf, length int, avgLen float64) float64 {
+	f := float64(tf)
+	norm := 1 - bm25B + bm25B*float64(length)/avgLen
+	return idf * f * (bm25K1 + 1) / (f + bm25K1*norm)
+}
+
+// CreateTextIndex builds a full-text index on each of fields. Values are
+// split on anything but letters and digits and lower-cased; string arrays
+// are indexed as one text. Text indexes are maintained on writes and
+// reloads like other indexes and are queried with Search. DropIndex removes
+// the index on a field by the name "text:<field>".
+func (dm *DataManager) CreateTextIndex(fields []string, opts TextIndexOptions) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if len(fields) == 0 {
+		return errors.New("No fields to index")
+	}
+
+	built := make([]*fieldIndex, len(fields))
+	started := time.Now()
+	ds := dm.snapshot()
+	for i, field := range fields {
+		built[i] = newTextIndex(field, opts)
+		for key, record := range ds.all() {
+			built[i].add(key, record)
+		}
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if dm.current != ds {
+		// Data changed while building; index the current version instead
+		for i, idx := range built {
+			built[i] = idx.empty()
+			for key, record := range dm.current.all() {
+				built[i].add(key, record)
+			}
+		}
+	}
+	current := dm.writable()
+	for _, idx := range built {
+		current.setIndex(textIndexName(idx.field), idx)
+		dm.logIndexBuilt(textIndexName(idx.field), idx, started)
+	}
+	return nil
+}
+
+// textIndexName returns the name a text index on field is stored under, so
+// that it can coexist with a hash or sorted index on the same field
+func textIndexName(field string) string {
+	return "text:" + field
+}
+
+// newTextIndex creates an empty text index on field
+func newTextIndex(field string, opts TextIndexOptions) *fieldIndex {
+	return &fieldIndex{field: field, kind: TextIndex, text: newInvertedIndex(opts)}
+}
+
+// Search returns the records matching any term of query across all text
+// indexes (or only those on fields, when given), best first by BM25
+// relevance. A limit of 0 or less returns every match.
+func (dm *DataManager) Search(query string, limit int, fields ...string) ([]SearchResult, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+
+	ds := dm.snapshot()
+	scores := make(map[string]float64)
+	searched := 0
+	for name, idx := range ds.indexes {
+		if idx.text == nil || (len(fields) > 0 && !containsString(fields, idx.field)) {
+			continue
+		}
+		ds.score(name, query, scores)
+		searched++
+	}
+	if searched == 0 {
+		return nil, errors.New("No text index to search; create one with CreateTextIndex")
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	exp, now := dm.expiryState(), time.Now()
+	for key, score := range scores {
+		if record, exists := ds.get(key); exists && exp.live(record, now) {
+			results = append(results, SearchResult{Key: key, Score: score, Record: record})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Key < results[j].Key
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stem strips common English inflections, a light variant of the Porter
+// stemmer's first steps that is good enough to match plural and tense forms
+func stem(word string) string {
+	if len(word) <= 3 {
+		return word
+	}
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "xes"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "zes"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+	for _, suffix := range []string{"ingly", "edly", "ing", "ed"} {
+		if strings.HasSuffix(word, suffix) {
+			base := word[:len(word)-len(suffix)]
+			if !strings.ContainsAny(base, "aeiouy") || len(base) < 2 {
+				break
+			}
+			word = base
+			// "hopping" -> "hop", but keep "ll", "ss" and "zz" ("falling" -> "fall")
+			if n := len(word); n >= 2 && word[n-1] == word[n-2] && !strings.ContainsRune("lsz", rune(word[n-1])) {
+				word = word[:n-1]
+			}
+			break
+		}
+	}
+	if strings.HasSuffix(word, "ly") && len(word) > 4 {
+		word = word[:len(word)-2]
+	}
+	return word
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// FuzzyMatch is the Value of a string condition with the "fuzzy" operator,
+// which matches field values within a few edits of Text. An edit inserts,
+// deletes or substitutes a character, or swaps two adjacent ones. A plain
+// string Value allows 0 edits for up to 2 characters, 1 for up to 5 and 2
+// beyond.
+type FuzzyMatch struct {
+	Text          string  `json:"text"`
+	MaxEdits      int     `json:"max_edits"`      // Most edits allowed (0 uses MinSimilarity, or the default)
+	MinSimilarity float64 `json:"min_similarity"` // Least 1 - edits / length of the longer string, from 0 to 1
+}
+
+// Fuzzy returns a condition matching records whose string field key is
+// within maxEdits edits of text
+func Fuzzy(key, text string, maxEdits int) FilterCondition {
+	return FilterCondition{Key: key, ValueType: "string", Operator: "fuzzy", Value: FuzzyMatch{Text: text, MaxEdits: maxEdits}}
+}
+
+// fuzzyMatchOf returns the FuzzyMatch held by a fuzzy condition's Value,
+// accepting a plain string and the JSON object form
+func fuzzyMatchOf(value interface{}) (FuzzyMatch, bool) {
+	switch v := value.(type) {
+	case string:
+		return FuzzyMatch{Text: v}, true
+	case FuzzyMatch:
+		return v, true
+	case *FuzzyMatch:
+		if v != nil {
+			return *v, true
+		}
+	case map[string]interface{}:
+		text, ok := v["text"].(string)
+		edits, _ := numericValue(v["max_edits"])
+		similarity, _ := numericValue(v["min_similarity"])
+		return FuzzyMatch{Text: text, MaxEdits: int(edits), MinSimilarity: similarity}, ok
+	}
+	return FuzzyMatch{}, false
+}
+
+// maxEdits returns the most edits a match may need: MaxEdits when set,
+// otherwise the bound implied by MinSimilarity or the default by length
+func (f FuzzyMatch) maxEdits(text []rune) int {
+	switch {
+	case f.MaxEdits > 0:
+		return f.MaxEdits
+	case f.MinSimilarity > 0 && f.MinSimilarity <= 1:
+		// A match n edits away is at most len(text)+n long
+		return int(math.Floor((1 - f.MinSimilarity) * float64(len(text)) / f.MinSimilarity))
+	case len(text) <= 2:
+		return 0
+	case len(text) <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// applyFuzzyCondition applies a fuzzy condition, folding both strings under
+// the condition's collation first
+func applyFuzzyCondition(fieldValue interface{}, condition FilterCondition) bool {
+	fieldVal, ok := fieldValue.(string)
+	if !ok {
+		return false
+	}
+	f, ok := fuzzyMatchOf(condition.Value)
+	if !ok {
+		return false
+	}
+	text := f.Text
+	if condition.Collation != BinaryCollation {
+		co, err := collatorFor(condition.Collation)
+		if err != nil {
+			return false
+		}
+		fieldVal, text = co.folded(fieldVal), co.folded(text)
+	}
+
+	a, b := []rune(fieldVal), []rune(text)
+	limit := f.maxEdits(b)
+	distance := editDistance(a, b, limit)
+	if distance > limit {
+		return false
+	}
+	if f.MaxEdits <= 0 && f.MinSimilarity > 0 {
+		return 1-float64(distance)/float64(max(len(a), len(b), 1)) >= f.MinSimilarity
+	}
+	return true
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b (Levenshtein distance counting an adjacent swap as one edit), or a value
+// above limit once the distance is known to exceed it
+func editDistance(a, b []rune, limit int) int {
+	if d := len(a) - len(b); d > limit || -d > limit {
+		return limit + 1
+	}
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// trigrams returns the distinct three-character sequences of s, padded so
+// that its first and last characters appear in more than one
+func trigrams(s string) []string {
+	padded := append(append([]rune("  "), []rune(s)...), ' ')
+	seen := make(map[string]bool, len(padded))
+	var grams []string
+	for i := 0; i+3 <= len(padded); i++ {
+		gram := string(padded[i : i+3])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// trigramIndexName returns the name a trigram index on field is stored under,
+// so that it can coexist with other indexes on the same field
+func trigramIndexName(field string) string {
+	return "trigram:" + field
+}
+
+// trigramText returns the text a trigram index or fuzzy lookup uses for s
+func (idx *fieldIndex) trigramText(s string) string {
+	if idx.collator != nil {
+		return idx.collator.folded(s)
+	}
+	return s
+}
+
+// addTrigrams registers a record under each trigram of its field value
+func (idx *fieldIndex) addTrigrams(key string, record map[string]interface{}) {
+	value, _ := resolvePath(record, idx.field)
+	s, ok := value.(string)
+	if !ok {
+		return
+	}
+	for _, gram := range trigrams(idx.trigramText(s)) {
+		keys, exists := idx.hash[gram]
+		if !exists {
+			keys = make(map[string]struct{})
+			idx.hash[gram] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// removeTrigrams drops a record from the trigram postings of its field value
+func (idx *fieldIndex) removeTrigrams(key string, record map[string]interface{}) {
+	value, _ := resolvePath(record, idx.field)
+	s, ok := value.(string)
+	if !ok {
+		return
+	}
+	for _, gram := range trigrams(idx.trigramText(s)) {
+		if keys, exists := idx.hash[gram]; exists {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(idx.hash, gram)
+			}
+		}
+	}
+}
+
+// trigramQuery returns the trigrams of a fuzzy condition's text and how many
+// of them a match must share. Each edit destroys at most four trigrams, so a
+// required count of zero or less means the index cannot narrow the search.
+func (idx *fieldIndex) trigramQuery(condition FilterCondition) ([]string, int, bool) {
+	f, ok := fuzzyMatchOf(condition.Value)
+	if !ok || condition.Collation != idx.collation {
+		return nil, 0, false
+	}
+	text := idx.trigramText(f.Text)
+	grams := trigrams(text)
+	required := len(grams) - 4*f.maxEdits([]rune(text))
+	return grams, required, required > 0
+}
+
+// trigramLookup returns the keys of records sharing enough trigrams with a
+// fuzzy condition to possibly match it
+func (idx *fieldIndex) trigramLookup(condition FilterCondition) []string {
+	grams, required, _ := idx.trigramQuery(condition)
+	shared := make(map[string]int)
+	for _, gram := range grams {
+		for key := range idx.hash[gram] {
+			shared[key]++
+		}
+	}
+	var keys []string
+	for key, n := range shared {
+		if n >= required {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// CreateTrigramIndex builds a trigram index on the string field, so fuzzy
+// conditions on it read only the records sharing enough three-character
+// sequences with the searched text. Conditions with the given collation use
+// it. Drop it with DropIndex("trigram:" + field).
+func (dm *DataManager) CreateTrigramIndex(field string, collation Collation) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if field == "" {
+		return errors.New("No field to index")
+	}
+	co, err := collatorFor(collation)
+	if err != nil {
+		return err
+	}
+
+	idx := newFieldIndex(field, TrigramIndex)
+	if collation != BinaryCollation {
+		idx.collation, idx.collator = collation, co
+	}
+	started := time.Now()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	ds := dm.writable()
+	for key, record := range ds.all() {
+		idx.add(key, record)
+	}
+	ds.setIndex(trigramIndexName(field), idx)
+	dm.logIndexBuilt(trigramIndexName(field), idx, started)
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// GeoValueType is the ValueType of location conditions. Their Key names a
+// field holding a point, either an object with lat and lon (or lng,
+// latitude and longitude) members, a GeoJSON Point or a [lon, lat] pair, or
+// two numeric fields as "lat_field,lon_field". The operators are
+// "within_radius", whose Value is a GeoRadius, and "in_bbox", whose Value is
+// a GeoBBox; in JSON they are objects with the same field names.
+const GeoValueType = "geo"
+
+// GeoRadius is the Value of a within_radius condition
+type GeoRadius struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	Km  float64 `json:"km"`
+}
+
+// GeoBBox is the Value of an in_bbox condition. A box whose MinLon is
+// greater than its MaxLon crosses the antimeridian.
+type GeoBBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// earthRadiusKm is the mean radius used by the haversine formula
+const earthRadiusKm = 6371.0088
+
+// WithinRadius returns a condition matching records whose point at key lies
+// within km kilometres of lat, lon
+func WithinRadius(key string, lat, lon, km float64) FilterCondition {
+	return FilterCondition{Key: key, ValueType: GeoValueType, Operator: "within_radius", Value: GeoRadius{Lat: lat, Lon: lon, Km: km}}
+}
+
+// InBBox returns a condition matching records whose point at key lies in the box
+func InBBox(key string, minLat, minLon, maxLat, maxLon float64) FilterCondition {
+	return FilterCondition{Key: key, ValueType: GeoValueType, Operator: "in_bbox",
+		Value: GeoBBox{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon}}
+}
+
+// HaversineKm returns the great-circle distance in kilometres between two points
+func HaversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rlat1, rlat2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLat, dLon := rlat2-rlat1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rlat1)*math.Cos(rlat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geoPoint returns the location a geo condition's key names in record
+func geoPoint(record map[string]interface{}, key string) (lat, lon float64, ok bool) {
+	if latField, lonField, pair := strings.Cut(key, ","); pair {
+		latValue, _ := resolvePath(record, strings.TrimSpace(latField))
+		lonValue, _ := resolvePath(record, strings.TrimSpace(lonField))
+		return validPoint(latValue, lonValue)
+	}
+
+	value, _ := resolvePath(record, key)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if coordinates, ok := v["coordinates"].([]interface{}); ok && v["type"] == "Point" && len(coordinates) >= 2 {
+			return validPoint(coordinates[1], coordinates[0])
+		}
+		return validPoint(firstPresent(v, "lat", "latitude"), firstPresent(v, "lon", "lng", "longitude"))
+	case []interface{}:
+		if len(v) == 2 {
+			return validPoint(v[1], v[0]) // GeoJSON order
+		}
+	}
+	return 0, 0, false
+}
+
+// firstPresent returns the first of names present in object
+func firstPresent(object map[string]interface{}, names ...string) interface{} {
+	for _, name := range names {
+		if v, ok := object[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// validPoint converts decoded coordinates, rejecting values outside the globe
+func validPoint(latValue, lonValue interface{}) (lat, lon float64, ok bool) {
+	lat, okLat := numericValue(latValue)
+	lon, okLon := numericValue(lonValue)
+	if !okLat || !okLon || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// geoArea returns the region a geo condition selects: a radius or a box
+func geoArea(condition FilterCondition) (*GeoRadius, *GeoBBox, bool) {
+	switch v := condition.Value.(type) {
+	case GeoRadius:
+		return &v, nil, condition.Operator == "within_radius"
+	case *GeoRadius:
+		return v, nil, v != nil && condition.Operator == "within_radius"
+	case GeoBBox:
+		return nil, &v, condition.Operator == "in_bbox"
+	case *GeoBBox:
+		return nil, v, v != nil && condition.Operator == "in_bbox"
+	case map[string]interface{}:
+		n := func(name string) (float64, bool) { return numericValue(v[name]) }
+		switch condition.Operator {
+		case "within_radius":
+			lat, ok1 := n("lat")
+			lon, ok2 := n("lon")
+			km, ok3 := n("km")
+			return &GeoRadius{Lat: lat, Lon: lon, Km: km}, nil, ok1 && ok2 && ok3
+		case "in_bbox":
+			minLat, ok1 := n("min_lat")
+			minLon, ok2 := n("min_lon")
+			maxLat, ok3 := n("max_lat")
+			maxLon, ok4 := n("max_lon")
+			return nil, &GeoBBox{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon}, ok1 && ok2 && ok3 && ok4
+		}
+	}
+	return nil, nil, false
+}
+
+// contains reports whether the box holds the point
+func (b *GeoBBox) contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon <= b.MaxLon {
+		return lon >= b.MinLon && lon <= b.MaxLon
+	}
+	return lon >= b.MinLon || lon <= b.MaxLon
+}
+
+// bounds returns a box enclosing the circle
+func (r *GeoRadius) bounds() *GeoBBox {
+	dLat := r.Km / earthRadiusKm * 180 / math.Pi
+	box := &GeoBBox{MinLat: math.Max(-90, r.Lat-dLat), MaxLat: math.Min(90, r.Lat+dLat), MinLon: -180, MaxLon: 180}
+	if box.MinLat > -90 && box.MaxLat < 90 {
+		dLon := math.Asin(math.Min(1, math.Sin(r.Km/earthRadiusKm)/math.Cos(r.Lat*math.Pi/180))) * 180 / math.Pi
+		if dLon < 180 {
+			box.MinLon, box.MaxLon = wrapLon(r.Lon-dLon), wrapLon(r.Lon+dLon)
+		}
+	}
+	return box
+}
+
+// wrapLon maps a longitude into [-180, 180]
+func wrapLon(lon float64) float64 {
+	for lon < -180 {
+		lon += 360
+	}
+	for lon > 180 {
+		lon -= 360
+	}
+	return lon
+}
+
+// matchGeo checks a record against a geo condition
+func matchGeo(record map[string]interface{}, condition FilterCondition) bool {
+	lat, lon, ok := geoPoint(record, condition.Key)
+	if !ok {
+		return false
+	}
+	radius, box, ok := geoArea(condition)
+	if !ok {
+		return false
+	}
+	if radius != nil {
+		return HaversineKm(radius.Lat, radius.Lon, lat, lon) <= radius.Km
+	}
+	return box.contains(lat, lon)
+}
+
+// geohashPrecision is the length of the geohashes a geo index stores
+// (cells of a few centimetres)
+const geohashPrecision = 12
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a point as a geohash of the given length
+func geohash(lat, lon float64, precision int) string {
+	minLat, maxLat, minLon, maxLon := -90.0, 90.0, -180.0, 180.0
+	hash := make([]byte, precision)
+	even := true
+	for i := range hash {
+		var c byte
+		for bit := 4; bit >= 0; bit-- {
+			if even {
+				if mid := (minLon + maxLon) / 2; lon >= mid {
+					c |= 1 << bit
+					minLon = mid
+				} else {
+					maxLon = mid
+				}
+			} else {
+				if mid := (minLat + maxLat) / 2; lat >= mid {
+					c |= 1 << bit
+					minLat = mid
+				} else {
+					maxLat = mid
+				}
+			}
+			even = !even
+		}
+		hash[i] = geohashAlphabet[c]
+	}
+	return string(hash)
+}
+
+// geohashCellSize returns the height and width in degrees of geohash cells of a length
+func geohashCellSize(precision int) (latDeg, lonDeg float64) {
+	bits := 5 * precision
+	return 180 / math.Exp2(float64(bits/2)), 360 / math.Exp2(float64(bits-bits/2))
+}
+
+// maxGeoCells bounds the geohash prefixes a geo index lookup scans
+const maxGeoCells = 64
+
+// geohashCover returns geohash prefixes whose cells together cover box,
+// as long as possible while staying within maxGeoCells
+func geohashCover(box *GeoBBox) []string {
+	spans := [][2]float64{{box.MinLon, box.MaxLon}}
+	if box.MinLon > box.MaxLon {
+		spans = [][2]float64{{box.MinLon, 180}, {-180, box.MaxLon}}
+	}
+	cells := func(precision int) int {
+		latDeg, lonDeg := geohashCellSize(precision)
+		rows := int(math.Floor(box.MaxLat/latDeg) - math.Floor(box.MinLat/latDeg) + 1)
+		n := 0
+		for _, span := range spans {
+			n += rows * int(math.Floor(span[1]/lonDeg)-math.Floor(span[0]/lonDeg)+1)
+		}
+		return n
+	}
+	precision := 1
+	for precision < geohashPrecision && cells(precision+1) <= maxGeoCells {
+		precision++
+	}
+
+	latDeg, lonDeg := geohashCellSize(precision)
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, span := range spans {
+		for lat := math.Floor(box.MinLat/latDeg) * latDeg; lat <= box.MaxLat; lat += latDeg {
+			for lon := math.Floor(span[0]/lonDeg) * lonDeg; lon <= span[1]; lon += lonDeg {
+				// Encode the cell centre, clamped so the poles and antimeridian stay in range
+				hash := geohash(math.Min(89.999999, lat+latDeg/2), math.Min(179.999999, lon+lonDeg/2), precision)
+				if !seen[hash] {
+					seen[hash] = true
+					prefixes = append(prefixes, hash)
+				}
+			}
+		}
+	}
+	return prefixes
+}
+
+// geoIndexName returns the name a geo index on key is stored under, so that
+// it can coexist with other indexes on the same field
+func geoIndexName(key string) string {
+	return "geo:" + key
+}
+
+// geoValue returns the geohash a geo index stores record under
+func (idx *fieldIndex) geoValue(record map[string]interface{}) (interface{}, bool) {
+	lat, lon, ok := geoPoint(record, idx.field)
+	if !ok {
+		return nil, false
+	}
+	return geohash(lat, lon, geohashPrecision), true
+}
+
+// geoScan walks the entries of a geo index in the cells covering the
+// condition's area; they may lie outside the area itself
+func (idx *fieldIndex) geoScan(condition FilterCondition, fn func(*skipNode) bool) {
+	radius, box, _ := geoArea(condition)
+	if radius != nil {
+		box = radius.bounds()
+	}
+	for _, prefix := range geohashCover(box) {
+		stopped := false
+		idx.sorted.scan(prefix, true, prefix+"~", false, func(n *skipNode) bool {
+			stopped = !fn(n)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// CreateGeoIndex builds a geohash index over the points at key (see
+// GeoValueType), so within_radius and in_bbox conditions on key read only
+// the records in nearby cells instead of scanning everything. Drop it with
+// DropIndex("geo:" + key).
+func (dm *DataManager) CreateGeoIndex(key string) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if key == "" {
+		return errors.New("No field to index")
+	}
+
+	idx := newFieldIndex(key, GeoIndex)
+	started := time.Now()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	ds := dm.writable()
+	for k, record := range ds.all() {
+		idx.add(k, record)
+	}
+	ds.setIndex(geoIndexName(key), idx)
+	dm.logIndexBuilt(geoIndexName(key), idx, started)
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The service below implements proto/jsondm.proto. Its messages are all
+// protobuf well-known types, so only the service glue lives here; it follows
+// the layout protoc-gen-go-grpc produces.
+
+const (
+	jsonDataManagerQueryMethod  = "/jsondm.JsonDataManager/Query"
+	jsonDataManagerGetMethod    = "/jsondm.JsonDataManager/Get"
+	jsonDataManagerPutMethod    = "/jsondm.JsonDataManager/Put"
+	jsonDataManagerDeleteMethod = "/jsondm.JsonDataManager/Delete"
+)
+
+// JsonDataManagerClient is the client API for the JsonDataManager service
+type JsonDataManagerClient interface {
+	Query(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (grpc.ServerStreamingClient[structpb.Struct], error)
+	Get(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*structpb.Struct, error)
+	Put(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*structpb.Struct, error)
+	Delete(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type jsonDataManagerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewJsonDataManagerClient creates a client for the JsonDataManager service
+func NewJsonDataManagerClient(cc grpc.ClientConnInterface) JsonDataManagerClient {
+	return &jsonDataManagerClient{cc}
+}
+
+func (c *jsonDataManagerClient) Query(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (grpc.ServerStreamingClient[structpb.Struct], error) {
+	stream, err := c.cc.NewStream(ctx, &jsonDataManagerServiceDesc.Streams[0], jsonDataManagerQueryMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[structpb.Struct, structpb.Struct]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (c *jsonDataManagerClient) Get(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*structpb.Struct, error) {
+	out := new(structpb.Struct)
+	if err := c.cc.Invoke(ctx, jsonDataManagerGetMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jsonDataManagerClient) Put(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*structpb.Struct, error) {
+	out := new(structpb.Struct)
+	if err := c.cc.Invoke(ctx, jsonDataManagerPutMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jsonDataManagerClient) Delete(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	if err := c.cc.Invoke(ctx, jsonDataManagerDeleteMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// JsonDataManagerServer is the server API for the JsonDataManager service
+type JsonDataManagerServer interface {
+	Query(*structpb.Struct, grpc.ServerStreamingServer[structpb.Struct]) error
+	Get(context.Context, *wrapperspb.StringValue) (*structpb.Struct, error)
+	Put(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	Delete(context.Context, *wrapperspb.StringValue) (*emptypb.Empty, error)
+}
+
+// RegisterJsonDataManagerServer registers srv with a gRPC server
+func RegisterJsonDataManagerServer(s grpc.ServiceRegistrar, srv JsonDataManagerServer) {
+	s.RegisterService(&jsonDataManagerServiceDesc, srv)
+}
+
+func jsonDataManagerQueryHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(structpb.Struct)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(JsonDataManagerServer).Query(m, &grpc.GenericServerStream[structpb.Struct, structpb.Struct]{ServerStream: stream})
+}
+
+func jsonDataManagerGetHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JsonDataManagerServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: jsonDataManagerGetMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JsonDataManagerServer).Get(ctx, req.(*wrapperspb.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func jsonDataManagerPutHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(structpb.Struct)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JsonDataManagerServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: jsonDataManagerPutMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JsonDataManagerServer).Put(ctx, req.(*structpb.Struct))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func jsonDataManagerDeleteHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JsonDataManagerServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: jsonDataManagerDeleteMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JsonDataManagerServer).Delete(ctx, req.(*wrapperspb.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var jsonDataManagerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "jsondm.JsonDataManager",
+	HandlerType: (*JsonDataManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Get", Handler: jsonDataManagerGetHandler},
+		{MethodName: "Put", Handler: jsonDataManagerPutHandler},
+		{MethodName: "Delete", Handler: jsonDataManagerDeleteHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Query", Handler: jsonDataManagerQueryHandler, ServerStreams: true},
+	},
+	Metadata: "proto/jsondm.proto",
+}
+
+// ServeGRPC exposes the manager as the JsonDataManager gRPC service on addr
+func (dm *DataManager) ServeGRPC(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(dm.authorizeUnary),
+		grpc.StreamInterceptor(dm.authorizeStream),
+	)
+	RegisterJsonDataManagerServer(server, &grpcService{dm: dm})
+	return server.Serve(listener)
+}
+
+// methodPermissions are the permissions the service's methods need
+var methodPermissions = map[string]Permission{
+	jsonDataManagerQueryMethod:  PermRead,
+	jsonDataManagerGetMethod:    PermRead,
+	jsonDataManagerPutMethod:    PermWrite,
+	jsonDataManagerDeleteMethod: PermWrite,
+}
+
+// authorizeCall authenticates a call from its metadata and checks the
+// permission its method needs, returning the context carrying the grant
+func (dm *DataManager) authorizeCall(ctx context.Context, method string) (context.Context, error) {
+	ac := dm.access
+	if ac == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	g, err := ac.authenticate(bearer(first("authorization"), first("x-api-key")), time.Now())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	permission, ok := methodPermissions[method]
+	if !ok {
+		permission = PermAdmin
+	}
+	if err := g.check(permission); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return context.WithValue(ctx, grantKey{}, g), nil
+}
+
+func (dm *DataManager) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := dm.authorizeCall(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (dm *DataManager) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := dm.authorizeCall(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorizedStream carries the caller's grant in its context
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context { return s.ctx }
+
+// grpcService adapts a DataManager to JsonDataManagerServer
+type grpcService struct {
+	dm *DataManager
+}
+
+// Query streams matching records as the scan finds them; Send blocks under
+// flow control, so a slow client throttles the scan instead of the server
+// buffering the whole result
+func (s *grpcService) Query(in *structpb.Struct, stream grpc.ServerStreamingServer[structpb.Struct]) error {
+	body, err := json.Marshal(in.AsMap())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	var req queryRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx := stream.Context()
+	policy := s.dm.redactionFor(ctx)
+	err = s.dm.streamQuery(req, grantFor(ctx), func(record map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		msg, err := structpb.NewStruct(project(s.dm.redactRecord(record, policy), req.Fields))
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return stream.Send(msg)
+	})
+	if _, ok := status.FromError(err); err != nil && !ok {
+		return status.Error(codeFor(err, codes.Internal), err.Error())
+	}
+	return err
+}
+
+func (s *grpcService) Get(ctx context.Context, in *wrapperspb.StringValue) (*structpb.Struct, error) {
+	record, err := s.dm.Get(in.GetValue())
+	if err == nil && !s.dm.visible(grantFor(ctx), record) {
+		err = &RecordError{Key: in.GetValue(), Err: ErrRecordNotFound}
+	}
+	if err != nil {
+		return nil, status.Error(codeFor(err, codes.Internal), err.Error())
+	}
+	msg, err := structpb.NewStruct(s.dm.redactRecord(record, s.dm.redactionFor(ctx)))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return msg, nil
+}
+
+func (s *grpcService) Put(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	if err := s.dm.putAs(grantFor(ctx), in.AsMap()); err != nil {
+		return nil, status.Error(codeFor(err, codes.InvalidArgument), err.Error())
+	}
+	policy := s.dm.redactionFor(ctx)
+	if policy == nil {
+		return in, nil
+	}
+	msg, err := structpb.NewStruct(s.dm.redactRecord(in.AsMap(), policy))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return msg, nil
+}
+
+func (s *grpcService) Delete(ctx context.Context, in *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	deleted, err := s.dm.deleteAs(grantFor(ctx), in.GetValue())
+	if err != nil {
+		return nil, status.Error(codeFor(err, codes.Internal), err.Error())
+	}
+	if !deleted {
+		return nil, status.Error(codes.NotFound, ErrRecordNotFound.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// codeFor maps an error to the gRPC status code reporting it, or fallback
+func codeFor(err error, fallback codes.Code) codes.Code {
+	switch {
+	case errors.Is(err, ErrInvalidMode):
+		return codes.FailedPrecondition
+	case errors.Is(err, ErrRecordNotFound):
+		return codes.NotFound
+	case errors.Is(err, ErrNoKeyField):
+		return codes.FailedPrecondition
+	case errors.Is(err, ErrInvalidExpr), errors.Is(err, ErrInvalidPageToken):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrRecordExists):
+		return codes.AlreadyExists
+	case errors.Is(err, ErrMemoryLimitExceeded):
+		return codes.ResourceExhausted
+	case errors.Is(err, ErrTooManyScans):
+		return codes.Unavailable
+	case errors.Is(err, ErrUnauthenticated):
+		return codes.Unauthenticated
+	case errors.Is(err, ErrForbidden):
+		return codes.PermissionDenied
+	default:
+		return fallback
+	}
+}
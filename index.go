@@ -0,0 +1,650 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// IndexType selects the structure backing a secondary index
+type IndexType int
+
+const (
+	HashIndex    IndexType = iota // Equality lookups (==)
+	SortedIndex                   // Equality and range lookups (>, >=, <, <=, ==)
+	TextIndex                     // Full-text search (see CreateTextIndex)
+	GeoIndex                      // Geohash cells of points (see CreateGeoIndex)
+	TrigramIndex                  // Three-character sequences for fuzzy matching (see CreateTrigramIndex)
+)
+
+// String returns the name of the index type
+func (t IndexType) String() string {
+	switch t {
+	case HashIndex:
+		return "hash"
+	case SortedIndex:
+		return "sorted"
+	case TextIndex:
+		return "text"
+	case GeoIndex:
+		return "geo"
+	case TrigramIndex:
+		return "trigram"
+	default:
+		return "unknown"
+	}
+}
+
+// fieldIndex is a secondary index over a single record field, or a sorted
+// index over an ordered list of fields (see CreateCompositeIndex)
+type fieldIndex struct {
+	field  string
+	fields []string // Indexed fields of a composite index (nil otherwise)
+	kind   IndexType
+	hash   map[interface{}]map[string]struct{} // Normalized value -> record keys
+	sorted *skipList
+	text   *invertedIndex // Terms of a text index
+
+	collation Collation // String comparison of a collated index (see CreateCollatedIndex)
+	collator  *collator
+}
+
+// newFieldIndex creates an empty index of the given type
+func newFieldIndex(field string, kind IndexType) *fieldIndex {
+	idx := &fieldIndex{field: field, kind: kind}
+	if kind == SortedIndex || kind == GeoIndex {
+		idx.sorted = newSkipList()
+	} else {
+		idx.hash = make(map[interface{}]map[string]struct{})
+	}
+	return idx
+}
+
+// empty returns a new index with the same definition and no entries
+func (idx *fieldIndex) empty() *fieldIndex {
+	if idx.fields != nil {
+		return newCompositeIndex(idx.fields)
+	}
+	if idx.text != nil {
+		return newTextIndex(idx.field, idx.text.opts)
+	}
+	e := newFieldIndex(idx.field, idx.kind)
+	e.collation, e.collator = idx.collation, idx.collator
+	return e
+}
+
+// valueOf returns the value record is indexed under
+func (idx *fieldIndex) valueOf(record map[string]interface{}) (interface{}, bool) {
+	if idx.fields != nil {
+		return compositeValue(record, idx.fields)
+	}
+	if idx.kind == GeoIndex {
+		return idx.geoValue(record)
+	}
+	value, _ := resolvePath(record, idx.field)
+	if s, ok := value.(string); ok && idx.collator != nil {
+		return idx.collator.key(s), true
+	}
+	return normalizeIndexValue(value)
+}
+
+// conditionValue converts a condition's comparison value into a value of this index
+func (idx *fieldIndex) conditionValue(condition FilterCondition) (interface{}, bool) {
+	if idx.collator == nil {
+		return conditionIndexValue(condition)
+	}
+	s, ok := condition.Value.(string)
+	if !ok || condition.ValueType != "string" || condition.Collation != idx.collation {
+		return nil, false
+	}
+	return idx.collator.key(s), true
+}
+
+// clone returns an independent copy of the index
+func (idx *fieldIndex) clone() *fieldIndex {
+	c := &fieldIndex{field: idx.field, fields: idx.fields, kind: idx.kind, collation: idx.collation, collator: idx.collator}
+	if idx.text != nil {
+		c.text = idx.text.clone()
+		return c
+	}
+	if idx.sorted != nil {
+		c.sorted = idx.sorted.clone()
+		return c
+	}
+	c.hash = make(map[interface{}]map[string]struct{}, len(idx.hash))
+	for value, keys := range idx.hash {
+		copied := make(map[string]struct{}, len(keys))
+		for key := range keys {
+			copied[key] = struct{}{}
+		}
+		c.hash[value] = copied
+	}
+	return c
+}
+
+// add registers a record under its value for the indexed field
+func (idx *fieldIndex) add(key string, record map[string]interface{}) {
+	if idx.text != nil {
+		idx.text.add(key, record[idx.field])
+		return
+	}
+	if idx.kind == TrigramIndex {
+		idx.addTrigrams(key, record)
+		return
+	}
+	value, ok := idx.valueOf(record)
+	if !ok {
+		return
+	}
+	if idx.sorted != nil {
+		idx.sorted.insert(value, key)
+		return
+	}
+	keys, exists := idx.hash[value]
+	if !exists {
+		keys = make(map[string]struct{})
+		idx.hash[value] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// remove drops a record from the index
+func (idx *fieldIndex) remove(key string, record map[string]interface{}) {
+	if idx.text != nil {
+		idx.text.remove(key, record[idx.field])
+		return
+	}
+	if idx.kind == TrigramIndex {
+		idx.removeTrigrams(key, record)
+		return
+	}
+	value, ok := idx.valueOf(record)
+	if !ok {
+		return
+	}
+	if idx.sorted != nil {
+		idx.sorted.remove(value, key)
+		return
+	}
+	if keys, exists := idx.hash[value]; exists {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.hash, value)
+		}
+	}
+}
+
+// supports reports whether the index can answer the given condition
+func (idx *fieldIndex) supports(condition FilterCondition) bool {
+	if idx.kind == GeoIndex {
+		_, _, ok := geoArea(condition)
+		return ok && condition.ValueType == GeoValueType && condition.Key == idx.field
+	}
+	if idx.kind == TrigramIndex {
+		_, _, ok := idx.trigramQuery(condition)
+		return ok && condition.Operator == "fuzzy" && condition.ValueType == "string" && condition.Key == idx.field
+	}
+	if idx.fields != nil || idx.text != nil || condition.Key != idx.field {
+		return false
+	}
+	if _, ok := idx.conditionValue(condition); !ok {
+		return false
+	}
+	switch condition.Operator {
+	case "==":
+		return true
+	case ">", ">=", "<", "<=":
+		return idx.kind == SortedIndex
+	default:
+		return false
+	}
+}
+
+// lookup returns the keys of records that may satisfy the condition
+func (idx *fieldIndex) lookup(condition FilterCondition) []string {
+	if idx.kind == TrigramIndex {
+		return idx.trigramLookup(condition)
+	}
+	value, _ := idx.conditionValue(condition)
+	var keys []string
+
+	if idx.kind == HashIndex {
+		for key := range idx.hash[value] {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	idx.scanMatching(condition, value, func(n *skipNode) bool {
+		keys = append(keys, n.key)
+		return true
+	})
+	return keys
+}
+
+// scanMatching walks the sorted entries that may satisfy condition, whose
+// comparison value is value
+func (idx *fieldIndex) scanMatching(condition FilterCondition, value interface{}, fn func(*skipNode) bool) {
+	if idx.kind == GeoIndex {
+		idx.geoScan(condition, fn)
+		return
+	}
+	idx.scanCondition(condition.Operator, value, fn)
+}
+
+// scanCondition walks the sorted entries selected by operator and value
+func (idx *fieldIndex) scanCondition(operator string, value interface{}, fn func(*skipNode) bool) {
+	switch operator {
+	case "==":
+		idx.sorted.scan(value, true, value, true, fn)
+	case ">":
+		idx.sorted.scan(value, false, nil, false, fn)
+	case ">=":
+		idx.sorted.scan(value, true, nil, false, fn)
+	case "<":
+		idx.sorted.scan(nil, false, value, false, fn)
+	case "<=":
+		idx.sorted.scan(nil, false, value, true, fn)
+	}
+}
+
+// estimate counts the records the condition would select, stopping once
+// the count exceeds limit
+func (idx *fieldIndex) estimate(condition FilterCondition, limit int) int {
+	if idx.kind == TrigramIndex {
+		return len(idx.trigramLookup(condition))
+	}
+	value, _ := idx.conditionValue(condition)
+	if idx.kind == HashIndex {
+		return len(idx.hash[value])
+	}
+
+	count := 0
+	idx.scanMatching(condition, value, func(*skipNode) bool {
+		count++
+		return count <= limit
+	})
+	return count
+}
+
+// stats returns the number of indexed entries and distinct values
+func (idx *fieldIndex) stats() (entries, distinct int) {
+	if idx.text != nil {
+		return len(idx.text.lengths), len(idx.text.postings)
+	}
+	if idx.kind == HashIndex {
+		for _, keys := range idx.hash {
+			entries += len(keys)
+		}
+		return entries, len(idx.hash)
+	}
+	var last interface{}
+	for n := idx.sorted.head.next[0]; n != nil; n = n.next[0] {
+		if entries == 0 || compareIndexValues(n.value, last) != 0 {
+			distinct++
+		}
+		last = n.value
+		entries++
+	}
+	return entries, distinct
+}
+
+// CreateIndex builds a secondary index on field over the in-memory data
+func (dm *DataManager) CreateIndex(field string, kind IndexType) error {
+	return dm.CreateCollatedIndex(field, kind, BinaryCollation)
+}
+
+// CreateCollatedIndex builds a secondary index on field whose string values
+// compare under collation. Only string conditions with the same Collation use
+// it, and a sorted collated index orders values as the collation does.
+func (dm *DataManager) CreateCollatedIndex(field string, kind IndexType, collation Collation) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if kind != HashIndex && kind != SortedIndex {
+		return ErrUnknownIndexType
+	}
+	co, err := collatorFor(collation)
+	if err != nil {
+		return err
+	}
+
+	idx := newFieldIndex(field, kind)
+	if collation != BinaryCollation {
+		idx.collation, idx.collator = collation, co
+	}
+	started := time.Now()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	ds := dm.writable()
+	for key, record := range ds.all() {
+		idx.add(key, record)
+	}
+	ds.setIndex(field, idx)
+	dm.logIndexBuilt(field, idx, started)
+	return nil
+}
+
+// DropIndex removes the secondary index on field, if any
+func (dm *DataManager) DropIndex(field string) {
+	dm.mu.Lock()
+	dm.writable().dropIndex(field)
+	dm.mu.Unlock()
+}
+
+// indexNameFor returns the name of the index that could answer condition
+func indexNameFor(condition FilterCondition) string {
+	switch {
+	case condition.ValueType == GeoValueType:
+		return geoIndexName(condition.Key)
+	case condition.Operator == "fuzzy":
+		return trigramIndexName(condition.Key)
+	}
+	return condition.Key
+}
+
+// rebuildIndexes repopulates every declared secondary index from data
+func rebuildIndexes(declared map[string]*fieldIndex, data map[string]map[string]interface{}) map[string]*fieldIndex {
+	rebuilt := make(map[string]*fieldIndex, len(declared))
+	for field, old := range declared {
+		idx := old.empty()
+		for key, record := range data {
+			idx.add(key, record)
+		}
+		rebuilt[field] = idx
+	}
+	return rebuilt
+}
+
+// normalizeIndexValue converts a decoded JSON value into a comparable index value
+func normalizeIndexValue(v interface{}) (interface{}, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case string:
+		return val, true
+	case bool:
+		return val, true
+	default:
+		return nil, false
+	}
+}
+
+// conditionIndexValue converts a condition's comparison value into an index value
+func conditionIndexValue(condition FilterCondition) (interface{}, bool) {
+	if condition.Collation != BinaryCollation {
+		return nil, false // Only a collated index with the same collation compares alike
+	}
+	switch condition.ValueType {
+	case "int":
+		if v, ok := condition.Value.(int); ok {
+			return float64(v), true
+		}
+	case "string", "datetime", "date":
+		// Dates in a fixed layout sort lexicographically in chronological order
+		if v, ok := condition.Value.(string); ok {
+			return v, true
+		}
+	case "bool":
+		if v, ok := condition.Value.(bool); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// valueRank orders index values of different types: bool < number < string,
+// then composite values and finally the indexMax sentinel
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case bool:
+		return 0
+	case float64:
+		return 1
+	case compositeKey:
+		return 3
+	case indexMaxValue:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// compareIndexValues compares two normalized index values
+func compareIndexValues(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch av := a.(type) {
+	case bool:
+		bv := b.(bool)
+		if av == bv {
+			return 0
+		}
+		if !av {
+			return -1
+		}
+		return 1
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			return -1
+		}
+		if av > bv {
+			return 1
+		}
+		return 0
+	case compositeKey:
+		return compareCompositeKeys(av, b.(compositeKey))
+	case indexMaxValue:
+		return 0
+	default:
+		as, bs := a.(string), b.(string)
+		if as < bs {
+			return -1
+		}
+		if as > bs {
+			return 1
+		}
+		return 0
+	}
+}
+
+// rankFloor returns the smallest index value sharing v's type
+func rankFloor(v interface{}) interface{} {
+	switch v.(type) {
+	case bool:
+		return false
+	case float64:
+		return math.Inf(-1)
+	case compositeKey:
+		return compositeKey{}
+	default:
+		return ""
+	}
+}
+
+const skipListMaxLevel = 24
+
+// skipNode is a single entry in a skip list
+type skipNode struct {
+	value interface{}
+	key   string
+	next  []*skipNode
+}
+
+// skipList is an ordered multimap from index value to record key
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+// newSkipList creates an empty skip list
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// compareEntry orders nodes by value, then by record key
+func compareEntry(value interface{}, key string, n *skipNode) int {
+	if c := compareIndexValues(value, n.value); c != 0 {
+		return c
+	}
+	if key < n.key {
+		return -1
+	}
+	if key > n.key {
+		return 1
+	}
+	return 0
+}
+
+// randomLevel picks the height of a new node
+func (s *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// insert adds a (value, key) entry, ignoring duplicates
+func (s *skipList) insert(value interface{}, key string) {
+	update := make([]*skipNode, skipListMaxLevel)
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && compareEntry(value, key, x.next[i]) > 0 {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	if n := x.next[0]; n != nil && compareEntry(value, key, n) == 0 {
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+	node := &skipNode{value: value, key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	s.length++
+}
+
+// clone copies the list by appending its entries in order
+func (s *skipList) clone() *skipList {
+	c := newSkipList()
+	tail := make([]*skipNode, skipListMaxLevel)
+	for i := range tail {
+		tail[i] = c.head
+	}
+	for n := s.head.next[0]; n != nil; n = n.next[0] {
+		level := c.randomLevel()
+		if level > c.level {
+			c.level = level
+		}
+		node := &skipNode{value: n.value, key: n.key, next: make([]*skipNode, level)}
+		for i := 0; i < level; i++ {
+			tail[i].next[i] = node
+			tail[i] = node
+		}
+		c.length++
+	}
+	return c
+}
+
+// remove deletes a (value, key) entry if present
+func (s *skipList) remove(value interface{}, key string) {
+	update := make([]*skipNode, skipListMaxLevel)
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && compareEntry(value, key, x.next[i]) > 0 {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	node := x.next[0]
+	if node == nil || compareEntry(value, key, node) != 0 {
+		return
+	}
+	for i := 0; i < s.level; i++ {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+}
+
+// seek returns the first node whose value is >= value (or > value when exclusive)
+func (s *skipList) seek(value interface{}, inclusive bool) *skipNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil {
+			c := compareIndexValues(x.next[i].value, value)
+			if c < 0 || (c == 0 && !inclusive) {
+				x = x.next[i]
+				continue
+			}
+			break
+		}
+	}
+	return x.next[0]
+}
+
+// scan visits entries between lo and hi (nil means unbounded within the
+// other bound's type) until fn returns false
+func (s *skipList) scan(lo interface{}, loInclusive bool, hi interface{}, hiInclusive bool, fn func(*skipNode) bool) {
+	ref := lo
+	if ref == nil {
+		ref = hi
+	}
+	if ref == nil {
+		return
+	}
+	rank := valueRank(ref)
+
+	var n *skipNode
+	if lo == nil {
+		n = s.seek(rankFloor(ref), true)
+	} else {
+		n = s.seek(lo, loInclusive)
+	}
+	for ; n != nil; n = n.next[0] {
+		if valueRank(n.value) != rank {
+			return
+		}
+		if hi != nil {
+			c := compareIndexValues(n.value, hi)
+			if c > 0 || (c == 0 && !hiInclusive) {
+				return
+			}
+		}
+		if !fn(n) {
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// IndexBuild tracks an index being built in the background by CreateIndexAsync.
+// Until it is ready the planner does not see the index and queries keep
+// using their previous plans.
+type IndexBuild struct {
+	Field   string
+	Type    IndexType
+	total   int
+	done    atomic.Int64
+	started time.Time
+	ready   atomic.Bool
+	err     error
+	finish  chan struct{}
+}
+
+// Progress returns the share of records indexed so far, from 0 to 100
+func (b *IndexBuild) Progress() float64 {
+	if b.ready.Load() || b.total == 0 {
+		return 100
+	}
+	return 100 * float64(b.done.Load()) / float64(b.total)
+}
+
+// ETA estimates the time left from the rate observed so far; it is zero
+// once the build has finished and unknown (-1) before any progress
+func (b *IndexBuild) ETA() time.Duration {
+	if b.Finished() {
+		return 0
+	}
+	done := b.done.Load()
+	if done == 0 {
+		return -1
+	}
+	elapsed := time.Since(b.started)
+	return time.Duration(float64(elapsed) * float64(int64(b.total)-done) / float64(done))
+}
+
+// Ready reports whether the index is built and used by queries
+func (b *IndexBuild) Ready() bool {
+	return b.ready.Load()
+}
+
+// Done is closed when the build finishes, successfully or not
+func (b *IndexBuild) Done() <-chan struct{} {
+	return b.finish
+}
+
+// Finished reports whether the build has ended
+func (b *IndexBuild) Finished() bool {
+	select {
+	case <-b.finish:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the build finishes and returns its error
+func (b *IndexBuild) Wait() error {
+	<-b.finish
+	return b.err
+}
+
+// CreateIndexAsync builds a secondary index on field in the background and
+// returns immediately. The index is built from a snapshot without blocking
+// readers or writers; writes made meanwhile are applied before it is
+// published. onDone, if not nil, is called with the outcome. Cancelling ctx
+// abandons the build.
+func (dm *DataManager) CreateIndexAsync(ctx context.Context, field string, kind IndexType, onDone func(error)) (*IndexBuild, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+	if kind != HashIndex && kind != SortedIndex {
+		return nil, ErrUnknownIndexType
+	}
+
+	dm.mu.Lock()
+	if _, busy := dm.building[field]; busy {
+		dm.mu.Unlock()
+		return nil, fmt.Errorf("An index on %q is already being built", field)
+	}
+	if dm.building == nil {
+		dm.building = make(map[string]*IndexBuild)
+	}
+	ds := dm.current
+	ds.shared.Store(true)
+	build := &IndexBuild{Field: field, Type: kind, total: ds.len(), started: time.Now(), finish: make(chan struct{})}
+	dm.building[field] = build
+	dm.mu.Unlock()
+
+	go func() {
+		build.err = dm.buildIndex(ctx, build, ds)
+		if build.err != nil && dm.logger != nil {
+			dm.logger.Error("index build failed", "index", field, "type", kind.String(), "error", build.err)
+		}
+		dm.mu.Lock()
+		delete(dm.building, field)
+		dm.mu.Unlock()
+		close(build.finish)
+		if onDone != nil {
+			onDone(build.err)
+		}
+	}()
+	return build, nil
+}
+
+// IndexBuilds returns the index builds in progress
+func (dm *DataManager) IndexBuilds() []*IndexBuild {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	builds := make([]*IndexBuild, 0, len(dm.building))
+	for _, build := range dm.building {
+		builds = append(builds, build)
+	}
+	return builds
+}
+
+// buildIndex fills an index from ds, catches up with later changes and publishes it
+func (dm *DataManager) buildIndex(ctx context.Context, build *IndexBuild, ds *dataset) error {
+	idx := newFieldIndex(build.Field, build.Type)
+	for key, record := range ds.all() {
+		if build.done.Add(1)%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		idx.add(key, record)
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	changed := dm.current != ds
+	current := dm.writable()
+	if changed {
+		// Records are never modified in place, so a changed record is a different map
+		for key, old := range ds.all() {
+			if record, exists := current.get(key); !exists {
+				idx.remove(key, old)
+			} else if !sameRecord(record, old) {
+				idx.remove(key, old)
+				idx.add(key, record)
+			}
+		}
+		for key, record := range current.all() {
+			if _, existed := ds.get(key); !existed {
+				idx.add(key, record)
+			}
+		}
+	}
+	current.setIndex(build.Field, idx)
+	build.ready.Store(true)
+	dm.logIndexBuilt(build.Field, idx, build.started)
+	return nil
+}
+
+// sameRecord reports whether a and b are the same record map
+func sameRecord(a, b map[string]interface{}) bool {
+	return reflect.ValueOf(a).UnsafePointer() == reflect.ValueOf(b).UnsafePointer()
+}
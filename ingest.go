@@ -0,0 +1,290 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message is a JSON message read from a topic
+type Message struct {
+	Partition string // Partition, subject or stream the message came from
+	Offset    int64  // Position of the message in its partition
+	Value     []byte // A JSON object
+}
+
+// MessageSource is a subscription to a topic of JSON messages. No adapter
+// ships with the package: callers implement it over their own Kafka, NATS
+// JetStream or other queue client, so the package depends on none of them.
+type MessageSource interface {
+	// Seek makes the next messages of partition start after offset
+	Seek(partition string, offset int64) error
+	// Fetch blocks until messages are available, or ctx is done
+	Fetch(ctx context.Context) ([]Message, error)
+}
+
+// MessageCommitter is a MessageSource that acknowledges processed messages
+// to the broker, such as a Kafka consumer group committing offsets
+type MessageCommitter interface {
+	Commit(offsets map[string]int64) error
+}
+
+// IngestOptions configures Ingest
+type IngestOptions struct {
+	Upsert     bool   // Upsert the records into memory, keyed by the key field (InMemory mode)
+	Dir        string // Append the records to NDJSON files in this directory ("" disables)
+	File       string // File name, where {field} is the value of a record field and {field:10} its first 10 characters (default "records.ndjson")
+	Checkpoint string // File the processed offsets are saved to after every batch (optional)
+}
+
+// IngestStats counts what Ingest processed
+type IngestStats struct {
+	Messages int64 // Messages fetched
+	Records  int64 // Records upserted or appended
+	Skipped  int64 // Malformed messages skipped under the error policy
+}
+
+// ingestCheckpoint is the content of an Ingest checkpoint file
+type ingestCheckpoint struct {
+	Offsets map[string]int64 `json:"offsets"` // Last processed offset by partition
+}
+
+// Ingest consumes src until ctx is cancelled, upserting every message into
+// the in-memory store and/or appending it to NDJSON files partitioned by
+// opts.File, such as "events-{ts:10}.ndjson" for one file per day of a "ts"
+// field. Delivery is at least once: after each batch the files are synced,
+// then the last offset of every partition is saved to opts.Checkpoint and
+// committed when src is a MessageCommitter. On start, partitions are sought
+// to the checkpointed offsets, so a crash only replays the batch that was in
+// flight; upserts make the replay harmless in memory, while files may hold
+// its records twice. Malformed messages follow the error policy (see
+// SetErrorPolicy). At most SetMaxOpenFiles files are open at once, however
+// many names opts.File produces. When ctx is cancelled, Ingest returns its
+// counts and nil.
+func (dm *DataManager) Ingest(ctx context.Context, src MessageSource, opts IngestOptions) (IngestStats, error) {
+	var stats IngestStats
+	if opts.Upsert && dm.mode != InMemoryMode {
+		return stats, ErrInvalidMode
+	}
+	if !opts.Upsert && opts.Dir == "" {
+		return stats, errors.New("Ingest needs Upsert or a directory to write to")
+	}
+	if opts.File == "" {
+		opts.File = "records.ndjson"
+	}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+			return stats, err
+		}
+	}
+
+	offsets := make(map[string]int64)
+	if opts.Checkpoint != "" {
+		if raw, err := os.ReadFile(opts.Checkpoint); err == nil {
+			var cp ingestCheckpoint
+			if err := json.Unmarshal(raw, &cp); err != nil {
+				return stats, fmt.Errorf("Invalid ingest checkpoint %s: %w", opts.Checkpoint, err)
+			}
+			for partition, offset := range cp.Offsets {
+				if err := src.Seek(partition, offset); err != nil {
+					return stats, err
+				}
+				offsets[partition] = offset
+			}
+		} else if !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+
+	maxOpen := dm.maxOpenFiles
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenFiles
+	}
+	files := &ingestFiles{dir: opts.Dir, maxOpen: maxOpen, byName: make(map[string]*list.Element), open: list.New()}
+	defer files.close()
+
+	for {
+		batch, err := src.Fetch(ctx)
+		if ctx.Err() != nil {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		lines := make(map[string][]byte)
+		for _, msg := range batch {
+			stats.Messages++
+			if err := dm.ingestMessage(msg, opts, lines); err != nil {
+				if err = dm.tolerate(err); err != nil {
+					return stats, err
+				}
+				stats.Skipped++
+			} else {
+				stats.Records++
+			}
+			if offset, seen := offsets[msg.Partition]; !seen || msg.Offset > offset {
+				offsets[msg.Partition] = msg.Offset
+			}
+		}
+		if err := files.append(lines); err != nil {
+			return stats, err
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if opts.Checkpoint != "" {
+			if err := saveIngestCheckpoint(opts.Checkpoint, offsets); err != nil {
+				return stats, err
+			}
+		}
+		if committer, ok := src.(MessageCommitter); ok {
+			if err := committer.Commit(offsets); err != nil {
+				return stats, err
+			}
+		}
+	}
+}
+
+// ingestMessage decodes a message, upserts it and adds its line to the file
+// it belongs in; malformed messages are reported as a ParseError
+func (dm *DataManager) ingestMessage(msg Message, opts IngestOptions, lines map[string][]byte) error {
+	var record map[string]interface{}
+	if err := json.Unmarshal(msg.Value, &record); err != nil || record == nil {
+		if err == nil {
+			err = errors.New("message is not a JSON object")
+		}
+		return &ParseError{File: msg.Partition, Offset: msg.Offset, Snippet: snippet(msg.Value), Err: err}
+	}
+	dm.track(len(msg.Value))
+	if opts.Upsert {
+		if err := dm.Put(record); err != nil {
+			return err
+		}
+	}
+	if opts.Dir != "" {
+		name := ingestFileName(opts.File, record)
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines[name] = append(append(lines[name], line...), '\n')
+	}
+	return nil
+}
+
+// ingestPlaceholder matches a {field} or {field:n} in an ingest file name
+var ingestPlaceholder = regexp.MustCompile(`\{([^{}:]+)(?::(\d+))?\}`)
+
+// ingestFileName fills the placeholders of pattern with the values of record
+func ingestFileName(pattern string, record map[string]interface{}) string {
+	return ingestPlaceholder.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		match := ingestPlaceholder.FindStringSubmatch(placeholder)
+		value := "unknown"
+		if v, ok := resolvePath(record, match[1]); ok && v != nil {
+			value = formatValue(v)
+		}
+		if n, err := strconv.Atoi(match[2]); err == nil && n < utf8.RuneCountInString(value) {
+			value = string([]rune(value)[:n])
+		}
+		return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(value)
+	})
+}
+
+// ingestFiles keeps the most recently written files of Ingest open
+type ingestFiles struct {
+	dir     string
+	maxOpen int                      // Files kept open at once
+	byName  map[string]*list.Element // Open files by name
+	open    *list.List               // Open files, most recently written first
+}
+
+// ingestFile is an open file of Ingest
+type ingestFile struct {
+	name string
+	file *os.File
+}
+
+// append appends lines to their files and syncs them, closing the least
+// recently written file to make room for another
+func (fs *ingestFiles) append(lines map[string][]byte) error {
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		element, ok := fs.byName[name]
+		if ok {
+			fs.open.MoveToFront(element)
+		} else {
+			if fs.open.Len() >= fs.maxOpen {
+				if err := fs.evict(fs.open.Back()); err != nil {
+					return err
+				}
+			}
+			f, err := os.OpenFile(filepath.Join(fs.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return err
+			}
+			element = fs.open.PushFront(&ingestFile{name: name, file: f})
+			fs.byName[name] = element
+		}
+		f := element.Value.(*ingestFile).file
+		if _, err := f.Write(lines[name]); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict closes the file of element
+func (fs *ingestFiles) evict(element *list.Element) error {
+	f := fs.open.Remove(element).(*ingestFile)
+	delete(fs.byName, f.name)
+	return f.file.Close()
+}
+
+// close closes every open file
+func (fs *ingestFiles) close() {
+	for fs.open.Len() > 0 {
+		fs.evict(fs.open.Back())
+	}
+}
+
+// saveIngestCheckpoint writes the offsets to path atomically
+func saveIngestCheckpoint(path string, offsets map[string]int64) error {
+	raw, err := json.MarshalIndent(ingestCheckpoint{Offsets: offsets}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+// SetHTTPTimeout sets the overall timeout for reading http(s):// inputs;
+// zero disables the timeout
+func (dm *DataManager) SetHTTPTimeout(timeout time.Duration) {
+	dm.httpTimeout = timeout
+}
+
+// SetMaxRecordSize caps the size of a single JSON record in bytes; larger
+// records are reported as parse errors (see SetErrorPolicy) instead of being
+// buffered. Zero, the default, accepts records of any size.
+func (dm *DataManager) SetMaxRecordSize(n int) {
+	dm.recordLimit = n
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// InternOptions configures string interning (see EnableStringInterning)
+type InternOptions struct {
+	MaxLength  int // Longest string value shared (default 64 bytes); field names are always shared
+	MaxEntries int // Distinct strings held by the table (default 1M); later strings are kept as decoded
+}
+
+// stringTable holds one copy of every distinct string shared by the records
+// of a manager
+type stringTable struct {
+	mu      sync.Mutex
+	opts    InternOptions
+	strings map[string]interface{} // Shared copy of each string, boxed
+	saved   int64                  // Bytes of duplicate strings replaced by shared copies
+}
+
+// InternStats reports the effect of string interning
+type InternStats struct {
+	Entries    int   // Distinct strings in the table
+	SavedBytes int64 // String bytes shared instead of allocated again
+}
+
+// WithStringInterning enables string interning (see EnableStringInterning)
+func WithStringInterning(opts InternOptions) Option {
+	return func(dm *DataManager) { dm.interning = newStringTable(opts) }
+}
+
+// EnableStringInterning makes InMemory loads and watched-file appends store
+// a single copy of every field name and of every short string value that
+// repeats, such as a status or country, instead of one allocation per
+// record. Loads with millions of records over a few distinct names and
+// values shrink substantially; strings longer than opts.MaxLength, like
+// free text, are kept as decoded. The table lives as long as the manager
+// and is shared with its collections.
+func (dm *DataManager) EnableStringInterning(opts InternOptions) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.interning = newStringTable(opts)
+}
+
+// DisableStringInterning stops interning and releases the table; strings
+// already shared stay shared
+func (dm *DataManager) DisableStringInterning() {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.interning = nil
+}
+
+// InternStats returns the size and savings of the string table
+func (dm *DataManager) InternStats() InternStats {
+	dm.mu.RLock()
+	t := dm.interning
+	dm.mu.RUnlock()
+	if t == nil {
+		return InternStats{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return InternStats{Entries: len(t.strings), SavedBytes: t.saved}
+}
+
+func newStringTable(opts InternOptions) *stringTable {
+	if opts.MaxLength <= 0 {
+		opts.MaxLength = 64
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 1 << 20
+	}
+	return &stringTable{opts: opts, strings: make(map[string]interface{})}
+}
+
+// intern returns record with its field names and short string values
+// replaced by shared copies, or record itself when interning is disabled.
+// Values of the key field keyName never repeat, so they are copied instead,
+// letting the decoder's small allocations around them be freed.
+func (dm *DataManager) intern(record map[string]interface{}, keyName string) map[string]interface{} {
+	t := dm.interning
+	if t == nil {
+		return record
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	interned := make(map[string]interface{}, len(record))
+	for field, value := range record {
+		if key, ok := value.(string); ok && field == keyName {
+			value = strings.Clone(key)
+		} else {
+			value = t.value(value)
+		}
+		interned[t.shared(field).(string)] = value
+	}
+	return interned
+}
+
+// object interns the fields of an object into a new map; the caller holds t.mu
+func (t *stringTable) object(record map[string]interface{}) map[string]interface{} {
+	interned := make(map[string]interface{}, len(record))
+	for field, value := range record {
+		interned[t.shared(field).(string)] = t.value(value)
+	}
+	return interned
+}
+
+// value interns a field value; the caller holds t.mu
+func (t *stringTable) value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if len(v) <= t.opts.MaxLength {
+			return t.shared(v)
+		}
+	case map[string]interface{}:
+		return t.object(v)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = t.value(item)
+		}
+	}
+	return value
+}
+
+// shared returns the shared copy of s, boxed once so that records also
+// share the interface value, adding s to the table while it has room; the
+// caller holds t.mu
+func (t *stringTable) shared(s string) interface{} {
+	if boxed, ok := t.strings[s]; ok {
+		t.saved += int64(len(s))
+		return boxed
+	}
+	var boxed interface{} = s
+	if len(t.strings) < t.opts.MaxEntries {
+		t.strings[s] = boxed
+	}
+	return boxed
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job is a query the manager re-runs on a schedule, replacing a file with
+// its results each time
+type Job struct {
+	Name       string            // Identifies the job
+	Schedule   string            // Cron spec "minute hour day-of-month month day-of-week", or @hourly, @daily, @weekly, @monthly, @every <duration>
+	Conditions []FilterCondition // Records written to the output
+	Source     string            // Input scanned in Split mode ("" uses the most recently loaded or scanned one)
+	Output     string            // File refreshed with the results
+	Format     string            // Export format name ("" picks it from Output's extension)
+	Export     ExportOptions     // Columns and other output settings
+}
+
+// JobStatus describes the runs of a scheduled job
+type JobStatus struct {
+	Name     string
+	NextRun  time.Time
+	LastRun  time.Time     // Start of the latest run (zero before the first)
+	Duration time.Duration // Length of the latest run
+	Records  int           // Records written by the latest successful run
+	Err      error         // Error of the latest run, nil when it succeeded
+}
+
+// scheduledJob is a registered job and its background runner
+type scheduledJob struct {
+	job      Job
+	format   ExportFormat
+	schedule *cronSchedule
+	running  sync.Mutex // Serializes runs
+	mu       sync.Mutex // Guards status
+	status   JobStatus
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// ScheduleJob registers job, replacing any job of the same name, and runs it
+// in the background at every time its schedule matches (in local time).
+// Each run queries the in-memory data, or scans job.Source in Split mode,
+// and atomically replaces job.Output with the results, so readers of the
+// file never see a partial report. Failed runs leave the previous output in
+// place; their error is logged and reported by Jobs.
+func (dm *DataManager) ScheduleJob(job Job) error {
+	if job.Name == "" {
+		return errors.New("Job has no name")
+	}
+	if job.Output == "" {
+		return fmt.Errorf("Job %q has no output file", job.Name)
+	}
+	schedule, err := parseCronSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("Job %q: %w", job.Name, err)
+	}
+	next := schedule.next(time.Now())
+	if next.IsZero() {
+		return fmt.Errorf("Job %q: schedule %q never matches", job.Name, job.Schedule)
+	}
+	name := job.Format
+	if name == "" {
+		name = strings.TrimPrefix(strings.ToLower(filepath.Ext(job.Output)), ".")
+	}
+	format, err := ParseExportFormat(name)
+	if err != nil {
+		return fmt.Errorf("Job %q: %w", job.Name, err)
+	}
+
+	sj := &scheduledJob{
+		job:      job,
+		format:   format,
+		schedule: schedule,
+		status:   JobStatus{Name: job.Name, NextRun: next},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	dm.mu.Lock()
+	if dm.jobs == nil {
+		dm.jobs = make(map[string]*scheduledJob)
+	}
+	previous := dm.jobs[job.Name]
+	dm.jobs[job.Name] = sj
+	dm.mu.Unlock()
+	if previous != nil {
+		previous.halt()
+	}
+	go dm.runPeriodically(sj)
+	return nil
+}
+
+// UnscheduleJob stops the job called name, waiting for a run in progress,
+// and reports whether it existed
+func (dm *DataManager) UnscheduleJob(name string) bool {
+	dm.mu.Lock()
+	sj := dm.jobs[name]
+	delete(dm.jobs, name)
+	dm.mu.Unlock()
+	if sj == nil {
+		return false
+	}
+	sj.halt()
+	return true
+}
+
+// StopJobs stops every scheduled job
+func (dm *DataManager) StopJobs() {
+	dm.mu.Lock()
+	jobs := dm.jobs
+	dm.jobs = nil
+	dm.mu.Unlock()
+	for _, sj := range jobs {
+		sj.halt()
+	}
+}
+
+// RunJob runs the job called name now, outside its schedule
+func (dm *DataManager) RunJob(name string) error {
+	dm.mu.RLock()
+	sj := dm.jobs[name]
+	dm.mu.RUnlock()
+	if sj == nil {
+		return fmt.Errorf("No job named %q", name)
+	}
+	return dm.runJob(sj)
+}
+
+// Jobs returns the status of every scheduled job, sorted by name
+func (dm *DataManager) Jobs() []JobStatus {
+	dm.mu.RLock()
+	jobs := make([]*scheduledJob, 0, len(dm.jobs))
+	for _, sj := range dm.jobs {
+		jobs = append(jobs, sj)
+	}
+	dm.mu.RUnlock()
+
+	statuses := make([]JobStatus, len(jobs))
+	for i, sj := range jobs {
+		sj.mu.Lock()
+		statuses[i] = sj.status
+		sj.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// runPeriodically runs sj whenever its schedule matches until it is halted
+func (dm *DataManager) runPeriodically(sj *scheduledJob) {
+	defer close(sj.done)
+	for {
+		sj.mu.Lock()
+		next := sj.status.NextRun
+		sj.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-sj.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			dm.runJob(sj)
+			sj.mu.Lock()
+			sj.status.NextRun = sj.schedule.next(time.Now())
+			sj.mu.Unlock()
+		}
+	}
+}
+
+// runJob runs the query of sj and replaces its output with the results
+func (dm *DataManager) runJob(sj *scheduledJob) error {
+	sj.running.Lock()
+	defer sj.running.Unlock()
+	started := time.Now()
+	results, err := dm.jobResults(sj.job)
+	if err == nil {
+		err = replaceFile(sj.job.Output, nil, func(w io.Writer) error {
+			return Export(results, w, sj.format, sj.job.Export)
+		})
+	}
+
+	elapsed := time.Since(started)
+	sj.mu.Lock()
+	sj.status.LastRun = started
+	sj.status.Duration = elapsed
+	sj.status.Err = err
+	if err == nil {
+		sj.status.Records = len(results)
+	}
+	sj.mu.Unlock()
+	if dm.logger != nil {
+		if err != nil {
+			dm.logger.Error("job failed", "job", sj.job.Name, "output", sj.job.Output, "error", err)
+		} else {
+			dm.logger.Info("job finished", "job", sj.job.Name, "output", sj.job.Output, "records", len(results), "duration", elapsed)
+		}
+	}
+	return err
+}
+
+// jobResults returns the records job writes, in input order
+func (dm *DataManager) jobResults(job Job) ([]map[string]interface{}, error) {
+	if dm.mode == InMemoryMode {
+		return dm.Query(job.Conditions)
+	}
+	p := dm.Pipeline().Workers(1).Filter(job.Conditions)
+	if job.Source != "" {
+		p.From(job.Source)
+	}
+	return p.Collect()
+}
+
+// halt stops the runner of sj and waits for it to exit
+func (sj *scheduledJob) halt() {
+	close(sj.stop)
+	<-sj.done
+}
+
+// cronSchedule is a parsed Job.Schedule
+type cronSchedule struct {
+	every                         time.Duration // Fixed interval of @every (0 for cron fields)
+	minute, hour, dom, month, dow uint64        // Bit sets of the matching values
+	anyDOM, anyDOW                bool          // Day fields given as "*"
+}
+
+// Named schedules accepted by parseCronSchedule
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// parseCronSchedule parses a five-field cron spec whose fields hold "*",
+// numbers, ranges "a-b", steps "*/n" or "a-b/n", and comma-separated lists
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("Invalid schedule interval %q", rest)
+		}
+		return &cronSchedule{every: every}, nil
+	}
+	if expanded, ok := cronShorthands[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %q: want 5 fields, got %d", spec, len(fields))
+	}
+
+	s := &cronSchedule{anyDOM: fields[2] == "*", anyDOW: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %w", spec, err)
+		}
+		*sets[i] = set
+	}
+	// Sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField returns the bit set of the values field matches
+func parseCronField(field string, low, high int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if before, after, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(after)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = before, n
+		}
+		from, to := low, high
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("bad range in %q", part)
+				}
+			} else if step > 1 {
+				to = high
+			}
+		}
+		if from < low || to > high || from > to {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, low, high)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time after t the schedule matches, or the zero
+// time when it matches none in the next five years (as for "0 0 30 2 *")
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay applies the cron rule that a day matches either day field when
+// both are restricted
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDOM && s.anyDOW:
+		return true
+	case s.anyDOM:
+		return dow
+	case s.anyDOW:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JoinType selects which records a Join produces
+type JoinType int
+
+const (
+	InnerJoin JoinType = iota // Only pairs of records whose keys match
+	LeftJoin                  // Every left record, merged with its matches when there are any
+)
+
+// Join matches the records of leftFile and rightFile whose leftKey and
+// rightKey fields are equal and returns the merged records. It is a hash
+// join: the smaller input (by size, when known) is held in memory, within
+// maxRAMUsage, and the larger one is streamed. A merged record holds the left
+// fields plus the right fields; a right field whose name is already used by
+// the left record with a different value is stored as "<name>_right".
+func (dm *DataManager) Join(leftFile, rightFile, leftKey, rightKey string, joinType JoinType) ([]map[string]interface{}, error) {
+	if joinType != InnerJoin && joinType != LeftJoin {
+		return nil, errors.New("Unknown join type")
+	}
+
+	buildLeft := dm.sourceSize(leftFile) < dm.sourceSize(rightFile)
+	buildFile, buildKey, probeFile, probeKey := rightFile, rightKey, leftFile, leftKey
+	if buildLeft {
+		buildFile, buildKey, probeFile, probeKey = leftFile, leftKey, rightFile, rightKey
+	}
+
+	table, built, err := dm.buildJoinTable(buildFile, buildKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, closer, err := dm.openRecords(probeFile)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var results []map[string]interface{}
+	matched := make(map[*joinEntry]bool)
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var entries []*joinEntry
+		if key, ok := normalizeIndexValue(record[probeKey]); ok {
+			entries = table[key]
+		}
+		for _, entry := range entries {
+			if buildLeft {
+				matched[entry] = true
+				results = append(results, mergeJoined(entry.record, record))
+			} else {
+				results = append(results, mergeJoined(record, entry.record))
+			}
+		}
+		if len(entries) == 0 && joinType == LeftJoin && !buildLeft {
+			results = append(results, mergeJoined(record, nil))
+		}
+	}
+
+	// Left records held in memory that found no partner
+	if joinType == LeftJoin && buildLeft {
+		for _, entry := range built {
+			if !matched[entry] {
+				results = append(results, mergeJoined(entry.record, nil))
+			}
+		}
+	}
+	return results, nil
+}
+
+// joinEntry is a record of the in-memory side of a join
+type joinEntry struct {
+	record map[string]interface{}
+}
+
+// buildJoinTable loads location into a hash table keyed by its key field.
+// Every record is also returned in input order, including those without a
+// usable key, so a left join can emit them.
+func (dm *DataManager) buildJoinTable(location, keyField string) (map[interface{}][]*joinEntry, []*joinEntry, error) {
+	reader, closer, err := dm.openRecords(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closer.Close()
+
+	table := make(map[interface{}][]*joinEntry)
+	var all []*joinEntry
+	var usage int64
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		usage += estimateRecordSize(record)
+		if usage > dm.maxRAMUsage {
+			return nil, nil, fmt.Errorf("Join input %s does not fit in the memory limit", location)
+		}
+		entry := &joinEntry{record: record}
+		all = append(all, entry)
+		if key, ok := normalizeIndexValue(record[keyField]); ok {
+			table[key] = append(table[key], entry)
+		}
+	}
+	return table, all, nil
+}
+
+// mergeJoined combines a left record with a right one (nil for an unmatched left join row)
+func mergeJoined(left, right map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(left)+len(right))
+	for field, value := range left {
+		merged[field] = value
+	}
+	for field, value := range right {
+		if existing, clash := merged[field]; clash {
+			a, aok := normalizeIndexValue(existing)
+			b, bok := normalizeIndexValue(value)
+			if aok && bok && a == b {
+				continue
+			}
+			field += "_right"
+		}
+		merged[field] = value
+	}
+	return merged
+}
+
+// sourceSize returns the size of the input at location, or -1 when unknown
+func (dm *DataManager) sourceSize(location string) int64 {
+	src, err := dm.resolveSource(location)
+	if err != nil {
+		return -1
+	}
+	if rs, ok := src.(RangeSource); ok {
+		if size, err := rs.Size(); err == nil {
+			return size
+		}
+	}
+	return -1
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// errUnsupportedSchema is returned when a schema document is not an object or boolean
+var errUnsupportedSchema = errors.New("JSON Schema must be an object or a boolean")
+
+// JSONSchema is a compiled JSON Schema document. It supports the validation
+// keywords of drafts 7 and 2020-12 that apply to JSON data (type, enum,
+// const, numeric and string bounds, pattern, format, items/prefixItems,
+// properties/required/additionalProperties/patternProperties, allOf, anyOf,
+// oneOf, not, if/then/else) and local $ref pointers. Remote references are
+// not supported.
+type JSONSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// CompileJSONSchema parses a JSON Schema document
+func CompileJSONSchema(doc []byte) (*JSONSchema, error) {
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, fmt.Errorf("Invalid JSON Schema: %w", err)
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, errUnsupportedSchema
+	}
+	s := &JSONSchema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.compile(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadJSONSchema reads and compiles a JSON Schema file
+func LoadJSONSchema(path string) (*JSONSchema, error) {
+	doc, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return CompileJSONSchema(doc)
+}
+
+// compile precompiles regular expressions and checks references
+func (s *JSONSchema) compile(node interface{}) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			switch key {
+			case "pattern":
+				if pattern, ok := value.(string); ok {
+					if err := s.addPattern(pattern); err != nil {
+						return err
+					}
+				}
+			case "patternProperties":
+				if props, ok := value.(map[string]interface{}); ok {
+					for pattern := range props {
+						if err := s.addPattern(pattern); err != nil {
+							return err
+						}
+					}
+				}
+			case "$ref":
+				if ref, ok := value.(string); ok {
+					if _, err := s.resolve(ref); err != nil {
+						return err
+					}
+				}
+			}
+			if err := s.compile(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range n {
+			if err := s.compile(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *JSONSchema) addPattern(pattern string) error {
+	if _, ok := s.patterns[pattern]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid pattern %q in JSON Schema: %w", pattern, err)
+	}
+	s.patterns[pattern] = re
+	return nil
+}
+
+// resolve follows a local reference such as "#/$defs/address"
+func (s *JSONSchema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("Unsupported JSON Schema reference %q", ref)
+	}
+	node := s.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("Unresolvable JSON Schema reference %q", ref)
+			}
+			node = n[i]
+		default:
+			node = nil
+		}
+		if node == nil {
+			return nil, fmt.Errorf("Unresolvable JSON Schema reference %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// Validate returns the ways record violates the schema, or nil if it is valid
+func (s *JSONSchema) Validate(record map[string]interface{}) []string {
+	var problems []string
+	s.validate(s.root, record, "", &problems, 0)
+	return problems
+}
+
+// validate checks value against schema, appending violations at path
+func (s *JSONSchema) validate(schema interface{}, value interface{}, path string, problems *[]string, depth int) {
+	fail := func(format string, args ...interface{}) {
+		at := path
+		if at == "" {
+			at = "/"
+		}
+		*problems = append(*problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if depth > 64 {
+		fail("schema nesting too deep")
+		return
+	}
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			fail("no value is allowed here")
+		}
+		return
+	}
+	sc, ok := schema.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if ref, ok := sc["$ref"].(string); ok {
+		if target, err := s.resolve(ref); err == nil {
+			s.validate(target, value, path, problems, depth+1)
+		}
+	}
+
+	if t, ok := sc["type"]; ok && !jsonTypeMatches(t, value) {
+		fail("expected %s, got %s", formatTypes(t), jsonSchemaTypeOf(value))
+		return
+	}
+	if enum, ok := sc["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range enum {
+			if reflect.DeepEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if c, ok := sc["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("value must be %v", c)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		s.validateNumber(sc, v, fail)
+	case string:
+		s.validateString(sc, v, fail)
+	case []interface{}:
+		s.validateArray(sc, v, path, problems, depth, fail)
+	case map[string]interface{}:
+		s.validateObject(sc, v, path, problems, depth, fail)
+	}
+
+	if all, ok := sc["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			s.validate(sub, value, path, problems, depth+1)
+		}
+	}
+	if anyOf, ok := sc["anyOf"].([]interface{}); ok {
+		if s.countValid(anyOf, value, path, depth) == 0 {
+			fail("value does not match any of the anyOf schemas")
+		}
+	}
+	if oneOf, ok := sc["oneOf"].([]interface{}); ok {
+		if n := s.countValid(oneOf, value, path, depth); n != 1 {
+			fail("value matches %d of the oneOf schemas, expected exactly 1", n)
+		}
+	}
+	if not, ok := sc["not"]; ok && s.isValid(not, value, path, depth) {
+		fail("value must not match the schema in not")
+	}
+	if cond, ok := sc["if"]; ok {
+		if s.isValid(cond, value, path, depth) {
+			if then, ok := sc["then"]; ok {
+				s.validate(then, value, path, problems, depth+1)
+			}
+		} else if els, ok := sc["else"]; ok {
+			s.validate(els, value, path, problems, depth+1)
+		}
+	}
+}
+
+func (s *JSONSchema) isValid(schema interface{}, value interface{}, path string, depth int) bool {
+	var problems []string
+	s.validate(schema, value, path, &problems, depth+1)
+	return len(problems) == 0
+}
+
+func (s *JSONSchema) countValid(schemas []interface{}, value interface{}, path string, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		if s.isValid(sub, value, path, depth) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *JSONSchema) validateNumber(sc map[string]interface{}, v float64, fail func(string, ...interface{})) {
+	if min, ok := sc["minimum"].(float64); ok {
+		if exclusive, _ := sc["exclusiveMinimum"].(bool); exclusive && v <= min {
+			fail("must be > %v", min)
+		} else if v < min {
+			fail("must be >= %v", min)
+		}
+	}
+	if max, ok := sc["maximum"].(float64); ok {
+		if exclusive, _ := sc["exclusiveMaximum"].(bool); exclusive && v >= max {
+			fail("must be < %v", max)
+		} else if v > max {
+			fail("must be <= %v", max)
+		}
+	}
+	if min, ok := sc["exclusiveMinimum"].(float64); ok && v <= min {
+		fail("must be > %v", min)
+	}
+	if max, ok := sc["exclusiveMaximum"].(float64); ok && v >= max {
+		fail("must be < %v", max)
+	}
+	if m, ok := sc["multipleOf"].(float64); ok && m > 0 {
+		if q := v / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", m)
+		}
+	}
+}
+
+func (s *JSONSchema) validateString(sc map[string]interface{}, v string, fail func(string, ...interface{})) {
+	length := utf8.RuneCountInString(v)
+	if min, ok := sc["minLength"].(float64); ok && float64(length) < min {
+		fail("must be at least %v characters", min)
+	}
+	if max, ok := sc["maxLength"].(float64); ok && float64(length) > max {
+		fail("must be at most %v characters", max)
+	}
+	if pattern, ok := sc["pattern"].(string); ok {
+		if re := s.patterns[pattern]; re != nil && !re.MatchString(v) {
+			fail("does not match pattern %q", pattern)
+		}
+	}
+	if format, ok := sc["format"].(string); ok && !formatMatches(format, v) {
+		fail("is not a valid %s", format)
+	}
+}
+
+func (s *JSONSchema) validateArray(sc map[string]interface{}, v []interface{}, path string, problems *[]string, depth int, fail func(string, ...interface{})) {
+	if min, ok := sc["minItems"].(float64); ok && float64(len(v)) < min {
+		fail("must have at least %v items", min)
+	}
+	if max, ok := sc["maxItems"].(float64); ok && float64(len(v)) > max {
+		fail("must have at most %v items", max)
+	}
+	if unique, _ := sc["uniqueItems"].(bool); unique {
+	outer:
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if reflect.DeepEqual(v[i], v[j]) {
+					fail("items must be unique")
+					break outer
+				}
+			}
+		}
+	}
+
+	// Draft 2020-12 uses prefixItems + items; draft 7 uses an items array + additionalItems
+	prefix, _ := sc["prefixItems"].([]interface{})
+	rest, hasRest := sc["items"]
+	if tuple, ok := rest.([]interface{}); ok {
+		prefix = tuple
+		rest, hasRest = sc["additionalItems"]
+	}
+	for i, item := range v {
+		itemPath := path + "/" + strconv.Itoa(i)
+		if i < len(prefix) {
+			s.validate(prefix[i], item, itemPath, problems, depth+1)
+		} else if hasRest {
+			s.validate(rest, item, itemPath, problems, depth+1)
+		}
+	}
+	if contains, ok := sc["contains"]; ok {
+		found := false
+		for _, item := range v {
+			if s.isValid(contains, item, path, depth) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must contain an item matching the contains schema")
+		}
+	}
+}
+
+func (s *JSONSchema) validateObject(sc map[string]interface{}, v map[string]interface{}, path string, problems *[]string, depth int, fail func(string, ...interface{})) {
+	if min, ok := sc["minProperties"].(float64); ok && float64(len(v)) < min {
+		fail("must have at least %v properties", min)
+	}
+	if max, ok := sc["maxProperties"].(float64); ok && float64(len(v)) > max {
+		fail("must have at most %v properties", max)
+	}
+	if required, ok := sc["required"].([]interface{}); ok {
+		for _, name := range required {
+			if field, ok := name.(string); ok {
+				if _, exists := v[field]; !exists {
+					fail("missing required property %q", field)
+				}
+			}
+		}
+	}
+
+	properties, _ := sc["properties"].(map[string]interface{})
+	patternProperties, _ := sc["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := sc["additionalProperties"]
+
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		propPath := path + "/" + key
+		matched := false
+		if sub, ok := properties[key]; ok {
+			s.validate(sub, v[key], propPath, problems, depth+1)
+			matched = true
+		}
+		for pattern, sub := range patternProperties {
+			if re := s.patterns[pattern]; re != nil && re.MatchString(key) {
+				s.validate(sub, v[key], propPath, problems, depth+1)
+				matched = true
+			}
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				fail("unexpected property %q", key)
+			} else {
+				s.validate(additional, v[key], propPath, problems, depth+1)
+			}
+		}
+	}
+}
+
+// jsonTypeMatches reports whether value has one of the types named by t
+func jsonTypeMatches(t interface{}, value interface{}) bool {
+	switch tt := t.(type) {
+	case string:
+		actual := jsonSchemaTypeOf(value)
+		return tt == actual || (tt == "number" && actual == "integer")
+	case []interface{}:
+		for _, name := range tt {
+			if jsonTypeMatches(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// jsonSchemaTypeOf names the JSON Schema type of a decoded value
+func jsonSchemaTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func formatTypes(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, len(list))
+		for i, name := range list {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// formatMatches checks the string formats that matter for filtering; unknown formats pass
+func formatMatches(format, v string) bool {
+	switch format {
+	case "date":
+		_, err := time.Parse("2006-01-02", v)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, v)
+		return err == nil
+	case "time":
+		_, err := time.Parse("15:04:05", strings.TrimSuffix(v, "Z"))
+		return err == nil
+	case "email":
+		_, err := mail.ParseAddress(v)
+		return err == nil && !strings.ContainsAny(v, "<> ")
+	default:
+		return true
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// keySeparator joins the parts of a composite key
+const keySeparator = "\x1f"
+
+// KeyFields returns the key name of a composite key over fields, in order,
+// such as "region,id". Pass it wherever a key field is taken.
+func KeyFields(fields ...string) string {
+	return strings.Join(fields, ",")
+}
+
+// CompositeKey returns the key of a record whose key fields, in the order
+// of the composite key name, hold values, as Get, Delete and the servers
+// take it. The canonical form of each value is the one of a single-field
+// key (see recordKey), and the parts are joined by the unit separator
+// "\x1f".
+func CompositeKey(values ...interface{}) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i], _ = canonicalKey(value)
+	}
+	return strings.Join(parts, keySeparator)
+}
+
+// recordKey returns the key of record under keyName: the canonical form of
+// the keyName field (a dotted path reaches into nested objects), or, when
+// keyName lists several comma-separated fields,
+// the canonical forms of their values joined by keySeparator. ok is false
+// when a key field is missing, null, an object or an array.
+func recordKey(record map[string]interface{}, keyName string) (string, bool) {
+	if !strings.Contains(keyName, ",") {
+		value, _ := resolvePath(record, keyName)
+		return canonicalKey(value)
+	}
+	var b strings.Builder
+	for rest, i := keyName, 0; rest != ""; i++ {
+		var field string
+		field, rest, _ = strings.Cut(rest, ",")
+		value, _ := resolvePath(record, field)
+		part, ok := canonicalKey(value)
+		if !ok {
+			return "", false
+		}
+		if i > 0 {
+			b.WriteString(keySeparator)
+		}
+		b.WriteString(part)
+	}
+	return b.String(), true
+}
+
+// keyFieldNames returns the fields of keyName
+func keyFieldNames(keyName string) []string {
+	return strings.Split(keyName, ",")
+}
+
+// plainStringKey reports whether key can only be the value of a string
+// field, not the canonical form of a number or bool
+func plainStringKey(key string) bool {
+	if key == "true" || key == "false" {
+		return false
+	}
+	_, err := strconv.ParseFloat(key, 64)
+	return err != nil
+}
+
+// canonicalKey returns the text of a key value: strings as they are,
+// integral numbers without a fraction or exponent ("42", whether read from
+// JSON, CSV or a binary format), other numbers in their shortest form, and
+// bools as "true" or "false"
+func canonicalKey(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return "", false
+		}
+		if v == 0 {
+			return "0", true // Also -0
+		}
+		if v == math.Trunc(v) && math.Abs(v) < 1e21 {
+			return strconv.FormatFloat(v, 'f', 0, 64), true
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return "", false
+}
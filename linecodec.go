@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Codec decodes and encodes a line-oriented record format, one record per
+// line, such as JSON behind a log prefix or protobuf messages in JSON form
+type Codec interface {
+	// Decode returns the record of a line, or nil to skip the line
+	Decode(line []byte) (map[string]interface{}, error)
+	// Encode returns the line of a record, without its line ending
+	Encode(record map[string]interface{}) ([]byte, error)
+}
+
+// RegisterCodec makes a line codec available under name and for files with
+// the given extensions, like a record codec registered with
+// RegisterRecordCodec: loads and scans read such files line by line through
+// Decode, SetInputFormat(name) selects it for other inputs, and
+// WriteRecords(w, name, records) writes through Encode. Lines Decode rejects
+// are reported as ParseErrors and follow the error policy.
+func RegisterCodec(name string, extensions []string, codec Codec) {
+	RegisterRecordCodec(name, extensions, lineCodec{codec: codec})
+}
+
+// lineCodec adapts a Codec to a RecordCodec
+type lineCodec struct {
+	codec Codec
+}
+
+func (c lineCodec) NewDecoder(r io.Reader) RecordDecoder {
+	return &lineDecoder{codec: c.codec, br: bufio.NewReader(r)}
+}
+
+func (c lineCodec) NewEncoder(w io.Writer) RecordEncoder {
+	return &lineEncoder{codec: c.codec, bw: bufio.NewWriter(w)}
+}
+
+// lineDecoder decodes a stream line by line
+type lineDecoder struct {
+	codec  Codec
+	br     *bufio.Reader
+	buf    []byte
+	line   int
+	offset int64
+}
+
+// Next decodes the next line that holds a record
+func (d *lineDecoder) Next() (map[string]interface{}, int, error) {
+	size := 0
+	for {
+		line, n, _, err := readLine(d.br, d.buf[:0], 0)
+		d.buf = line
+		offset := d.offset
+		d.offset += int64(n)
+		size += n
+		if n > 0 {
+			d.line++
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			record, decodeErr := d.codec.Decode(line)
+			if decodeErr != nil {
+				return nil, size, &ParseError{Line: d.line, Offset: offset, Snippet: snippet(line), Err: decodeErr}
+			}
+			if record != nil {
+				return record, size, nil
+			}
+		}
+		if err != nil {
+			return nil, size, err
+		}
+	}
+}
+
+// lineEncoder writes one encoded record per line
+type lineEncoder struct {
+	codec Codec
+	bw    *bufio.Writer
+}
+
+func (e *lineEncoder) Encode(record map[string]interface{}) error {
+	line, err := e.codec.Encode(record)
+	if err != nil {
+		return err
+	}
+	e.bw.Write(line)
+	return e.bw.WriteByte('\n')
+}
+
+func (e *lineEncoder) Flush() error {
+	return e.bw.Flush()
+}
+
+// PrefixedJSONCodec reads lines made of a prefix, such as a timestamp or a
+// log level, followed by a JSON object, as in
+// `2024-01-02T03:04:05Z INFO {"user": "ann"}`
+type PrefixedJSONCodec struct {
+	Field string // Field receiving the trimmed prefix ("" drops it)
+}
+
+// Decode splits the line at its first '{' and decodes the object after it
+func (c PrefixedJSONCodec) Decode(line []byte) (map[string]interface{}, error) {
+	start := bytes.IndexByte(line, '{')
+	if start < 0 {
+		return nil, errors.New("line holds no JSON object")
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(line[start:], &record); err != nil {
+		return nil, err
+	}
+	if c.Field != "" {
+		if prefix := bytes.TrimSpace(line[:start]); len(prefix) > 0 {
+			record[c.Field] = string(prefix)
+		}
+	}
+	return record, nil
+}
+
+// Encode writes the prefix field, a space and the rest of the record as JSON
+func (c PrefixedJSONCodec) Encode(record map[string]interface{}) ([]byte, error) {
+	prefix, _ := record[c.Field].(string)
+	if prefix == "" {
+		return json.Marshal(record)
+	}
+	rest := make(map[string]interface{}, len(record))
+	for field, value := range record {
+		if field != c.Field {
+			rest[field] = value
+		}
+	}
+	line, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(prefix+" "), line...), nil
+}
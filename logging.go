@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Logger receives structured log events as a message followed by alternating
+// keys and values. *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// SetLogger sends log events to logger (nil, the default, disables logging):
+// load and scan start and finish, skipped malformed records with their
+// position, index builds, and slow queries (see SetSlowQueryThreshold)
+func (dm *DataManager) SetLogger(logger Logger) {
+	dm.logger = logger
+}
+
+// SetSlowQueryThreshold logs queries and Split-mode scans taking at least d
+// as warnings; zero disables slow query logging
+func (dm *DataManager) SetSlowQueryThreshold(d time.Duration) {
+	dm.slowQuery = d
+}
+
+// logOperation logs the outcome of a load or scan
+func (dm *DataManager) logOperation(op, source string, elapsed time.Duration, records, bytes int64, err error) {
+	if err != nil {
+		dm.logger.Error(op+" failed", "source", source, "records", records, "bytes", bytes, "duration", elapsed, "error", err)
+		return
+	}
+	dm.logger.Info(op+" finished", "source", source, "records", records, "bytes", bytes, "duration", elapsed, "parse_errors", dm.ParseErrorCount())
+	if op == "scan" && dm.slowQuery > 0 && elapsed >= dm.slowQuery {
+		dm.logger.Warn("slow query", "source", source, "duration", elapsed)
+	}
+}
+
+// logSlowQuery logs an in-memory query that took at least the slow query threshold
+func (dm *DataManager) logSlowQuery(plan *QueryPlan, conditions []FilterCondition, elapsed time.Duration, rows int) {
+	if dm.logger == nil || dm.slowQuery <= 0 || elapsed < dm.slowQuery {
+		return
+	}
+	formatted := make([]string, len(conditions))
+	for i, condition := range conditions {
+		formatted[i] = formatCondition(condition)
+	}
+	dm.logger.Warn("slow query", "conditions", strings.Join(formatted, " AND "), "plan", plan.String(), "rows", rows, "duration", elapsed)
+}
+
+// logParseError logs a malformed record that the error policy skips
+func (dm *DataManager) logParseError(err *ParseError) {
+	if dm.logger == nil {
+		return
+	}
+	args := []interface{}{"error", err.Err}
+	if err.File != "" {
+		args = append(args, "file", err.File)
+	}
+	if err.Line > 0 {
+		args = append(args, "line", err.Line)
+	}
+	if err.Offset >= 0 {
+		args = append(args, "offset", err.Offset)
+	}
+	dm.logger.Warn("skipped malformed record", args...)
+}
+
+// logIndexBuilt logs a finished index build
+func (dm *DataManager) logIndexBuilt(name string, idx *fieldIndex, started time.Time) {
+	if dm.logger == nil {
+		return
+	}
+	entries, distinct := idx.stats()
+	dm.logger.Info("index built", "index", name, "type", idx.kind.String(), "entries", entries, "distinct", distinct, "duration", time.Since(started))
+}
+
+// describePaths names a list of inputs in log events
+func describePaths(paths []string) string {
+	switch len(paths) {
+	case 0:
+		return ""
+	case 1:
+		return paths[0]
+	default:
+		return fmt.Sprintf("%s and %d more", paths[0], len(paths)-1)
+	}
+}
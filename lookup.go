@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// keyOffsetIndex maps the keys of a local NDJSON file to the offsets of their
+// lines, so Split-mode point lookups read one line instead of scanning
+type keyOffsetIndex struct {
+	path    string
+	keyName string
+	offsets map[string]int64
+	size    int64     // File size when indexed
+	modTime time.Time // File modification time when indexed
+}
+
+// BuildKeyIndex records the offset of every line of the NDJSON file at
+// filePath by its keyName field, for Get, GetMany and Exists in Split mode.
+// When a key appears more than once the last line wins, as in loads. The
+// index is rebuilt automatically when the file changes.
+func (dm *DataManager) BuildKeyIndex(filePath string, keyName string) error {
+	if dm.mode != SplitMode {
+		return ErrInvalidMode
+	}
+	idx, err := dm.buildKeyOffsets(filePath, keyName)
+	if err != nil {
+		return err
+	}
+	dm.mu.Lock()
+	dm.keyOffsets = idx
+	dm.keyName = keyName
+	dm.mu.Unlock()
+	return nil
+}
+
+// buildKeyOffsets scans filePath and indexes the offsets of its lines by key
+func (dm *DataManager) buildKeyOffsets(filePath string, keyName string) (*keyOffsetIndex, error) {
+	started := time.Now()
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	br := dm.chunkReader(f)
+	defer dm.releaseChunkReader(br)
+	if head, _ := br.Peek(2); bytes.Equal(head, []byte{0x1f, 0x8b}) {
+		return nil, fmt.Errorf("%s is compressed; key indexes need uncompressed newline-delimited JSON", filePath)
+	}
+
+	idx := &keyOffsetIndex{path: filePath, keyName: keyName, offsets: make(map[string]int64), size: info.Size(), modTime: info.ModTime()}
+	wanted := make(map[string]bool)
+	for _, field := range keyFieldNames(keyName) {
+		wanted[field] = true
+	}
+	var buf []byte
+	var pos int64
+	for {
+		line, n, _, err := readLine(br, buf[:0], dm.recordLimit)
+		buf = line
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if pos == 0 && trimmed[0] == '[' {
+				return nil, fmt.Errorf("%s holds a JSON array; key indexes need newline-delimited JSON", filePath)
+			}
+			fields := make(map[string]interface{}, len(wanted))
+			if line, perr := dm.preprocessLine(line); perr == nil && extractFields(line, wanted, fields) == nil {
+				if key, ok := recordKey(fields, keyName); ok {
+					idx.offsets[key] = pos
+				}
+			}
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dm.logger != nil {
+		dm.logger.Info("key index built", "source", filePath, "key", keyName, "entries", len(idx.offsets), "duration", time.Since(started))
+	}
+	return idx, nil
+}
+
+// Get returns the record stored under key. In Split mode it asks the storage
+// engine (see OpenStorage), or reads the line found by the key index (see
+// BuildKeyIndex). A missing key is reported as a
+// RecordError matching ErrRecordNotFound.
+func (dm *DataManager) Get(key string) (map[string]interface{}, error) {
+	records, err := dm.GetMany([]string{key})
+	if err != nil {
+		return nil, err
+	}
+	record, ok := records[key]
+	if !ok {
+		return nil, &RecordError{Key: key, Err: ErrRecordNotFound}
+	}
+	return record, nil
+}
+
+// Exists reports whether a record is stored under key
+func (dm *DataManager) Exists(key string) (bool, error) {
+	_, err := dm.Get(key)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, ErrRecordNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// GetMany returns the records stored under keys, keyed by key. Keys without a
+// record are left out of the result.
+func (dm *DataManager) GetMany(keys []string) (map[string]map[string]interface{}, error) {
+	switch dm.mode {
+	case InMemoryMode:
+		records := make(map[string]map[string]interface{}, len(keys))
+		for _, key := range keys {
+			if record, ok := dm.lookup(key); ok {
+				records[key] = record
+			}
+		}
+		return records, nil
+	case SplitMode:
+		if engine := dm.storageEngine(); engine != nil {
+			return storageGetMany(engine, keys)
+		}
+		return dm.readKeys(keys)
+	}
+	return nil, ErrInvalidMode
+}
+
+// currentKeyOffsets returns the key index, building it for the loaded source
+// in AutoMode and rebuilding it when its file changed since it was built
+func (dm *DataManager) currentKeyOffsets() (*keyOffsetIndex, error) {
+	dm.mu.RLock()
+	idx, path, keyName := dm.keyOffsets, dm.sourcePath, dm.keyName
+	dm.mu.RUnlock()
+
+	if idx != nil && dm.auto && (idx.path != path || idx.keyName != keyName) {
+		idx = nil // Load moved on to another input
+	}
+	if idx == nil {
+		if !dm.auto || path == "" || keyName == "" {
+			return nil, fmt.Errorf("%w; call BuildKeyIndex before point lookups in Split mode", ErrNoKeyField)
+		}
+	} else {
+		path, keyName = idx.path, idx.keyName
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() == idx.size && info.ModTime().Equal(idx.modTime) {
+			return idx, nil
+		}
+	}
+
+	idx, err := dm.buildKeyOffsets(path, keyName)
+	if err != nil {
+		return nil, err
+	}
+	dm.mu.Lock()
+	dm.keyOffsets = idx
+	dm.mu.Unlock()
+	return idx, nil
+}
+
+// readKeys reads the lines of keys from the key-indexed file in file order
+func (dm *DataManager) readKeys(keys []string) (map[string]map[string]interface{}, error) {
+	idx, err := dm.currentKeyOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	type wantedLine struct {
+		key    string
+		offset int64
+	}
+	var lines []wantedLine
+	for _, key := range keys {
+		if offset, ok := idx.offsets[key]; ok {
+			lines = append(lines, wantedLine{key, offset})
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].offset < lines[j].offset })
+
+	records := make(map[string]map[string]interface{}, len(lines))
+	offsets := make([]int64, len(lines))
+	for i, l := range lines {
+		offsets[i] = l.offset
+	}
+	err = dm.readLinesAt(idx.path, offsets, func(i int, record map[string]interface{}, _ int) error {
+		records[lines[i].key] = record
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// readLinesAt decodes the NDJSON lines of path starting at offsets, in
+// ascending order, and passes each record to fn with the index of its offset
+// and the size of its line
+func (dm *DataManager) readLinesAt(path string, offsets []int64, fn func(i int, record map[string]interface{}, size int) error) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := dm.chunkReader(f)
+	defer dm.releaseChunkReader(br)
+
+	var buf []byte
+	for i, offset := range offsets {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		br.Reset(f)
+		line, n, _, err := readLine(br, buf[:0], 0)
+		buf = line
+		if err != nil && err != io.EOF {
+			return err
+		}
+		raw := line
+		if line, err = dm.preprocessLine(raw); err != nil {
+			return &ParseError{File: path, Offset: offset, Snippet: snippet(raw), Err: err}
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		record, err := dm.decodeRecord(line)
+		if err != nil {
+			return &ParseError{File: path, Offset: offset, Snippet: snippet(line), Err: err}
+		}
+		dm.derive(record)
+		if err := fn(i, record, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,139 +1,351 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // DataManager manages JSON data either in memory or in split mode
 type DataManager struct {
-	data         map[string]map[string]interface{}
+	current      *dataset // In-memory data; see snapshot and writable
 	mu           sync.RWMutex
 	maxRAMUsage  int64 // Max memory usage in bytes (default: 2GB)
-	currentUsage int64
-	mode         string // "InMemory" or "Split"
-	index        map[string]map[string]int // Index for optimized search
+	currentUsage *int64 // Tracked usage, shared with the manager's collections
+	dataUsage    int64  // Part of currentUsage charged for the in-memory data, released when a load replaces it
+	mode         Mode // InMemoryMode or SplitMode; in AutoMode, the one chosen by Load
+	auto         bool // Created in AutoMode
+	httpTimeout  time.Duration             // Timeout for http(s):// inputs (0 means none)
+	keyName      string                    // Key field of the loaded data
+	sourcePath   string                    // Location of the most recently loaded or scanned data
+	inputFormat  string                    // Forced input format ("" detects it)
+	csvOptions   CSVOptions                // Settings for CSV/TSV input
+	wal          *writeAheadLog            // Write-ahead log for InMemory writes (nil when disabled)
+	cache        *recordCache              // LRU cache for LookupInSplitMode (nil when disabled)
+	keyOffsets   *keyOffsetIndex           // Line offsets by key for Split-mode point lookups (nil until built)
+	subscribers  map[*Subscription]struct{} // Active change subscriptions
+	validator    *recordValidation         // Validation applied to reads and writes (nil when disabled)
+	errorPolicy  ErrorPolicy               // Handling of malformed records
+	recordLimit  int                       // Largest accepted JSON record in bytes (0 means no limit)
+	sourceField  string                    // Field recording each record's file in multi-file loads ("" disables)
+	partitions   *regexp.Regexp            // File name pattern holding partition values (nil when unset)
+	dedupFields  []string                  // Fields identifying duplicate records during loads (nil disables)
+	fastScan     bool                      // Parse only referenced fields of NDJSON lines in Split mode
+	projection   []string                  // Fields kept in Split-mode results (nil keeps all)
+	building     map[string]*IndexBuild    // Indexes being built by CreateIndexAsync
+	collections  map[string]*DataManager   // Named datasets created by CreateCollection
+	parent       *DataManager              // Manager a collection belongs to (nil for others)
+	expiry       *expiryState              // Record expiration (nil when disabled)
+	reload       *reloadState              // Background reload of the loaded file (nil when disabled)
+	sqlIndex     *sqlIndex                 // SQLite mirror of indexed fields used by Split-mode scans (nil when unused)
+	storage      StorageEngine             // Engine behind Split-mode reads and writes (nil until OpenStorage)
+	preprocess   LinePreprocessor          // Transforms NDJSON lines before decoding (nil when unused)
+	jobs         map[string]*scheduledJob  // Periodic queries registered by ScheduleJob
+	views        map[string]*MaterializedView // Materialized views created by CreateView
+	interning    *stringTable              // Shared copies of repeated strings of loaded records (nil when disabled)
+	decoder      Decoder                   // Decoder of NDJSON lines ("" uses the build's default)
+	noStatistics bool                      // Skip gathering the statistics catalog during loads
+	versions     *versionStore             // Past versions of records (nil when disabled)
+	computed     []computedField           // Fields added to records as they are read
+	keyStrategy  MergeStrategy             // Resolves records sharing a key during loads
+	surrogate    SurrogateKeys             // Generation of keys for records without one
+	keySequence  int64                     // Highest line number key generated (accessed atomically)
+	duplicates   int                       // Records repeating a key in the last load or merge
+	coercion     *coercion                 // Normalizes decoded values to declared types (nil when disabled)
+	repair       *repairer                 // Fixes malformed NDJSON lines (nil when disabled)
+	charset      Charset                   // Character encoding of text input (CharsetAuto detects it)
+	progress     progressConfig            // Progress reporting for loads and scans
+	throttle     *throttle                 // Throughput limits of loads and scans (nil when unlimited)
+	encryption   *fileCipher               // Encrypts snapshots, the WAL and spill files (nil when disabled)
+	redaction    *RedactionPolicy          // Applied to records returned by the servers (nil returns them as stored)
+	fieldTags    map[string][]string       // Tags of fields, such as "pii", used by redaction rules
+	access       *AccessControl            // Authentication and roles of server callers (nil allows everyone)
+	scheduler    *scanScheduler            // Admission of concurrent Split-mode scans (nil when unlimited)
+	resultLimit  ResultLimit               // Memory bound of the records kept by Find (zero when unlimited)
+	maxOpenFiles int                       // Files ExportPartitioned and Ingest keep open at once (0 means 64)
+	blooms       map[string]*fileBlooms    // Bloom filters of files, by path, cached by bloomsOf
+	metrics      Metrics                   // Instrumentation events (nil when disabled)
+	logger       Logger                    // Structured log events (nil when disabled)
+	slowQuery    time.Duration             // Queries taking at least this long are logged (0 disables)
+	workers      int                       // Goroutines used by parallel scans (0 tunes the count)
+	chunkSize    int64                     // Bytes per chunk of parallel scans (0 tunes the size)
+	pinWorkers   bool                      // Pins the workers of parallel scans to CPUs
+	tuner        *scanTuner                // Decode throughput observed by parallel scans
+	dateLayouts  []string                  // Extra layouts accepted for date and datetime conditions
+	bufferSize   int                       // Read buffer of line scans (0 means the 1MB default)
+	parseErrors  parseErrorLog             // Malformed records skipped by the latest load or scan
 	wg           sync.WaitGroup
 }
 
 // FilterCondition describes a filtering condition
 type FilterCondition struct {
-	Key       string      // Field name (e.g., "age", "fullname")
-	ValueType string      // Data type (e.g., "int", "string", "datetime", "date", "bool")
-	Operator  string      // Comparison operator (e.g., ">", "==", "contains", "<")
-	Value     interface{} // Value to compare (e.g., 30, "James", "2024-01-01", true)
+	Key       string      `json:"key"`       // Field name (e.g., "age", "fullname")
+	ValueType string      `json:"type"`      // Data type (e.g., "int", "string", "datetime", "date", "bool")
+	Operator  string      `json:"operator"`  // Comparison operator (e.g., ">", "==", "contains", "<")
+	Value     interface{} `json:"value"`     // Value to compare (e.g., 30, "James", "2024-01-01", true)
+	Collation Collation   `json:"collation"` // How string values compare (e.g., "ci", "de,ai"; empty compares bytes)
 }
 
 // NewDataManager creates a new DataManager instance
-func NewDataManager(maxRAMUsage int64, mode string) *DataManager {
-	return &DataManager{
-		data:        make(map[string]map[string]interface{}),
-		maxRAMUsage: maxRAMUsage,
-		mode:        mode,
-		index:       make(map[string]map[string]int),
-	}
+func NewDataManager(maxRAMUsage int64, mode Mode) *DataManager {
+	dm := &DataManager{
+		current:      newDataset(),
+		maxRAMUsage:  maxRAMUsage,
+		currentUsage: new(int64),
+		mode:         mode,
+		httpTimeout:  30 * time.Second,
+		tuner:        &scanTuner{},
+	}
+	if mode == AutoMode {
+		dm.mode, dm.auto = InMemoryMode, true
+	}
+	return dm
 }
 
-// LoadDataInMemory loads the entire JSON file into memory and creates index
+// LoadDataInMemory loads the entire JSON file (NDJSON or array) into memory and creates index.
+// Files ending in .csv or .tsv are read as delimited text (see SetCSVOptions).
+// filePath may also be "-" for stdin, an http(s):// URL, a cloud object
+// location such as s3://bucket/key, or a glob such as events-2024-*.json.
+// keyName may hold string, number or bool values, or list several fields
+// forming a composite key (see KeyFields and CompositeKey).
 func (dm *DataManager) LoadDataInMemory(filePath string, keyName string) error {
-	if dm.mode != "InMemory" {
-		return errors.New("Invalid mode for this operation")
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if isGlob(filePath) {
+		paths, err := expandGlob(filePath)
+		if err != nil {
+			return err
+		}
+		err = dm.LoadFilesInMemory(paths, keyName)
+		dm.setSourcePath(filePath)
+		return err
 	}
 
-	file, err := os.Open(filePath)
+	src, err := dm.resolveSource(filePath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	dm.setSourcePath(filePath)
+	return dm.LoadSourceInMemory(src, keyName)
+}
+
+// LoadFromReader loads every record from r into memory and creates index
+func (dm *DataManager) LoadFromReader(r io.Reader, keyName string) (err error) {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
 
-	scanner := bufio.NewScanner(file)
+	defer dm.beginOperation("load", "reader", nil)(&err)
+	reader, err := dm.newReaderFor(r, "")
+	if err != nil {
+		return err
+	}
+	return dm.loadRecords(reader, keyName)
+}
+
+// loadRecords reads every record into memory and swaps in the new data and indexes
+func (dm *DataManager) loadRecords(reader recordReader, keyName string) error {
 	tempData := make(map[string]map[string]interface{})
-	tempIndex := make(map[string]map[string]int)
+	dm.parseErrors.reset()
+	keyName = dm.surrogateKeyName(keyName)
+	if keyName == SurrogateKeyField {
+		atomic.StoreInt64(&dm.keySequence, 0)
+	}
+	duplicates := newDuplicateFilter(dm.dedupFields)
+	var stats *statsCatalog
+	if !dm.noStatistics {
+		stats = newStatsCatalog()
+	}
+	strategy := dm.keyStrategy
+	repeated := newDuplicateKeys(strategy.Policy == RejectDuplicates)
+	number := 0
+
+	// The data being replaced is not counted against the limit, and what
+	// this load charged is given back unless it is swapped in
+	replaced := atomic.LoadInt64(&dm.dataUsage)
+	var added int64
+	swapped := false
+	defer func() {
+		if !swapped {
+			atomic.AddInt64(dm.currentUsage, -added)
+		}
+	}()
+
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		number++
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		record = dm.intern(record, keyName)
 
-	for scanner.Scan() {
-		var record map[string]interface{}
-		line := scanner.Text()
-		if err := json.Unmarshal([]byte(line), &record); err != nil {
+		valid, err := dm.conforms(record)
+		if err != nil {
 			return err
 		}
 
-		if key, ok := record[keyName].(string); ok {
-			tempData[key] = record
+		if valid {
+			dup, err := duplicates.duplicate(record)
+			if err != nil {
+				return err
+			}
+			valid = !dup
+		}
 
-			// Create index for optimized search on keyName
-			if _, exists := tempIndex[keyName]; !exists {
-				tempIndex[keyName] = make(map[string]int)
+		if dm.surrogate != NoSurrogateKeys {
+			dm.assignSurrogateKey(record, keyName, func() RecordPosition { return readerPosition(reader, "", number) })
+		}
+		if key, ok := recordKey(record, keyName); ok && valid {
+			old, exists := tempData[key]
+			if exists {
+				// Resolve the duplicate key with the configured strategy
+				repeated.repeat(key, readerPosition(reader, "", number))
+				if record, err = dm.resolveMerge(strategy, old, record); err != nil {
+					return fmt.Errorf("Merging records with %s %q: %w", keyName, key, err)
+				}
+				if stats != nil {
+					stats.remove(old)
+				}
+			} else {
+				repeated.first(key, readerPosition(reader, "", number))
+			}
+			if record == nil {
+				delete(tempData, key)
+				continue
 			}
-			// Assuming line numbers are keys for this example (you could use offsets)
-			tempIndex[keyName][key] = len(tempData)
+			if stats != nil {
+				stats.add(record)
+			}
+			tempData[key] = record
 		}
 
 		// Simulate RAM usage tracking
-		dm.currentUsage += int64(len(line))
-		if dm.currentUsage > dm.maxRAMUsage {
-			return errors.New("Memory usage exceeds the maximum allowed limit")
+		added += int64(size)
+		if usage := atomic.AddInt64(dm.currentUsage, int64(size)) - replaced; usage > dm.maxRAMUsage {
+			return dm.memoryLimitError(usage)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	dm.setDuplicateKeyCount(repeated.count)
+	if err := repeated.err(keyName); err != nil {
 		return err
 	}
 
+	// Build the indexes before publishing, so queries keep running against
+	// the previous version until the new one is complete
+	loaded := loadedDataset(tempData, rebuildIndexes(dm.snapshot().indexes, tempData), stats)
+
 	dm.mu.Lock()
-	dm.data = tempData
-	dm.index = tempIndex
+	dm.current = loaded
+	dm.keyName = keyName
+	atomic.AddInt64(dm.currentUsage, -atomic.SwapInt64(&dm.dataUsage, added))
+	swapped = true
+	dm.refillViewsLocked(tempData)
+	if dm.versions != nil {
+		dm.versions = newVersionStore(dm.versions.opts)
+	}
 	dm.mu.Unlock()
 
 	return nil
 }
 
-// LoadDataInSplitMode reads the JSON file in parts and filters data based on conditions
+// LoadDataInSplitMode streams the JSON file (NDJSON or array) and filters data based on conditions.
+// Files ending in .csv or .tsv are read as delimited text (see SetCSVOptions).
+// filePath may also be "-" for stdin, an http(s):// URL, a cloud object
+// location such as s3://bucket/key, or a glob such as events-2024-*.json.
 func (dm *DataManager) LoadDataInSplitMode(filePath string, conditions []FilterCondition) ([]map[string]interface{}, error) {
-	if dm.mode != "Split" {
-		return nil, errors.New("Invalid mode for this operation")
+	if dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+	if isGlob(filePath) {
+		paths, err := expandGlob(filePath)
+		if err != nil {
+			return nil, err
+		}
+		dm.setSourcePath(filePath)
+		return dm.LoadFilesInSplitMode(paths, conditions)
+	}
+
+	src, err := dm.resolveSource(filePath)
+	if err != nil {
+		return nil, err
 	}
+	dm.setSourcePath(filePath)
+	return dm.LoadSourceInSplitMode(src, conditions)
+}
 
-	file, err := os.Open(filePath)
+// LoadFromReaderInSplitMode streams records from r and filters data based on conditions
+func (dm *DataManager) LoadFromReaderInSplitMode(r io.Reader, conditions []FilterCondition) (_ []map[string]interface{}, err error) {
+	if dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+
+	budget, err := dm.beginScan()
+	if err != nil {
+		return nil, err
+	}
+	defer budget.done()
+	defer dm.beginOperation("scan", "reader", nil)(&err)
+	reader, err := dm.newReaderFor(r, "")
+	if err != nil {
+		return nil, err
+	}
+	dm.parseErrors.reset()
+	results, err := dm.filterRecords(reader, conditions, budget)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return dm.finishScan(results)
+}
 
-	scanner := bufio.NewScanner(file)
+// filterRecords streams every record and keeps those matching conditions,
+// charging them to budget
+func (dm *DataManager) filterRecords(reader recordReader, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, error) {
 	var filteredData []map[string]interface{}
 
-	for scanner.Scan() {
-		var record map[string]interface{}
-		line := scanner.Text()
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-		if err := json.Unmarshal([]byte(line), &record); err != nil {
+		valid, err := dm.conforms(record)
+		if err != nil {
 			return nil, err
 		}
 
 		// Apply filter conditions on each record
-		if dm.matchConditions(record, conditions) {
+		if valid && dm.matchConditions(record, conditions) {
 			filteredData = append(filteredData, record)
 		}
 
 		// Track memory usage to ensure it doesn't exceed the limit
-		dm.currentUsage += int64(len(line))
-		if dm.currentUsage > dm.maxRAMUsage {
-			return nil, errors.New("Memory usage exceeds the maximum allowed limit")
+		if err := budget.charge(int64(size)); err != nil {
+			return nil, err
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
 	return filteredData, nil
 }
 
@@ -180,6 +392,14 @@ func applyStringCondition(fieldValue interface{}, operator string, value interfa
 		return strings.Contains(fieldVal, compareVal)
 	case "==":
 		return fieldVal == compareVal
+	case ">":
+		return fieldVal > compareVal
+	case ">=":
+		return fieldVal >= compareVal
+	case "<":
+		return fieldVal < compareVal
+	case "<=":
+		return fieldVal <= compareVal
 	default:
 		return false
 	}
@@ -257,6 +477,50 @@ func applyDateCondition(fieldValue interface{}, operator string, value interface
 	}
 }
 
+// applyTimeCondition compares time values parsed with layout or any of extra
+func applyTimeCondition(fieldValue interface{}, operator string, value interface{}, layout string, extra []string) bool {
+	fieldVal, ok := parseTime(fieldValue, layout, extra)
+	if !ok {
+		return false
+	}
+	compareVal, ok := parseTime(value, layout, extra)
+	if !ok {
+		return false
+	}
+
+	switch operator {
+	case ">":
+		return fieldVal.After(compareVal)
+	case ">=":
+		return !fieldVal.Before(compareVal)
+	case "<":
+		return fieldVal.Before(compareVal)
+	case "<=":
+		return !fieldVal.After(compareVal)
+	case "==":
+		return fieldVal.Equal(compareVal)
+	default:
+		return false
+	}
+}
+
+// parseTime parses a string value with the first of layout and extra that fits
+func parseTime(value interface{}, layout string, extra []string) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(layout, s); err == nil {
+		return t, true
+	}
+	for _, l := range extra {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
 // applyBoolCondition applies boolean-based filter conditions
 func applyBoolCondition(fieldValue interface{}, operator string, value interface{}) bool {
 	fieldVal, ok := fieldValue.(bool)
@@ -279,33 +543,20 @@ func applyBoolCondition(fieldValue interface{}, operator string, value interface
 // matchConditions checks if a record matches the given filter conditions
 func (dm *DataManager) matchConditions(record map[string]interface{}, conditions []FilterCondition) bool {
 	for _, condition := range conditions {
-		fieldValue, exists := record[condition.Key]
-		if !exists {
-			return false
-		}
-
 		switch condition.ValueType {
-		case "int":
-			if !applyIntCondition(fieldValue, condition.Operator, condition.Value) {
+		case ExprValueType:
+			if !matchExpr(record, condition) {
 				return false
 			}
-		case "string":
-			if !applyStringCondition(fieldValue, condition.Operator, condition.Value) {
+			continue
+		case GeoValueType:
+			if !matchGeo(record, condition) {
 				return false
 			}
-		case "datetime":
-			if !applyDateTimeCondition(fieldValue, condition.Operator, condition.Value) {
-				return false
-			}
-		case "date":
-			if !applyDateCondition(fieldValue, condition.Operator, condition.Value) {
-				return false
-			}
-		case "bool":
-			if !applyBoolCondition(fieldValue, condition.Operator, condition.Value) {
-				return false
-			}
-		default:
+			continue
+		}
+		fieldValue, exists := resolvePath(record, condition.Key)
+		if !exists || !dm.matchField(fieldValue, condition) {
 			return false
 		}
 	}
@@ -313,45 +564,51 @@ func (dm *DataManager) matchConditions(record map[string]interface{}, conditions
 	return true
 }
 
-// Main function
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	// Initialize DataManager
-	dataManager := NewDataManager(2*1024*1024*1024, "Split") // Max 2GB RAM usage
-
-	// Define filter conditions
-	conditions := []FilterCondition{
-		{Key: "age", ValueType: "int", Operator: ">", Value: 30},
-		{Key: "fullname", ValueType: "string", Operator: "contains", Value: "James"},
-		{Key: "status", ValueType: "bool", Operator: "==", Value: false},
-		{Key: "ent_dt", ValueType: "datetime", Operator: "==", Value: "2024-09-03 09:00:00"},
+// matchField checks a field value against a condition, accepting the
+// configured extra date layouts
+func (dm *DataManager) matchField(fieldValue interface{}, condition FilterCondition) bool {
+	if condition.ValueType == ArrayValueType {
+		return applyArrayCondition(fieldValue, condition, dm.matchField)
 	}
-
-	// Load and filter data depending on the mode
-	var filteredData []map[string]interface{}
-	var err error
-	if dataManager.mode == "InMemory" {
-		// Load data into memory and apply filtering
-		err = dataManager.LoadDataInMemory("users.json", "username")
-		if err == nil {
-			for _, record := range dataManager.data {
-				if dataManager.matchConditions(record, conditions) {
-					filteredData = append(filteredData, record)
-				}
-			}
+	if len(dm.dateLayouts) > 0 {
+		switch condition.ValueType {
+		case "datetime":
+			return applyTimeCondition(fieldValue, condition.Operator, condition.Value, "2006-01-02 15:04:05", dm.dateLayouts)
+		case "date":
+			return applyTimeCondition(fieldValue, condition.Operator, condition.Value, "2006-01-02", dm.dateLayouts)
 		}
-	} else if dataManager.mode == "Split" {
-		// Process data in Split mode
-		filteredData, err = dataManager.LoadDataInSplitMode("users.json", conditions)
 	}
+	return matchValue(fieldValue, condition)
+}
 
-	if err != nil {
-		log.Println("Error loading data:", err)
-	} else {
-		fmt.Println("Filtered Data:", filteredData)
+// matchValue checks a single field value against a condition
+func matchValue(fieldValue interface{}, condition FilterCondition) bool {
+	switch condition.ValueType {
+	case "int":
+		return applyIntCondition(fieldValue, condition.Operator, condition.Value)
+	case "string":
+		if condition.Operator == "fuzzy" {
+			return applyFuzzyCondition(fieldValue, condition)
+		}
+		if condition.Collation != BinaryCollation {
+			return applyCollatedCondition(fieldValue, condition)
+		}
+		return applyStringCondition(fieldValue, condition.Operator, condition.Value)
+	case "datetime":
+		return applyDateTimeCondition(fieldValue, condition.Operator, condition.Value)
+	case "date":
+		return applyDateCondition(fieldValue, condition.Operator, condition.Value)
+	case "bool":
+		return applyBoolCondition(fieldValue, condition.Operator, condition.Value)
+	case ArrayValueType:
+		return applyArrayCondition(fieldValue, condition, matchValue)
+	default:
+		return false
 	}
+}
 
-	// Wait for all goroutines to finish
-	dataManager.wg.Wait()
+// Main function
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
 }
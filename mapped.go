@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// MappedFile is an NDJSON file mapped into memory with its line offsets
+// indexed, so repeated Split-mode queries iterate over the mapping instead
+// of reading the file again. The DataManager's error policy, fast scan,
+// deduplication and projection settings apply to its queries.
+type MappedFile struct {
+	dm     *DataManager
+	path   string
+	data   []byte
+	lines  []int64 // Offset of each non-blank line
+	closed bool
+	mu     sync.RWMutex
+}
+
+// OpenMapped maps an NDJSON file and indexes its lines. Close releases the mapping.
+func (dm *DataManager) OpenMapped(filePath string) (*MappedFile, error) {
+	if dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mapFile(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &MappedFile{dm: dm, path: filePath, data: data}
+	if first := bytes.TrimLeft(data, " \t\r\n"); len(first) > 0 && first[0] == '[' {
+		unmapFile(data)
+		return nil, fmt.Errorf("%s holds a JSON array; OpenMapped needs newline-delimited JSON", filePath)
+	}
+	for start := 0; start < len(data); {
+		end := bytes.IndexByte(data[start:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += start
+		}
+		if len(bytes.TrimSpace(data[start:end])) > 0 {
+			mf.lines = append(mf.lines, int64(start))
+		}
+		start = end + 1
+	}
+	return mf, nil
+}
+
+// Len returns the number of records (non-blank lines) in the file
+func (mf *MappedFile) Len() int {
+	return len(mf.lines)
+}
+
+// line returns the bytes of line i without its line ending
+func (mf *MappedFile) line(i int) []byte {
+	start := mf.lines[i]
+	end := bytes.IndexByte(mf.data[start:], '\n')
+	if end < 0 {
+		return bytes.TrimRight(mf.data[start:], "\r")
+	}
+	return bytes.TrimRight(mf.data[start:start+int64(end)], "\r")
+}
+
+// Query filters the mapped records, scanning one slice of lines per CPU core
+func (mf *MappedFile) Query(conditions []FilterCondition) ([]map[string]interface{}, error) {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	if mf.closed {
+		return nil, ErrClosed
+	}
+
+	dm := mf.dm
+	budget, err := dm.beginScan()
+	if err != nil {
+		return nil, err
+	}
+	defer budget.done()
+	dm.parseErrors.reset()
+	workers := dm.parallelism()
+	per := (len(mf.lines) + workers - 1) / workers
+	results := make([][]map[string]interface{}, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		from, to := w*per, (w+1)*per
+		if to > len(mf.lines) {
+			to = len(mf.lines)
+		}
+		if from >= to {
+			break
+		}
+		wg.Add(1)
+		go func(w, from, to int) {
+			defer wg.Done()
+			results[w], errs[w] = mf.scan(from, to, conditions, budget)
+		}(w, from, to)
+	}
+	wg.Wait()
+
+	var filteredData []map[string]interface{}
+	for w := range results {
+		if errs[w] != nil {
+			return nil, errs[w]
+		}
+		filteredData = append(filteredData, results[w]...)
+	}
+	return dm.finishScan(filteredData)
+}
+
+// scan filters lines [from, to), charging matches to budget
+func (mf *MappedFile) scan(from, to int, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, error) {
+	dm := mf.dm
+	ls := dm.newLineScanner(conditions)
+	var filteredData []map[string]interface{}
+	for i := from; i < to; i++ {
+		line := mf.line(i)
+		if dm.recordLimit > 0 && len(line) > dm.recordLimit {
+			parseErr := &ParseError{File: mf.path, Offset: mf.lines[i], Snippet: snippet(line), Err: fmt.Errorf("record of %d bytes exceeds the %d byte limit", len(line), dm.recordLimit)}
+			if err := dm.tolerate(parseErr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		record, err := ls.matchLine(line, mf.lines[i])
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		filteredData = append(filteredData, record)
+		filteredData = append(filteredData, ls.extra...)
+
+		// The mapping itself is paged in by the OS; only results count against the limit
+		if err := budget.charge(int64(len(line))); err != nil {
+			return nil, err
+		}
+	}
+	return filteredData, nil
+}
+
+// Close unmaps the file; queries fail afterwards
+func (mf *MappedFile) Close() error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	data := mf.data
+	mf.data, mf.lines, mf.closed = nil, nil, true
+	return unmapFile(data)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MergePolicy selects how MergeFiles and loads resolve records sharing a key
+type MergePolicy int
+
+const (
+	LastWins         MergePolicy = iota // The record read last, or the newest by TimestampField
+	FirstWins                           // The record read first
+	MergeByFunc                         // The result of the strategy's Merge function
+	RejectDuplicates                    // None: fail with a *DuplicateKeyError
+)
+
+// MergeStrategy tells MergeFiles, and loads (see SetDuplicateKeys), which
+// record to keep when several share a key
+type MergeStrategy struct {
+	Policy         MergePolicy
+	TimestampField string // With LastWins, keep the record with the newest value of this field
+	// Merge combines the record kept so far with a later one sharing its key
+	// (MergeByFunc). Returning a nil record drops the key.
+	Merge func(existing, incoming map[string]interface{}) (map[string]interface{}, error)
+}
+
+// LastWriteWins keeps, for each key, the record whose timestampField is the
+// newest; records without it lose to those with it, and ties go to the
+// record read last. An empty timestampField keeps the record read last.
+func LastWriteWins(timestampField string) MergeStrategy {
+	return MergeStrategy{Policy: LastWins, TimestampField: timestampField}
+}
+
+// FirstWriteWins keeps, for each key, the record read first
+func FirstWriteWins() MergeStrategy {
+	return MergeStrategy{Policy: FirstWins}
+}
+
+// MergeWith resolves each conflict by calling merge with the record kept so
+// far and the one just read
+func MergeWith(merge func(existing, incoming map[string]interface{}) (map[string]interface{}, error)) MergeStrategy {
+	return MergeStrategy{Policy: MergeByFunc, Merge: merge}
+}
+
+// RejectDuplicateKeys fails when several records share a key, reporting
+// where they were read
+func RejectDuplicateKeys() MergeStrategy {
+	return MergeStrategy{Policy: RejectDuplicates}
+}
+
+// validate checks that the strategy can be applied
+func (s MergeStrategy) validate() error {
+	switch s.Policy {
+	case LastWins, FirstWins, RejectDuplicates:
+	case MergeByFunc:
+		if s.Merge == nil {
+			return errors.New("MergeByFunc requires a Merge function")
+		}
+	default:
+		return fmt.Errorf("Unknown merge policy %d", s.Policy)
+	}
+	return nil
+}
+
+// mergeEntry is the record currently kept for a key
+type mergeEntry struct {
+	record map[string]interface{}
+	size   int64
+}
+
+// MergeFiles reads the records of paths, in order and in any supported
+// format, and returns one record per value of keyField, resolving conflicts
+// with strategy. Key values match by their text across formats. Records appear in the order their key was first read;
+// records without keyField are passed through unchanged. The kept records
+// are held in memory within maxRAMUsage. Write the result with Export or
+// WriteRecords to produce a single merged file.
+func (dm *DataManager) MergeFiles(paths []string, keyField string, strategy MergeStrategy) (_ []map[string]interface{}, err error) {
+	if len(paths) == 0 {
+		return nil, ErrNoInput
+	}
+	if keyField == "" {
+		return nil, ErrNoKeyField
+	}
+	if err := strategy.validate(); err != nil {
+		return nil, err
+	}
+
+	defer dm.beginOperation("merge", describePaths(paths), func() int64 { return dm.filesSize(paths) })(&err)
+	budget := dm.sharedBudget()
+	kept := make(map[string]*mergeEntry)
+	var order []*mergeEntry
+	duplicates := newDuplicateKeys(strategy.Policy == RejectDuplicates)
+	defer func() { dm.setDuplicateKeyCount(duplicates.count) }()
+	number := 0
+	for _, path := range paths {
+		reader, closer, err := dm.openRecords(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for {
+			record, size, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			number++
+			dm.track(size)
+			if err != nil {
+				if err = dm.tolerate(err); err != nil {
+					closer.Close()
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				continue
+			}
+
+			key, ok := recordKey(record, keyField)
+			entry := kept[key]
+			if !ok || entry == nil {
+				entry = &mergeEntry{record: record, size: estimateRecordSize(record)}
+				if ok {
+					kept[key] = entry
+					duplicates.first(key, readerPosition(reader, path, number))
+				}
+				order = append(order, entry)
+				if err := budget.charge(entry.size); err != nil {
+					closer.Close()
+					return nil, err
+				}
+				continue
+			}
+
+			duplicates.repeat(key, readerPosition(reader, path, number))
+			resolved, err := dm.resolveMerge(strategy, entry.record, record)
+			if err != nil {
+				closer.Close()
+				return nil, fmt.Errorf("Merging %q: %w", key, err)
+			}
+			resolvedSize := estimateRecordSize(resolved)
+			if err := budget.charge(resolvedSize - entry.size); err != nil {
+				closer.Close()
+				return nil, err
+			}
+			entry.record, entry.size = resolved, resolvedSize
+		}
+		closer.Close()
+	}
+	if err := duplicates.err(keyField); err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]interface{}, 0, len(order))
+	for _, entry := range order {
+		if entry.record != nil {
+			results = append(results, entry.record)
+		}
+	}
+	return results, nil
+}
+
+// resolveMerge returns the record to keep out of existing and incoming
+func (dm *DataManager) resolveMerge(strategy MergeStrategy, existing, incoming map[string]interface{}) (map[string]interface{}, error) {
+	switch strategy.Policy {
+	case FirstWins, RejectDuplicates:
+		return existing, nil
+	case MergeByFunc:
+		if existing == nil {
+			return incoming, nil // A key dropped earlier starts over
+		}
+		return strategy.Merge(existing, incoming)
+	}
+	if strategy.TimestampField == "" || existing == nil {
+		return incoming, nil
+	}
+	a, _ := resolvePath(existing, strategy.TimestampField)
+	b, _ := resolvePath(incoming, strategy.TimestampField)
+	if dm.compareTimestamps(a, b) > 0 {
+		return existing, nil
+	}
+	return incoming, nil
+}
+
+// compareTimestamps orders two timestamp values: numbers (such as epoch
+// seconds) numerically, strings as times when they parse as RFC 3339 or one
+// of the extra date layouts and as text otherwise. Missing values sort first.
+func (dm *DataManager) compareTimestamps(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return cmp.Compare(x, y)
+		}
+	}
+	ta, okA := parseTime(a, time.RFC3339Nano, dm.dateLayouts)
+	tb, okB := parseTime(b, time.RFC3339Nano, dm.dateLayouts)
+	if okA && okB {
+		return ta.Compare(tb)
+	}
+	return cmp.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives instrumentation events from a DataManager. Implementations
+// must be safe for concurrent use; parallel scans report from several goroutines.
+type Metrics interface {
+	ObserveRecord(bytes int)                          // A record was read during a load or scan
+	ObserveParseError()                               // A malformed record was encountered
+	ObserveLatency(operation string, d time.Duration) // A "load", "scan" or "query" completed
+	ObserveCache(hit bool)                            // A record cache lookup
+	SetMemoryUsage(bytes int64)                       // Tracked memory usage after an operation
+}
+
+// SetMetrics sends instrumentation events to m (nil disables them)
+func (dm *DataManager) SetMetrics(m Metrics) {
+	dm.metrics = m
+}
+
+// timeOperation returns a function reporting the duration of op and the
+// memory usage to the metrics
+func (dm *DataManager) timeOperation(op string) func() {
+	m := dm.metrics
+	if m == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		m.ObserveLatency(op, time.Since(start))
+		m.SetMemoryUsage(atomic.LoadInt64(dm.currentUsage))
+	}
+}
+
+// latencyBuckets are the upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	counts []int64 // Observations per bucket (not cumulative); the last is +Inf
+	count  int64
+	sum    float64
+}
+
+// PrometheusMetrics collects Metrics events and serves them in the Prometheus
+// text exposition format, e.g. on /metrics of the HTTP server
+type PrometheusMetrics struct {
+	records     atomic.Int64
+	bytes       atomic.Int64
+	parseErrors atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	memory      atomic.Int64
+	mu          sync.Mutex
+	latency     map[string]*histogram // By operation
+}
+
+// NewPrometheusMetrics returns an empty collector
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{latency: make(map[string]*histogram)}
+}
+
+// ObserveRecord counts a record and its bytes
+func (p *PrometheusMetrics) ObserveRecord(bytes int) {
+	p.records.Add(1)
+	p.bytes.Add(int64(bytes))
+}
+
+// ObserveParseError counts a malformed record
+func (p *PrometheusMetrics) ObserveParseError() {
+	p.parseErrors.Add(1)
+}
+
+// ObserveLatency adds d to the histogram of operation
+func (p *PrometheusMetrics) ObserveLatency(operation string, d time.Duration) {
+	seconds := d.Seconds()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.latency[operation]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		p.latency[operation] = h
+	}
+	h.counts[sort.SearchFloat64s(latencyBuckets, seconds)]++
+	h.count++
+	h.sum += seconds
+}
+
+// ObserveCache counts a cache hit or miss
+func (p *PrometheusMetrics) ObserveCache(hit bool) {
+	if hit {
+		p.cacheHits.Add(1)
+	} else {
+		p.cacheMisses.Add(1)
+	}
+}
+
+// SetMemoryUsage records the current memory usage
+func (p *PrometheusMetrics) SetMemoryUsage(bytes int64) {
+	p.memory.Store(bytes)
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text format to w
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+	}
+
+	counter("jsondm_records_scanned_total", "Records read by loads and scans.", p.records.Load())
+	counter("jsondm_bytes_read_total", "Bytes of records read by loads and scans.", p.bytes.Load())
+	counter("jsondm_parse_errors_total", "Malformed records encountered.", p.parseErrors.Load())
+	hits, misses := p.cacheHits.Load(), p.cacheMisses.Load()
+	counter("jsondm_cache_hits_total", "Record cache lookups served from the cache.", hits)
+	counter("jsondm_cache_misses_total", "Record cache lookups that scanned the input.", misses)
+	ratio := math.NaN()
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	gauge("jsondm_cache_hit_ratio", "Fraction of record cache lookups that hit.", ratio)
+	gauge("jsondm_memory_usage_bytes", "Tracked memory usage after the latest operation.", float64(p.memory.Load()))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	const name = "jsondm_operation_duration_seconds"
+	fmt.Fprintf(cw, "# HELP %s Duration of loads, scans and queries.\n# TYPE %s histogram\n", name, name)
+	operations := make([]string, 0, len(p.latency))
+	for op := range p.latency {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	for _, op := range operations {
+		h := p.latency[op]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(cw, "%s_bucket{operation=%q,le=%q} %d\n", name, op, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(cw, "%s_bucket{operation=%q,le=\"+Inf\"} %d\n", name, op, h.count)
+		fmt.Fprintf(cw, "%s_sum{operation=%q} %s\n", name, op, formatFloat(h.sum))
+		fmt.Fprintf(cw, "%s_count{operation=%q} %d\n", name, op, h.count)
+	}
+	return cw.n, cw.err
+}
+
+// formatFloat formats a sample value as Prometheus expects
+func formatFloat(f float64) string {
+	if math.IsNaN(f) {
+		return "NaN"
+	}
+	return fmt.Sprint(f)
+}
+
+// countingWriter tracks the bytes written and the first error
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Mode selects how a DataManager holds its data
+type Mode string
+
+const (
+	// InMemoryMode loads every record into memory, with indexes, writes and transactions
+	InMemoryMode Mode = "InMemory"
+	// SplitMode streams the input on every query, keeping only the results in memory
+	SplitMode Mode = "Split"
+	// AutoMode decides per input: Load keeps it in memory when it fits within
+	// the memory limit and streams it otherwise
+	AutoMode Mode = "Auto"
+)
+
+// ParseMode returns the Mode named s
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case InMemoryMode, SplitMode, AutoMode:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%w: %q (want \"InMemory\", \"Split\" or \"Auto\")", ErrInvalidMode, s)
+}
+
+// String returns the mode name
+func (m Mode) String() string {
+	return string(m)
+}
+
+// Mode returns the mode queries currently run in. In AutoMode it is the mode
+// chosen by the latest Load (InMemoryMode before any load).
+func (dm *DataManager) Mode() Mode {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.mode
+}
+
+// Load reads the input at filePath in AutoMode. If its size is known and
+// fits within the remaining memory limit it is loaded into memory keyed by
+// keyName, as LoadDataInMemory would; otherwise it is left on disk and Query
+// streams it, as LoadDataInSplitMode would. Inputs of unknown size, such as
+// stdin or a chunked HTTP response, cannot be read twice and are loaded.
+func (dm *DataManager) Load(filePath string, keyName string) error {
+	if !dm.auto {
+		return ErrInvalidMode
+	}
+
+	var size int64
+	if isGlob(filePath) {
+		paths, err := expandGlob(filePath)
+		if err != nil {
+			return err
+		}
+		size = dm.filesSize(paths)
+	} else {
+		src, err := dm.resolveSource(filePath)
+		if err != nil {
+			return err
+		}
+		size = sourceSize(src)
+	}
+
+	// The dataset a load would replace is released by it, so its usage
+	// counts as free
+	free := dm.maxRAMUsage - (atomic.LoadInt64(dm.currentUsage) - atomic.LoadInt64(&dm.dataUsage))
+	if size >= 0 && size > free {
+		dm.mu.Lock()
+		dm.mode = SplitMode
+		dm.sourcePath = filePath
+		dm.keyName = keyName
+		dm.mu.Unlock()
+		if dm.logger != nil {
+			dm.logger.Info("input exceeds the memory limit; streaming it", "source", filePath, "bytes", size)
+		}
+		return nil
+	}
+	dm.mu.Lock()
+	dm.mode = InMemoryMode
+	dm.mu.Unlock()
+	return dm.LoadDataInMemory(filePath, keyName)
+}
+
+// queryStream runs a Query in AutoMode against an input Load left on disk
+func (dm *DataManager) queryStream(conditions []FilterCondition) ([]map[string]interface{}, error) {
+	path := dm.loadedPath()
+	if path == "" {
+		return nil, fmt.Errorf("%w: nothing has been loaded", ErrNoInput)
+	}
+	return dm.LoadDataInSplitMode(path, conditions)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// msgpackCodec reads and writes a stream of MessagePack maps
+type msgpackCodec struct{}
+
+func (msgpackCodec) NewDecoder(r io.Reader) RecordDecoder {
+	return &msgpackDecoder{r: bufio.NewReader(r)}
+}
+
+func (msgpackCodec) NewEncoder(w io.Writer) RecordEncoder {
+	return &msgpackEncoder{w: bufio.NewWriter(w)}
+}
+
+// msgpackDecoder decodes consecutive top-level maps
+type msgpackDecoder struct {
+	r *bufio.Reader
+	n int // Bytes consumed by the current record
+}
+
+// Next decodes the next map
+func (d *msgpackDecoder) Next() (map[string]interface{}, int, error) {
+	if _, err := d.r.Peek(1); err != nil {
+		return nil, 0, err
+	}
+	d.n = 0
+	value, err := d.value()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, d.n, err
+	}
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, d.n, errors.New("MessagePack record is not a map")
+	}
+	return record, d.n, nil
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.n++
+	}
+	return b, err
+}
+
+func (d *msgpackDecoder) readN(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(d.r, buf)
+	d.n += read
+	return buf, err
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	buf, err := d.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(buf[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(buf)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(buf)), nil
+	default:
+		return binary.BigEndian.Uint64(buf), nil
+	}
+}
+
+// value decodes one MessagePack value into the types JSON decoding produces
+func (d *msgpackDecoder) value() (interface{}, error) {
+	tag, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case tag <= 0x7f:
+		return float64(tag), nil
+	case tag >= 0xe0:
+		return float64(int8(tag)), nil
+	case tag >= 0x80 && tag <= 0x8f:
+		return d.mapValue(int(tag & 0x0f))
+	case tag >= 0x90 && tag <= 0x9f:
+		return d.arrayValue(int(tag & 0x0f))
+	case tag >= 0xa0 && tag <= 0xbf:
+		return d.stringValue(int(tag & 0x1f))
+	}
+
+	switch tag {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb: // bin and str
+		sizes := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}
+		n, err := d.readUint(sizes[tag])
+		if err != nil {
+			return nil, err
+		}
+		return d.stringValue(int(n))
+	case 0xca:
+		bits, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.readUint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.readUint(1 << (tag - 0xcc))
+		return float64(n), err
+	case 0xd0:
+		n, err := d.readUint(1)
+		return float64(int8(n)), err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return float64(int16(n)), err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return float64(int32(n)), err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return float64(int64(n)), err
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (tag - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayValue(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (tag - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext
+		return d.extValue(1 << (tag - 0xd4))
+	case 0xc7, 0xc8, 0xc9: // ext
+		n, err := d.readUint(1 << (tag - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.extValue(int(n))
+	default:
+		return nil, fmt.Errorf("Invalid MessagePack type 0x%02x", tag)
+	}
+}
+
+func (d *msgpackDecoder) stringValue(n int) (interface{}, error) {
+	buf, err := d.readN(n)
+	return string(buf), err
+}
+
+func (d *msgpackDecoder) arrayValue(n int) (interface{}, error) {
+	items := make([]interface{}, n)
+	for i := range items {
+		item, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) mapValue(n int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := key.(string); ok {
+			m[s] = value
+		} else {
+			m[formatValue(key)] = value
+		}
+	}
+	return m, nil
+}
+
+// extValue decodes extension types; timestamps become datetime strings and
+// unknown extensions are dropped
+func (d *msgpackDecoder) extValue(n int) (interface{}, error) {
+	extType, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readN(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(extType) != -1 {
+		return nil, nil
+	}
+
+	var t time.Time
+	switch n {
+	case 4:
+		t = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		t = time.Unix(int64(v&0x3ffffffff), int64(v>>34))
+	case 12:
+		t = time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data)))
+	default:
+		return nil, errors.New("Invalid MessagePack timestamp")
+	}
+	return t.UTC().Format("2006-01-02 15:04:05"), nil
+}
+
+// msgpackEncoder writes records as MessagePack maps
+type msgpackEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *msgpackEncoder) Encode(record map[string]interface{}) error {
+	return e.value(record)
+}
+
+func (e *msgpackEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+func (e *msgpackEncoder) writeUint(tag byte, size int, n uint64) {
+	e.w.WriteByte(tag)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	e.w.Write(buf[8-size:])
+}
+
+func (e *msgpackEncoder) length(fix, fixMax byte, tag8, tag16, tag32 byte, n int) {
+	switch {
+	case n <= int(fixMax):
+		e.w.WriteByte(fix | byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		e.writeUint(tag8, 1, uint64(n))
+	case n <= math.MaxUint16:
+		e.writeUint(tag16, 2, uint64(n))
+	default:
+		e.writeUint(tag32, 4, uint64(n))
+	}
+}
+
+// value encodes a decoded JSON value; integral numbers use the compact integer forms
+func (e *msgpackEncoder) value(v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		return e.w.WriteByte(0xc0)
+	case bool:
+		if val {
+			return e.w.WriteByte(0xc3)
+		}
+		return e.w.WriteByte(0xc2)
+	case int:
+		return e.integer(int64(val))
+	case int64:
+		return e.integer(val)
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<63 {
+			return e.integer(int64(val))
+		}
+		e.writeUint(0xcb, 8, math.Float64bits(val))
+	case string:
+		e.length(0xa0, 31, 0xd9, 0xda, 0xdb, len(val))
+		e.w.WriteString(val)
+	case []interface{}:
+		e.length(0x90, 15, 0, 0xdc, 0xdd, len(val))
+		for _, item := range val {
+			if err := e.value(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.length(0x80, 15, 0, 0xde, 0xdf, len(keys))
+		for _, key := range keys {
+			e.value(key)
+			if err := e.value(val[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot encode %T as MessagePack", v)
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) integer(n int64) error {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return e.w.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		return e.w.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		e.writeUint(0xd0, 1, uint64(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		e.writeUint(0xd1, 2, uint64(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		e.writeUint(0xd2, 4, uint64(n))
+	default:
+		e.writeUint(0xd3, 8, uint64(n))
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// OffsetIndexSuffix is appended to the path of a file to name its offset index
+const OffsetIndexSuffix = ".offsets"
+
+// An offset index file starts with a header of four little-endian 64-bit
+// words: the magic, the size and modification time (Unix nanoseconds) of the
+// indexed file, and the width of the entries that follow, one per line: 4
+// bytes when the file is under 4GB and 8 otherwise.
+var offsetIndexMagic = [8]byte{'J', 'D', 'M', 'O', 'F', 'F', '1', 0}
+
+const offsetIndexHeaderSize = 32
+
+// OffsetIndex locates the lines of an NDJSON file by number through its
+// offset index file, written by BuildOffsetIndex. Lines are numbered from 0
+// and blank lines are not counted, so line n holds the record at position n.
+// It is safe for concurrent use; Close releases the files it keeps open.
+type OffsetIndex struct {
+	Path    string    // Indexed file
+	Lines   int       // Non-blank lines of the file
+	Size    int64     // File size when indexed
+	ModTime time.Time // File modification time when indexed
+
+	index    *os.File // Offset index file
+	contents []byte   // Decrypted offset index file, read whole when encrypted (nil otherwise)
+	data     *os.File // Indexed file
+	width    int64    // Bytes per entry
+}
+
+// BuildOffsetIndex records the start offset of every non-blank line of the
+// NDJSON file at filePath in a compact binary file next to it, named with
+// OffsetIndexSuffix, and returns it opened. The index gives constant-time
+// access to line n (see OffsetIndex.ReadLine and RecordAt), and Split-mode
+// scans of the unchanged file use it to divide the file into chunks holding
+// equal numbers of lines at exact line boundaries. The index is encrypted
+// under SetEncryption, and an existing one is replaced.
+func (dm *DataManager) BuildOffsetIndex(filePath string) (*OffsetIndex, error) {
+	started := time.Now()
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	br := dm.chunkReader(f)
+	defer dm.releaseChunkReader(br)
+	if head, _ := br.Peek(2); bytes.Equal(head, []byte{0x1f, 0x8b}) {
+		return nil, fmt.Errorf("%s is compressed; offset indexes need uncompressed newline-delimited JSON", filePath)
+	}
+
+	width := int64(4)
+	if info.Size() > math.MaxUint32 {
+		width = 8
+	}
+	lines := 0
+	err = replaceFile(filePath+OffsetIndexSuffix, dm.encryption, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		header := append([]byte(nil), offsetIndexMagic[:]...)
+		header = binary.LittleEndian.AppendUint64(header, uint64(info.Size()))
+		header = binary.LittleEndian.AppendUint64(header, uint64(info.ModTime().UnixNano()))
+		header = binary.LittleEndian.AppendUint64(header, uint64(width))
+		bw.Write(header)
+
+		var pos, lineStart int64
+		blank := true // Nothing but whitespace read of the current line
+		entry := make([]byte, width)
+		for {
+			chunk, err := br.ReadSlice('\n')
+			if blank {
+				if i := skipSpace(chunk, 0); i < len(chunk) {
+					if lines == 0 && chunk[i] == '[' {
+						return fmt.Errorf("%s holds a JSON array; offset indexes need newline-delimited JSON", filePath)
+					}
+					blank = false
+				}
+			}
+			pos += int64(len(chunk))
+			if err == bufio.ErrBufferFull {
+				continue // The line goes on
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if !blank {
+				if width == 4 {
+					binary.LittleEndian.PutUint32(entry, uint32(lineStart))
+				} else {
+					binary.LittleEndian.PutUint64(entry, uint64(lineStart))
+				}
+				bw.Write(entry)
+				lines++
+			}
+			if err == io.EOF {
+				return bw.Flush()
+			}
+			lineStart, blank = pos, true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dm.logger != nil {
+		dm.logger.Info("offset index built", "source", filePath, "lines", lines, "duration", time.Since(started))
+	}
+	return dm.OpenOffsetIndex(filePath)
+}
+
+// OpenOffsetIndex opens the offset index of the NDJSON file at filePath
+// written by BuildOffsetIndex. It fails with ErrStaleIndex when the file
+// has changed since, and with an error matching os.ErrNotExist when it has
+// no index. Indexes written under SetEncryption are opened with the
+// manager's OpenOffsetIndex.
+func OpenOffsetIndex(filePath string) (*OffsetIndex, error) {
+	return openOffsetIndex(filePath, nil)
+}
+
+// OpenOffsetIndex opens the offset index of the NDJSON file at filePath
+// like the package's OpenOffsetIndex. Under SetEncryption the index is
+// decrypted into memory, since its sealed frames cannot be read at random.
+func (dm *DataManager) OpenOffsetIndex(filePath string) (*OffsetIndex, error) {
+	return openOffsetIndex(filePath, dm.encryption)
+}
+
+// openOffsetIndex opens the offset index of filePath, decrypting it with c
+func openOffsetIndex(filePath string, c *fileCipher) (*OffsetIndex, error) {
+	index, err := os.Open(filePath + OffsetIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	idx := &OffsetIndex{Path: filePath, index: index}
+	if err := idx.open(c); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// open reads the header of the index, or all of it when encrypted, and
+// opens the indexed file
+func (idx *OffsetIndex) open(c *fileCipher) error {
+	br := bufio.NewReader(idx.index)
+	if magic, _ := br.Peek(len(encryptedMagic)); c != nil || bytes.Equal(magic, encryptedMagic) {
+		r, err := c.reader(br, idx.index.Name())
+		if err != nil {
+			return err
+		}
+		if idx.contents, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	size := int64(len(idx.contents))
+	if idx.contents == nil {
+		info, err := idx.index.Stat()
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+	}
+	header := make([]byte, offsetIndexHeaderSize)
+	if err := idx.readAt(header, 0); err != nil || !bytes.Equal(header[:8], offsetIndexMagic[:]) {
+		return fmt.Errorf("%s is not an offset index", idx.index.Name())
+	}
+	idx.Size = int64(binary.LittleEndian.Uint64(header[8:]))
+	idx.ModTime = time.Unix(0, int64(binary.LittleEndian.Uint64(header[16:])))
+	idx.width = int64(binary.LittleEndian.Uint64(header[24:]))
+	if idx.width != 4 && idx.width != 8 || (size-offsetIndexHeaderSize)%idx.width != 0 {
+		return fmt.Errorf("%s is not an offset index", idx.index.Name())
+	}
+	idx.Lines = int((size - offsetIndexHeaderSize) / idx.width)
+
+	var err error
+	if idx.data, err = os.Open(idx.Path); err != nil {
+		return err
+	}
+	if !idx.Fresh() {
+		return fmt.Errorf("%w: %s changed since it was indexed", ErrStaleIndex, idx.Path)
+	}
+	return nil
+}
+
+// readAt fills b from the index file at offset
+func (idx *OffsetIndex) readAt(b []byte, offset int64) error {
+	if idx.contents == nil {
+		_, err := idx.index.ReadAt(b, offset)
+		return err
+	}
+	if offset+int64(len(b)) > int64(len(idx.contents)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(b, idx.contents[offset:])
+	return nil
+}
+
+// Fresh reports whether the indexed file still has the size and
+// modification time it had when indexed
+func (idx *OffsetIndex) Fresh() bool {
+	info, err := idx.data.Stat()
+	return err == nil && info.Size() == idx.Size && info.ModTime().Equal(idx.ModTime)
+}
+
+// Offset returns the byte offset at which line n starts
+func (idx *OffsetIndex) Offset(n int) (int64, error) {
+	if n < 0 || n >= idx.Lines {
+		return 0, fmt.Errorf("Line %d is out of range: %s has %d lines", n, idx.Path, idx.Lines)
+	}
+	entry := make([]byte, idx.width)
+	if err := idx.readAt(entry, offsetIndexHeaderSize+int64(n)*idx.width); err != nil {
+		return 0, err
+	}
+	if idx.width == 4 {
+		return int64(binary.LittleEndian.Uint32(entry)), nil
+	}
+	return int64(binary.LittleEndian.Uint64(entry)), nil
+}
+
+// ReadLine returns line n without its line ending, reading nothing else of
+// the file
+func (idx *OffsetIndex) ReadLine(n int) ([]byte, error) {
+	start, err := idx.Offset(n)
+	if err != nil {
+		return nil, err
+	}
+	end := idx.Size
+	if n+1 < idx.Lines {
+		if end, err = idx.Offset(n + 1); err != nil {
+			return nil, err
+		}
+	}
+	line := make([]byte, end-start)
+	if _, err := idx.data.ReadAt(line, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i] // Blank lines may follow
+	}
+	return bytes.TrimRight(line, "\r"), nil
+}
+
+// Boundaries returns the offsets dividing the file into at most chunks
+// ranges holding equal numbers of lines, from 0 to the file size
+func (idx *OffsetIndex) Boundaries(chunks int) ([]int64, error) {
+	chunks = max(min(chunks, idx.Lines), 1)
+	bounds := []int64{0}
+	for i := 1; i < chunks; i++ {
+		offset, err := idx.Offset(i * idx.Lines / chunks)
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, offset)
+	}
+	return append(bounds, idx.Size), nil
+}
+
+// Close releases the index and the indexed file
+func (idx *OffsetIndex) Close() error {
+	err := idx.index.Close()
+	if idx.data != nil {
+		if cerr := idx.data.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RecordAt decodes line n of the file indexed by idx as its loads would,
+// through the line preprocessor, coercion, repair and computed fields. A
+// malformed line is returned as a *ParseError whatever the error policy.
+func (dm *DataManager) RecordAt(idx *OffsetIndex, n int) (map[string]interface{}, error) {
+	raw, err := idx.ReadLine(n)
+	if err != nil {
+		return nil, err
+	}
+	start, _ := idx.Offset(n)
+	line, err := dm.preprocessLine(raw)
+	if err != nil {
+		return nil, &ParseError{File: idx.Path, Offset: start, Snippet: snippet(raw), Err: err}
+	}
+	record, err := dm.decodeRecord(line)
+	if err != nil {
+		return nil, &ParseError{File: idx.Path, Offset: start, Snippet: snippet(line), Err: err}
+	}
+	dm.derive(record)
+	return record, nil
+}
+
+// chunkBounds divides a source into chunks for a parallel scan: at the
+// line boundaries of its offset index when it is a local file with a fresh
+// one, and into equal byte ranges otherwise
+func (dm *DataManager) chunkBounds(rs RangeSource, size int64, chunks int) []int64 {
+	if fs, ok := rs.(*fileSource); ok {
+		if idx, err := dm.OpenOffsetIndex(fs.path); err == nil {
+			defer idx.Close()
+			if bounds, err := idx.Boundaries(chunks); err == nil && idx.Size == size {
+				return bounds
+			}
+		}
+	}
+	chunkSize := size / int64(chunks)
+	bounds := make([]int64, chunks+1)
+	for i := range bounds {
+		bounds[i] = int64(i) * chunkSize
+	}
+	bounds[chunks] = size
+	return bounds
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// Option configures a DataManager created by New
+type Option func(dm *DataManager)
+
+// defaultMaxRAM is the memory limit of a DataManager created by New
+const defaultMaxRAM = 2 * 1024 * 1024 * 1024
+
+// New creates a DataManager configured by opts. Without options it runs in
+// InMemoryMode with a 2GB memory limit. NewDataManager(maxRAM, mode) is
+// equivalent to New(WithMaxRAM(maxRAM), WithMode(mode)).
+func New(opts ...Option) (*DataManager, error) {
+	dm := NewDataManager(defaultMaxRAM, InMemoryMode)
+	for _, opt := range opts {
+		opt(dm)
+	}
+	if _, err := ParseMode(string(dm.mode)); err != nil {
+		return nil, err
+	}
+	if dm.mode == AutoMode {
+		dm.mode, dm.auto = InMemoryMode, true
+	}
+	if dm.maxRAMUsage <= 0 {
+		return nil, fmt.Errorf("Invalid memory limit %d", dm.maxRAMUsage)
+	}
+	if s := dm.scheduler; s != nil && s.opts.ScanMemory > dm.maxRAMUsage {
+		return nil, fmt.Errorf("Scan memory %d exceeds the memory limit %d", s.opts.ScanMemory, dm.maxRAMUsage)
+	}
+	if dm.chunkSize < 0 {
+		return nil, fmt.Errorf("Invalid chunk size %d", dm.chunkSize)
+	}
+	if err := dm.validateResultLimit(dm.resultLimit); err != nil {
+		return nil, err
+	}
+	if err := dm.charset.validate(); err != nil {
+		return nil, err
+	}
+	if err := dm.keyStrategy.validate(); err != nil {
+		return nil, err
+	}
+	if err := dm.surrogate.validate(); err != nil {
+		return nil, err
+	}
+	if dm.surrogate != NoSurrogateKeys && dm.keyName == "" {
+		dm.keyName = SurrogateKeyField
+	}
+	if c := dm.coercion; c != nil && c.rules == nil {
+		if err := c.init(); err != nil {
+			return nil, err
+		}
+	}
+	if c := dm.encryption; c != nil && c.aead == nil {
+		if err := c.init(); err != nil {
+			return nil, err
+		}
+	}
+	return dm, nil
+}
+
+// WithMaxRAM sets the memory limit in bytes
+func WithMaxRAM(bytes int64) Option {
+	return func(dm *DataManager) { dm.maxRAMUsage = bytes }
+}
+
+// WithMode selects InMemoryMode, SplitMode or AutoMode
+func WithMode(mode Mode) Option {
+	return func(dm *DataManager) { dm.mode = mode }
+}
+
+// WithWorkers sets how many goroutines parallel scans use (default: tuned, at
+// most one per CPU; see SetChunkSize)
+func WithWorkers(n int) Option {
+	return func(dm *DataManager) { dm.workers = n }
+}
+
+// WithLogger sends log events to logger (see SetLogger)
+func WithLogger(logger Logger) Option {
+	return func(dm *DataManager) { dm.logger = logger }
+}
+
+// WithMetrics sends instrumentation events to m (see SetMetrics)
+func WithMetrics(m Metrics) Option {
+	return func(dm *DataManager) { dm.metrics = m }
+}
+
+// WithDateLayouts accepts additional time layouts (see time.Parse) for the
+// values of "datetime" and "date" conditions and the fields they compare,
+// tried after the default "2006-01-02 15:04:05" and "2006-01-02". Sorted
+// indexes and partition pruning compare dates as text, so they are not used
+// for date conditions while extra layouts are set.
+func WithDateLayouts(layouts ...string) Option {
+	return func(dm *DataManager) { dm.dateLayouts = append([]string(nil), layouts...) }
+}
+
+// WithScannerBufferSize sets the read buffer of Split-mode line scans (default 1MB)
+func WithScannerBufferSize(bytes int) Option {
+	return func(dm *DataManager) { dm.bufferSize = bytes }
+}
+
+// WithMaxRecordSize caps the size of a single record (see SetMaxRecordSize)
+func WithMaxRecordSize(bytes int) Option {
+	return func(dm *DataManager) { dm.recordLimit = bytes }
+}
+
+// WithHTTPTimeout sets the timeout for http(s):// inputs (see SetHTTPTimeout)
+func WithHTTPTimeout(timeout time.Duration) Option {
+	return func(dm *DataManager) { dm.httpTimeout = timeout }
+}
+
+// WithSlowQueryThreshold logs queries slower than d (see SetSlowQueryThreshold)
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(dm *DataManager) { dm.slowQuery = d }
+}
+
+// parallelism returns how many goroutines a parallel scan uses
+func (dm *DataManager) parallelism() int {
+	if dm.workers > 0 {
+		return dm.workers
+	}
+	return runtime.NumCPU()
+}
+
+// chunkReader returns a buffered reader over r for a line scan; release it
+// with releaseChunkReader
+func (dm *DataManager) chunkReader(r io.Reader) *bufio.Reader {
+	if dm.bufferSize > 0 && dm.bufferSize != defaultChunkBuffer {
+		return bufio.NewReaderSize(r, dm.bufferSize)
+	}
+	br := chunkReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+// releaseChunkReader returns a reader from chunkReader to the pool
+func (dm *DataManager) releaseChunkReader(br *bufio.Reader) {
+	if br.Size() == defaultChunkBuffer {
+		br.Reset(nil)
+		chunkReaders.Put(br)
+	}
+}
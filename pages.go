@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Page is one page of the records matching a query (see QueryPage)
+type Page struct {
+	Records   []map[string]interface{}
+	NextToken string // Resumes after the last record of the page; "" when no records remain
+}
+
+// pageToken is the content of the opaque continuation tokens of QueryPage
+type pageToken struct {
+	Conditions     uint64 `json:"c"`           // Hash of the conditions the token continues
+	Offset         int64  `json:"o,omitempty"` // Split mode: byte offset of the line after the page
+	Fingerprint    uint32 `json:"f,omitempty"` // Split mode: CRC-32 of the first FingerprintLen bytes of the input
+	FingerprintLen int64  `json:"n,omitempty"`
+	After          string `json:"a,omitempty"` // InMemory mode: key of the last record of the page
+}
+
+// errPageFull stops a page's scan once it holds pageSize records
+var errPageFull = errors.New("page full")
+
+// QueryPage returns up to pageSize records matching conditions, starting
+// where the page that returned token ended, or at the beginning for an empty
+// token. Pass the page's NextToken to get the following page; it is ""
+// once no records remain, although a page ending exactly at the last match
+// is followed by an empty one. In Split mode the token holds the byte offset
+// reached in the scanned file, so each page reads on from there instead of
+// rescanning the pages before it; the input must be an uncompressed NDJSON
+// file, as for ScanWithCheckpoints, and records appended to it show up on
+// later pages. Split-mode pages always read the input of the latest load or
+// scan, whatever the token holds. In InMemory mode pages follow the order of the keys, and the
+// token holds the last key returned, so writes between pages neither repeat
+// nor skip records. A token only continues the query it came from: other
+// conditions, or a replaced input, fail with ErrInvalidPageToken. Pages are
+// not deduplicated (see SetDeduplicate).
+func (dm *DataManager) QueryPage(conditions []FilterCondition, pageSize int, token string) (*Page, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("Invalid page size %d", pageSize)
+	}
+	hash, err := conditionsHash(conditions)
+	if err != nil {
+		return nil, err
+	}
+	state := pageToken{Conditions: hash}
+	if token != "" {
+		if state, err = decodePageToken(token); err != nil {
+			return nil, err
+		}
+		if state.Conditions != hash {
+			return nil, fmt.Errorf("%w: it continues a query with other conditions", ErrInvalidPageToken)
+		}
+	}
+	if dm.mode == InMemoryMode {
+		return dm.memoryPage(conditions, pageSize, state)
+	}
+	return dm.filePage(conditions, pageSize, state)
+}
+
+// memoryPage returns the page of in-memory records after state.After, in key order
+func (dm *DataManager) memoryPage(conditions []FilterCondition, pageSize int, state pageToken) (*Page, error) {
+	ds := dm.snapshot()
+	plan := dm.plan(ds, conditions)
+	dm.mu.RLock()
+	keyName := dm.keyName
+	dm.mu.RUnlock()
+
+	// Only the pageSize+1 smallest keys after state.After are kept, the extra
+	// one telling whether another page follows
+	var matches pageHeap
+	dm.visit(ds, plan, func(record map[string]interface{}) bool {
+		key, ok := recordKey(record, keyName)
+		if !ok || (state.After != "" && key <= state.After) {
+			return true
+		}
+		if len(matches) <= pageSize {
+			heap.Push(&matches, pageMatch{key, record})
+		} else if key < matches[0].key {
+			matches[0] = pageMatch{key, record}
+			heap.Fix(&matches, 0)
+		}
+		return true
+	})
+	sort.Slice(matches, func(i, j int) bool { return matches[i].key < matches[j].key })
+
+	page := &Page{}
+	for i, match := range matches {
+		if i == pageSize {
+			next := state
+			next.After = matches[i-1].key
+			page.NextToken = next.encode()
+			break
+		}
+		page.Records = append(page.Records, match.record)
+	}
+	return page, nil
+}
+
+// pageMatch is a record of a page and its key
+type pageMatch struct {
+	key    string
+	record map[string]interface{}
+}
+
+// pageHeap orders the matches of a page by descending key, so the largest
+// kept is replaced first
+type pageHeap []pageMatch
+
+func (h pageHeap) Len() int            { return len(h) }
+func (h pageHeap) Less(i, j int) bool  { return h[i].key > h[j].key }
+func (h pageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pageHeap) Push(x interface{}) { *h = append(*h, x.(pageMatch)) }
+func (h *pageHeap) Pop() interface{} {
+	old := *h
+	match := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return match
+}
+
+// filePage scans the input from state.Offset until the page is full
+func (dm *DataManager) filePage(conditions []FilterCondition, pageSize int, state pageToken) (*Page, error) {
+	path := dm.loadedPath()
+	if path == "" {
+		return nil, fmt.Errorf("%w: nothing has been loaded", ErrNoInput)
+	}
+	if state.Offset == 0 && state.FingerprintLen == 0 {
+		fingerprint, n, err := fingerprintFile(path, checkpointFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		state.Fingerprint, state.FingerprintLen = fingerprint, n
+	} else {
+		// A page was full, so the input held data when the token was made
+		if state.FingerprintLen <= 0 || state.FingerprintLen > checkpointFingerprint {
+			return nil, fmt.Errorf("%w: it holds no fingerprint of the input", ErrInvalidPageToken)
+		}
+		fingerprint, n, err := fingerprintFile(path, state.FingerprintLen)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if info.Size() < state.Offset || n != state.FingerprintLen || fingerprint != state.Fingerprint {
+			return nil, fmt.Errorf("%w: %s changed since the page was read", ErrInvalidPageToken, path)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(state.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	counted := &countingReader{r: file}
+	br := dm.chunkReader(counted)
+	defer dm.releaseChunkReader(br)
+	if first, err := peekNonSpace(br); err == nil && (first == '[' || first == 0x1f) {
+		return nil, errors.New("Paging requires an uncompressed NDJSON file")
+	}
+
+	page := &Page{}
+	dm.parseErrors.reset()
+	start := state.Offset
+	ls := dm.newLineScanner(conditions)
+	err = ls.eachLine(br, start, math.MaxInt64, func(record map[string]interface{}, _ int) error {
+		if record == nil {
+			return nil
+		}
+		if len(dm.projection) > 0 {
+			record = project(record, dm.projection)
+		}
+		page.Records = append(page.Records, record)
+		if len(page.Records) == pageSize {
+			return errPageFull
+		}
+		return nil
+	})
+	if err == errPageFull {
+		// Everything read from the file but still buffered is not part of the page
+		state.Offset = start + counted.n - int64(br.Buffered())
+		page.NextToken = state.encode()
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// conditionsHash identifies a list of conditions
+func conditionsHash(conditions []FilterCondition) (uint64, error) {
+	raw, err := json.Marshal(conditions)
+	if err != nil {
+		return 0, err
+	}
+	return hashString(string(raw)), nil
+}
+
+// encode returns the token as URL-safe text
+func (t pageToken) encode() string {
+	raw, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodePageToken parses a token returned by encode
+func decodePageToken(token string) (pageToken, error) {
+	var t pageToken
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(raw, &t)
+	}
+	if err != nil {
+		return t, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// parquetColumn describes a leaf column of a Parquet file
+type parquetColumn struct {
+	path     []string // Path from the root; nested groups become nested maps
+	index    int      // Position among the row group's column chunks
+	repeated bool     // Whether the column is part of a list
+	node     parquet.Node
+	convert  func(parquet.Value) interface{}
+}
+
+// LoadParquetInSplitMode scans a Parquet file, decoding only the columns
+// referenced by conditions or listed in columns (nil means every column), and
+// skipping row groups whose min/max statistics rule out a match
+func (dm *DataManager) LoadParquetInSplitMode(filePath string, conditions []FilterCondition, columns []string) ([]map[string]interface{}, error) {
+	if dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+
+	src, err := dm.resolveSource(filePath)
+	if err != nil {
+		return nil, err
+	}
+	dm.setSourcePath(filePath)
+	budget, err := dm.beginScan()
+	if err != nil {
+		return nil, err
+	}
+	defer budget.done()
+	return dm.scanParquetSource(src, conditions, columns, budget)
+}
+
+// scanParquetSource opens src as a Parquet file and filters its rows
+func (dm *DataManager) scanParquetSource(src Source, conditions []FilterCondition, columns []string, budget *scanBudget) ([]map[string]interface{}, error) {
+	ra, size, closer, err := openReaderAt(src)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	file, err := parquet.OpenFile(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(dm.computed) == 0 {
+		return dm.scanParquet(file, conditions, columns, budget)
+	}
+
+	// Conditions on computed fields are checked once the fields are added
+	var stored, computed []FilterCondition
+	for _, condition := range conditions {
+		if dm.isComputed(condition.Key) {
+			computed = append(computed, condition)
+		} else {
+			stored = append(stored, condition)
+		}
+	}
+	records, err := dm.scanParquet(file, stored, nil, budget)
+	if err != nil {
+		return nil, err
+	}
+	kept := records[:0]
+	for _, record := range records {
+		dm.derive(record)
+		if dm.matchConditions(record, computed) {
+			if columns != nil {
+				record = project(record, columns)
+			}
+			kept = append(kept, record)
+		}
+	}
+	return kept, nil
+}
+
+// openReaderAt returns random access to src, which Parquet requires
+func openReaderAt(src Source) (io.ReaderAt, int64, io.Closer, error) {
+	switch s := src.(type) {
+	case *fileSource:
+		file, err := os.Open(s.path)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, nil, err
+		}
+		return file, info.Size(), file, nil
+	case *objectSource:
+		size, err := s.Size()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return s, size, io.NopCloser(nil), nil
+	default:
+		return nil, 0, nil, errors.New("Parquet input requires a local file or cloud object")
+	}
+}
+
+// scanParquet filters the rows of file row group by row group
+func (dm *DataManager) scanParquet(file *parquet.File, conditions []FilterCondition, columns []string, budget *scanBudget) ([]map[string]interface{}, error) {
+	leaves := parquetLeaves(file.Schema())
+
+	// Columns needed to evaluate conditions, and columns returned in records
+	wanted := func(names []string) map[string]bool {
+		set := make(map[string]bool, len(names))
+		for _, name := range names {
+			set[name] = true
+		}
+		return set
+	}
+	conditionColumns := make([]string, 0, len(conditions))
+	for _, condition := range conditions {
+		conditionColumns = append(conditionColumns, conditionFields(condition)...)
+	}
+	filterSet := wanted(conditionColumns)
+	outputSet := wanted(columns)
+
+	var filterLeaves, outputLeaves []parquetColumn
+	for _, leaf := range leaves {
+		top := leaf.path[0]
+		if filterSet[top] {
+			filterLeaves = append(filterLeaves, leaf)
+		}
+		if columns == nil || outputSet[top] {
+			outputLeaves = append(outputLeaves, leaf)
+		}
+	}
+
+	var filteredData []map[string]interface{}
+	metadata := file.Metadata()
+	for g, rowGroup := range file.RowGroups() {
+		if !parquetRowGroupMayMatch(metadata.RowGroups[g], leaves, conditions) {
+			continue
+		}
+		numRows := rowGroup.NumRows()
+		chunks := rowGroup.ColumnChunks()
+
+		// Evaluate conditions on just the filter columns first
+		matched := make([]bool, numRows)
+		filterRecords := make([]map[string]interface{}, numRows)
+		for i := range filterRecords {
+			filterRecords[i] = make(map[string]interface{}, len(filterLeaves))
+		}
+		if err := fillParquetColumns(filterRecords, chunks, filterLeaves); err != nil {
+			return nil, err
+		}
+		anyMatched := false
+		for i, record := range filterRecords {
+			if dm.matchConditions(record, conditions) {
+				matched[i] = true
+				anyMatched = true
+			}
+		}
+		if !anyMatched {
+			continue
+		}
+
+		// Then decode the output columns and keep the matching rows
+		records := make([]map[string]interface{}, numRows)
+		for i := range records {
+			if matched[i] {
+				records[i] = make(map[string]interface{}, len(outputLeaves))
+			}
+		}
+		if err := fillParquetColumns(records, chunks, outputLeaves); err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if !matched[i] {
+				continue
+			}
+			filteredData = append(filteredData, record)
+
+			if err := budget.charge(estimateRecordSize(record)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return filteredData, nil
+}
+
+// parquetLeaves lists the leaf columns of a schema with their value converters
+func parquetLeaves(schema *parquet.Schema) []parquetColumn {
+	var leaves []parquetColumn
+	for _, path := range schema.Columns() {
+		leaf, ok := schema.Lookup(path...)
+		if !ok {
+			continue
+		}
+		leaves = append(leaves, parquetColumn{
+			path:     path,
+			index:    leaf.ColumnIndex,
+			repeated: leaf.MaxRepetitionLevel > 0,
+			node:     leaf.Node,
+			convert:  parquetConverter(leaf.Node.Type()),
+		})
+	}
+	return leaves
+}
+
+// fillParquetColumns decodes the given leaf columns into records; nil
+// entries in records are skipped but still consume their values
+func fillParquetColumns(records []map[string]interface{}, chunks []parquet.ColumnChunk, leaves []parquetColumn) error {
+	for _, leaf := range leaves {
+		if leaf.repeated {
+			return fmt.Errorf("Parquet column %q is repeated; lists are not supported", strings.Join(leaf.path, "."))
+		}
+		row := 0
+		err := readParquetChunk(chunks[leaf.index], func(v parquet.Value) {
+			if row < len(records) && records[row] != nil {
+				var value interface{}
+				if !v.IsNull() {
+					value = leaf.convert(v)
+				}
+				setNested(records[row], leaf.path, value)
+			}
+			row++
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readParquetChunk calls fn for every value of a column chunk in row order
+func readParquetChunk(chunk parquet.ColumnChunk, fn func(parquet.Value)) error {
+	pages := chunk.Pages()
+	defer pages.Close()
+
+	buffer := make([]parquet.Value, 1024)
+	for {
+		page, err := pages.ReadPage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		values := page.Values()
+		for {
+			n, err := values.ReadValues(buffer)
+			for _, v := range buffer[:n] {
+				fn(v)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				parquet.Release(page)
+				return err
+			}
+		}
+		parquet.Release(page)
+	}
+}
+
+// setNested stores value at path, creating intermediate maps for nested groups
+func setNested(record map[string]interface{}, path []string, value interface{}) {
+	for _, name := range path[:len(path)-1] {
+		child, ok := record[name].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			record[name] = child
+		}
+		record = child
+	}
+	record[path[len(path)-1]] = value
+}
+
+// parquetConverter maps Parquet values to the types JSON decoding produces:
+// numbers become float64, dates "2006-01-02" strings, and timestamps
+// "2006-01-02 15:04:05" strings, so the existing filters apply unchanged
+func parquetConverter(t parquet.Type) func(parquet.Value) interface{} {
+	logical := t.LogicalType()
+	switch {
+	case logical != nil && logical.Date != nil:
+		return func(v parquet.Value) interface{} {
+			return time.Unix(int64(v.Int32())*86400, 0).UTC().Format("2006-01-02")
+		}
+	case logical != nil && logical.Timestamp != nil:
+		unit := logical.Timestamp.Unit
+		return func(v parquet.Value) interface{} {
+			return parquetTimestamp(v.Int64(), unit).Format("2006-01-02 15:04:05")
+		}
+	}
+
+	switch t.Kind() {
+	case parquet.Boolean:
+		return func(v parquet.Value) interface{} { return v.Boolean() }
+	case parquet.Int32:
+		return func(v parquet.Value) interface{} { return float64(v.Int32()) }
+	case parquet.Int64:
+		return func(v parquet.Value) interface{} { return float64(v.Int64()) }
+	case parquet.Float:
+		return func(v parquet.Value) interface{} { return float64(v.Float()) }
+	case parquet.Double:
+		return func(v parquet.Value) interface{} { return v.Double() }
+	default:
+		return func(v parquet.Value) interface{} { return string(v.ByteArray()) }
+	}
+}
+
+// parquetTimestamp converts a timestamp in the given unit to UTC time
+func parquetTimestamp(n int64, unit format.TimeUnit) time.Time {
+	switch {
+	case unit.Millis != nil:
+		return time.UnixMilli(n).UTC()
+	case unit.Nanos != nil:
+		return time.Unix(0, n).UTC()
+	default:
+		return time.UnixMicro(n).UTC()
+	}
+}
+
+// parquetRowGroupMayMatch uses column chunk statistics to decide whether any
+// row of a row group could satisfy every condition
+func parquetRowGroupMayMatch(rowGroup format.RowGroup, leaves []parquetColumn, conditions []FilterCondition) bool {
+	for _, condition := range conditions {
+		want, ok := conditionIndexValue(condition)
+		if !ok {
+			continue
+		}
+		for _, leaf := range leaves {
+			if len(leaf.path) != 1 || leaf.path[0] != condition.Key || leaf.index >= len(rowGroup.Columns) {
+				continue
+			}
+			stats := rowGroup.Columns[leaf.index].MetaData.Statistics
+			if stats.NullCount == rowGroup.NumRows && rowGroup.NumRows > 0 {
+				return false
+			}
+			min, okMin := decodeParquetStat(leaf, firstBytes(stats.MinValue, stats.Min))
+			max, okMax := decodeParquetStat(leaf, firstBytes(stats.MaxValue, stats.Max))
+			if !okMin || !okMax || valueRank(min) != valueRank(want) {
+				continue
+			}
+			if !rangeMayMatch(condition.Operator, want, min, max) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rangeMayMatch reports whether some value in [min, max] can satisfy operator against want
+func rangeMayMatch(operator string, want, min, max interface{}) bool {
+	switch operator {
+	case "==":
+		return compareIndexValues(want, min) >= 0 && compareIndexValues(want, max) <= 0
+	case ">":
+		return compareIndexValues(max, want) > 0
+	case ">=":
+		return compareIndexValues(max, want) >= 0
+	case "<":
+		return compareIndexValues(min, want) < 0
+	case "<=":
+		return compareIndexValues(min, want) <= 0
+	default:
+		return true
+	}
+}
+
+// decodeParquetStat decodes a PLAIN-encoded min/max statistic into a normalized value
+func decodeParquetStat(leaf parquetColumn, raw []byte) (interface{}, bool) {
+	if raw == nil {
+		return nil, false
+	}
+	var v parquet.Value
+	switch leaf.node.Type().Kind() {
+	case parquet.Boolean:
+		if len(raw) < 1 {
+			return nil, false
+		}
+		v = parquet.BooleanValue(raw[0] != 0)
+	case parquet.Int32:
+		if len(raw) < 4 {
+			return nil, false
+		}
+		v = parquet.Int32Value(int32(binary.LittleEndian.Uint32(raw)))
+	case parquet.Int64:
+		if len(raw) < 8 {
+			return nil, false
+		}
+		v = parquet.Int64Value(int64(binary.LittleEndian.Uint64(raw)))
+	case parquet.Float:
+		if len(raw) < 4 {
+			return nil, false
+		}
+		v = parquet.FloatValue(math.Float32frombits(binary.LittleEndian.Uint32(raw)))
+	case parquet.Double:
+		if len(raw) < 8 {
+			return nil, false
+		}
+		v = parquet.DoubleValue(math.Float64frombits(binary.LittleEndian.Uint64(raw)))
+	case parquet.ByteArray:
+		v = parquet.ByteArrayValue(raw)
+	default:
+		return nil, false
+	}
+	return normalizeIndexValue(leaf.convert(v))
+}
+
+// firstBytes returns the first non-nil slice
+func firstBytes(values ...[]byte) []byte {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// estimateRecordSize approximates the memory held by a decoded record
+func estimateRecordSize(record map[string]interface{}) int64 {
+	var size int64
+	for key, value := range record {
+		size += int64(len(key)) + 16
+		switch v := value.(type) {
+		case string:
+			size += int64(len(v))
+		case map[string]interface{}:
+			size += estimateRecordSize(v)
+		}
+	}
+	return size
+}
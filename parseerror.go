@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrorPolicy selects how loads and scans react to records that cannot be parsed
+type ErrorPolicy int
+
+const (
+	FailFast ErrorPolicy = iota // Abort at the first malformed record (default)
+	Skip                        // Skip malformed records, only counting them
+	Collect                     // Skip malformed records and keep their details for ParseErrors
+)
+
+// maxCollectedParseErrors bounds the details kept under the Collect policy
+const maxCollectedParseErrors = 1000
+
+// ParseError reports a record that could not be decoded
+type ParseError struct {
+	File    string // Input the record came from, in multi-file loads
+	Line    int    // 1-based line number; 0 when unknown (parallel chunk scans)
+	Offset  int64  // Byte offset of the record in the input; -1 when unknown
+	Snippet string // Beginning of the offending input
+	Err     error
+}
+
+// Error formats the position, cause and snippet
+func (e *ParseError) Error() string {
+	position := fmt.Sprintf("offset %d", e.Offset)
+	if e.Line > 0 {
+		position = fmt.Sprintf("line %d", e.Line)
+	}
+	if e.File != "" {
+		position = e.File + ": " + position
+	}
+	if e.Snippet == "" {
+		return fmt.Sprintf("%s: %v", position, e.Err)
+	}
+	return fmt.Sprintf("%s: %v (near %q)", position, e.Err, e.Snippet)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// snippet returns the start of raw input for error reports
+func snippet(raw []byte) string {
+	const max = 80
+	if len(raw) > max {
+		raw = raw[:max]
+		for len(raw) > 0 && !utf8.Valid(raw) {
+			raw = raw[:len(raw)-1]
+		}
+	}
+	return string(raw)
+}
+
+// parseErrorLog records the malformed records skipped by the latest load or scan
+type parseErrorLog struct {
+	mu     sync.Mutex
+	count  int64
+	errors []ParseError
+}
+
+func (l *parseErrorLog) reset() {
+	l.mu.Lock()
+	l.count = 0
+	l.errors = nil
+	l.mu.Unlock()
+}
+
+func (l *parseErrorLog) add(err *ParseError, keep bool) {
+	l.mu.Lock()
+	l.count++
+	if keep && len(l.errors) < maxCollectedParseErrors {
+		l.errors = append(l.errors, *err)
+	}
+	l.mu.Unlock()
+}
+
+// SetErrorPolicy chooses whether malformed records abort a load or scan
+// (FailFast), are skipped (Skip), or are skipped and reported (Collect).
+// Errors that make the rest of the input unreadable, such as a syntax error
+// inside a JSON array, always abort.
+func (dm *DataManager) SetErrorPolicy(policy ErrorPolicy) {
+	dm.errorPolicy = policy
+}
+
+// ParseErrors returns the malformed records skipped by the most recent load
+// or scan under the Collect policy (at most 1000)
+func (dm *DataManager) ParseErrors() []ParseError {
+	dm.parseErrors.mu.Lock()
+	defer dm.parseErrors.mu.Unlock()
+	return append([]ParseError(nil), dm.parseErrors.errors...)
+}
+
+// ParseErrorCount returns how many malformed records the most recent load or scan skipped
+func (dm *DataManager) ParseErrorCount() int64 {
+	dm.parseErrors.mu.Lock()
+	defer dm.parseErrors.mu.Unlock()
+	return dm.parseErrors.count
+}
+
+// tolerate applies the error policy to a read error, returning nil when the
+// malformed record should be skipped and reading can continue
+func (dm *DataManager) tolerate(err error) error {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		return err
+	}
+	if dm.metrics != nil {
+		dm.metrics.ObserveParseError()
+	}
+	if dm.errorPolicy == FailFast {
+		return err
+	}
+	dm.logParseError(parseErr)
+	dm.parseErrors.add(parseErr, dm.errorPolicy == Collect)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// SetPartitionScheme registers a regular expression whose named groups
+// extract partition values from file paths, e.g.
+// `events-(?P<date>\d{4}-\d{2}-\d{2})\.json`. In multi-file scans a file is
+// skipped without being opened when a condition on a field named like a
+// group cannot hold for its value, and the value is added to records that
+// lack the field. Date and datetime conditions treat a coarser value such as
+// "2024-09" as covering every date that starts with it. An empty pattern
+// removes the scheme.
+func (dm *DataManager) SetPartitionScheme(pattern string) error {
+	if pattern == "" {
+		dm.partitions = nil
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	hasNames := false
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			hasNames = true
+		}
+	}
+	if !hasNames {
+		return fmt.Errorf("Partition pattern %q has no named groups", pattern)
+	}
+	dm.partitions = re
+	return nil
+}
+
+// partitionValues extracts the partition fields encoded in path
+func (dm *DataManager) partitionValues(path string) map[string]string {
+	if dm.partitions == nil {
+		return nil
+	}
+	match := dm.partitions.FindStringSubmatch(filepath.ToSlash(path))
+	if match == nil {
+		return nil
+	}
+	values := make(map[string]string)
+	for i, name := range dm.partitions.SubexpNames() {
+		if name != "" && match[i] != "" {
+			values[name] = match[i]
+		}
+	}
+	return values
+}
+
+// partitionVerdict says whether a condition holds for none, all or only
+// some of the records in a partition
+type partitionVerdict int
+
+const (
+	partitionSome partitionVerdict = iota
+	partitionNone
+	partitionAll
+)
+
+// prunePartitions drops the files whose partition values rule out the
+// conditions and returns, for each kept file, the conditions still needing a
+// per-record check and the partition values to add to its records
+func (dm *DataManager) prunePartitions(paths []string, conditions []FilterCondition) ([]string, [][]FilterCondition, []map[string]string) {
+	var kept []string
+	var perFile [][]FilterCondition
+	var values []map[string]string
+
+files:
+	for _, path := range paths {
+		partition := dm.partitionValues(path)
+		var remaining []FilterCondition
+		for _, condition := range conditions {
+			value, ok := partition[condition.Key]
+			if !ok || !dm.textComparable(condition) {
+				remaining = append(remaining, condition)
+				continue
+			}
+			switch evaluatePartition(value, condition) {
+			case partitionNone:
+				continue files
+			case partitionSome:
+				remaining = append(remaining, condition)
+			}
+		}
+		kept = append(kept, path)
+		perFile = append(perFile, remaining)
+		values = append(values, partition)
+	}
+	return kept, perFile, values
+}
+
+// evaluatePartition compares a partition value with a condition on its field
+func evaluatePartition(value string, condition FilterCondition) partitionVerdict {
+	switch condition.ValueType {
+	case "date", "datetime":
+		v, ok := condition.Value.(string)
+		if !ok {
+			return partitionSome
+		}
+		// A value coarser than the condition covers the range [value, value+"\xff"]
+		lo, hi := value, value
+		if len(v) > len(value) {
+			hi = value + "\xff"
+		}
+		return compareRange(lo, hi, v, condition.Operator)
+	case "int":
+		v, ok := condition.Value.(int)
+		n, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			return partitionSome
+		}
+		if applyIntCondition(n, condition.Operator, v) {
+			return partitionAll
+		}
+		return partitionNone
+	case "string":
+		if condition.Operator == "==" || condition.Operator == "contains" {
+			if matchValue(value, condition) {
+				return partitionAll
+			}
+			return partitionNone
+		}
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return partitionSome
+		}
+		if applyBoolCondition(b, condition.Operator, condition.Value) {
+			return partitionAll
+		}
+		return partitionNone
+	}
+	return partitionSome
+}
+
+// compareRange classifies a string range [lo, hi] against "x <op> v"
+func compareRange(lo, hi, v, operator string) partitionVerdict {
+	verdict := func(all, none bool) partitionVerdict {
+		switch {
+		case all:
+			return partitionAll
+		case none:
+			return partitionNone
+		default:
+			return partitionSome
+		}
+	}
+	switch operator {
+	case ">":
+		return verdict(lo > v, hi <= v)
+	case ">=":
+		return verdict(lo >= v, hi < v)
+	case "<":
+		return verdict(hi < v, lo >= v)
+	case "<=":
+		return verdict(hi <= v, lo > v)
+	case "==":
+		return verdict(lo == v && hi == v, v < lo || v > hi)
+	default:
+		return partitionSome
+	}
+}
+
+// addPartitionValues sets partition fields missing from records, typing
+// numeric values like JSON numbers
+func addPartitionValues(records []map[string]interface{}, values map[string]string) {
+	for field, raw := range values {
+		var value interface{} = raw
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			value = n
+		}
+		for _, record := range records {
+			if _, exists := record[field]; !exists {
+				record[field] = value
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultMaxOpenFiles bounds the files ExportPartitioned and Ingest keep open at once
+const defaultMaxOpenFiles = 64
+
+// MissingPartition names the partition of records lacking the partition
+// field, or holding null, an object or an array in it
+const MissingPartition = "_missing"
+
+// PartitionedExport describes the files written by ExportPartitioned
+type PartitionedExport struct {
+	Records    int64                // Records written
+	Partitions map[string]ShardInfo // File of each partition value
+}
+
+// Values returns the partition values in ascending order
+func (e *PartitionedExport) Values() []string {
+	values := make([]string, 0, len(e.Partitions))
+	for value := range e.Partitions {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// SetMaxOpenFiles bounds the output files ExportPartitioned and Ingest keep
+// open at once (default 64); the least recently written one is closed to
+// make room and reopened for appending when its partition comes up again
+func (dm *DataManager) SetMaxOpenFiles(n int) {
+	dm.maxOpenFiles = n
+}
+
+// partitionPattern is a parsed output path pattern of ExportPartitioned
+type partitionPattern struct {
+	before, after string
+	layout        string // Time layout of the value ("" uses it as it is)
+}
+
+// parsePartitionPattern splits pattern around its {value} or {value:layout}
+// placeholder
+func parsePartitionPattern(pattern string) (partitionPattern, error) {
+	start := strings.Index(pattern, "{value")
+	end := strings.Index(pattern[max(start, 0):], "}")
+	if start < 0 || end < 0 {
+		return partitionPattern{}, fmt.Errorf("Output pattern %q lacks a {value} placeholder", pattern)
+	}
+	end += start
+	p := partitionPattern{before: pattern[:start], after: pattern[end+1:]}
+	switch placeholder := pattern[start+len("{value") : end]; {
+	case placeholder == "":
+	case strings.HasPrefix(placeholder, ":") && len(placeholder) > 1:
+		p.layout = placeholder[1:]
+	default:
+		return partitionPattern{}, fmt.Errorf("Invalid placeholder {value%s} in output pattern %q", placeholder, pattern)
+	}
+	if strings.Contains(p.after, "{value") {
+		return partitionPattern{}, fmt.Errorf("Output pattern %q holds more than one {value} placeholder", pattern)
+	}
+	return p, nil
+}
+
+// value returns the partition of a field value: its canonical key text, or
+// the time it holds in the pattern's layout
+func (p partitionPattern) value(v interface{}) string {
+	if p.layout != "" {
+		if t, ok := exprTime(v); ok {
+			return t.Format(p.layout)
+		}
+		return MissingPartition
+	}
+	if text, ok := canonicalKey(v); ok && text != "" {
+		return text
+	}
+	return MissingPartition
+}
+
+// path returns the output file of a partition value. The value is escaped
+// so that it always names a single path element.
+func (p partitionPattern) path(value string) string {
+	element := url.PathEscape(value)
+	if element == "." || element == ".." {
+		element = strings.ReplaceAll(element, ".", "%2E")
+	}
+	return p.before + element + p.after
+}
+
+// partitionFile is the output file of one partition value
+type partitionFile struct {
+	value   string
+	file    *os.File // nil while closed
+	buf     *bufio.Writer
+	info    ShardInfo
+	element *list.Element // Place among the open files
+}
+
+// ExportPartitioned writes the records matching conditions to one NDJSON
+// file per value of partitionField, such as one file per country or per
+// day, streaming them in a single pass. outDirPattern names the files with
+// a {value} placeholder, as in "exports/country={value}/part.ndjson"; with a
+// time layout, as in "exports/{value:2006-01-02}.ndjson", date and time
+// values are grouped by their formatted text. Values are escaped to stay a
+// single path element, and records lacking the field go to the
+// MissingPartition file. Directories are created as needed and existing
+// files are replaced. Records keep their input order within each file.
+// The input is the in-memory data in InMemory mode and the most recently
+// loaded or scanned input in Split mode; at most SetMaxOpenFiles files are
+// open at once, however many values there are.
+func (dm *DataManager) ExportPartitioned(conditions []FilterCondition, partitionField, outDirPattern string) (_ *PartitionedExport, err error) {
+	pattern, err := parsePartitionPattern(outDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	maxOpen := dm.maxOpenFiles
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenFiles
+	}
+
+	export := &PartitionedExport{Partitions: make(map[string]ShardInfo)}
+	files := make(map[string]*partitionFile)
+	open := list.New() // Open files, most recently written first
+	closeFile := func(f *partitionFile) error {
+		err := f.buf.Flush()
+		if cerr := f.file.Close(); err == nil {
+			err = cerr
+		}
+		open.Remove(f.element)
+		f.file, f.buf, f.element = nil, nil, nil
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			if f.file != nil {
+				if cerr := closeFile(f); err == nil {
+					err = cerr
+				}
+			}
+			export.Partitions[f.value] = f.info
+		}
+	}()
+
+	write := func(record map[string]interface{}) error {
+		value, _ := resolvePath(record, partitionField)
+		partition := pattern.value(value)
+		f := files[partition]
+		if f == nil {
+			f = &partitionFile{value: partition, info: ShardInfo{Path: pattern.path(partition)}}
+			files[partition] = f
+		}
+		if f.file == nil {
+			if open.Len() >= maxOpen {
+				if err := closeFile(open.Back().Value.(*partitionFile)); err != nil {
+					return err
+				}
+			}
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if f.info.Records > 0 {
+				flags = os.O_WRONLY | os.O_APPEND // Reopened after being closed to make room
+			} else if err := os.MkdirAll(filepath.Dir(f.info.Path), 0o755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(f.info.Path, flags, 0o644)
+			if err != nil {
+				return err
+			}
+			f.file, f.buf = file, bufio.NewWriter(file)
+			f.element = open.PushFront(f)
+		} else {
+			open.MoveToFront(f.element)
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err := f.buf.Write(line); err != nil {
+			return err
+		}
+		f.info.Records++
+		f.info.Bytes += int64(len(line))
+		export.Records++
+		return nil
+	}
+
+	err = dm.Pipeline().Workers(1).Filter(conditions).ForEach(write)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// resolvePath returns the value of the field key in record. A key naming no
+// top-level field is read as a dotted path through nested objects and
+// arrays, such as "address.city" or "items.0.sku".
+func resolvePath(record map[string]interface{}, key string) (interface{}, bool) {
+	if value, ok := record[key]; ok || !strings.Contains(key, ".") {
+		return value, ok
+	}
+	var value interface{} = record
+	for _, part := range strings.Split(key, ".") {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			v, ok := container[part]
+			if !ok {
+				return nil, false
+			}
+			value = v
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(container) {
+				return nil, false
+			}
+			value = container[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// pathHead returns the top-level field a dotted path starts with
+func pathHead(key string) string {
+	head, _, _ := strings.Cut(key, ".")
+	return head
+}
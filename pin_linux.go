@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	workerCPUsOnce sync.Once
+	workerCPUs     []int // CPUs the process may run on, taken in turn across NUMA nodes
+)
+
+// pinWorker locks the calling goroutine to its thread and binds the thread
+// to the CPU of worker slot, returning a function undoing both
+func pinWorker(slot int) func() {
+	runtime.LockOSThread()
+	workerCPUsOnce.Do(func() { workerCPUs = interleavedCPUs() })
+	var previous unix.CPUSet
+	if len(workerCPUs) == 0 || unix.SchedGetaffinity(0, &previous) != nil {
+		return runtime.UnlockOSThread
+	}
+	var set unix.CPUSet
+	set.Set(workerCPUs[slot%len(workerCPUs)])
+	if unix.SchedSetaffinity(0, &set) != nil {
+		return runtime.UnlockOSThread
+	}
+	return func() {
+		unix.SchedSetaffinity(0, &previous) // The thread goes back to the scheduler
+		runtime.UnlockOSThread()
+	}
+}
+
+// interleavedCPUs returns the CPUs the process may run on, one from each
+// NUMA node in turn
+func interleavedCPUs() []int {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		return nil
+	}
+	nodes, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*/cpulist")
+	sort.Strings(nodes)
+	var perNode [][]int
+	seen := make(map[int]bool)
+	for _, node := range nodes {
+		data, err := os.ReadFile(node)
+		if err != nil {
+			continue
+		}
+		var cpus []int
+		for _, cpu := range parseCPUList(strings.TrimSpace(string(data))) {
+			if allowed.IsSet(cpu) && !seen[cpu] {
+				cpus = append(cpus, cpu)
+				seen[cpu] = true
+			}
+		}
+		if len(cpus) > 0 {
+			perNode = append(perNode, cpus)
+		}
+	}
+	// CPUs missing from the node lists, as without NUMA support, form a node
+	var rest []int
+	for cpu := 0; cpu < len(allowed)*64; cpu++ {
+		if allowed.IsSet(cpu) && !seen[cpu] {
+			rest = append(rest, cpu)
+		}
+	}
+	if len(rest) > 0 {
+		perNode = append(perNode, rest)
+	}
+
+	var order []int
+	for i := 0; len(order) < len(seen)+len(rest); i++ {
+		for _, cpus := range perNode {
+			if i < len(cpus) {
+				order = append(order, cpus[i])
+			}
+		}
+	}
+	return order
+}
+
+// parseCPUList parses a kernel CPU list such as "0-3,8-11"
+func parseCPUList(list string) []int {
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		first, last, found := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			continue
+		}
+		hi := lo
+		if found {
+			if hi, err = strconv.Atoi(last); err != nil {
+				continue
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "runtime"
+
+// pinWorker locks the calling goroutine to its thread, returning a function
+// undoing it; binding threads to CPUs is not supported on this platform
+func pinWorker(slot int) func() {
+	runtime.LockOSThread()
+	return runtime.UnlockOSThread
+}
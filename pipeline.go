@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Pipeline is a chain of record transformations run as a stream over the
+// loaded data or an input, built with DataManager.Pipeline. Each stage runs
+// in its own goroutines, connected by bounded channels, so huge inputs are
+// transformed with little memory and stages overlap on several cores.
+type Pipeline struct {
+	dm       *DataManager
+	location string
+	stages   []pipelineStage
+	workers  int
+	buffer   int
+	ctx      context.Context
+}
+
+// pipelineStage transforms one record into zero or more records
+type pipelineStage func(record map[string]interface{}, emit func(map[string]interface{}) error) error
+
+// Pipeline starts an empty pipeline. Its input is the in-memory data in
+// InMemory mode and the most recently loaded or scanned input in Split mode,
+// unless From selects another one.
+func (dm *DataManager) Pipeline() *Pipeline {
+	return &Pipeline{dm: dm, workers: dm.parallelism(), buffer: 256, ctx: context.Background()}
+}
+
+// From reads the records of location, which may be a file, URL, object
+// location or glob, instead of the manager's data
+func (p *Pipeline) From(location string) *Pipeline {
+	p.location = location
+	return p
+}
+
+// Workers sets how many goroutines run each stage (default one per CPU).
+// With more than one, records may leave a stage in a different order than
+// they entered it; Workers(1) preserves the input order.
+func (p *Pipeline) Workers(n int) *Pipeline {
+	if n > 0 {
+		p.workers = n
+	}
+	return p
+}
+
+// Buffer sets the capacity of the channels between stages (default 256)
+func (p *Pipeline) Buffer(n int) *Pipeline {
+	if n >= 0 {
+		p.buffer = n
+	}
+	return p
+}
+
+// Context makes the pipeline stop with ctx's error when ctx is done
+func (p *Pipeline) Context(ctx context.Context) *Pipeline {
+	p.ctx = ctx
+	return p
+}
+
+// Filter keeps the records matching all conditions
+func (p *Pipeline) Filter(conditions []FilterCondition) *Pipeline {
+	p.stages = append(p.stages, func(record map[string]interface{}, emit func(map[string]interface{}) error) error {
+		if p.dm.matchConditions(record, conditions) {
+			return emit(record)
+		}
+		return nil
+	})
+	return p
+}
+
+// Map replaces each record with the one fn returns, dropping it when fn
+// returns nil. In InMemory mode fn receives the stored records, which it
+// must copy rather than modify.
+func (p *Pipeline) Map(fn func(record map[string]interface{}) (map[string]interface{}, error)) *Pipeline {
+	p.stages = append(p.stages, func(record map[string]interface{}, emit func(map[string]interface{}) error) error {
+		out, err := fn(record)
+		if err != nil || out == nil {
+			return err
+		}
+		return emit(out)
+	})
+	return p
+}
+
+// FlatMap replaces each record with the records fn returns, such as one
+// record per element of an array field
+func (p *Pipeline) FlatMap(fn func(record map[string]interface{}) ([]map[string]interface{}, error)) *Pipeline {
+	p.stages = append(p.stages, func(record map[string]interface{}, emit func(map[string]interface{}) error) error {
+		out, err := fn(record)
+		if err != nil {
+			return err
+		}
+		for _, r := range out {
+			if err := emit(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return p
+}
+
+// Reduce runs the pipeline and folds its output into one value, starting
+// from initial. fn is called from a single goroutine, so the accumulator
+// needs no locking.
+func (p *Pipeline) Reduce(initial interface{}, fn func(acc interface{}, record map[string]interface{}) (interface{}, error)) (interface{}, error) {
+	acc := initial
+	err := p.ForEach(func(record map[string]interface{}) error {
+		var err error
+		acc, err = fn(acc, record)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// Collect runs the pipeline and returns its output records, charging them
+// to the memory limit like the results of a scan
+func (p *Pipeline) Collect() ([]map[string]interface{}, error) {
+	budget, err := p.dm.beginScan()
+	if err != nil {
+		return nil, err
+	}
+	defer budget.done()
+	var results []map[string]interface{}
+	err = p.ForEach(func(record map[string]interface{}) error {
+		results = append(results, record)
+		return budget.charge(estimateRecordSize(record))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ForEach runs the pipeline and calls fn with each output record from a
+// single goroutine. The first error from the input, a stage or fn stops
+// every stage and is returned.
+func (p *Pipeline) ForEach(fn func(record map[string]interface{}) error) (err error) {
+	location := p.location
+	if location == "" {
+		location = p.dm.loadedPath()
+	}
+	defer p.dm.beginOperation("pipeline", location, nil)(&err)
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	send := func(out chan<- map[string]interface{}) func(map[string]interface{}) error {
+		return func(record map[string]interface{}) error {
+			select {
+			case out <- record:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	source := make(chan map[string]interface{}, p.buffer)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(source)
+		if err := p.read(send(source)); err != nil && ctx.Err() == nil {
+			fail(err)
+		}
+	}()
+
+	in := source
+	for _, stage := range p.stages {
+		out := make(chan map[string]interface{}, p.buffer)
+		var workers sync.WaitGroup
+		for i := 0; i < p.workers; i++ {
+			workers.Add(1)
+			go func(stage pipelineStage, in <-chan map[string]interface{}) {
+				defer workers.Done()
+				emit := send(out)
+				for record := range in {
+					if ctx.Err() != nil {
+						continue // Drain so upstream stages can finish
+					}
+					if err := stage(record, emit); err != nil && ctx.Err() == nil {
+						fail(err)
+					}
+				}
+			}(stage, in)
+		}
+		wg.Add(1)
+		go func(out chan map[string]interface{}) {
+			defer wg.Done()
+			workers.Wait()
+			close(out)
+		}(out)
+		in = out
+	}
+
+	for record := range in {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := fn(record); err != nil {
+			fail(err)
+		}
+	}
+	wg.Wait()
+	if firstErr == nil && p.ctx.Err() != nil {
+		return p.ctx.Err()
+	}
+	return firstErr
+}
+
+// read sends every input record to emit
+func (p *Pipeline) read(emit func(map[string]interface{}) error) error {
+	dm := p.dm
+	location := p.location
+	if location == "" && dm.mode == InMemoryMode {
+		for _, record := range dm.snapshot().all() {
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if location == "" {
+		if location = dm.loadedPath(); location == "" {
+			return fmt.Errorf("%w: nothing has been scanned or loaded", ErrNoInput)
+		}
+	}
+
+	paths := []string{location}
+	if isGlob(location) {
+		var err error
+		if paths, err = expandGlob(location); err != nil {
+			return err
+		}
+	}
+	dm.parseErrors.reset()
+	for _, path := range paths {
+		reader, closer, err := dm.openRecords(path)
+		if err != nil {
+			return err
+		}
+		err = dm.eachMatch(reader, nil, emit)
+		closer.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
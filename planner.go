@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// QueryPlan describes how a query will be executed
+type QueryPlan struct {
+	Index         string            // Field of the chosen index, empty for a full scan
+	IndexType     IndexType         // Type of the chosen index
+	Driver        *FilterCondition  // Condition answered by the index
+	Drivers       []FilterCondition // Conditions answered together by a composite index
+	Recheck       bool              // Whether the driver is re-applied to candidates
+	Residual      []FilterCondition // Conditions applied to each candidate
+	EstimatedRows int               // Estimated number of candidate records
+	EstimatedHits int               // Estimated number of matching records, from the statistics catalog (-1 without statistics)
+	TotalRows     int               // Number of records in the dataset
+}
+
+// String renders the plan in a human readable form
+func (p *QueryPlan) String() string {
+	var sb strings.Builder
+	if p.Driver == nil {
+		fmt.Fprintf(&sb, "Full Scan (est. rows=%d of %d)", p.EstimatedRows, p.TotalRows)
+	} else if len(p.Drivers) > 0 {
+		parts := make([]string, len(p.Drivers))
+		for i, condition := range p.Drivers {
+			parts[i] = formatCondition(condition)
+		}
+		fmt.Fprintf(&sb, "Index Scan using composite index on %s (%s) (est. rows=%d of %d)",
+			p.Index, strings.Join(parts, " AND "), p.EstimatedRows, p.TotalRows)
+	} else {
+		fmt.Fprintf(&sb, "Index Scan using %s index on %s (%s) (est. rows=%d of %d)",
+			p.IndexType, p.Index, formatCondition(*p.Driver), p.EstimatedRows, p.TotalRows)
+		if p.Recheck {
+			fmt.Fprintf(&sb, "\n  Recheck: %s", formatCondition(*p.Driver))
+		}
+	}
+	if len(p.Residual) > 0 {
+		parts := make([]string, len(p.Residual))
+		for i, condition := range p.Residual {
+			parts[i] = formatCondition(condition)
+		}
+		fmt.Fprintf(&sb, "\n  Filter: %s", strings.Join(parts, " AND "))
+	}
+	if p.EstimatedHits >= 0 {
+		fmt.Fprintf(&sb, "\n  Estimated matches: %d", p.EstimatedHits)
+	}
+	return sb.String()
+}
+
+// formatCondition renders a single condition
+func formatCondition(condition FilterCondition) string {
+	if condition.ValueType == ExprValueType {
+		return fmt.Sprintf("(%v)", condition.Value)
+	}
+	if sub, ok := condition.Value.(FilterCondition); ok {
+		return fmt.Sprintf("%s %s (%s)", condition.Key, condition.Operator, strings.TrimSpace(formatCondition(sub)))
+	}
+	if s, ok := condition.Value.(string); ok && condition.Collation != BinaryCollation {
+		return fmt.Sprintf("%s %s %q COLLATE %s", condition.Key, condition.Operator, s, condition.Collation)
+	} else if ok {
+		return fmt.Sprintf("%s %s %q", condition.Key, condition.Operator, s)
+	}
+	return fmt.Sprintf("%s %s %v", condition.Key, condition.Operator, condition.Value)
+}
+
+// Explain returns the plan the query planner would choose for conditions
+func (dm *DataManager) Explain(conditions []FilterCondition) (*QueryPlan, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+
+	return dm.plan(dm.snapshot(), conditions), nil
+}
+
+// plan picks the cheapest access path for conditions over ds
+func (dm *DataManager) plan(ds *dataset, conditions []FilterCondition) *QueryPlan {
+	plan := &QueryPlan{
+		EstimatedRows: ds.len(),
+		EstimatedHits: -1,
+		TotalRows:     ds.len(),
+	}
+	defer dm.estimate(ds, plan, conditions)
+	driver := -1
+
+	// Try the most selective conditions first, so that the index estimates
+	// of the others stop counting early
+	for _, i := range dm.bySelectivity(ds, conditions) {
+		condition := conditions[i]
+		idx, ok := ds.indexes[indexNameFor(condition)]
+		if !ok || !idx.supports(condition) || !dm.textComparable(condition) {
+			continue
+		}
+		// Only count as far as the best plan so far; anything beyond that loses anyway
+		rows := ds.estimate(indexNameFor(condition), condition, plan.EstimatedRows)
+		if rows < plan.EstimatedRows || (driver < 0 && rows == plan.EstimatedRows) {
+			plan.EstimatedRows = rows
+			plan.Index = idx.field
+			plan.IndexType = idx.kind
+			driver = i
+		}
+	}
+
+	// A composite index wins when it narrows the candidates further
+	var composite []int
+	for _, idx := range ds.indexes {
+		if idx.fields == nil {
+			continue
+		}
+		used := idx.compositeMatch(conditions)
+		if len(used) == 0 || !dm.allTextComparable(conditions, used) {
+			continue
+		}
+		drivers := make([]FilterCondition, len(used))
+		for i, c := range used {
+			drivers[i] = conditions[c]
+		}
+		rows := len(ds.lookupComposite(idx.field, drivers, plan.EstimatedRows))
+		if rows < plan.EstimatedRows || (rows == plan.EstimatedRows && len(used) > len(composite) && (driver < 0 || len(used) > 1)) {
+			plan.EstimatedRows = rows
+			plan.Index = idx.field
+			plan.IndexType = SortedIndex
+			plan.Drivers = drivers
+			composite = used
+		}
+	}
+	if composite != nil {
+		// Composite bounds are unbounded across value types, so every driver is rechecked
+		plan.Driver = &plan.Drivers[0]
+		plan.Recheck = true
+		answered := make(map[int]bool)
+		for _, i := range composite {
+			answered[i] = true
+		}
+		for i, condition := range conditions {
+			if !answered[i] {
+				plan.Residual = append(plan.Residual, condition)
+			}
+		}
+		return plan
+	}
+
+	if driver < 0 {
+		plan.Residual = conditions
+		return plan
+	}
+
+	d := conditions[driver]
+	plan.Driver = &d
+	// Recheck date strings, which the index compares lexically, geo areas,
+	// whose geohash cells extend beyond them, and fuzzy matches, for which
+	// shared trigrams only narrow the candidates
+	plan.Recheck = d.ValueType == "datetime" || d.ValueType == "date" || d.ValueType == GeoValueType || d.Operator == "fuzzy"
+	for i, condition := range conditions {
+		if i != driver {
+			plan.Residual = append(plan.Residual, condition)
+		}
+	}
+	return plan
+}
+
+// bySelectivity returns the positions of conditions, the most selective
+// first by the statistics of ds; without statistics, in their given order
+func (dm *DataManager) bySelectivity(ds *dataset, conditions []FilterCondition) []int {
+	order := make([]int, len(conditions))
+	for i := range order {
+		order[i] = i
+	}
+	if ds.stats == nil || len(conditions) < 2 {
+		return order
+	}
+	desc := ds.stats.describe()
+	fractions := make([]float64, len(conditions))
+	for i, condition := range conditions {
+		if fraction, ok := desc.selectivity(condition); ok {
+			fractions[i] = fraction
+		} else {
+			fractions[i] = 1
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return fractions[order[a]] < fractions[order[b]] })
+	return order
+}
+
+// estimate fills in the estimated matches of plan and moves the most
+// selective residual conditions first, so that records fail early
+func (dm *DataManager) estimate(ds *dataset, plan *QueryPlan, conditions []FilterCondition) {
+	if ds.stats == nil {
+		return
+	}
+	desc := ds.stats.describe()
+	hits := float64(desc.Records)
+	for _, condition := range conditions {
+		if fraction, ok := desc.selectivity(condition); ok {
+			hits *= fraction
+		}
+	}
+	plan.EstimatedHits = int(math.Round(math.Min(hits, float64(plan.EstimatedRows))))
+
+	if len(plan.Residual) > 1 {
+		residual := append([]FilterCondition(nil), plan.Residual...)
+		order := dm.bySelectivity(ds, residual)
+		plan.Residual = make([]FilterCondition, len(residual))
+		for i, j := range order {
+			plan.Residual[i] = residual[j]
+		}
+	}
+}
+
+// textComparable reports whether condition can be answered by comparing
+// values as text, as indexes and partition pruning do; with extra date
+// layouts, date conditions cannot
+func (dm *DataManager) textComparable(condition FilterCondition) bool {
+	return len(dm.dateLayouts) == 0 || (condition.ValueType != "datetime" && condition.ValueType != "date")
+}
+
+// allTextComparable reports whether every condition picked by used is textComparable
+func (dm *DataManager) allTextComparable(conditions []FilterCondition, used []int) bool {
+	for _, i := range used {
+		if !dm.textComparable(conditions[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// execute runs a plan against ds
+func (dm *DataManager) execute(ds *dataset, plan *QueryPlan) []map[string]interface{} {
+	var results []map[string]interface{}
+	dm.visit(ds, plan, func(record map[string]interface{}) bool {
+		results = append(results, record)
+		return true
+	})
+	return results
+}
+
+// visit calls fn with each record matching the plan until fn returns
+// false, and returns how many records it examined
+func (dm *DataManager) visit(ds *dataset, plan *QueryPlan, fn func(record map[string]interface{}) bool) int {
+	exp, now := dm.expiryState(), time.Now()
+
+	if plan.Driver == nil {
+		examined := 0
+		for _, record := range ds.all() {
+			examined++
+			if exp.live(record, now) && dm.matchConditions(record, plan.Residual) && !fn(record) {
+				break
+			}
+		}
+		return examined
+	}
+
+	if len(plan.Drivers) > 0 {
+		filters := append(append([]FilterCondition{}, plan.Drivers...), plan.Residual...)
+		keys := ds.lookupComposite(plan.Index, plan.Drivers, -1)
+		for i, key := range keys {
+			if record, exists := ds.get(key); exists && exp.live(record, now) && dm.matchConditions(record, filters) && !fn(record) {
+				return i + 1
+			}
+		}
+		return len(keys)
+	}
+
+	filters := plan.Residual
+	if plan.Recheck {
+		filters = append([]FilterCondition{*plan.Driver}, plan.Residual...)
+	}
+	keys := ds.lookup(indexNameFor(*plan.Driver), *plan.Driver)
+	for i, key := range keys {
+		if record, exists := ds.get(key); exists && exp.live(record, now) && dm.matchConditions(record, filters) && !fn(record) {
+			return i + 1
+		}
+	}
+	return len(keys)
+}
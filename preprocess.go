@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// LinePreprocessor transforms a raw line of newline-delimited input before
+// it is decoded as JSON, returning an empty line to skip it. Parallel scans
+// call it from several goroutines at once.
+type LinePreprocessor func(line []byte) ([]byte, error)
+
+// WithLinePreprocessor sets the hook applied to every line of NDJSON input
+// (see SetLinePreprocessor)
+func WithLinePreprocessor(p LinePreprocessor) Option {
+	return func(dm *DataManager) { dm.preprocess = p }
+}
+
+// SetLinePreprocessor makes loads, scans, counts, imports, key indexes and
+// point lookups pass every line of NDJSON input through p before decoding
+// it, so files that are not quite NDJSON, such as syslog output with a
+// prefix before each object, are read directly. Errors returned by p are
+// reported as ParseErrors and follow the error policy. nil removes the hook.
+func (dm *DataManager) SetLinePreprocessor(p LinePreprocessor) {
+	dm.preprocess = p
+}
+
+// preprocessLine applies the line preprocessor, if any
+func (dm *DataManager) preprocessLine(line []byte) ([]byte, error) {
+	if dm.preprocess == nil {
+		return line, nil
+	}
+	return dm.preprocess(line)
+}
+
+// TrimLinePrefix is a LinePreprocessor dropping everything before the first
+// '{' of a line, such as the timestamp and host of a syslog line; lines
+// without an object are skipped
+func TrimLinePrefix(line []byte) ([]byte, error) {
+	start := bytes.IndexByte(line, '{')
+	if start < 0 {
+		return nil, nil
+	}
+	return line[start:], nil
+}
+
+// UnwrapJSONField returns a LinePreprocessor replacing each line with the
+// JSON object held as an escaped string in its field, as in the Docker log
+// line {"log": "{\"user\": \"ann\"}\n", "stream": "stdout"}
+func UnwrapJSONField(field string) LinePreprocessor {
+	wanted := map[string]bool{field: true}
+	return func(line []byte) ([]byte, error) {
+		fields := make(map[string]interface{}, 1)
+		if err := extractFields(line, wanted, fields); err != nil {
+			return nil, err
+		}
+		inner, ok := fields[field].(string)
+		if !ok {
+			return nil, fmt.Errorf("field %q does not hold a string", field)
+		}
+		if !json.Valid([]byte(inner)) {
+			return nil, fmt.Errorf("field %q does not hold JSON", field)
+		}
+		return []byte(inner), nil
+	}
+}
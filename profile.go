@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ProfileOptions configures Profile
+type ProfileOptions struct {
+	TopValues int // Most frequent values listed per field (default 10)
+	Sample    int // Records read (0 reads all)
+}
+
+// DataProfile describes the contents of a dataset, field by field
+type DataProfile struct {
+	Source    string           `json:"source"`
+	Records   int              `json:"records"`
+	Bytes     int64            `json:"bytes"`
+	Generated time.Time        `json:"generated"`
+	Fields    []*FieldProfile  `json:"fields"`    // By field name; nested objects are profiled with dotted paths
+	Anomalies []ProfileAnomaly `json:"anomalies"` // Fields worth a closer look before writing queries
+}
+
+// FieldProfile describes the values of one field
+type FieldProfile struct {
+	Field     string         `json:"field"`
+	Type      string         `json:"type"`      // Dominant type, as reported by InferSchema ("mixed" when there is none)
+	Types     map[string]int `json:"types"`     // Values of each type: "int", "float", "string", "date", "datetime", "bool", "object" or "array"
+	Present   int            `json:"present"`   // Records holding a value other than null
+	Nulls     int            `json:"nulls"`     // Records holding null
+	Missing   int            `json:"missing"`   // Records lacking the field
+	FillRate  float64        `json:"fill_rate"` // Share of the records holding a value
+	Distinct  int            `json:"distinct"`  // Estimated distinct strings, numbers and bools
+	TopValues []ValueCount   `json:"top_values,omitempty"`
+	Numbers   *NumericStats  `json:"numbers,omitempty"` // Statistics of the numbers
+	Lengths   *NumericStats  `json:"lengths,omitempty"` // Statistics of the lengths of strings, in characters
+	Items     *NumericStats  `json:"items,omitempty"`   // Statistics of the lengths of arrays
+	Dates     *DateRange     `json:"dates,omitempty"`   // Range of the date and datetime strings
+	firstOf   map[string]int // First record holding each type
+	sketch    hyperLogLog
+	counters  *spaceSaving
+	nested    map[string]*FieldProfile
+}
+
+// DateRange is the range of the date and datetime strings of a field
+type DateRange struct {
+	Count    int    `json:"count"`
+	Earliest string `json:"earliest"`
+	Latest   string `json:"latest"`
+}
+
+// ProfileAnomaly is something unexpected about a field
+type ProfileAnomaly struct {
+	Field   string         `json:"field"`
+	Kind    string         `json:"kind"` // "mixed_types"
+	Message string         `json:"message"`
+	Records map[string]int `json:"records"` // First record, counting from 1, holding each type
+}
+
+// Profile reads the records of filePath (a file, URL, object location or
+// glob) in one streaming pass and describes every field: the types
+// observed, how often it is filled, its most frequent values, the
+// distribution of string and array lengths, numeric statistics and the range
+// of dates. Fields holding values of incompatible types, such as numbers in
+// some records and strings in others, are listed as anomalies with the
+// first record of each type. WriteHTML renders the profile as a standalone
+// page; it also marshals to JSON.
+func (dm *DataManager) Profile(filePath string, opts ProfileOptions) (*DataProfile, error) {
+	if opts.TopValues <= 0 {
+		opts.TopValues = 10
+	}
+	reader, closer, err := dm.openRecords(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	profile := &DataProfile{Source: filePath, Generated: time.Now()}
+	fields := make(map[string]*FieldProfile)
+	for opts.Sample <= 0 || profile.Records < opts.Sample {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		profile.Records++
+		profile.Bytes += int64(size)
+		profileObject(fields, "", record, profile.Records, opts.TopValues)
+	}
+
+	var collect func(fields map[string]*FieldProfile)
+	collect = func(fields map[string]*FieldProfile) {
+		for _, f := range fields {
+			f.finish(profile.Records, opts.TopValues)
+			profile.Fields = append(profile.Fields, f)
+			if anomaly, ok := f.anomaly(); ok {
+				profile.Anomalies = append(profile.Anomalies, anomaly)
+			}
+			collect(f.nested)
+		}
+	}
+	collect(fields)
+	sort.Slice(profile.Fields, func(i, j int) bool { return profile.Fields[i].Field < profile.Fields[j].Field })
+	sort.Slice(profile.Anomalies, func(i, j int) bool { return profile.Anomalies[i].Field < profile.Anomalies[j].Field })
+	return profile, nil
+}
+
+// profileObject adds the fields of an object, the number-th record or part
+// of it, to the profiles in fields
+func profileObject(fields map[string]*FieldProfile, prefix string, object map[string]interface{}, number, top int) {
+	for field, value := range object {
+		f := fields[field]
+		if f == nil {
+			f = &FieldProfile{Field: field, Types: make(map[string]int), firstOf: make(map[string]int)}
+			if prefix != "" {
+				f.Field = prefix + "." + field
+			}
+			capacity := 100 * top
+			if capacity < 1000 {
+				capacity = 1000
+			}
+			f.counters = newSpaceSaving(capacity)
+			fields[field] = f
+		}
+		f.observe(value, number)
+		if nested, ok := value.(map[string]interface{}); ok {
+			if f.nested == nil {
+				f.nested = make(map[string]*FieldProfile)
+			}
+			profileObject(f.nested, f.Field, nested, number, top)
+		}
+	}
+}
+
+// observe adds the value of the field in the number-th record
+func (f *FieldProfile) observe(value interface{}, number int) {
+	kind := schemaType(value)
+	if kind == "null" {
+		f.Nulls++
+		return
+	}
+	f.Present++
+	f.Types[kind]++
+	if _, seen := f.firstOf[kind]; !seen {
+		f.firstOf[kind] = number
+	}
+
+	switch v := value.(type) {
+	case string:
+		f.sketch.add(hashString(v))
+		if f.Lengths == nil {
+			f.Lengths = newNumericStats(f.Field)
+		}
+		f.Lengths.observe(float64(utf8.RuneCountInString(v)))
+		if kind == "date" || kind == "datetime" {
+			if f.Dates == nil {
+				f.Dates = &DateRange{Earliest: v, Latest: v}
+			}
+			f.Dates.Count++
+			if v < f.Dates.Earliest {
+				f.Dates.Earliest = v
+			}
+			if v > f.Dates.Latest {
+				f.Dates.Latest = v
+			}
+		}
+	case bool:
+		if v {
+			f.sketch.add(hashUint64(1))
+		} else {
+			f.sketch.add(hashUint64(2))
+		}
+	case []interface{}:
+		if f.Items == nil {
+			f.Items = newNumericStats(f.Field)
+		}
+		f.Items.observe(float64(len(v)))
+		return
+	case map[string]interface{}:
+		return
+	default:
+		x, ok := numericValue(v)
+		if !ok {
+			return
+		}
+		f.sketch.add(hashUint64(math.Float64bits(x)))
+		if f.Numbers == nil {
+			f.Numbers = newNumericStats(f.Field)
+		}
+		f.Numbers.observe(x)
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		f.counters.add(string(encoded))
+	}
+}
+
+// finish derives the summaries of the field over records records
+func (f *FieldProfile) finish(records, top int) {
+	f.Missing = records - f.Present - f.Nulls
+	if records > 0 {
+		f.FillRate = float64(f.Present) / float64(records)
+	}
+	f.Type = dominantType(f.Types)
+	f.Distinct = int(math.Round(f.sketch.estimate()))
+	if scalars := f.Present - f.Types["object"] - f.Types["array"]; f.Distinct > scalars {
+		f.Distinct = scalars
+	}
+	f.TopValues, _ = f.counters.top(top)
+	for _, stats := range []*NumericStats{f.Numbers, f.Lengths, f.Items} {
+		if stats != nil {
+			stats.finish()
+		}
+	}
+}
+
+// anomaly reports whether the field holds values of incompatible types
+func (f *FieldProfile) anomaly() (ProfileAnomaly, bool) {
+	if f.Type != "mixed" || len(f.Types) < 2 {
+		return ProfileAnomaly{}, false
+	}
+	kinds := make([]string, 0, len(f.Types))
+	for kind := range f.Types {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if f.Types[kinds[i]] != f.Types[kinds[j]] {
+			return f.Types[kinds[i]] > f.Types[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s in %d records (first: record %d)", kind, f.Types[kind], f.firstOf[kind])
+	}
+	return ProfileAnomaly{
+		Field:   f.Field,
+		Kind:    "mixed_types",
+		Message: "Mixed types: " + strings.Join(parts, ", "),
+		Records: f.firstOf,
+	}, true
+}
+
+// WriteHTML renders the profile as a standalone HTML page
+func (p *DataProfile) WriteHTML(w io.Writer) error {
+	return profileTemplate.Execute(w, p)
+}
+
+var profileTemplate = template.Must(template.New("profile").Funcs(template.FuncMap{
+	"percent": func(x float64) string { return fmt.Sprintf("%.1f%%", 100*x) },
+	"number":  func(x float64) string { return fmt.Sprintf("%.4g", x) },
+	"value": func(v interface{}) string {
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	},
+	"types": func(types map[string]int) string {
+		parts := make([]string, 0, len(types))
+		for kind, n := range types {
+			parts = append(parts, fmt.Sprintf("%s: %d", kind, n))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ", ")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Profile of {{.Source}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; }
+td.n { text-align: right; }
+.anomaly { color: #a00; }
+details { margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<h1>Profile of {{.Source}}</h1>
+<p>{{.Records}} records, {{.Bytes}} bytes, {{len .Fields}} fields. Generated {{.Generated.Format "2006-01-02 15:04:05"}}.</p>
+{{if .Anomalies}}<h2>Anomalies</h2>
+<table>
+<tr><th>Field</th><th>Problem</th></tr>
+{{range .Anomalies}}<tr class="anomaly"><td>{{.Field}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Fields</h2>
+<table>
+<tr><th>Field</th><th>Type</th><th>Fill rate</th><th>Nulls</th><th>Missing</th><th>Distinct</th><th>Types</th></tr>
+{{range .Fields}}<tr><td><a href="#{{.Field}}">{{.Field}}</a></td><td>{{.Type}}</td><td class="n">{{percent .FillRate}}</td><td class="n">{{.Nulls}}</td><td class="n">{{.Missing}}</td><td class="n">~{{.Distinct}}</td><td>{{types .Types}}</td></tr>
+{{end}}</table>
+{{range .Fields}}<details id="{{.Field}}" open>
+<summary><strong>{{.Field}}</strong> ({{.Type}})</summary>
+{{with .Numbers}}<p>Numbers: min {{number .Min}}, max {{number .Max}}, mean {{number .Mean}}, std. dev. {{number .StdDev}}, median {{number .P50}}, p99 {{number .P99}}</p>
+{{end}}{{with .Lengths}}<p>String lengths: min {{number .Min}}, max {{number .Max}}, mean {{number .Mean}}, median {{number .P50}}, p99 {{number .P99}}</p>
+{{end}}{{with .Items}}<p>Array lengths: min {{number .Min}}, max {{number .Max}}, mean {{number .Mean}}, median {{number .P50}}</p>
+{{end}}{{with .Dates}}<p>Dates: {{.Earliest}} to {{.Latest}} ({{.Count}} values)</p>
+{{end}}{{if .TopValues}}<table>
+<tr><th>Value</th><th>Count</th></tr>
+{{range .TopValues}}<tr><td>{{value .Value}}</td><td class="n">{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}</details>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ProgressFunc receives the progress of a load or scan. totalBytes is -1 when
+// the input size is unknown, such as for stdin or a reader.
+type ProgressFunc func(bytesRead, totalBytes, recordsProcessed int64)
+
+// progressConfig is the callback set by SetProgressFunc and the tracker of
+// the load or scan being reported
+type progressConfig struct {
+	fn       ProgressFunc
+	interval time.Duration
+	running  atomic.Pointer[progressTracker]
+	counting atomic.Pointer[progressTracker] // Counts the input of the ResultSet being gathered
+}
+
+// progressTracker counts the bytes and records of the load or scan in progress
+type progressTracker struct {
+	bytes   atomic.Int64
+	records atomic.Int64
+	total   int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// SetProgressFunc makes loads and scans (LoadDataInMemory,
+// LoadDataInSplitMode and the reader, source and multi-file variants) call fn
+// every interval while they run, and once more when they finish. The calls
+// continue while no bytes are read, so a stalled input shows up as unchanged
+// counts. An interval of 0 reports once per second; a nil fn disables reporting.
+func (dm *DataManager) SetProgressFunc(fn ProgressFunc, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	dm.progress.fn, dm.progress.interval = fn, interval
+}
+
+// beginOperation starts reporting the progress, metrics and log events of a
+// load or scan ("load" or "scan") of source and returns the function ending
+// it, which takes the operation's error. size returns the input size for
+// progress reports; nil means unknown. Loads nested in another one report
+// their progress as part of it.
+func (dm *DataManager) beginOperation(op, source string, size func() int64) func(*error) {
+	timed := dm.timeOperation(op)
+	fn, interval, logger := dm.progress.fn, dm.progress.interval, dm.logger
+	if fn == nil && logger == nil {
+		return func(*error) { timed() }
+	}
+	totalBytes := int64(-1)
+	if size != nil && fn != nil {
+		totalBytes = size()
+	}
+	t := &progressTracker{total: totalBytes, stop: make(chan struct{}), done: make(chan struct{})}
+	if !dm.progress.running.CompareAndSwap(nil, t) {
+		return func(*error) { timed() }
+	}
+
+	started := time.Now()
+	if logger != nil {
+		logger.Info(op+" started", "source", source)
+	}
+	if fn != nil {
+		go func() {
+			defer close(t.done)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-t.stop:
+					return
+				case <-ticker.C:
+					fn(t.bytes.Load(), t.total, t.records.Load())
+				}
+			}
+		}()
+	} else {
+		close(t.done)
+	}
+
+	return func(errp *error) {
+		close(t.stop)
+		<-t.done
+		dm.progress.running.Store(nil)
+		if fn != nil {
+			fn(t.bytes.Load(), t.total, t.records.Load())
+		}
+		if logger != nil {
+			dm.logOperation(op, source, time.Since(started), t.records.Load(), t.bytes.Load(), *errp)
+		}
+		timed()
+	}
+}
+
+// track counts one record of n bytes toward the progress being reported and
+// the metrics, and waits while the throughput limits are reached
+func (dm *DataManager) track(n int) {
+	if dm.throttle != nil {
+		dm.throttle.wait(n)
+	}
+	if t := dm.progress.running.Load(); t != nil {
+		t.bytes.Add(int64(n))
+		t.records.Add(1)
+	}
+	if t := dm.progress.counting.Load(); t != nil {
+		t.bytes.Add(int64(n))
+		t.records.Add(1)
+	}
+	if dm.metrics != nil {
+		dm.metrics.ObserveRecord(n)
+	}
+}
+
+// sourceSize returns the size of src in bytes, or -1 if it is unknown
+func sourceSize(src Source) int64 {
+	if sized, ok := src.(interface{ Size() (int64, error) }); ok {
+		if size, err := sized.Size(); err == nil {
+			return size
+		}
+	}
+	return -1
+}
+
+// filesSize returns the combined size of paths in bytes, or -1 if any is unknown
+func (dm *DataManager) filesSize(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
+		src, err := dm.resolveSource(path)
+		if err != nil {
+			return -1
+		}
+		size := sourceSize(src)
+		if size < 0 {
+			return -1
+		}
+		total += size
+	}
+	return total
+}
@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// Query returns the in-memory records matching all conditions, letting the
+// query planner choose between an index lookup and a full scan. In AutoMode
+// it streams the loaded input instead when Load left it on disk, and in
+// Split mode it scans the storage engine opened by OpenStorage.
+func (dm *DataManager) Query(conditions []FilterCondition) ([]map[string]interface{}, error) {
+	if dm.storageEngine() != nil && dm.mode == SplitMode {
+		return dm.ScanRange("", "", conditions)
+	}
+	if dm.auto && dm.mode == SplitMode {
+		return dm.queryStream(conditions)
+	}
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+
+	defer dm.timeOperation("query")()
+	started := time.Now()
+	ds := dm.snapshot()
+	plan := dm.plan(ds, conditions)
+	results := dm.execute(ds, plan)
+	dm.logSlowQuery(plan, conditions, time.Since(started), len(results))
+	return results, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// recordReader yields decoded records one at a time, returning io.EOF when
+// the input is exhausted
+type recordReader interface {
+	Next() (record map[string]interface{}, size int, err error)
+}
+
+// newRecordReader detects whether r holds a top-level JSON array or
+// newline-delimited JSON and returns a matching reader. Records larger than
+// maxRecordSize bytes are rejected with a *ParseError (0 means no limit).
+func newRecordReader(r io.Reader, maxRecordSize int) (recordReader, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if first == '[' {
+		ar, err := newArrayReader(br)
+		if err != nil {
+			return nil, err
+		}
+		ar.maxSize = maxRecordSize
+		return ar, nil
+	}
+	return &lineReader{reader: br, maxSize: maxRecordSize}, nil
+}
+
+// newJSONReader is newRecordReader with the manager's record limit, passing
+// the lines of NDJSON input through its line preprocessor
+func (dm *DataManager) newJSONReader(r io.Reader) (recordReader, error) {
+	reader, err := newRecordReader(r, dm.recordLimit)
+	if lr, ok := reader.(*lineReader); ok {
+		lr.preprocess = dm.preprocess
+		lr.decode = dm.decodeRecord
+		if dm.repair != nil {
+			lr.split = dm.decodeRecords
+		}
+	}
+	return reader, err
+}
+
+// peekNonSpace discards leading whitespace and returns the next byte without consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// lineReader reads newline-delimited JSON, one record per line, without a
+// limit on line length beyond the optional maxSize
+type lineReader struct {
+	reader  *bufio.Reader
+	maxSize int    // Longest accepted line in bytes (0 means no limit)
+	line    int    // Number of the line last read
+	offset  int64  // Bytes consumed so far, including line endings
+	buf     []byte // Reused line buffer
+
+	preprocess LinePreprocessor                               // Applied to each line before decoding (optional)
+	decode     func([]byte) (map[string]interface{}, error)   // Decodes each line (nil uses encoding/json)
+	split      func([]byte) ([]map[string]interface{}, error) // Decodes each line into one or more records, replacing decode (optional)
+	pending    []map[string]interface{}                       // Further records of the line last split
+}
+
+// Next decodes the next non-blank line; a malformed or oversized line is
+// reported as a *ParseError and reading may continue with the following line
+func (lr *lineReader) Next() (map[string]interface{}, int, error) {
+	if len(lr.pending) > 0 {
+		record := lr.pending[0]
+		lr.pending = lr.pending[1:]
+		return record, 0, nil // The line's size came with its first record
+	}
+	for {
+		var line []byte
+		var n int
+		var tooLong bool
+		var err error
+		line, n, tooLong, err = readLine(lr.reader, lr.buf[:0], lr.maxSize)
+		lr.buf = line[:0]
+		if n == 0 && err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		lr.line++
+		start := lr.offset
+		lr.offset += int64(n)
+
+		if tooLong {
+			return nil, n, &ParseError{
+				Line:    lr.line,
+				Offset:  start,
+				Snippet: snippet(line),
+				Err:     fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, lr.maxSize),
+			}
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if lr.preprocess != nil {
+			raw := line
+			if line, err = lr.preprocess(raw); err != nil {
+				return nil, n, &ParseError{Line: lr.line, Offset: start, Snippet: snippet(raw), Err: err}
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+		}
+		var record map[string]interface{}
+		if lr.split != nil {
+			var records []map[string]interface{}
+			if records, err = lr.split(line); err == nil {
+				record, lr.pending = records[0], records[1:]
+			}
+		} else if lr.decode != nil {
+			record, err = lr.decode(line)
+		} else {
+			err = json.Unmarshal(line, &record)
+		}
+		if err != nil {
+			return nil, n, &ParseError{Line: lr.line, Offset: start, Snippet: snippet(line), Err: err}
+		}
+		return record, n, nil
+	}
+}
+
+// readLine appends the next line of br to buf without its line ending and
+// returns it with the number of bytes consumed. Once a line exceeds maxSize
+// (0 means no limit) the rest of it is discarded rather than buffered and
+// tooLong is set. err is io.EOF when the input ends, possibly after a final
+// unterminated line.
+func readLine(br *bufio.Reader, buf []byte, maxSize int) (line []byte, n int, tooLong bool, err error) {
+	line = buf
+	for {
+		chunk, err := br.ReadSlice('\n')
+		n += len(chunk)
+		if !tooLong {
+			if maxSize > 0 && len(line)+len(chunk) > maxSize+2 {
+				tooLong = true
+				keep := maxSize - len(line)
+				if keep > 0 {
+					line = append(line, chunk[:keep]...)
+				}
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if !tooLong && maxSize > 0 && len(line) > maxSize {
+			tooLong = true
+		}
+		return line, n, tooLong, err
+	}
+}
+
+// arrayReader streams the elements of a top-level JSON array
+type arrayReader struct {
+	decoder *json.Decoder
+	maxSize int // Largest accepted element in bytes (0 means no limit)
+	done    bool
+}
+
+// newArrayReader consumes the opening bracket of a JSON array
+func newArrayReader(r io.Reader) (*arrayReader, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("Expected a JSON array")
+	}
+	return &arrayReader{decoder: decoder}, nil
+}
+
+// Next decodes the next array element
+func (ar *arrayReader) Next() (map[string]interface{}, int, error) {
+	if ar.done {
+		return nil, 0, io.EOF
+	}
+	if !ar.decoder.More() {
+		// Consume the closing bracket, then report anything but whitespace after it
+		if _, err := ar.decoder.Token(); err != nil {
+			return nil, 0, err
+		}
+		ar.done = true
+		end := ar.decoder.InputOffset()
+		if _, err := ar.decoder.Token(); err != io.EOF {
+			return nil, 0, &ParseError{Offset: end, Err: errors.New("data after the closing bracket of the array")}
+		}
+		return nil, 0, io.EOF
+	}
+
+	start := ar.decoder.InputOffset()
+	var record map[string]interface{}
+	if err := ar.decoder.Decode(&record); err != nil {
+		return nil, 0, err
+	}
+	size := int(ar.decoder.InputOffset() - start)
+	if ar.maxSize > 0 && size > ar.maxSize {
+		return nil, size, &ParseError{
+			Offset: start,
+			Err:    fmt.Errorf("record of %d bytes exceeds the %d byte limit", size, ar.maxSize),
+		}
+	}
+	return record, size, nil
+}
+
+// sliceReader yields records that have already been decoded
+type sliceReader struct {
+	records []map[string]interface{}
+	pos     int
+}
+
+// Next returns the next record of the slice
+func (sr *sliceReader) Next() (map[string]interface{}, int, error) {
+	if sr.pos >= len(sr.records) {
+		return nil, 0, io.EOF
+	}
+	record := sr.records[sr.pos]
+	sr.pos++
+	return record, int(estimateRecordSize(record)), nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RedactAction is what a redaction rule does to a field
+type RedactAction string
+
+const (
+	RedactDrop RedactAction = "drop" // Remove the field
+	RedactMask RedactAction = "mask" // Replace its characters with '*', keeping the last Keep
+	RedactHash RedactAction = "hash" // Replace it with a keyed hash, so equal values still match
+	RedactFake RedactAction = "fake" // Replace it with a realistic fake, the same for equal values
+)
+
+// RedactionRule redacts one field, or every field carrying a tag
+type RedactionRule struct {
+	Field  string       `json:"field,omitempty"` // Field name or dotted path such as "contact.email"
+	Tag    string       `json:"tag,omitempty"`   // Applies to the fields tagged with it (see TagField)
+	Action RedactAction `json:"action"`
+	Keep   int          `json:"keep,omitempty"` // Trailing characters left visible by mask
+	Fake   FakeKind     `json:"fake,omitempty"` // Kind of fake (default: guessed from the field name, see GuessFakeKind)
+}
+
+// RedactionPolicy lists the fields hidden from one kind of consumer
+type RedactionPolicy struct {
+	Rules []RedactionRule `json:"rules"`
+	Salt  string          `json:"salt,omitempty"` // Key of the HMAC behind hash and fake; without it hashes of guessed values can be compared
+}
+
+// LoadRedactionPolicy reads a policy from a JSON file such as
+// {"rules": [{"field": "email", "action": "mask", "keep": 4}, {"tag": "pii", "action": "drop"}]}
+func LoadRedactionPolicy(path string) (*RedactionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy RedactionPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("Invalid redaction policy %s: %w", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// validate checks that every rule names a field or tag and a known action
+func (p *RedactionPolicy) validate() error {
+	for i, rule := range p.Rules {
+		if (rule.Field == "") == (rule.Tag == "") {
+			return fmt.Errorf("Redaction rule %d needs exactly one of a field or a tag", i)
+		}
+		switch rule.Action {
+		case RedactDrop, RedactMask, RedactHash, RedactFake:
+		default:
+			return fmt.Errorf("Unknown redaction action %q", rule.Action)
+		}
+		if err := rule.Fake.validate(); err != nil {
+			return err
+		}
+		if rule.Keep < 0 {
+			return fmt.Errorf("Redaction rule %d keeps a negative number of characters", i)
+		}
+	}
+	return nil
+}
+
+// TagField labels a field (or dotted path) with tags such as "pii", so
+// redaction rules can refer to the tag instead of listing every field
+func (dm *DataManager) TagField(field string, tags ...string) {
+	if dm.fieldTags == nil {
+		dm.fieldTags = make(map[string][]string)
+	}
+	dm.fieldTags[field] = append(dm.fieldTags[field], tags...)
+}
+
+// SetRedaction applies policy to every record the HTTP and gRPC servers
+// return, unless a handler made by HandlerWithRedaction chooses another. A
+// nil policy returns records unchanged.
+func (dm *DataManager) SetRedaction(policy *RedactionPolicy) error {
+	if policy != nil {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+	dm.redaction = policy
+	return nil
+}
+
+// Redact returns copies of records with the fields covered by policy
+// dropped, masked or hashed; the records themselves are not modified. Use it
+// on query results before Export or WriteRecords to produce a restricted
+// extract. A nil policy returns records as they are.
+func (dm *DataManager) Redact(records []map[string]interface{}, policy *RedactionPolicy) ([]map[string]interface{}, error) {
+	if policy == nil || len(policy.Rules) == 0 {
+		return records, nil
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	rules := dm.redactionRules(policy)
+	redacted := make([]map[string]interface{}, len(records))
+	for i, record := range records {
+		redacted[i] = policy.apply(record, rules)
+	}
+	return redacted, nil
+}
+
+// redactRecord redacts a single record; it skips validation, which
+// SetRedaction and HandlerWithRedaction already did
+func (dm *DataManager) redactRecord(record map[string]interface{}, policy *RedactionPolicy) map[string]interface{} {
+	if policy == nil || len(policy.Rules) == 0 || record == nil {
+		return record
+	}
+	return policy.apply(record, dm.redactionRules(policy))
+}
+
+// redactionRules resolves tag rules into one rule per field; a field listed
+// by name keeps its own rule over one inherited from a tag
+func (dm *DataManager) redactionRules(policy *RedactionPolicy) map[string]RedactionRule {
+	rules := make(map[string]RedactionRule)
+	for _, rule := range policy.Rules {
+		if rule.Tag == "" {
+			continue
+		}
+		for field, tags := range dm.fieldTags {
+			for _, tag := range tags {
+				if tag == rule.Tag {
+					rules[field] = rule
+				}
+			}
+		}
+	}
+	for _, rule := range policy.Rules {
+		if rule.Field != "" {
+			rules[rule.Field] = rule
+		}
+	}
+	return rules
+}
+
+// apply returns a copy of record with rules applied, copying only the nested
+// objects it changes
+func (p *RedactionPolicy) apply(record map[string]interface{}, rules map[string]RedactionRule) map[string]interface{} {
+	out := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		out[k] = v
+	}
+	for field, rule := range rules {
+		if _, exists := record[field]; exists || !strings.Contains(field, ".") {
+			p.redactField(out, field, rule)
+			continue
+		}
+		path := strings.Split(field, ".")
+		parent := out
+		for _, part := range path[:len(path)-1] {
+			object, ok := parent[part].(map[string]interface{})
+			if !ok {
+				parent = nil
+				break
+			}
+			copied := make(map[string]interface{}, len(object))
+			for k, v := range object {
+				copied[k] = v
+			}
+			parent[part] = copied
+			parent = copied
+		}
+		if parent != nil {
+			p.redactField(parent, path[len(path)-1], rule)
+		}
+	}
+	return out
+}
+
+// redactField applies rule to the field of object, if present
+func (p *RedactionPolicy) redactField(object map[string]interface{}, field string, rule RedactionRule) {
+	value, exists := object[field]
+	if !exists {
+		return
+	}
+	switch rule.Action {
+	case RedactDrop:
+		delete(object, field)
+	case RedactMask:
+		if value != nil {
+			object[field] = mask(redactionText(value), rule.Keep)
+		}
+	case RedactHash:
+		if value != nil {
+			mac := hmac.New(sha256.New, []byte(p.Salt))
+			mac.Write([]byte(redactionText(value)))
+			object[field] = hex.EncodeToString(mac.Sum(nil))
+		}
+	case RedactFake:
+		if value != nil {
+			kind := rule.Fake
+			if kind == "" {
+				kind = GuessFakeKind(field)
+			}
+			object[field] = p.fake(value, kind)
+		}
+	}
+}
+
+// redactionText is the text that masking and hashing see: strings as they
+// are, other values as JSON
+func redactionText(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// mask replaces every character of s but the last keep with '*'
+func mask(s string, keep int) string {
+	runes := []rune(s)
+	hidden := max(len(runes)-keep, 0)
+	return strings.Repeat("*", hidden) + string(runes[hidden:])
+}
+
+// redactionKey is the request context key of a handler's redaction policy
+type redactionKey struct{}
+
+// HandlerWithRedaction returns the HTTP handler of Serve with policy applied
+// to every record it returns in place of the one set by SetRedaction. Serve
+// it on another address or path to give restricted consumers the same data:
+//
+//	restricted, err := dm.HandlerWithRedaction(partnerPolicy)
+//	mux.Handle("/", dm.Handler())
+//	mux.Handle("/partner/", http.StripPrefix("/partner", restricted))
+func (dm *DataManager) HandlerWithRedaction(policy *RedactionPolicy) (http.Handler, error) {
+	if policy == nil {
+		policy = &RedactionPolicy{}
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	handler := dm.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), redactionKey{}, policy)))
+	}), nil
+}
+
+// redactionFor returns the policy applying to a request: the caller's role
+// policy, then the handler's, then the default
+func (dm *DataManager) redactionFor(ctx context.Context) *RedactionPolicy {
+	if g := grantFor(ctx); g != nil && g.redaction != nil {
+		return g.redaction
+	}
+	if policy, ok := ctx.Value(redactionKey{}).(*RedactionPolicy); ok {
+		return policy
+	}
+	return dm.redaction
+}
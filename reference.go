@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// LookupSpec describes a Lookup stage
+type LookupSpec struct {
+	Collection   string `json:"collection"`              // Collection holding the referenced records
+	LocalField   string `json:"local_field"`             // Field or dotted path of each result holding the reference, or an array of them
+	ForeignField string `json:"foreign_field,omitempty"` // Field of the referenced records it matches ("" means their key field)
+	As           string `json:"as,omitempty"`            // Field the referenced records are stored in (default Collection)
+	Many         bool   `json:"many,omitempty"`          // Store every match as an array instead of the first one
+}
+
+// Lookup enriches results with the records of another collection they
+// reference, such as the user of each order:
+//
+//	orders, err = dm.Lookup(orders, LookupSpec{Collection: "users", LocalField: "user_id", As: "user"})
+//
+// The references of all the results are fetched in one batch: by key with
+// GetMany when ForeignField is empty or the collection's key field (in Split
+// mode this needs its key index; see BuildKeyIndex), and otherwise with a
+// single pass over the collection. The collection is looked up among the
+// manager's collections, then among those of the manager it belongs to. The
+// returned records are copies holding the referenced record under As, or an
+// array of them when LocalField holds an array or Many is set; results whose
+// reference matches nothing are returned without As, or with an empty array.
+func (dm *DataManager) Lookup(results []map[string]interface{}, spec LookupSpec) ([]map[string]interface{}, error) {
+	return dm.lookupReferences(results, spec, nil)
+}
+
+// lookupReferences runs a Lookup stage, embedding only the referenced
+// records keep accepts when it is set
+func (dm *DataManager) lookupReferences(results []map[string]interface{}, spec LookupSpec, keep func(map[string]interface{}) bool) ([]map[string]interface{}, error) {
+	if spec.LocalField == "" {
+		return nil, fmt.Errorf("Lookup in %q requires a local field", spec.Collection)
+	}
+	target, err := dm.sibling(spec.Collection)
+	if err != nil {
+		return nil, err
+	}
+	as := spec.As
+	if as == "" {
+		as = spec.Collection
+	}
+
+	wanted := make(map[interface{}]bool)
+	for _, record := range results {
+		for _, ref := range references(record, spec.LocalField) {
+			wanted[ref] = true
+		}
+	}
+	matches, err := target.fetchReferences(wanted, spec.ForeignField)
+	if err != nil {
+		return nil, err
+	}
+
+	enriched := make([]map[string]interface{}, len(results))
+	for i, record := range results {
+		copied := make(map[string]interface{}, len(record)+1)
+		for field, value := range record {
+			copied[field] = value
+		}
+		var found []interface{}
+		for _, ref := range references(record, spec.LocalField) {
+			for _, match := range matches[ref] {
+				if keep == nil || keep(match) {
+					found = append(found, match)
+				}
+			}
+		}
+		value, _ := resolvePath(record, spec.LocalField)
+		if _, isArray := value.([]interface{}); isArray || spec.Many {
+			if found == nil {
+				found = []interface{}{}
+			}
+			copied[as] = found
+		} else if len(found) > 0 {
+			copied[as] = found[0]
+		}
+		enriched[i] = copied
+	}
+	return enriched, nil
+}
+
+// sibling returns the named collection of the manager or, for a
+// collection, of the manager it belongs to
+func (dm *DataManager) sibling(name string) (*DataManager, error) {
+	c, err := dm.Collection(name)
+	if err != nil && dm.parent != nil {
+		return dm.parent.Collection(name)
+	}
+	return c, err
+}
+
+// references returns the reference values a record holds at path: its
+// value, or the elements of an array
+func references(record map[string]interface{}, path string) []interface{} {
+	value, ok := resolvePath(record, path)
+	if !ok {
+		return nil
+	}
+	values, isArray := value.([]interface{})
+	if !isArray {
+		values = []interface{}{value}
+	}
+	refs := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if ref, ok := normalizeIndexValue(v); ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// fetchReferences returns the records whose field, or key when field is
+// empty, holds one of the wanted values, grouped by value
+func (dm *DataManager) fetchReferences(wanted map[interface{}]bool, field string) (map[interface{}][]map[string]interface{}, error) {
+	matches := make(map[interface{}][]map[string]interface{}, len(wanted))
+	if len(wanted) == 0 {
+		return matches, nil
+	}
+
+	dm.mu.RLock()
+	keyName := dm.keyName
+	dm.mu.RUnlock()
+	if field == "" || field == keyName {
+		keys := make([]string, 0, len(wanted))
+		byKey := make(map[string][]interface{}, len(wanted)) // 7 and "7" share a key
+		for ref := range wanted {
+			key := referenceKey(ref)
+			if byKey[key] == nil {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], ref)
+		}
+		records, err := dm.GetMany(keys)
+		if err != nil {
+			return nil, err
+		}
+		for key, record := range records {
+			for _, ref := range byKey[key] {
+				matches[ref] = append(matches[ref], record)
+			}
+		}
+		return matches, nil
+	}
+
+	collect := func(record map[string]interface{}) {
+		value, ok := resolvePath(record, field)
+		if !ok {
+			return
+		}
+		if ref, ok := normalizeIndexValue(value); ok && wanted[ref] {
+			matches[ref] = append(matches[ref], record)
+		}
+	}
+	if dm.mode == InMemoryMode {
+		now := time.Now()
+		for _, record := range dm.snapshot().all() {
+			if dm.expiry.live(record, now) {
+				collect(record)
+			}
+		}
+		return matches, nil
+	}
+
+	path := dm.loadedPath()
+	if path == "" {
+		return nil, fmt.Errorf("%w: nothing has been loaded", ErrNoInput)
+	}
+	reader, closer, err := dm.openRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		collect(record)
+	}
+	return matches, nil
+}
+
+// referenceKey formats a reference value as a record key
+func referenceKey(ref interface{}) string {
+	if key, ok := canonicalKey(ref); ok {
+		return key
+	}
+	return fmt.Sprint(ref)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReloadOptions configures EnableAutoReload
+type ReloadOptions struct {
+	Interval time.Duration     // How often the source is checked for changes (default 5s)
+	OnSwap   func(ReloadEvent) // Called after each reload, successful or not (optional)
+}
+
+// ReloadEvent describes a background reload
+type ReloadEvent struct {
+	Path     string        // Location that was reloaded
+	Records  int           // Records held after the reload
+	Duration time.Duration // Time taken to load the new data
+	Err      error         // Why the reload failed; the previous data is still served
+}
+
+// reloadState is the active auto-reload configuration
+type reloadState struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// EnableAutoReload watches the local file (or the files of the glob) most
+// recently loaded in memory, or by Load in AutoMode, and reloads it in the
+// background when it is replaced or modified, so a long-running service
+// follows the exports that overwrite it. A change is reloaded once the files
+// have stayed the same for a whole interval, so a file still being written
+// is not read half way. The new data and its indexes are built beside the
+// current ones and swapped in atomically: queries keep seeing the previous
+// version until the swap, and keep it if the reload fails. Writes made since
+// the last load are lost on reload. Call DisableAutoReload to stop.
+func (dm *DataManager) EnableAutoReload(opts ReloadOptions) error {
+	if dm.mode != InMemoryMode && !dm.auto {
+		return ErrInvalidMode
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+
+	dm.mu.RLock()
+	path, keyName := dm.sourcePath, dm.keyName
+	dm.mu.RUnlock()
+	if path == "" || keyName == "" {
+		return fmt.Errorf("%w: load a file before enabling auto reload", ErrNoInput)
+	}
+	loaded, err := sourceSignature(path)
+	if err != nil {
+		return fmt.Errorf("Cannot watch %s for auto reload: %w", path, err)
+	}
+
+	state := &reloadState{stop: make(chan struct{}), done: make(chan struct{})}
+	dm.mu.Lock()
+	if dm.reload != nil {
+		dm.mu.Unlock()
+		return errors.New("Auto reload is already enabled")
+	}
+	dm.reload = state
+	dm.mu.Unlock()
+
+	go dm.reloadPeriodically(state, path, keyName, loaded, opts)
+	return nil
+}
+
+// DisableAutoReload stops watching the source, waiting for a reload in
+// progress to finish
+func (dm *DataManager) DisableAutoReload() {
+	dm.mu.Lock()
+	state := dm.reload
+	dm.reload = nil
+	dm.mu.Unlock()
+	if state != nil {
+		close(state.stop)
+		<-state.done
+	}
+}
+
+// reloadPeriodically reloads path whenever its signature changed and then
+// held still for an interval, until DisableAutoReload
+func (dm *DataManager) reloadPeriodically(state *reloadState, path, keyName, loaded string, opts ReloadOptions) {
+	defer close(state.done)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	previous := loaded
+	for {
+		select {
+		case <-state.stop:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := sourceSignature(path)
+		if err != nil {
+			continue // Replaced by rename, or briefly missing
+		}
+		if current == loaded || current != previous {
+			previous = current
+			continue
+		}
+
+		started := time.Now()
+		if dm.auto {
+			err = dm.Load(path, keyName)
+		} else {
+			err = dm.LoadDataInMemory(path, keyName)
+		}
+		if err == nil {
+			loaded = current
+		}
+		if opts.OnSwap != nil {
+			opts.OnSwap(ReloadEvent{
+				Path:     path,
+				Records:  dm.snapshot().len(),
+				Duration: time.Since(started),
+				Err:      err,
+			})
+		}
+	}
+}
+
+// sourceSignature summarizes the names, sizes and modification times of the
+// local files at path, which may be a glob
+func sourceSignature(path string) (string, error) {
+	paths := []string{path}
+	if isGlob(path) {
+		var err error
+		if paths, err = expandGlob(path); err != nil {
+			return "", err
+		}
+	}
+	var sig strings.Builder
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sig, "%s:%d:%d\n", p, info.Size(), info.ModTime().UnixNano())
+	}
+	return sig.String(), nil
+}
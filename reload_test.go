@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeUsers writes n NDJSON records keyed by id to path
+func writeUsers(t *testing.T, path string, n int, name string) int64 {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "{\"id\":\"u%d\",\"name\":%q}\n", i, name)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return int64(b.Len())
+}
+
+func TestLoadReleasesReplacedUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.ndjson")
+	size := writeUsers(t, path, 20, "a")
+
+	// The limit holds one copy of the data but not two
+	dm := NewDataManager(2*size-1, InMemoryMode)
+	for i := 0; i < 3; i++ {
+		if err := dm.LoadDataInMemory(path, "id"); err != nil {
+			t.Fatalf("load %d: %v", i+1, err)
+		}
+	}
+	if usage := atomic.LoadInt64(dm.currentUsage); usage > size {
+		t.Errorf("usage after three loads = %d, want at most %d", usage, size)
+	}
+}
+
+func TestFailedLoadKeepsUsage(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.ndjson")
+	big := filepath.Join(dir, "big.ndjson")
+	size := writeUsers(t, small, 5, "a")
+	writeUsers(t, big, 500, "b")
+
+	dm := NewDataManager(4*size, InMemoryMode)
+	if err := dm.LoadDataInMemory(small, "id"); err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt64(dm.currentUsage)
+	if err := dm.LoadDataInMemory(big, "id"); err == nil {
+		t.Fatal("loading past the memory limit succeeded")
+	}
+	if usage := atomic.LoadInt64(dm.currentUsage); usage != before {
+		t.Errorf("usage after a failed load = %d, want %d", usage, before)
+	}
+	if got := dm.snapshot().len(); got != 5 {
+		t.Errorf("records after a failed load = %d, want 5", got)
+	}
+}
+
+func TestAutoReloadOverHalfTheLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.ndjson")
+	size := writeUsers(t, path, 20, "a")
+
+	dm := NewDataManager(size+size/2, InMemoryMode)
+	if err := dm.LoadDataInMemory(path, "id"); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan ReloadEvent, 8)
+	if err := dm.EnableAutoReload(ReloadOptions{Interval: 10 * time.Millisecond, OnSwap: func(e ReloadEvent) { events <- e }}); err != nil {
+		t.Fatal(err)
+	}
+	defer dm.DisableAutoReload()
+
+	for i, name := range []string{"b", "c", "d"} {
+		time.Sleep(20 * time.Millisecond) // A later modification time
+		writeUsers(t, path, 20, name)
+		select {
+		case e := <-events:
+			if e.Err != nil {
+				t.Fatalf("reload %d: %v", i+1, e.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reload %d did not happen", i+1)
+		}
+		record, err := dm.Get("u0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record["name"] != name {
+			t.Errorf("reload %d: name = %v, want %s", i+1, record["name"], name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Repaired lines kept as samples by RepairReport
+const maxRepairSamples = 5
+
+// RepairKind names a defect fixed by the repair pass
+type RepairKind string
+
+const (
+	RepairBOM           RepairKind = "bom"            // Byte order mark before the record
+	RepairTrailingComma RepairKind = "trailing_comma" // Comma before a closing } or ]
+	RepairNonFinite     RepairKind = "non_finite"     // NaN, Infinity or -Infinity, written as null
+	RepairSingleQuotes  RepairKind = "single_quotes"  // String or key in single quotes
+	RepairConcatenated  RepairKind = "concatenated"   // Further object on the same line, read as its own record
+)
+
+// RepairReport summarizes the work of the repair pass since it was enabled
+// or last reset
+type RepairReport struct {
+	Lines   int                `json:"lines"`   // Lines that decoded only once repaired
+	Records int                `json:"records"` // Records read from those lines
+	Fixes   map[RepairKind]int `json:"fixes"`   // Defects fixed, by kind
+	Samples []string           `json:"samples"` // First repaired lines as read, shortened
+}
+
+// repairer counts the lines repaired for a manager
+type repairer struct {
+	mu     sync.Mutex
+	report RepairReport
+}
+
+// WithRepair enables the repair pass (see SetRepair)
+func WithRepair() Option {
+	return func(dm *DataManager) { dm.repair = &repairer{} }
+}
+
+// SetRepair enables or disables the repair pass over NDJSON lines that fail
+// to decode, so dirty exports load without an external cleanup script. It
+// fixes trailing commas before } and ], the NaN, Infinity and -Infinity
+// that some encoders write for non-finite numbers (read as null, the only
+// JSON value they can stand for), strings and keys in single quotes, and a
+// byte order mark before the record. A line holding several objects one
+// after the other, as in {"a":1}{"a":2}, is read as that many records by
+// loads, pipelines, imports and Split-mode scans; lookups, bulk loads and
+// watches read one record per line and keep reporting such lines as
+// malformed. Lines that decode as they are never go through the pass, and
+// lines it cannot fix are reported as they would be without it. Fast scan
+// is bypassed while repair is on, since defects are only found by decoding
+// lines whole. RepairReport counts the fixes.
+func (dm *DataManager) SetRepair(enabled bool) {
+	if !enabled {
+		dm.repair = nil
+	} else if dm.repair == nil {
+		dm.repair = &repairer{}
+	}
+}
+
+// RepairReport returns how many lines the repair pass fixed and how
+func (dm *DataManager) RepairReport() RepairReport {
+	report := RepairReport{Fixes: make(map[RepairKind]int)}
+	r := dm.repair
+	if r == nil {
+		return report
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report.Lines, report.Records = r.report.Lines, r.report.Records
+	for kind, n := range r.report.Fixes {
+		report.Fixes[kind] = n
+	}
+	report.Samples = append([]string(nil), r.report.Samples...)
+	return report
+}
+
+// ResetRepairReport clears the counts of RepairReport
+func (dm *DataManager) ResetRepairReport() {
+	if r := dm.repair; r != nil {
+		r.mu.Lock()
+		r.report = RepairReport{}
+		r.mu.Unlock()
+	}
+}
+
+// decodeRecords decodes a line into its records: the one it holds, or
+// those repair recovers from it
+func (dm *DataManager) decodeRecords(line []byte) ([]map[string]interface{}, error) {
+	record, err := dm.decodeJSON(line)
+	if err == nil {
+		return []map[string]interface{}{record}, nil
+	}
+	if dm.repair != nil {
+		if records, ok := dm.repair.fix(line, dm.decodeJSON, true); ok {
+			return records, nil
+		}
+	}
+	return nil, err
+}
+
+// fix repairs a line that failed to decode and decodes the result,
+// reporting false when the line is beyond repair. Without split, a line
+// holding several objects is beyond repair.
+func (r *repairer) fix(line []byte, decode func([]byte) (map[string]interface{}, error), split bool) ([]map[string]interface{}, bool) {
+	parts, fixes := repairLine(line)
+	if len(fixes) == 0 || (!split && len(parts) > 1) {
+		return nil, false
+	}
+	records := make([]map[string]interface{}, len(parts))
+	for i, part := range parts {
+		record, err := decode(part)
+		if err != nil {
+			return nil, false
+		}
+		records[i] = record
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report.Fixes == nil {
+		r.report.Fixes = make(map[RepairKind]int)
+	}
+	r.report.Lines++
+	r.report.Records += len(records)
+	for kind, n := range fixes {
+		r.report.Fixes[kind] += n
+	}
+	if len(r.report.Samples) < maxRepairSamples {
+		r.report.Samples = append(r.report.Samples, snippet(line))
+	}
+	return records, true
+}
+
+// repairLine rewrites the defects of a line of JSON it knows how to fix,
+// returning the line split into its top-level objects and the fixes made
+func repairLine(line []byte) ([][]byte, map[RepairKind]int) {
+	fixes := make(map[RepairKind]int)
+	if rest, ok := bytes.CutPrefix(line, []byte("\ufeff")); ok {
+		line = rest
+		fixes[RepairBOM]++
+	}
+
+	var parts [][]byte
+	out := make([]byte, 0, len(line)+8)
+	depth := 0
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(line))
+			out = append(out, line[i:end]...)
+			i = end
+
+		case c == '\'':
+			out = append(out, '"')
+			for i++; i < len(line) && line[i] != '\''; i++ {
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					out = append(out, '\'')
+					i++
+				case line[i] == '\\' && i+1 < len(line):
+					out = append(out, line[i], line[i+1])
+					i++
+				case line[i] == '"':
+					out = append(out, '\\', '"')
+				default:
+					out = append(out, line[i])
+				}
+			}
+			out = append(out, '"')
+			i++ // Past the closing quote
+			fixes[RepairSingleQuotes]++
+
+		case c == ',':
+			if j := skipSpace(line, i+1); j < len(line) && (line[j] == '}' || line[j] == ']') {
+				fixes[RepairTrailingComma]++
+			} else {
+				out = append(out, c)
+			}
+			i++
+
+		case c == '{' || c == '[':
+			depth++
+			out = append(out, c)
+			i++
+
+		case c == '}' || c == ']':
+			depth--
+			out = append(out, c)
+			i++
+			if j := skipSpace(line, i); depth == 0 && j < len(line) && line[j] == '{' {
+				parts = append(parts, out)
+				out = make([]byte, 0, len(line)-j)
+				fixes[RepairConcatenated]++
+				i = j
+			}
+
+		default:
+			if n := nonFiniteLength(line[i:]); n > 0 {
+				out = append(out, "null"...)
+				fixes[RepairNonFinite]++
+				i += n
+			} else {
+				out = append(out, c)
+				i++
+			}
+		}
+	}
+	return append(parts, out), fixes
+}
+
+// nonFiniteLength returns the length of the NaN, Infinity, -Infinity or
+// +Infinity token b starts with, or 0
+func nonFiniteLength(b []byte) int {
+	for _, token := range [...]string{"NaN", "Infinity", "-Infinity", "+Infinity"} {
+		if bytes.HasPrefix(b, []byte(token)) {
+			return len(token)
+		}
+	}
+	return 0
+}
+
+// matchRepaired is matchLine for managers repairing lines: it returns the
+// first matching record of the line and leaves the others in ls.extra
+func (ls *lineScanner) matchRepaired(line []byte, offset int64) (map[string]interface{}, error) {
+	dm := ls.dm
+	records, err := dm.decodeRecords(line)
+	if err != nil {
+		return nil, dm.tolerate(&ParseError{Offset: offset, Snippet: snippet(line), Err: err})
+	}
+	var first map[string]interface{}
+	for _, record := range records {
+		dm.derive(record)
+		valid, err := dm.conforms(record)
+		if err != nil {
+			return nil, err
+		}
+		if !valid || !dm.matchConditions(record, ls.conditions) {
+			continue
+		}
+		if first == nil {
+			first = record
+		} else {
+			ls.extra = append(ls.extra, record)
+		}
+	}
+	return first, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIOptions configures FetchAPI and LoadAPI
+type APIOptions struct {
+	URL         string            // First page of the endpoint
+	Headers     map[string]string // Sent with every request, such as {"Authorization": "Bearer ..."}
+	RecordsPath string            // Dotted path of the record array in each page ("" when the page is the array)
+	NextPath    string            // Dotted path of the next page's URL, or of a cursor sent in CursorParam
+	CursorParam string            // Query parameter carrying the cursor found at NextPath
+	PageParam   string            // Query parameter numbering the pages from 1, when there is no next link
+	MaxPages    int               // Stop after this many pages (0 means all)
+	Retries     int               // Retries of a failed request (default 3; negative disables them)
+	Backoff     time.Duration     // Delay before the first retry, doubled for each next one (default 500ms)
+	CachePath   string            // NDJSON file the records are stored in
+	MaxAge      time.Duration     // LoadAPI reuses a cache younger than this (0 always fetches)
+}
+
+// FetchAPI downloads every page of a paginated JSON endpoint and stores its
+// records in opts.CachePath as NDJSON, returning how many were stored. The
+// next page is found, in order of preference, at opts.NextPath in the body,
+// in a Link header with rel="next", or by incrementing opts.PageParam until
+// a page holds no records. Requests failing with a network error, 429 or a
+// 5xx status are retried with exponential backoff, honouring Retry-After.
+// The cache is written to a temporary file and renamed once complete, so a
+// failed fetch keeps the previous cache and readers never see a partial one.
+func (dm *DataManager) FetchAPI(opts APIOptions) (n int, err error) {
+	if opts.URL == "" || opts.CachePath == "" {
+		return 0, errors.New("FetchAPI requires a URL and a cache path")
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+
+	defer dm.beginOperation("fetch", opts.URL, nil)(&err)
+	tmp := opts.CachePath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	client := &http.Client{Timeout: dm.httpTimeout}
+	bw := bufio.NewWriter(file)
+	next, page := opts.URL, 1
+	for pages := 0; next != "" && (opts.MaxPages <= 0 || pages < opts.MaxPages); pages++ {
+		body, header, err := fetchPage(client, next, opts)
+		if err != nil {
+			return n, err
+		}
+		records, link, err := parsePage(body, opts)
+		if err != nil {
+			return n, fmt.Errorf("Page %s: %w", next, err)
+		}
+		for _, record := range records {
+			line, err := json.Marshal(record)
+			if err != nil {
+				return n, err
+			}
+			bw.Write(append(line, '\n'))
+			dm.track(len(line) + 1)
+		}
+		n += len(records)
+
+		current := next
+		switch {
+		case opts.NextPath != "":
+			next, err = nextFromCursor(current, link, opts.CursorParam)
+		case linkNext(header) != "":
+			next, err = resolveLink(current, linkNext(header))
+		case opts.PageParam != "" && len(records) > 0:
+			page++
+			next, err = withParam(opts.URL, opts.PageParam, strconv.Itoa(page))
+		default:
+			next = ""
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	if err := file.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp, opts.CachePath)
+}
+
+// LoadAPI serves queries from a local snapshot of a paginated JSON endpoint:
+// it fetches the endpoint into opts.CachePath with FetchAPI, unless the cache
+// is younger than opts.MaxAge, and loads the cache keyed by keyName in
+// InMemory mode, with Load in AutoMode, or leaves it on disk for Query to
+// stream in Split mode. Call it again to refresh the snapshot, or use
+// EnableAutoReload to pick up caches refreshed by FetchAPI elsewhere.
+func (dm *DataManager) LoadAPI(opts APIOptions, keyName string) error {
+	if info, err := os.Stat(opts.CachePath); err != nil || opts.MaxAge <= 0 || time.Since(info.ModTime()) >= opts.MaxAge {
+		if _, err := dm.FetchAPI(opts); err != nil {
+			return err
+		}
+	}
+	switch {
+	case dm.auto:
+		return dm.Load(opts.CachePath, keyName)
+	case dm.mode == InMemoryMode:
+		return dm.LoadDataInMemory(opts.CachePath, keyName)
+	case dm.mode == SplitMode:
+		dm.mu.Lock()
+		dm.keyName = keyName
+		dm.mu.Unlock()
+		dm.setSourcePath(opts.CachePath)
+		return nil
+	}
+	return ErrInvalidMode
+}
+
+// fetchPage GETs a page, retrying transient failures with backoff
+func fetchPage(client *http.Client, pageURL string, opts APIOptions) ([]byte, http.Header, error) {
+	delay := opts.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		for name, value := range opts.Headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := client.Do(req)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return body, resp.Header, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("Unexpected HTTP status fetching %s: %s", pageURL, resp.Status)
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return nil, nil, err // Not worth retrying
+			}
+			if seconds, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && seconds >= 0 {
+				delay = time.Duration(seconds) * time.Second
+			}
+		}
+		if attempt >= opts.Retries {
+			return nil, nil, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// parsePage returns the records of a page and the value at opts.NextPath
+func parsePage(body []byte, opts APIOptions) ([]map[string]interface{}, interface{}, error) {
+	var page interface{}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, nil, err
+	}
+	var next interface{}
+	items := page
+	if obj, ok := page.(map[string]interface{}); ok {
+		if opts.NextPath != "" {
+			next, _ = resolvePath(obj, opts.NextPath)
+		}
+		if opts.RecordsPath != "" {
+			items, _ = resolvePath(obj, opts.RecordsPath)
+		}
+	}
+
+	list, ok := items.([]interface{})
+	if !ok {
+		if items == nil {
+			return nil, next, nil // No records field on the last page
+		}
+		return nil, nil, fmt.Errorf("no record array at %q", opts.RecordsPath)
+	}
+	records := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		record, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, nil, errors.New("records must be JSON objects")
+		}
+		records = append(records, record)
+	}
+	return records, next, nil
+}
+
+// nextFromCursor returns the next page's URL from the value at NextPath: a
+// URL, or a cursor added to the current URL as param
+func nextFromCursor(current string, next interface{}, param string) (string, error) {
+	var s string
+	switch v := next.(type) {
+	case nil:
+		return "", nil
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", fmt.Errorf("Unexpected next page value %v", next)
+	}
+	if s == "" {
+		return "", nil
+	}
+	if param != "" {
+		return withParam(current, param, s)
+	}
+	return resolveLink(current, s)
+}
+
+// linkNext returns the target of the rel="next" entry of a Link header
+func linkNext(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(link, ";")
+			if ok && strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// resolveLink resolves a possibly relative link against the current URL
+func resolveLink(current, link string) (string, error) {
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// withParam returns rawURL with query parameter name set to value
+func withParam(rawURL, name, value string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
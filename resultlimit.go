@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// OverflowPolicy selects what a query does when its results outgrow its
+// ResultLimit
+type OverflowPolicy int
+
+const (
+	OverflowError    OverflowPolicy = iota // Fail with a MemoryLimitError
+	OverflowTruncate                       // Keep the records that fit and set ResultSet.Truncated
+	OverflowSpill                          // Write the records past the limit to a temporary file
+)
+
+// ResultLimit bounds the memory held by the records a query returns,
+// separately from the manager's memory limit on the loaded data
+type ResultLimit struct {
+	MaxBytes int64          // Estimated size of the records kept in memory (0 means no limit)
+	Overflow OverflowPolicy // What happens to the records past MaxBytes
+}
+
+// WithResultLimit sets the result limit of Find (see SetResultLimit)
+func WithResultLimit(limit ResultLimit) Option {
+	return func(dm *DataManager) { dm.resultLimit = limit }
+}
+
+// SetResultLimit bounds the memory held by the results of each Find call
+// whose FindOptions carry no limit of their own. When the estimated size of
+// the matching records passes limit.MaxBytes, OverflowError fails the query
+// with a *MemoryLimitError, OverflowTruncate returns the records that fit
+// with ResultSet.Truncated set, and OverflowSpill writes the remaining
+// records to a temporary file (encrypted when SetEncryption is in effect)
+// read back by ResultSet.Iterator. In Split mode, a limited query streams
+// its input record by record and charges only the records it keeps, so a
+// scan of an input larger than the memory limit succeeds as long as its
+// results fit. A zero limit turns the bound off.
+func (dm *DataManager) SetResultLimit(limit ResultLimit) error {
+	if err := dm.validateResultLimit(limit); err != nil {
+		return err
+	}
+	dm.resultLimit = limit
+	return nil
+}
+
+// validateResultLimit checks that limit fits within the memory limit and
+// names a known policy
+func (dm *DataManager) validateResultLimit(limit ResultLimit) error {
+	if limit.MaxBytes < 0 || limit.MaxBytes > dm.maxRAMUsage {
+		return fmt.Errorf("Result limit %d is outside the memory limit %d", limit.MaxBytes, dm.maxRAMUsage)
+	}
+	switch limit.Overflow {
+	case OverflowError, OverflowTruncate, OverflowSpill:
+		return nil
+	}
+	return fmt.Errorf("Unknown overflow policy %d", limit.Overflow)
+}
+
+// resultCollector keeps the matching records of a query within its count
+// and memory limits
+type resultCollector struct {
+	dm        *DataManager
+	limit     ResultLimit
+	count     int   // Records kept (0 means no limit)
+	held      int64 // Estimated size of records
+	matched   int
+	records   []map[string]interface{}
+	truncated bool
+	spill     *resultSpill // Records past the memory limit (nil until the first)
+}
+
+// resultSpill is the temporary file holding records past a query's memory limit
+type resultSpill struct {
+	file    *os.File
+	w       io.WriteCloser
+	bw      *bufio.Writer
+	records int
+}
+
+// add counts a matching record and keeps it in memory, spills it or drops
+// it according to the limits
+func (c *resultCollector) add(record map[string]interface{}) error {
+	c.matched++
+	if c.count > 0 && len(c.records)+c.spilled() >= c.count {
+		c.truncated = true
+		return nil
+	}
+	if c.spill != nil {
+		return c.spill.write(record)
+	}
+	if c.truncated {
+		return nil
+	}
+	size := estimateRecordSize(record)
+	if c.limit.MaxBytes > 0 && c.held+size > c.limit.MaxBytes {
+		switch c.limit.Overflow {
+		case OverflowTruncate:
+			c.truncated = true
+			return nil
+		case OverflowSpill:
+			spill, err := newResultSpill(c.dm.encryption)
+			if err != nil {
+				return err
+			}
+			c.spill = spill
+			return spill.write(record)
+		}
+		return &MemoryLimitError{Usage: c.held + size, Limit: c.limit.MaxBytes}
+	}
+	c.held += size
+	c.records = append(c.records, record)
+	return nil
+}
+
+// spilled returns the number of records written to the spill file
+func (c *resultCollector) spilled() int {
+	if c.spill == nil {
+		return 0
+	}
+	return c.spill.records
+}
+
+// finish flushes the spill file, or removes it when the query failed
+func (c *resultCollector) finish(err error) error {
+	if c.spill == nil {
+		return err
+	}
+	if err == nil {
+		err = c.spill.close()
+	}
+	if err != nil {
+		c.spill.remove()
+		c.spill = nil
+	}
+	return err
+}
+
+// newResultSpill creates a temporary file for spilled records, encrypted when c is set
+func newResultSpill(c *fileCipher) (*resultSpill, error) {
+	f, err := os.CreateTemp("", "results-*")
+	if err != nil {
+		return nil, err
+	}
+	w := c.writer(f)
+	return &resultSpill{file: f, w: w, bw: bufio.NewWriter(w)}, nil
+}
+
+// write appends record to the spill file as a line of JSON
+func (s *resultSpill) write(record map[string]interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.bw.Write(line)
+	if err := s.bw.WriteByte('\n'); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// close flushes the spill file so it can be read back
+func (s *resultSpill) close() error {
+	err := s.bw.Flush()
+	if err == nil {
+		err = s.w.Close()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// remove deletes the spill file
+func (s *resultSpill) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// ResultIterator walks the records of a ResultSet, including those spilled
+// to disk
+type ResultIterator struct {
+	rs      *ResultSet
+	next    int
+	file    *os.File
+	decoder *json.Decoder
+}
+
+// Iterator returns an iterator over every record of the result set: those
+// held in memory, then those spilled past its memory limit. Spilled records
+// are read back as decoded JSON, so values such as times come back as
+// strings. Close the iterator, and the result set once done with it.
+func (r *ResultSet) Iterator() *ResultIterator {
+	return &ResultIterator{rs: r}
+}
+
+// Next returns the next record, or io.EOF after the last one
+func (it *ResultIterator) Next() (map[string]interface{}, error) {
+	if it.next < len(it.rs.records) {
+		it.next++
+		return it.rs.records[it.next-1], nil
+	}
+	if it.rs.spillPath == "" {
+		return nil, io.EOF
+	}
+	if it.decoder == nil {
+		f, err := os.Open(it.rs.spillPath)
+		if err != nil {
+			return nil, err
+		}
+		it.file = f
+		r, err := it.rs.cipher.reader(bufio.NewReader(f), f.Name())
+		if err != nil {
+			return nil, err
+		}
+		it.decoder = json.NewDecoder(r)
+	}
+	var record map[string]interface{}
+	if err := it.decoder.Decode(&record); err != nil {
+		return nil, err // io.EOF after the last spilled record
+	}
+	return record, nil
+}
+
+// Close releases the spill file opened by the iterator
+func (it *ResultIterator) Close() error {
+	if it.file == nil {
+		return nil
+	}
+	return it.file.Close()
+}
+
+// Close deletes the file holding the spilled records of the result set
+func (r *ResultSet) Close() error {
+	if r.spillPath == "" {
+		return nil
+	}
+	err := os.Remove(r.spillPath)
+	r.spillPath = ""
+	return err
+}
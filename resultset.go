@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// FindOptions configures Find
+type FindOptions struct {
+	Limit       int         // Records kept in the result set (0 keeps all)
+	Source      string      // Split-mode input (default: the most recently loaded or scanned data)
+	ResultLimit ResultLimit // Memory bound of the records kept (default: the manager's, see SetResultLimit)
+	OrderBy     []SortField // Order of the records (default: the order they are found in)
+}
+
+// ResultSet holds the records matching a query, with what it took to find them
+type ResultSet struct {
+	Scanned   int64         // Records read from the input, or examined in memory (-1 when unknown)
+	Matched   int           // Records matching the conditions, including those past the limit
+	BytesRead int64         // Input bytes read (0 in memory, -1 when unknown)
+	Elapsed   time.Duration // Time taken by the query
+	Truncated bool          // Whether the limit or the result limit left matching records out
+	Spilled   int           // Records written to disk past the result limit (see Iterator)
+	Warnings  []string      // Malformed records skipped under the error policy
+	records   []map[string]interface{}
+	spillPath string      // File holding the spilled records ("" when none)
+	cipher    *fileCipher // Encryption of the spill file
+}
+
+// Records returns the records of the result set held in memory, which
+// excludes those spilled to disk
+func (r *ResultSet) Records() []map[string]interface{} {
+	return r.records
+}
+
+// Len returns the number of records in the result set, including those
+// spilled to disk
+func (r *ResultSet) Len() int {
+	return len(r.records) + r.Spilled
+}
+
+// First returns the first record, reporting whether there is one
+func (r *ResultSet) First() (map[string]interface{}, bool) {
+	if len(r.records) == 0 {
+		return nil, false
+	}
+	return r.records[0], true
+}
+
+// Decode stores the records held in memory in the slice out points to, such as a
+// *[]User or *[]*User, following DecodeRecord's rules
+func (r *ResultSet) Decode(out interface{}) error {
+	target := reflect.ValueOf(out)
+	if target.Kind() != reflect.Pointer || target.IsNil() || target.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Decode needs a pointer to a slice, got %T", out)
+	}
+	slice := target.Elem()
+	elem := slice.Type().Elem()
+	pointers := elem.Kind() == reflect.Pointer
+	if pointers {
+		elem = elem.Elem()
+	}
+	decoded := reflect.MakeSlice(slice.Type(), len(r.records), len(r.records))
+	for i, record := range r.records {
+		value := reflect.New(elem)
+		if err := DecodeRecord(record, value.Interface()); err != nil {
+			return fmt.Errorf("Record %d: %w", i, err)
+		}
+		if pointers {
+			decoded.Index(i).Set(value)
+		} else {
+			decoded.Index(i).Set(value.Elem())
+		}
+	}
+	slice.Set(decoded)
+	return nil
+}
+
+// Find runs a query and returns its records as a ResultSet. In InMemory mode
+// it plans the query like Query, and Scanned counts the records the plan
+// examined. In Split mode it scans opts.Source like LoadDataInSplitMode, or
+// the storage engine when one is open and no source is given, and
+// counts the records and bytes read; while another Find scans on the same
+// manager, those counts are -1. With opts.Limit, Matched still counts every
+// matching record and Truncated reports that some were left out. The
+// memory held by the records kept is bounded by opts.ResultLimit, or the
+// manager's result limit (see SetResultLimit); a result set holding
+// spilled records must be closed. opts.OrderBy sorts the matching records
+// before the limits apply; in Split mode the sort spills to temporary files
+// like SortTo, so inputs of any size can be ordered as long as the records
+// kept fit, or spill, within the result limit.
+func (dm *DataManager) Find(conditions []FilterCondition, opts FindOptions) (*ResultSet, error) {
+	started := time.Now()
+	limit := opts.ResultLimit
+	if limit.MaxBytes == 0 {
+		limit = dm.resultLimit
+	} else if err := dm.validateResultLimit(limit); err != nil {
+		return nil, err
+	}
+	collector := &resultCollector{dm: dm, limit: limit, count: opts.Limit}
+	keep := collector.add
+	var sorter *externalSorter
+	if len(opts.OrderBy) > 0 {
+		// In memory only the order of the stored records is sorted
+		sorter = dm.newExternalSorter(opts.OrderBy, dm.mode != InMemoryMode)
+		defer sorter.close()
+		keep = sorter.add
+	}
+	result := &ResultSet{}
+	var err error
+	if dm.mode == InMemoryMode {
+		defer dm.timeOperation("query")()
+		ds := dm.snapshot()
+		plan := dm.plan(ds, conditions)
+		examined := dm.visit(ds, plan, func(record map[string]interface{}) bool {
+			err = keep(record)
+			return err == nil
+		})
+		if err == nil && sorter != nil {
+			err = sorter.each(collector.add)
+		}
+		result.Scanned = int64(examined)
+		dm.logSlowQuery(plan, conditions, time.Since(started), collector.matched)
+	} else {
+		source := opts.Source
+		if source == "" {
+			source = dm.loadedPath()
+		}
+		engine := dm.storageEngine()
+		if source == "" && engine == nil {
+			return nil, fmt.Errorf("%w: nothing has been loaded", ErrNoInput)
+		}
+		counters := &progressTracker{}
+		counting := dm.progress.counting.CompareAndSwap(nil, counters)
+		if engine != nil && opts.Source == "" {
+			source = ""
+		}
+		if limit.MaxBytes > 0 || sorter != nil {
+			err = dm.streamMatches(source, conditions, keep)
+			if err == nil && sorter != nil {
+				err = sorter.each(collector.add)
+			}
+		} else {
+			var records []map[string]interface{}
+			if source == "" {
+				records, err = dm.ScanRange("", "", conditions)
+			} else {
+				records, err = dm.LoadDataInSplitMode(source, conditions)
+			}
+			for i := 0; err == nil && i < len(records); i++ {
+				err = collector.add(records[i])
+			}
+		}
+		if counting {
+			dm.progress.counting.Store(nil)
+		}
+		if err != nil {
+			collector.finish(err)
+			return nil, err
+		}
+		result.Scanned, result.BytesRead = -1, -1
+		if counting {
+			result.Scanned, result.BytesRead = counters.records.Load(), counters.bytes.Load()
+		}
+		for _, parseErr := range dm.ParseErrors() {
+			result.Warnings = append(result.Warnings, parseErr.Error())
+		}
+		if skipped := dm.ParseErrorCount() - int64(len(result.Warnings)); skipped > 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Skipped %d malformed records", skipped))
+		}
+	}
+
+	if err := collector.finish(err); err != nil {
+		return nil, err
+	}
+	result.records, result.Matched, result.Truncated = collector.records, collector.matched, collector.truncated
+	if spill := collector.spill; spill != nil {
+		result.Spilled, result.spillPath, result.cipher = spill.records, spill.file.Name(), dm.encryption
+	}
+	result.Elapsed = time.Since(started)
+	return result, nil
+}
+
+// streamMatches calls fn with each record of source matching conditions,
+// after deduplication and the projection, or with those of the storage
+// engine when source is empty, reading one record at a time
+func (dm *DataManager) streamMatches(source string, conditions []FilterCondition, fn func(map[string]interface{}) error) error {
+	if source == "" {
+		return dm.storageEngine().ScanRange("", "", func(_ string, record map[string]interface{}) error {
+			if !dm.matchConditions(record, conditions) {
+				return nil
+			}
+			return fn(record)
+		})
+	}
+	dm.setSourcePath(source)
+	duplicates := newDuplicateFilter(dm.dedupFields)
+	return dm.Pipeline().From(source).Workers(1).Filter(conditions).ForEach(func(record map[string]interface{}) error {
+		if dup, err := duplicates.duplicate(record); err != nil || dup {
+			return err
+		}
+		if len(dm.projection) > 0 {
+			record = project(record, dm.projection)
+		}
+		return fn(record)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Sample returns a uniformly random sample of up to n records of filePath
+// matching conditions, using reservoir sampling: the file is streamed once
+// and only the sample is held in memory. filePath may be a glob. The sample
+// is in no particular order.
+func (dm *DataManager) Sample(filePath string, n int, conditions []FilterCondition) ([]map[string]interface{}, error) {
+	return dm.sample(filePath, n, conditions, rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+// SampleWithSeed is like Sample but draws the same sample for the same seed and input
+func (dm *DataManager) SampleWithSeed(filePath string, n int, conditions []FilterCondition, seed int64) ([]map[string]interface{}, error) {
+	return dm.sample(filePath, n, conditions, rand.New(rand.NewSource(seed)))
+}
+
+// sample fills a reservoir of n matching records using rng
+func (dm *DataManager) sample(filePath string, n int, conditions []FilterCondition, rng *rand.Rand) ([]map[string]interface{}, error) {
+	if n <= 0 {
+		return nil, errors.New("Sample size must be positive")
+	}
+
+	var reader recordReader
+	if isGlob(filePath) {
+		paths, err := expandGlob(filePath)
+		if err != nil {
+			return nil, err
+		}
+		multi := &multiFileReader{dm: dm, paths: paths}
+		defer multi.close()
+		reader = multi
+	} else {
+		single, closer, err := dm.openRecords(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		reader = single
+	}
+
+	dm.parseErrors.reset()
+	reservoir := make([]map[string]interface{}, 0, n)
+	seen := 0
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		valid, err := dm.conforms(record)
+		if err != nil {
+			return nil, err
+		}
+		if !valid || !dm.matchConditions(record, conditions) {
+			continue
+		}
+
+		// Algorithm R: the i-th match replaces a random slot with probability n/i
+		seen++
+		if len(reservoir) < n {
+			reservoir = append(reservoir, record)
+		} else if j := rng.Intn(seen); j < n {
+			reservoir[j] = record
+		}
+	}
+	return reservoir, nil
+}
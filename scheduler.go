@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyOptions limits the Split-mode scans running at once and the
+// memory each of them may hold
+type ConcurrencyOptions struct {
+	MaxScans     int           // Scans running at once (0 is unlimited)
+	MaxQueued    int           // Scans waiting for a slot; more fail with ErrTooManyScans (0 is unlimited)
+	ScanMemory   int64         // Memory budget of each scan in bytes (default: the memory limit divided by MaxScans)
+	QueueTimeout time.Duration // Longest wait for a slot before failing with ErrTooManyScans (0 waits indefinitely)
+}
+
+// scanScheduler admits scans in arrival order while their number and
+// reserved budgets fit within the limits
+type scanScheduler struct {
+	mu       sync.Mutex
+	opts     ConcurrencyOptions
+	running  int
+	reserved int64
+	queue    []*scanWaiter
+}
+
+// scanWaiter is a scan queued for admission
+type scanWaiter struct {
+	budget int64
+	ready  chan struct{} // Closed once the scan is admitted
+}
+
+// scanBudget tracks the memory held by the results of one scan
+type scanBudget struct {
+	dm    *DataManager
+	sched *scanScheduler // nil when scans share the whole memory limit
+	limit int64
+	used  int64
+}
+
+// SetConcurrency lets several Split-mode scans run against the manager at
+// once, each with its own memory budget reserved from the memory limit. Scans
+// beyond MaxScans, or whose budget no longer fits in what the running scans
+// left of the limit, wait in a queue and start in arrival order as others
+// finish, so a burst of large scans cannot starve earlier ones. A scan whose
+// results outgrow its budget fails with a MemoryLimitError. Without it, every
+// scan draws on the whole limit.
+func (dm *DataManager) SetConcurrency(opts ConcurrencyOptions) error {
+	if opts.ScanMemory > dm.maxRAMUsage {
+		return fmt.Errorf("Scan memory %d exceeds the memory limit %d", opts.ScanMemory, dm.maxRAMUsage)
+	}
+	if opts == (ConcurrencyOptions{}) {
+		dm.scheduler = nil
+		return nil
+	}
+	dm.scheduler = &scanScheduler{opts: opts}
+	return nil
+}
+
+// WithConcurrency limits concurrent Split-mode scans (see SetConcurrency)
+func WithConcurrency(opts ConcurrencyOptions) Option {
+	return func(dm *DataManager) { dm.scheduler = &scanScheduler{opts: opts} }
+}
+
+// beginScan waits until a scan may start and returns its budget, which the
+// caller must release with done
+func (dm *DataManager) beginScan() (*scanBudget, error) {
+	s := dm.scheduler
+	if s == nil {
+		return dm.sharedBudget(), nil
+	}
+	budget := s.opts.ScanMemory
+	if budget <= 0 {
+		budget = dm.maxRAMUsage
+		if s.opts.MaxScans > 0 {
+			budget /= int64(s.opts.MaxScans)
+		}
+	}
+	if err := s.admit(budget, dm.maxRAMUsage); err != nil {
+		return nil, err
+	}
+	return &scanBudget{dm: dm, sched: s, limit: budget}, nil
+}
+
+// sharedBudget returns a budget drawing on the whole memory limit, as loads
+// and unscheduled scans do
+func (dm *DataManager) sharedBudget() *scanBudget {
+	return &scanBudget{dm: dm, limit: dm.maxRAMUsage}
+}
+
+// admit blocks until a scan reserving budget bytes of pool fits
+func (s *scanScheduler) admit(budget, pool int64) error {
+	s.mu.Lock()
+	if len(s.queue) == 0 && s.fits(budget, pool) {
+		s.running++
+		s.reserved += budget
+		s.mu.Unlock()
+		return nil
+	}
+	if s.opts.MaxQueued > 0 && len(s.queue) >= s.opts.MaxQueued {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %d scans queued", ErrTooManyScans, len(s.queue))
+	}
+	w := &scanWaiter{budget: budget, ready: make(chan struct{})}
+	s.queue = append(s.queue, w)
+	s.mu.Unlock()
+
+	if s.opts.QueueTimeout <= 0 {
+		<-w.ready
+		return nil
+	}
+	timer := time.NewTimer(s.opts.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, queued := range s.queue {
+		if queued == w {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.wake(pool) // The next scan may fit where this one did not
+			return fmt.Errorf("%w: no slot within %v", ErrTooManyScans, s.opts.QueueTimeout)
+		}
+	}
+	return nil // Admitted just as the timer fired
+}
+
+// fits reports whether one more scan reserving budget bytes of pool may run
+func (s *scanScheduler) fits(budget, pool int64) bool {
+	if s.opts.MaxScans > 0 && s.running >= s.opts.MaxScans {
+		return false
+	}
+	// A lone scan always runs, even when its budget is the whole pool
+	return s.running == 0 || s.reserved+budget <= pool
+}
+
+// wake admits queued scans from the front while they fit; s.mu must be held
+func (s *scanScheduler) wake(pool int64) {
+	for len(s.queue) > 0 && s.fits(s.queue[0].budget, pool) {
+		w := s.queue[0]
+		s.queue = s.queue[1:]
+		s.running++
+		s.reserved += w.budget
+		close(w.ready)
+	}
+}
+
+// charge counts n bytes of results toward the scan's budget
+func (b *scanBudget) charge(n int64) error {
+	usage := atomic.AddInt64(b.dm.currentUsage, n)
+	if b.sched == nil {
+		if usage > b.limit {
+			return b.dm.memoryLimitError(usage)
+		}
+		return nil
+	}
+	if used := atomic.AddInt64(&b.used, n); used > b.limit {
+		return &MemoryLimitError{Usage: used, Limit: b.limit}
+	}
+	return nil
+}
+
+// done releases the scan's memory and slot to queued scans
+func (b *scanBudget) done() {
+	if b.sched == nil {
+		return
+	}
+	atomic.AddInt64(b.dm.currentUsage, -atomic.LoadInt64(&b.used))
+	s := b.sched
+	s.mu.Lock()
+	s.running--
+	s.reserved -= b.limit
+	s.wake(b.dm.maxRAMUsage)
+	s.mu.Unlock()
+}
+
+// setSourcePath records the input of the latest load or scan
+func (dm *DataManager) setSourcePath(path string) {
+	dm.mu.Lock()
+	dm.sourcePath = path
+	dm.mu.Unlock()
+}
+
+// loadedPath returns the input of the latest load or scan, which Split-mode
+// queries rescan
+func (dm *DataManager) loadedPath() string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.sourcePath
+}
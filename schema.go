@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxTrackedCardinality bounds the distinct values InferSchema remembers per field
+const maxTrackedCardinality = 10000
+
+// FieldSchema describes one top-level field
+type FieldSchema struct {
+	Type        string         `json:"type"`        // "int", "float", "string", "date", "datetime", "bool", "object", "array", or "mixed"
+	Nullable    bool           `json:"nullable"`    // The field may be null or missing
+	Present     int            `json:"present"`     // Sampled records containing the field with a non-null value
+	Nulls       int            `json:"nulls"`       // Sampled records where the field was null or missing
+	Cardinality int            `json:"cardinality"` // Distinct values seen (at most 10000)
+	Types       map[string]int `json:"types"`       // Count of each observed type
+}
+
+// Schema describes the records of a dataset
+type Schema struct {
+	Fields  map[string]*FieldSchema `json:"fields"`
+	Sampled int                     `json:"sampled"` // Records inspected by InferSchema
+	Strict  bool                    `json:"strict"`  // Treat fields missing from Fields as violations
+}
+
+// InferSchema reads up to sampleN records (all of them when sampleN <= 0)
+// and reports the type, nullability and cardinality of every field
+func (dm *DataManager) InferSchema(filePath string, sampleN int) (*Schema, error) {
+	src, err := dm.resolveSource(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader recordReader
+	if dm.formatFor(sourceName(src)) == "parquet" {
+		records, err := dm.scanParquetSource(src, nil, nil, dm.sharedBudget())
+		if err != nil {
+			return nil, err
+		}
+		reader = &sliceReader{records: records}
+	} else {
+		input, err := src.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer input.Close()
+		if reader, err = dm.newReaderFor(input, sourceName(src)); err != nil {
+			return nil, err
+		}
+	}
+
+	schema := &Schema{Fields: make(map[string]*FieldSchema)}
+	distinct := make(map[string]map[interface{}]struct{})
+	for sampleN <= 0 || schema.Sampled < sampleN {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		schema.observe(record, distinct)
+	}
+	schema.finish(distinct)
+	return schema, nil
+}
+
+// columnSchema infers the schema of the given fields, which may be dotted
+// paths, over every record of results
+func columnSchema(results []map[string]interface{}, fields []string) *Schema {
+	schema := &Schema{Fields: make(map[string]*FieldSchema)}
+	distinct := make(map[string]map[interface{}]struct{})
+	for _, record := range results {
+		projected := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if value, ok := resolvePath(record, field); ok {
+				projected[field] = value
+			}
+		}
+		schema.observe(projected, distinct)
+	}
+	schema.finish(distinct)
+	return schema
+}
+
+// observe adds a sampled record to the schema, remembering the distinct
+// values of its fields in distinct
+func (s *Schema) observe(record map[string]interface{}, distinct map[string]map[interface{}]struct{}) {
+	for field, value := range record {
+		fs, ok := s.Fields[field]
+		if !ok {
+			// Records sampled before the field first appeared lacked it
+			fs = &FieldSchema{Types: make(map[string]int), Nulls: s.Sampled}
+			s.Fields[field] = fs
+			distinct[field] = make(map[interface{}]struct{})
+		}
+		kind := schemaType(value)
+		if kind == "null" {
+			fs.Nulls++
+			continue
+		}
+		fs.Present++
+		fs.Types[kind]++
+		if v, ok := normalizeIndexValue(value); ok && len(distinct[field]) < maxTrackedCardinality {
+			distinct[field][v] = struct{}{}
+		}
+	}
+	for field, fs := range s.Fields {
+		if _, ok := record[field]; !ok {
+			fs.Nulls++
+		}
+	}
+	s.Sampled++
+}
+
+// finish derives the nullability, cardinality and type of every field
+func (s *Schema) finish(distinct map[string]map[interface{}]struct{}) {
+	for field, fs := range s.Fields {
+		fs.Nullable = fs.Nulls > 0
+		fs.Cardinality = len(distinct[field])
+		fs.Type = dominantType(fs.Types)
+	}
+}
+
+// schemaType classifies a decoded value using the filter value types where possible
+func schemaType(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "int"
+		}
+		return "float"
+	case int, int64:
+		return "int"
+	case string:
+		if _, err := time.Parse("2006-01-02 15:04:05", val); err == nil {
+			return "datetime"
+		}
+		if _, err := time.Parse("2006-01-02", val); err == nil {
+			return "date"
+		}
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		return "mixed"
+	}
+}
+
+// dominantType collapses the observed types of a field into one
+func dominantType(types map[string]int) string {
+	switch len(types) {
+	case 0:
+		return "mixed"
+	case 1:
+		for kind := range types {
+			return kind
+		}
+	}
+	if len(types) == 2 && types["int"] > 0 && types["float"] > 0 {
+		return "float"
+	}
+	if len(types) == 2 && types["string"] > 0 && (types["date"] > 0 || types["datetime"] > 0) {
+		return "string"
+	}
+	return "mixed"
+}
+
+// typeConforms reports whether a value of observed type fits the declared type
+func typeConforms(declared, observed string) bool {
+	switch declared {
+	case "mixed", observed:
+		return true
+	case "float":
+		return observed == "int"
+	case "string":
+		return observed == "date" || observed == "datetime"
+	default:
+		return false
+	}
+}
+
+// Validate returns the ways record deviates from the schema, or nil if it conforms
+func (s *Schema) Validate(record map[string]interface{}) []string {
+	var problems []string
+	fields := make([]string, 0, len(s.Fields))
+	for field := range s.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		fs := s.Fields[field]
+		value, exists := record[field]
+		if !exists || value == nil {
+			if !fs.Nullable {
+				problems = append(problems, fmt.Sprintf("%s: missing required field", field))
+			}
+			continue
+		}
+		if observed := schemaType(value); !typeConforms(fs.Type, observed) {
+			problems = append(problems, fmt.Sprintf("%s: expected %s, got %s", field, fs.Type, observed))
+		}
+	}
+	if s.Strict {
+		var extra []string
+		for field := range record {
+			if _, ok := s.Fields[field]; !ok {
+				extra = append(extra, fmt.Sprintf("%s: unexpected field", field))
+			}
+		}
+		sort.Strings(extra)
+		problems = append(problems, extra...)
+	}
+	return problems
+}
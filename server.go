@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Records of a streamed query whose lookups are fetched together
+const queryBatchSize = 256
+
+// queryRequest is the body of POST /query
+type queryRequest struct {
+	Conditions []FilterCondition `json:"conditions"`
+	Limit      int               `json:"limit"`      // Maximum number of records to return (0 means all)
+	Fields     []string          `json:"fields"`     // Fields to include in each record (empty means all)
+	Expr       string            `json:"expr"`       // Expression every record must also satisfy (see ExprCondition)
+	Lookups    []LookupSpec      `json:"lookups"`    // Records of other collections to embed (see Lookup)
+	PageSize   int               `json:"page_size"`  // Return one page of this many records (see QueryPage)
+	PageToken  string            `json:"page_token"` // Continue after the page that returned this token
+}
+
+// Serve exposes the manager over HTTP on addr:
+//
+//	POST   /query          run a query; body {"conditions": [...], "limit": 100, "fields": [...]};
+//	                       "lookups": [{"collection": "users", "local_field": "user_id", "as": "user"}]
+//	                       embeds referenced records of other collections (see Lookup);
+//	                       "page_size": 100 returns one page, and the X-Next-Page-Token
+//	                       response header, sent back as "page_token", the next (see QueryPage)
+//	GET    /records/{key}  fetch a record (Split mode needs a key index; see BuildKeyIndex);
+//	                       ?as_of=<RFC 3339 time> fetches an earlier version (see EnableVersioning)
+//	GET    /records/{key}/history  list the versions of a record (see EnableVersioning)
+//	POST   /records        insert or replace a record (InMemory mode)
+//	PATCH  /records/{key}  apply update operators such as {"$inc": {"visits": 1}} (InMemory mode)
+//	DELETE /records/{key}  delete a record (InMemory mode)
+//	GET    /metrics        Prometheus metrics, when SetMetrics was given a PrometheusMetrics
+//	GET    /describe       per-field statistics of the dataset (see DescribeDataset)
+//	GET    /collections    list the names of the collections (see CreateCollection)
+//	       /collections/{name}/...  the routes above, against the named collection
+//
+// Query results are streamed as a JSON array, or as NDJSON when the request
+// has "Accept: application/x-ndjson" or "?format=ndjson".
+func (dm *DataManager) Serve(addr string) error {
+	return http.ListenAndServe(addr, dm.Handler())
+}
+
+// Handler returns the HTTP handler used by Serve
+func (dm *DataManager) Handler() http.Handler {
+	return dm.authorize(dm.routes())
+}
+
+// routes returns the unauthenticated routes of Handler
+func (dm *DataManager) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /query", dm.handleQuery)
+	mux.HandleFunc("GET /records/{key}", dm.handleGetRecord)
+	mux.HandleFunc("GET /records/{key}/history", dm.handleHistory)
+	mux.HandleFunc("POST /records", dm.handlePutRecord)
+	mux.HandleFunc("PATCH /records/{key}", dm.handlePatchRecord)
+	mux.HandleFunc("DELETE /records/{key}", dm.handleDeleteRecord)
+	mux.HandleFunc("GET /metrics", dm.handleMetrics)
+	mux.HandleFunc("GET /describe", dm.handleDescribe)
+	mux.HandleFunc("GET /collections", dm.handleCollections)
+	mux.HandleFunc("/collections/{name}/", dm.handleCollection)
+	return mux
+}
+
+func (dm *DataManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	handler, ok := dm.metrics.(http.Handler)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func (dm *DataManager) handleDescribe(w http.ResponseWriter, r *http.Request) {
+	desc, err := dm.DescribeDataset()
+	if err != nil {
+		writeError(w, statusFor(err, http.StatusInternalServerError), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, desc)
+}
+
+func (dm *DataManager) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ctx := r.Context()
+	g, policy := grantFor(ctx), dm.redactionFor(ctx)
+	ndjson := r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	if req.PageSize > 0 {
+		// A page is bounded by its size, and its token is a header sent
+		// ahead of the records
+		results, next, err := dm.runQuery(req, g)
+		if err != nil {
+			writeError(w, statusFor(err, http.StatusInternalServerError), err)
+			return
+		}
+		if next != "" {
+			w.Header().Set("X-Next-Page-Token", next)
+		}
+		if policy != nil {
+			results, _ = dm.Redact(results, policy)
+		}
+		streamRecords(w, results, req.Fields, ndjson)
+		return
+	}
+
+	// Records are written as the scan finds them, so a slow client holds the
+	// scan back instead of the whole result being collected first
+	out := newRecordStream(w, req.Fields, ndjson)
+	err := dm.streamQuery(req, g, func(record map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return out.write(dm.redactRecord(record, policy))
+	})
+	if err != nil {
+		if out.started {
+			// The status has been sent; abort so the client sees a broken
+			// response rather than a complete-looking partial one
+			panic(http.ErrAbortHandler)
+		}
+		writeError(w, statusFor(err, http.StatusInternalServerError), err)
+		return
+	}
+	out.close()
+}
+
+// runQuery executes a decoded query request in the current mode, keeping
+// the records visible to the caller's grant, and returns the token of the
+// next page of a paged request
+func (dm *DataManager) runQuery(req queryRequest, g *grant) ([]map[string]interface{}, string, error) {
+	conditions, err := req.filter()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var results []map[string]interface{}
+	var next string
+	switch {
+	case req.PageSize > 0:
+		// Records hidden by the grant leave pages short rather than shifting them
+		var page *Page
+		if page, err = dm.QueryPage(conditions, req.PageSize, req.PageToken); err == nil {
+			results, next = page.Records, page.NextToken
+		}
+	case dm.mode == InMemoryMode:
+		results, err = dm.Query(conditions)
+	case dm.mode == SplitMode:
+		if path := dm.loadedPath(); path == "" {
+			err = errors.New("No data source has been scanned yet")
+		} else {
+			results, err = dm.LoadDataInSplitMode(path, conditions)
+		}
+	default:
+		err = ErrInvalidMode
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if g != nil && g.filters != nil {
+		visible := results[:0:0]
+		for _, record := range results {
+			if dm.visible(g, record) {
+				visible = append(visible, record)
+			}
+		}
+		results = visible
+	}
+	if req.Limit > 0 && len(results) > req.Limit {
+		results = results[:req.Limit]
+	}
+	for _, spec := range req.Lookups {
+		var keep func(map[string]interface{}) bool
+		if g != nil && g.filters != nil {
+			keep = func(record map[string]interface{}) bool { return dm.visible(g, record) }
+		}
+		if results, err = dm.lookupReferences(results, spec, keep); err != nil {
+			return nil, "", err
+		}
+	}
+	return results, next, nil
+}
+
+// errQueryDone stops the scan of a streamed query once its limit is reached
+var errQueryDone = errors.New("Query limit reached")
+
+// streamQuery executes a decoded query request like runQuery but passes the
+// records to fn as the scan finds them, so that a blocking fn holds the scan
+// back instead of the results piling up. Records with lookups are passed in
+// batches of queryBatchSize, whose references are fetched together; a paged
+// request is collected a page at a time.
+func (dm *DataManager) streamQuery(req queryRequest, g *grant, fn func(map[string]interface{}) error) error {
+	if req.PageSize > 0 {
+		results, _, err := dm.runQuery(req, g)
+		for i := 0; err == nil && i < len(results); i++ {
+			err = fn(results[i])
+		}
+		return err
+	}
+	conditions, err := req.filter()
+	if err != nil {
+		return err
+	}
+
+	var keep func(map[string]interface{}) bool
+	if g != nil && g.filters != nil {
+		keep = func(record map[string]interface{}) bool { return dm.visible(g, record) }
+	}
+	var batch []map[string]interface{}
+	flush := func() error {
+		var err error
+		for _, spec := range req.Lookups {
+			if batch, err = dm.lookupReferences(batch, spec, keep); err != nil {
+				return err
+			}
+		}
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	sent := 0
+	emit := func(record map[string]interface{}) error {
+		if keep != nil && !keep(record) {
+			return nil
+		}
+		batch = append(batch, record)
+		sent++
+		if len(batch) >= queryBatchSize || len(req.Lookups) == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if req.Limit > 0 && sent >= req.Limit {
+			return errQueryDone
+		}
+		return nil
+	}
+
+	switch {
+	case dm.mode == InMemoryMode:
+		defer dm.timeOperation("query")()
+		started := time.Now()
+		ds := dm.snapshot()
+		plan := dm.plan(ds, conditions)
+		dm.visit(ds, plan, func(record map[string]interface{}) bool {
+			err = emit(record)
+			return err == nil
+		})
+		dm.logSlowQuery(plan, conditions, time.Since(started), sent)
+	case dm.mode == SplitMode:
+		if path := dm.loadedPath(); path == "" {
+			err = errors.New("No data source has been scanned yet")
+		} else {
+			err = dm.streamMatches(path, conditions, emit)
+		}
+	default:
+		err = ErrInvalidMode
+	}
+	if err == errQueryDone {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// filter returns the conditions of the request, including its expression
+func (req queryRequest) filter() ([]FilterCondition, error) {
+	conditions := normalizeConditions(req.Conditions)
+	if req.Expr != "" {
+		condition, err := ExprCondition(req.Expr)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func (dm *DataManager) handleGetRecord(w http.ResponseWriter, r *http.Request) {
+	var record map[string]interface{}
+	var err error
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		t, perr := time.Parse(time.RFC3339Nano, asOf)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, perr)
+			return
+		}
+		record, err = dm.GetAsOf(r.PathValue("key"), t)
+	} else {
+		record, err = dm.Get(r.PathValue("key"))
+	}
+	if err == nil && !dm.visible(grantFor(r.Context()), record) {
+		err = &RecordError{Key: r.PathValue("key"), Err: ErrRecordNotFound}
+	}
+	if err != nil {
+		writeError(w, statusFor(err, http.StatusInternalServerError), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dm.redactRecord(record, dm.redactionFor(r.Context())))
+}
+
+func (dm *DataManager) handleHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := dm.History(r.PathValue("key"))
+	if err != nil {
+		writeError(w, statusFor(err, http.StatusBadRequest), err)
+		return
+	}
+	g := grantFor(r.Context())
+	policy := dm.redactionFor(r.Context())
+	visible := history[:0]
+	for _, version := range history {
+		if dm.visible(g, version.Record) {
+			version.Record = dm.redactRecord(version.Record, policy)
+			visible = append(visible, version)
+		}
+	}
+	if len(visible) == 0 {
+		err := &RecordError{Key: r.PathValue("key"), Err: ErrRecordNotFound}
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, visible)
+}
+
+func (dm *DataManager) handlePutRecord(w http.ResponseWriter, r *http.Request) {
+	var record map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := dm.putAs(grantFor(r.Context()), record); err != nil {
+		writeError(w, statusFor(err, http.StatusBadRequest), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, dm.redactRecord(record, dm.redactionFor(r.Context())))
+}
+
+func (dm *DataManager) handlePatchRecord(w http.ResponseWriter, r *http.Request) {
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	record, err := dm.updateAs(grantFor(r.Context()), r.PathValue("key"), update)
+	if err != nil {
+		writeError(w, statusFor(err, http.StatusBadRequest), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dm.redactRecord(record, dm.redactionFor(r.Context())))
+}
+
+func (dm *DataManager) handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
+	deleted, err := dm.deleteAs(grantFor(r.Context()), r.PathValue("key"))
+	if err != nil {
+		writeError(w, statusFor(err, http.StatusInternalServerError), err)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, ErrRecordNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// normalizeConditions converts JSON-decoded condition values to the Go types
+// the filters expect (JSON numbers decode as float64, int filters need int)
+func normalizeConditions(conditions []FilterCondition) []FilterCondition {
+	normalized := make([]FilterCondition, len(conditions))
+	for i, condition := range conditions {
+		if f, ok := condition.Value.(float64); ok && condition.ValueType == "int" && f == float64(int(f)) {
+			condition.Value = int(f)
+		}
+		if condition.ValueType == ArrayValueType {
+			if f, ok := condition.Value.(float64); ok && condition.Operator == "length" && f == float64(int(f)) {
+				condition.Value = int(f)
+			} else if sub, ok := subCondition(condition.Value); ok && condition.Operator != "contains" {
+				condition.Value = sub
+			}
+		}
+		normalized[i] = condition
+	}
+	return normalized
+}
+
+// project returns a copy of record restricted to fields
+func project(record map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return record
+	}
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, exists := record[field]; exists {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// streamRecords writes records one at a time, flushing as it goes
+func streamRecords(w http.ResponseWriter, records []map[string]interface{}, fields []string, ndjson bool) {
+	out := newRecordStream(w, fields, ndjson)
+	for _, record := range records {
+		if err := out.write(record); err != nil {
+			return
+		}
+	}
+	out.close()
+}
+
+// recordStream writes records to a response as a JSON array or NDJSON. The
+// response starts once the buffered output first reaches it, so an error
+// before then can still be answered with an error status.
+type recordStream struct {
+	w       http.ResponseWriter
+	bw      *bufio.Writer
+	encoder *json.Encoder
+	flusher http.Flusher
+	fields  []string
+	ndjson  bool
+	written int  // Records written
+	started bool // Whether anything has reached the client
+}
+
+// newRecordStream prepares a response of records projected on fields
+func newRecordStream(w http.ResponseWriter, fields []string, ndjson bool) *recordStream {
+	s := &recordStream{w: w, fields: fields, ndjson: ndjson}
+	s.bw = bufio.NewWriter(s)
+	s.encoder = json.NewEncoder(s.bw)
+	s.flusher, _ = w.(http.Flusher)
+	return s
+}
+
+// Write passes buffered output on to the response
+func (s *recordStream) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// write adds a record to the response, flushing every 100 records
+func (s *recordStream) write(record map[string]interface{}) error {
+	if s.written == 0 {
+		s.begin()
+	} else if !s.ndjson {
+		s.bw.WriteString(",")
+	}
+	if err := s.encoder.Encode(project(record, s.fields)); err != nil {
+		return err
+	}
+	s.written++
+	if s.flusher != nil && s.written%100 == 0 {
+		if err := s.bw.Flush(); err != nil {
+			return err
+		}
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// begin sets the content type and opens the JSON array
+func (s *recordStream) begin() {
+	if s.ndjson {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		s.w.Header().Set("Content-Type", "application/json")
+		s.bw.WriteString("[")
+	}
+}
+
+// close ends the response
+func (s *recordStream) close() {
+	if s.written == 0 {
+		s.begin()
+	}
+	if !s.ndjson {
+		s.bw.WriteString("]\n")
+	}
+	s.bw.Flush()
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusFor maps an error to the HTTP status reporting it, or fallback
+func statusFor(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrInvalidMode):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrRecordNotFound), errors.Is(err, ErrCollectionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNoKeyField):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidExpr), errors.Is(err, ErrInvalidPageToken):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrRecordExists), errors.Is(err, ErrCollectionExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrMemoryLimitExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrTooManyScans):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return fallback
+	}
+}
+
+// writeError writes an error as a JSON response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
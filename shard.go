@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ShardStrategy decides which shard each record of SplitFile goes to. Set
+// exactly one of Key (with Shards), Records or Bytes, or use ShardByKey,
+// ShardByCount or ShardBySize.
+type ShardStrategy struct {
+	Key     string `json:"key,omitempty"`     // Field whose hash picks the shard
+	Shards  int    `json:"shards,omitempty"`  // Number of shards when sharding by Key
+	Records int64  `json:"records,omitempty"` // Records per shard
+	Bytes   int64  `json:"bytes,omitempty"`   // Target shard size in bytes; a shard holds at least one record
+	Dir     string `json:"-"`                 // Output directory (default: the input's)
+	Prefix  string `json:"-"`                 // Shard file name prefix (default: the input's base name)
+}
+
+// ShardByKey spreads records over n shards by the hash of key, so every
+// record with a given key value lands in the same shard
+func ShardByKey(key string, n int) ShardStrategy {
+	return ShardStrategy{Key: key, Shards: n}
+}
+
+// ShardByCount starts a new shard every n records
+func ShardByCount(n int64) ShardStrategy {
+	return ShardStrategy{Records: n}
+}
+
+// ShardBySize starts a new shard before one would grow past bytes
+func ShardBySize(bytes int64) ShardStrategy {
+	return ShardStrategy{Bytes: bytes}
+}
+
+// ShardManifest describes the shards written by SplitFile. It is stored as
+// JSON next to them; shard paths are relative to the manifest.
+type ShardManifest struct {
+	Input     string        `json:"input"`
+	Strategy  ShardStrategy `json:"strategy"`
+	Hash      string        `json:"hash,omitempty"` // Hash of key values when sharding by key
+	Records   int64         `json:"records"`
+	Shards    []ShardInfo   `json:"shards"`
+	CreatedAt time.Time     `json:"created_at"`
+	dir       string
+}
+
+// ShardInfo describes one shard file
+type ShardInfo struct {
+	Path    string `json:"path"`
+	Records int64  `json:"records"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// shardHash names the hash of key values recorded in manifests
+const shardHash = "fnv1a32"
+
+// validate checks that exactly one strategy is chosen
+func (s ShardStrategy) validate() error {
+	chosen := 0
+	if s.Key != "" {
+		if s.Shards <= 0 {
+			return fmt.Errorf("Sharding by %s requires a positive number of shards", s.Key)
+		}
+		chosen++
+	}
+	if s.Records > 0 {
+		chosen++
+	}
+	if s.Bytes > 0 {
+		chosen++
+	}
+	if chosen != 1 {
+		return errors.New("Shard strategy needs exactly one of a key, a record count or a size")
+	}
+	return nil
+}
+
+// shardOf returns the shard of a key value among n. Strings hash as they
+// are, other values by their JSON encoding, and missing values as "".
+func shardOf(value interface{}, n int) int {
+	var text string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		text = v
+	default:
+		encoded, _ := json.Marshal(v)
+		text = string(encoded)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(text))
+	return int(h.Sum32() % uint32(n))
+}
+
+// shardWriter is one shard file being written
+type shardWriter struct {
+	file *os.File // nil once closed
+	buf  *bufio.Writer
+	info ShardInfo
+}
+
+// write appends one encoded record and its newline
+func (w *shardWriter) write(line []byte) error {
+	if _, err := w.buf.Write(line); err != nil {
+		return err
+	}
+	w.info.Records++
+	w.info.Bytes += int64(len(line))
+	return nil
+}
+
+// close flushes and closes the shard file, if still open
+func (w *shardWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.buf.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	return err
+}
+
+// SplitFile partitions the records of input, in any supported format, into
+// NDJSON shard files named <prefix>-00000.json, <prefix>-00001.json and so
+// on, and writes <prefix>.manifest.json describing them. Shards can then be
+// processed in parallel, queried together with ScanShards, or loaded with
+// LoadFilesInSplitMode. Records keep their input order within each shard.
+func (dm *DataManager) SplitFile(input string, strategy ShardStrategy) (_ *ShardManifest, err error) {
+	if err := strategy.validate(); err != nil {
+		return nil, err
+	}
+	dir, prefix := strategy.Dir, strategy.Prefix
+	if dir == "" {
+		dir = filepath.Dir(input)
+	}
+	if prefix == "" {
+		base := filepath.Base(input)
+		prefix = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	defer dm.beginOperation("split", input, func() int64 { return dm.filesSize([]string{input}) })(&err)
+	reader, closer, err := dm.openRecords(input)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	manifest := &ShardManifest{Input: input, Strategy: strategy, CreatedAt: time.Now().UTC(), dir: dir}
+	if strategy.Key != "" {
+		manifest.Hash = shardHash
+	}
+	var shards []*shardWriter
+	defer func() {
+		for _, w := range shards {
+			if cerr := w.close(); err == nil {
+				err = cerr
+			}
+			manifest.Shards = append(manifest.Shards, w.info)
+		}
+		if err == nil {
+			err = manifest.save(filepath.Join(dir, prefix+".manifest.json"))
+		}
+	}()
+	open := func(i int) (*shardWriter, error) {
+		name := fmt.Sprintf("%s-%05d.json", prefix, i)
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		return &shardWriter{file: file, buf: bufio.NewWriter(file), info: ShardInfo{Path: name}}, nil
+	}
+	if strategy.Key != "" {
+		for i := 0; i < strategy.Shards; i++ {
+			w, err := open(i)
+			if err != nil {
+				return nil, err
+			}
+			shards = append(shards, w)
+		}
+	}
+
+	for {
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		dm.track(size)
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, '\n')
+
+		if strategy.Key != "" {
+			value, _ := resolvePath(record, strategy.Key)
+			err = shards[shardOf(value, strategy.Shards)].write(line)
+		} else {
+			// Roll over to a new shard when the current one is full
+			if n := len(shards); n == 0 ||
+				(strategy.Records > 0 && shards[n-1].info.Records >= strategy.Records) ||
+				(strategy.Bytes > 0 && shards[n-1].info.Records > 0 && shards[n-1].info.Bytes+int64(len(line)) > strategy.Bytes) {
+				if n > 0 {
+					if err := shards[n-1].close(); err != nil {
+						return nil, err
+					}
+				}
+				next, err := open(n)
+				if err != nil {
+					return nil, err
+				}
+				shards = append(shards, next)
+			}
+			err = shards[len(shards)-1].write(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Records++
+	}
+	return manifest, nil
+}
+
+// save writes the manifest to path
+func (m *ShardManifest) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// LoadShardManifest reads a manifest written by SplitFile
+func LoadShardManifest(path string) (*ShardManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m ShardManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Invalid shard manifest %s: %w", path, err)
+	}
+	m.dir = filepath.Dir(path)
+	return &m, nil
+}
+
+// Paths returns the locations of the shard files
+func (m *ShardManifest) Paths() []string {
+	paths := make([]string, len(m.Shards))
+	for i, shard := range m.Shards {
+		paths[i] = filepath.Join(m.dir, shard.Path)
+	}
+	return paths
+}
+
+// ShardFor returns the location of the shard holding records whose key
+// field equals value, or "" when the shards are not split by key
+func (m *ShardManifest) ShardFor(value interface{}) string {
+	if m.Strategy.Key == "" || m.Hash != shardHash || len(m.Shards) != m.Strategy.Shards {
+		return ""
+	}
+	return filepath.Join(m.dir, m.Shards[shardOf(value, len(m.Shards))].Path)
+}
+
+// ScanShards filters the shards listed in the manifest at manifestPath in
+// Split mode, as LoadFilesInSplitMode would. When they are split by key and
+// a condition requires the key to equal a value, only that value's shard is
+// read.
+func (dm *DataManager) ScanShards(manifestPath string, conditions []FilterCondition) ([]map[string]interface{}, error) {
+	m, err := LoadShardManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, condition := range conditions {
+		if condition.Key != m.Strategy.Key || condition.Operator != "==" || condition.Collation != BinaryCollation {
+			continue
+		}
+		if condition.ValueType != "string" && condition.ValueType != "int" {
+			continue
+		}
+		if path := m.ShardFor(condition.Value); path != "" {
+			return dm.LoadFilesInSplitMode([]string{path}, conditions)
+		}
+	}
+	return dm.LoadFilesInSplitMode(m.Paths(), conditions)
+}
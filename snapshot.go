@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SaveSnapshot writes the in-memory data, or the records of the storage
+// engine in Split mode (see OpenStorage), to path as NDJSON, gzip-compressed
+// when path ends in ".gz". The file is replaced atomically, so a crash
+// leaves either the previous snapshot or the new one.
+func (dm *DataManager) SaveSnapshot(path string) error {
+	if engine := dm.storageEngine(); engine != nil && dm.mode == SplitMode {
+		return dm.saveStorageSnapshot(path, engine)
+	}
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+
+	return writeSnapshotFile(path, dm.snapshot().records(), dm.encryption)
+}
+
+// LoadSnapshot replaces the in-memory data with a snapshot written by
+// SaveSnapshot (plain or gzip-compressed NDJSON) and rebuilds indexes
+func (dm *DataManager) LoadSnapshot(path string, keyName string) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	plain, err := dm.encryption.reader(bufio.NewReader(file), path)
+	if err != nil {
+		return err
+	}
+	r, err := maybeGunzip(bufio.NewReader(plain))
+	if err != nil {
+		return err
+	}
+	reader, err := newRecordReader(r, 0)
+	if err != nil {
+		return err
+	}
+	return dm.loadRecords(reader, keyName)
+}
+
+// maybeGunzip wraps r in a gzip reader when it starts with the gzip magic bytes
+func maybeGunzip(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(2)
+	if err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(r)
+	}
+	return r, nil
+}
+
+// writeSnapshotFile writes data as NDJSON sorted by key to a temporary file,
+// encrypted when c is set, and renames it over path, so readers never see a
+// partial snapshot
+func writeSnapshotFile(path string, data map[string]map[string]interface{}, c *fileCipher) error {
+	return replaceFile(path, c, func(w io.Writer) error {
+		return encodeSnapshot(w, path, data)
+	})
+}
+
+// replaceFile writes path atomically with encode, through a temporary file
+// encrypted when c is set
+func replaceFile(path string, c *fileCipher, encode func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := c.writer(tmp)
+	if err := encode(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// encodeSnapshot writes the records to w, compressing them for ".gz" paths
+func encodeSnapshot(w io.Writer, path string, data map[string]map[string]interface{}) error {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	var out io.Writer = bw
+	var gz *gzip.Writer
+	if strings.HasSuffix(strings.ToLower(path), ".gz") {
+		gz = gzip.NewWriter(bw)
+		out = gz
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, key := range keys {
+		if err := encoder.Encode(data[key]); err != nil {
+			return err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SortField orders records by the value of a field
+type SortField struct {
+	Field      string // Field name; a dotted path reaches into nested objects
+	Descending bool
+}
+
+// ParseOrderBy parses a comma-separated ordering such as "timestamp desc, id",
+// where each field may be followed by asc or desc
+func ParseOrderBy(spec string) ([]SortField, error) {
+	var order []SortField
+	for _, part := range strings.Split(spec, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 || len(words) > 2 {
+			return nil, fmt.Errorf("Invalid ordering %q", strings.TrimSpace(part))
+		}
+		field := SortField{Field: words[0]}
+		if len(words) == 2 {
+			switch strings.ToLower(words[1]) {
+			case "asc":
+			case "desc":
+				field.Descending = true
+			default:
+				return nil, fmt.Errorf("Invalid ordering %q: expected asc or desc", strings.TrimSpace(part))
+			}
+		}
+		order = append(order, field)
+	}
+	return order, nil
+}
+
+// sortKey returns the values record is ordered by: bools, numbers and
+// strings as a sorted index holds them, times as RFC 3339 text in UTC, and
+// nil for values that cannot be ordered
+func sortKey(record map[string]interface{}, order []SortField) []interface{} {
+	key := make([]interface{}, len(order))
+	for i, field := range order {
+		value, _ := resolvePath(record, field.Field)
+		if t, ok := value.(time.Time); ok {
+			value = t.UTC().Format(time.RFC3339Nano)
+		}
+		key[i], _ = normalizeIndexValue(value)
+	}
+	return key
+}
+
+// compareSortKeys compares two sort keys field by field. Missing values
+// sort last in either direction.
+func compareSortKeys(a, b []interface{}, order []SortField) int {
+	for i, field := range order {
+		switch {
+		case a[i] == nil && b[i] == nil:
+			continue
+		case a[i] == nil:
+			return 1
+		case b[i] == nil:
+			return -1
+		}
+		c := compareIndexValues(a[i], b[i])
+		if field.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// sortEntry is a record with its sort key, as stored in run files
+type sortEntry struct {
+	Key    []interface{}          `json:"k"`
+	Record map[string]interface{} `json:"r"`
+}
+
+// externalSorter orders records, spilling sorted runs to temporary files
+// once the records it holds pass its limit and merging them at the end
+type externalSorter struct {
+	order   []SortField
+	cipher  *fileCipher
+	limit   int64 // Bytes of records held before spilling (0 never spills)
+	held    int64
+	entries []sortEntry
+	runs    []string
+}
+
+// newExternalSorter returns a sorter by order. With spill, records past the
+// manager's spill threshold are written to disk.
+func (dm *DataManager) newExternalSorter(order []SortField, spill bool) *externalSorter {
+	s := &externalSorter{order: order, cipher: dm.encryption}
+	if spill {
+		s.limit = int64(dm.spillThreshold())
+	}
+	return s
+}
+
+// add takes a record to sort
+func (s *externalSorter) add(record map[string]interface{}) error {
+	s.entries = append(s.entries, sortEntry{Key: sortKey(record, s.order), Record: record})
+	if s.limit == 0 {
+		return nil
+	}
+	if s.held += estimateRecordSize(record); s.held >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+// sortEntries orders the held records, keeping the input order of equal keys
+func (s *externalSorter) sortEntries() {
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return compareSortKeys(s.entries[i].Key, s.entries[j].Key, s.order) < 0
+	})
+}
+
+// spill writes the held records to a sorted run file, encrypted when the
+// manager encrypts spill files
+func (s *externalSorter) spill() error {
+	s.sortEntries()
+	f, err := os.CreateTemp("", "sort-run-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f.Name())
+	w := s.cipher.writer(f)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, entry := range s.entries {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = bw.Flush()
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	s.entries, s.held = s.entries[:0], 0
+	return err
+}
+
+// each calls fn with every record in order. Records read back from run
+// files are decoded JSON.
+func (s *externalSorter) each(fn func(map[string]interface{}) error) error {
+	if len(s.runs) == 0 {
+		s.sortEntries()
+		for _, entry := range s.entries {
+			if err := fn(entry.Record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(s.entries) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	h := &sortHeap{order: s.order}
+	for i, run := range s.runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := s.cipher.reader(bufio.NewReader(f), run)
+		if err != nil {
+			return err
+		}
+		cursor := &sortCursor{decoder: json.NewDecoder(r), run: i}
+		ok, err := cursor.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.cursors = append(h.cursors, cursor)
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		cursor := h.cursors[0]
+		if err := fn(cursor.head.Record); err != nil {
+			return err
+		}
+		ok, err := cursor.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// close deletes the run files
+func (s *externalSorter) close() {
+	for _, run := range s.runs {
+		os.Remove(run)
+	}
+	s.runs = nil
+}
+
+// sortCursor is the next unread entry of a sorted run
+type sortCursor struct {
+	decoder *json.Decoder
+	head    sortEntry
+	run     int
+}
+
+// advance reads the next entry of the run, reporting false at its end
+func (c *sortCursor) advance() (bool, error) {
+	c.head = sortEntry{}
+	if err := c.decoder.Decode(&c.head); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// sortHeap orders run cursors by their next entry; equal keys come from
+// the earlier run first, so the merge is stable
+type sortHeap struct {
+	order   []SortField
+	cursors []*sortCursor
+}
+
+func (h *sortHeap) Len() int { return len(h.cursors) }
+func (h *sortHeap) Less(i, j int) bool {
+	if c := compareSortKeys(h.cursors[i].head.Key, h.cursors[j].head.Key, h.order); c != 0 {
+		return c < 0
+	}
+	return h.cursors[i].run < h.cursors[j].run
+}
+func (h *sortHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *sortHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*sortCursor)) }
+func (h *sortHeap) Pop() interface{} {
+	cursor := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return cursor
+}
+
+// SortTo writes the records of filePath matching conditions to w as NDJSON,
+// ordered by order, and returns how many were written. Records with equal
+// sort values keep their input order. Memory stays bounded however large
+// the input is: once the records held pass a quarter of the memory limit,
+// they are sorted and spilled to a temporary run file (encrypted under
+// SetEncryption), and the runs are merged as the output is written.
+func (dm *DataManager) SortTo(filePath string, conditions []FilterCondition, order []SortField, w io.Writer) (int, error) {
+	if len(order) == 0 {
+		return 0, fmt.Errorf("SortTo needs at least one sort field")
+	}
+	sorter := dm.newExternalSorter(order, true)
+	defer sorter.close()
+	err := dm.Pipeline().From(filePath).Workers(1).Filter(conditions).ForEach(sorter.add)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	count := 0
+	err = sorter.each(func(record map[string]interface{}) error {
+		count++
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source is a readable dataset location such as a local file, a URL, or a
+// cloud storage object
+type Source interface {
+	Open() (io.ReadCloser, error)
+}
+
+// RangeSource is a Source that supports random access, which allows
+// LoadDataInSplitMode to scan it in parallel chunks
+type RangeSource interface {
+	Source
+	Size() (int64, error)
+	OpenRange(offset int64) (io.ReadCloser, error) // Reads from offset to the end
+}
+
+// SourceFactory builds a Source from a location such as "s3://bucket/key"
+type SourceFactory func(location string) (Source, error)
+
+var (
+	sourceFactoriesMu sync.RWMutex
+	sourceFactories   = map[string]SourceFactory{
+		"s3":     s3SourceFromURL,
+		"gs":     gcsSourceFromURL,
+		"azblob": azureSourceFromURL,
+	}
+)
+
+// RegisterSourceScheme makes locations of the form "<scheme>://..." resolve through factory
+func RegisterSourceScheme(scheme string, factory SourceFactory) {
+	sourceFactoriesMu.Lock()
+	sourceFactories[scheme] = factory
+	sourceFactoriesMu.Unlock()
+}
+
+// Files smaller than this are scanned sequentially
+const parallelScanThreshold = 8 * 1024 * 1024
+
+// fileSource reads a local file
+type fileSource struct {
+	path string
+}
+
+// NewFileSource returns a Source for a local file
+func NewFileSource(path string) Source {
+	return &fileSource{path: path}
+}
+
+func (s *fileSource) Open() (io.ReadCloser, error) {
+	return os.Open(s.path)
+}
+
+func (s *fileSource) Size() (int64, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *fileSource) OpenRange(offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *fileSource) name() string {
+	return s.path
+}
+
+// readerSource wraps an already open stream such as stdin
+type readerSource struct {
+	r io.ReadCloser
+}
+
+func (s *readerSource) Open() (io.ReadCloser, error) {
+	return s.r, nil
+}
+
+// urlSource fetches a plain http(s):// URL
+type urlSource struct {
+	url    string
+	client *http.Client
+}
+
+func (s *urlSource) Open() (io.ReadCloser, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected HTTP status fetching %s: %s", s.url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *urlSource) name() string {
+	return s.url
+}
+
+// sourceName returns the location of src when it is known, for format detection
+func sourceName(src Source) string {
+	if named, ok := src.(interface{ name() string }); ok {
+		return named.name()
+	}
+	return ""
+}
+
+// resolveSource maps a path, "-", URL, or registered scheme to a Source
+func (dm *DataManager) resolveSource(path string) (Source, error) {
+	switch {
+	case path == "-":
+		return &readerSource{r: io.NopCloser(os.Stdin)}, nil
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		return &urlSource{url: path, client: &http.Client{Timeout: dm.httpTimeout}}, nil
+	}
+
+	if scheme, _, ok := strings.Cut(path, "://"); ok {
+		sourceFactoriesMu.RLock()
+		factory, exists := sourceFactories[scheme]
+		sourceFactoriesMu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("Unsupported source scheme: %s", scheme)
+		}
+		return factory(path)
+	}
+	return NewFileSource(path), nil
+}
+
+// LoadSourceInMemory loads every record from src into memory and creates index
+func (dm *DataManager) LoadSourceInMemory(src Source, keyName string) (err error) {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+
+	defer dm.beginOperation("load", sourceName(src), func() int64 { return sourceSize(src) })(&err)
+	if dm.formatFor(sourceName(src)) == "parquet" {
+		records, err := dm.scanParquetSource(src, nil, nil, dm.sharedBudget())
+		if err != nil {
+			return err
+		}
+		return dm.loadRecords(&sliceReader{records: records}, keyName)
+	}
+
+	input, err := src.Open()
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	reader, err := dm.newReaderFor(input, sourceName(src))
+	if err != nil {
+		return err
+	}
+	return dm.loadRecords(reader, keyName)
+}
+
+// openRecords returns a reader over every record at location, whatever its format
+func (dm *DataManager) openRecords(location string) (recordReader, io.Closer, error) {
+	src, err := dm.resolveSource(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dm.formatFor(sourceName(src)) == "parquet" {
+		records, err := dm.scanParquetSource(src, nil, nil, dm.sharedBudget())
+		if err != nil {
+			return nil, nil, err
+		}
+		return &sliceReader{records: records}, io.NopCloser(nil), nil
+	}
+
+	input, err := src.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := dm.newReaderFor(input, sourceName(src))
+	if err != nil {
+		input.Close()
+		return nil, nil, err
+	}
+	return reader, input, nil
+}
+
+// LoadSourceInSplitMode filters the records of src, scanning newline-delimited
+// sources in parallel chunks when they support range reads
+func (dm *DataManager) LoadSourceInSplitMode(src Source, conditions []FilterCondition) (_ []map[string]interface{}, err error) {
+	if dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+
+	budget, err := dm.beginScan()
+	if err != nil {
+		return nil, err
+	}
+	defer budget.done()
+	defer dm.beginOperation("scan", sourceName(src), func() int64 { return sourceSize(src) })(&err)
+	dm.parseErrors.reset()
+	results, err := dm.scanSource(src, conditions, budget)
+	if err != nil {
+		return nil, err
+	}
+	return dm.finishScan(results)
+}
+
+// scanSource filters the records of src in whichever way suits its format and location
+func (dm *DataManager) scanSource(src Source, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, error) {
+	if results, ok, err := dm.scanSQLIndex(src, conditions, budget); ok {
+		return results, err
+	}
+	if results, ok, err := dm.scanZones(src, conditions, budget); ok {
+		return results, err
+	}
+	if dm.formatFor(sourceName(src)) == "parquet" {
+		return dm.scanParquetSource(src, conditions, nil, budget)
+	}
+	if rs, ok := src.(RangeSource); ok && dm.formatFor(sourceName(src)) == "json" {
+		if size, err := rs.Size(); err == nil && size >= parallelScanThreshold {
+			if lineDelimited, err := dm.isLineDelimited(rs); err == nil && lineDelimited {
+				return dm.scanChunks(rs, size, conditions, budget)
+			}
+		}
+	}
+
+	input, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	if dm.fastScan && dm.formatFor(sourceName(src)) == "json" {
+		text, err := dm.transcode(input)
+		if err != nil {
+			return nil, err
+		}
+		br := dm.chunkReader(text)
+		defer dm.releaseChunkReader(br)
+		if first, err := peekNonSpace(br); err == nil && first != '[' {
+			return dm.newLineScanner(conditions).scanLines(br, 0, math.MaxInt64, budget)
+		}
+		reader, err := dm.newJSONReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dm.filterRecords(dm.deriving(reader), conditions, budget)
+	}
+
+	reader, err := dm.newReaderFor(input, sourceName(src))
+	if err != nil {
+		return nil, err
+	}
+	return dm.filterRecords(reader, conditions, budget)
+}
+
+// isLineDelimited reports whether the source holds NDJSON rather than a JSON
+// array, in UTF-8 that can be split at byte offsets
+func (dm *DataManager) isLineDelimited(rs RangeSource) (bool, error) {
+	body, err := rs.OpenRange(0)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	br := bufio.NewReaderSize(body, charsetSampleSize)
+	if sample, err := br.Peek(charsetSampleSize); (err == nil || err == io.EOF) && !dm.plainUTF8(sample) {
+		return false, nil // Transcoded input is read sequentially
+	}
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return false, err
+	}
+	return first != '[', nil
+}
+
+// scanChunks splits the source into chunks sized by planScan and filters
+// them concurrently, each worker taking the next chunk when it is done
+func (dm *DataManager) scanChunks(rs RangeSource, size int64, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, error) {
+	workers, chunkSize := dm.planScan(size)
+	bounds := dm.chunkBounds(rs, size, int(max((size+chunkSize-1)/chunkSize, 1)))
+	chunks := len(bounds) - 1
+	workers = min(workers, chunks)
+	dm.tuner.record(ScanTuning{Workers: workers, Chunks: chunks, ChunkSize: size / int64(chunks), Pinned: dm.pinWorkers})
+
+	results := make([][]map[string]interface{}, chunks)
+	errs := make([]error, chunks)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if dm.pinWorkers {
+				defer pinWorker(w)()
+			}
+			for i := int(next.Add(1) - 1); i < chunks; i = int(next.Add(1) - 1) {
+				started := time.Now()
+				results[i], errs[i] = dm.scanChunk(rs, bounds[i], bounds[i+1], conditions, budget)
+				if errs[i] != nil {
+					next.Store(int64(chunks)) // The others stop after their chunk
+					return
+				}
+				dm.tuner.observe(bounds[i+1]-bounds[i], time.Since(started))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var filteredData []map[string]interface{}
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		filteredData = append(filteredData, results[i]...)
+	}
+	return filteredData, nil
+}
+
+// scanChunk filters every line that starts within [start, end)
+func (dm *DataManager) scanChunk(rs RangeSource, start, end int64, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, error) {
+	// Begin one byte early so a line starting exactly at start is not mistaken
+	// for the tail of the previous chunk's last line
+	offset := start
+	if start > 0 {
+		offset = start - 1
+	}
+	body, err := rs.OpenRange(offset)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	br := dm.chunkReader(body)
+	defer dm.releaseChunkReader(br)
+	pos := offset
+	if start > 0 {
+		_, skipped, _, err := readLine(br, nil, 1)
+		pos += int64(skipped)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dm.newLineScanner(conditions).scanLines(br, pos, end, budget)
+}
+
+// scanLine decodes and validates one line of a chunk scan, returning a nil
+// record when the line is skipped by the error policy or validation
+func (dm *DataManager) scanLine(line []byte, offset int64) (map[string]interface{}, error) {
+	record, err := dm.decodeRecord(line)
+	if err != nil {
+		return nil, dm.tolerate(&ParseError{Offset: offset, Snippet: snippet(line), Err: err})
+	}
+	dm.derive(record)
+	valid, err := dm.conforms(record)
+	if err != nil || !valid {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SQLDialect selects the SQL syntax ExportToSQL generates
+type SQLDialect string
+
+const (
+	PostgresDialect SQLDialect = "postgres" // $1 placeholders, "quoted" identifiers, JSONB columns
+	MySQLDialect    SQLDialect = "mysql"    // ? placeholders, `quoted` identifiers, JSON columns
+	SQLiteDialect   SQLDialect = "sqlite"   // ? placeholders, "quoted" identifiers, TEXT for JSON
+)
+
+// SQLExportOptions configures ExportToSQL
+type SQLExportOptions struct {
+	Dialect     SQLDialect        // SQL syntax (default: guessed from the driver's package)
+	Columns     []string          // Fields exported, in column order (default: every field, sorted)
+	ColumnNames map[string]string // Column name of a field when it differs from the field name
+	ColumnTypes map[string]string // SQL type of a field's column when creating the table, overriding the inferred one
+	CreateTable bool              // Create the table from the records' inferred schema when it does not exist
+	PrimaryKey  []string          // Fields making up the primary key of a created table
+	BatchSize   int               // Rows per INSERT statement (default 500)
+}
+
+// ExportToSQL inserts results into table of db and returns how many rows
+// were inserted. With opts.CreateTable, a missing table is created with a
+// column per field, typed from the schema inferred from results (see
+// InferSchema): integers as BIGINT, floats as DOUBLE, dates and datetimes as
+// DATE and TIMESTAMP, objects and arrays as JSON, and fields of mixed type
+// as TEXT. An existing table is kept, and fields without a matching column
+// are left out. Rows are inserted in one transaction, opts.BatchSize rows at
+// a time, with prepared multi-row INSERT statements; objects and arrays are
+// stored as JSON text and missing fields as NULL.
+func ExportToSQL(db *sql.DB, table string, results []map[string]interface{}, opts SQLExportOptions) (int64, error) {
+	return ExportToSQLContext(context.Background(), db, table, results, opts)
+}
+
+// ExportToSQLContext is ExportToSQL with a context for the statements
+func ExportToSQLContext(ctx context.Context, db *sql.DB, table string, results []map[string]interface{}, opts SQLExportOptions) (int64, error) {
+	dialect := opts.Dialect
+	if dialect == "" {
+		dialect = guessDialect(db)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	fields := columnsFor(results, opts.Columns)
+	column := func(field string) string {
+		if name, ok := opts.ColumnNames[field]; ok {
+			return name
+		}
+		return field
+	}
+
+	existing, err := tableColumns(ctx, db, table, dialect)
+	if err != nil && !opts.CreateTable {
+		return 0, fmt.Errorf("Table %s is not accessible: %w", table, err)
+	}
+	if err != nil {
+		if _, err := db.ExecContext(ctx, createTableSQL(table, fields, column, results, opts, dialect)); err != nil {
+			return 0, fmt.Errorf("Creating table %s: %w", table, err)
+		}
+	} else {
+		kept := fields[:0:0]
+		for _, field := range fields {
+			if existing[strings.ToLower(column(field))] {
+				kept = append(kept, field)
+			}
+		}
+		fields = kept
+	}
+	if len(fields) == 0 || len(results) == 0 {
+		return 0, nil
+	}
+
+	// Stay below the 65535 bind parameters Postgres and MySQL accept
+	if max := 65535 / len(fields); batchSize > max {
+		batchSize = max
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var inserted int64
+	var stmt *sql.Stmt
+	preparedRows := 0
+	args := make([]interface{}, 0, batchSize*len(fields))
+	for start := 0; start < len(results); start += batchSize {
+		batch := results[start:min(start+batchSize, len(results))]
+		if len(batch) != preparedRows {
+			if stmt != nil {
+				stmt.Close()
+			}
+			if stmt, err = tx.PrepareContext(ctx, insertSQL(table, fields, column, len(batch), dialect)); err != nil {
+				return 0, err
+			}
+			preparedRows = len(batch)
+		}
+		args = args[:0]
+		for _, record := range batch {
+			for _, field := range fields {
+				value, _ := resolvePath(record, field)
+				args = append(args, sqlValue(value))
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			stmt.Close()
+			return 0, fmt.Errorf("Inserting rows %d-%d into %s: %w", start+1, start+len(batch), table, err)
+		}
+		inserted += int64(len(batch))
+	}
+	if stmt != nil {
+		stmt.Close()
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+// guessDialect picks a dialect from the package of db's driver
+func guessDialect(db *sql.DB) SQLDialect {
+	driver := strings.ToLower(reflect.TypeOf(db.Driver()).String())
+	switch {
+	case strings.Contains(driver, "mysql"):
+		return MySQLDialect
+	case strings.Contains(driver, "sqlite"):
+		return SQLiteDialect
+	default:
+		return PostgresDialect
+	}
+}
+
+// tableColumns returns the lower-cased column names of table, failing when
+// it does not exist
+func tableColumns(ctx context.Context, db *sql.DB, table string, dialect SQLDialect) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM "+quoteTable(table, dialect)+" WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, nil
+}
+
+// createTableSQL builds the CREATE TABLE statement for fields, typed from
+// the schema of results
+func createTableSQL(table string, fields []string, column func(string) string, results []map[string]interface{}, opts SQLExportOptions, dialect SQLDialect) string {
+	schema := columnSchema(results, fields)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE %s (", quoteTable(table, dialect))
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		kind := "mixed"
+		nullable := true
+		if fs, ok := schema.Fields[field]; ok {
+			kind, nullable = fs.Type, fs.Nullable
+		}
+		sqlType, ok := opts.ColumnTypes[field]
+		if !ok {
+			sqlType = sqlColumnType(kind, dialect)
+		}
+		fmt.Fprintf(&b, "%s %s", quoteIdent(column(field), dialect), sqlType)
+		if !nullable {
+			b.WriteString(" NOT NULL")
+		}
+	}
+	if len(opts.PrimaryKey) > 0 {
+		keys := make([]string, len(opts.PrimaryKey))
+		for i, field := range opts.PrimaryKey {
+			keys[i] = quoteIdent(column(field), dialect)
+		}
+		fmt.Fprintf(&b, ", PRIMARY KEY (%s)", strings.Join(keys, ", "))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// sqlColumnType maps an inferred schema type to a column type
+func sqlColumnType(kind string, dialect SQLDialect) string {
+	switch kind {
+	case "int":
+		return "BIGINT"
+	case "float":
+		if dialect == PostgresDialect {
+			return "DOUBLE PRECISION"
+		}
+		return "DOUBLE"
+	case "bool":
+		return "BOOLEAN"
+	case "date":
+		return "DATE"
+	case "datetime":
+		if dialect == MySQLDialect {
+			return "DATETIME"
+		}
+		return "TIMESTAMP"
+	case "object", "array":
+		switch dialect {
+		case PostgresDialect:
+			return "JSONB"
+		case MySQLDialect:
+			return "JSON"
+		}
+	}
+	return "TEXT"
+}
+
+// insertSQL builds a multi-row INSERT of rows rows into the columns of fields
+func insertSQL(table string, fields []string, column func(string) string, rows int, dialect SQLDialect) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s (", quoteTable(table, dialect))
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(quoteIdent(column(field), dialect))
+	}
+	b.WriteString(") VALUES ")
+	n := 0
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for i := range fields {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			n++
+			if dialect == PostgresDialect {
+				b.WriteString("$" + strconv.Itoa(n))
+			} else {
+				b.WriteString("?")
+			}
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// quoteTable quotes each part of a possibly schema-qualified table name
+func quoteTable(table string, dialect SQLDialect) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = quoteIdent(part, dialect)
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteIdent quotes an identifier for dialect
+func quoteIdent(name string, dialect SQLDialect) string {
+	if dialect == MySQLDialect {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlValue converts a decoded JSON value to a driver argument
+func sqlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case map[string]interface{}, []interface{}:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(raw)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SQLIndexOptions configures UseSQLIndex
+type SQLIndexOptions struct {
+	Fields []string // Fields or dotted paths mirrored into the index, one column each
+	Table  string   // Table holding the index (default "records"); its metadata goes in "<table>_meta"
+}
+
+// sqlIndex mirrors indexed fields and line offsets of an NDJSON file into
+// a SQLite table
+type sqlIndex struct {
+	db      *sql.DB
+	path    string
+	table   string
+	fields  []string
+	size    int64     // File size when indexed
+	modTime time.Time // File modification time when indexed
+}
+
+// sqlIndexMeta is the row of "<table>_meta" recognizing an up-to-date index
+type sqlIndexMeta struct {
+	Path    string   `json:"path"`
+	Fields  []string `json:"fields"`
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"mod_time"`
+}
+
+// UseSQLIndex mirrors opts.Fields and the line offset of every record of the
+// NDJSON file at filePath into a SQLite database, so Split-mode scans of the
+// file delegate their conditions to SQLite and read only the matching lines,
+// while the records themselves stay in the file. db is opened by the caller
+// with any SQLite driver, such as sql.Open("sqlite", "events.idx"), so the
+// package does not depend on one. The index is durable: when db already
+// holds an index of the unchanged file with the same fields it is reused,
+// and it is rebuilt when the file changes. Scans use it when at least one
+// condition is on an indexed field with a comparison or "contains"; the
+// other conditions, and the record bodies, are checked after reading the
+// lines. QuerySQLIndex runs arbitrary WHERE clauses against it.
+func (dm *DataManager) UseSQLIndex(db *sql.DB, filePath string, opts SQLIndexOptions) error {
+	if dm.mode != SplitMode {
+		return ErrInvalidMode
+	}
+	if len(opts.Fields) == 0 {
+		return fmt.Errorf("A SQL index of %s needs at least one field", filePath)
+	}
+	idx := &sqlIndex{db: db, path: filePath, table: opts.Table, fields: opts.Fields}
+	if idx.table == "" {
+		idx.table = "records"
+	}
+	if err := idx.open(dm); err != nil {
+		return err
+	}
+	dm.mu.Lock()
+	dm.sqlIndex = idx
+	dm.mu.Unlock()
+	return nil
+}
+
+// QuerySQLIndex returns the records of the SQL-indexed file whose indexed
+// columns satisfy where, a SQLite WHERE clause with ? placeholders for args,
+// in file order. Columns are named after the fields; quote dotted paths, as
+// in `"address.city" = ?`.
+func (dm *DataManager) QuerySQLIndex(where string, args ...interface{}) ([]map[string]interface{}, error) {
+	dm.mu.RLock()
+	idx := dm.sqlIndex
+	dm.mu.RUnlock()
+	if idx == nil {
+		return nil, errors.New("No SQL index; call UseSQLIndex first")
+	}
+	if err := idx.open(dm); err != nil {
+		return nil, err
+	}
+	offsets, err := idx.offsets(where, args)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]map[string]interface{}, 0, len(offsets))
+	err = dm.readLinesAt(idx.path, offsets, func(_ int, record map[string]interface{}, _ int) error {
+		results = append(results, record)
+		return nil
+	})
+	return results, err
+}
+
+// scanSQLIndex answers a scan of src from the SQL index when it covers src
+// and some of the conditions, reporting whether it did
+func (dm *DataManager) scanSQLIndex(src Source, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, bool, error) {
+	dm.mu.RLock()
+	idx := dm.sqlIndex
+	dm.mu.RUnlock()
+	if idx == nil || sourceName(src) != idx.path {
+		return nil, false, nil
+	}
+	where, args := idx.translate(conditions, len(dm.dateLayouts) > 0)
+	if where == "" {
+		return nil, false, nil
+	}
+	if err := idx.open(dm); err != nil {
+		return nil, true, err
+	}
+	offsets, err := idx.offsets(where, args)
+	if err != nil {
+		return nil, true, err
+	}
+
+	var results []map[string]interface{}
+	err = dm.readLinesAt(idx.path, offsets, func(_ int, record map[string]interface{}, size int) error {
+		dm.track(size)
+		if valid, err := dm.conforms(record); err != nil || !valid {
+			return err
+		}
+		if dm.matchConditions(record, conditions) {
+			results = append(results, record)
+		}
+		return budget.charge(int64(size))
+	})
+	return results, true, err
+}
+
+// open reuses the index stored in the database when it matches the file
+// and rebuilds it otherwise
+func (idx *sqlIndex) open(dm *DataManager) error {
+	info, err := os.Stat(idx.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == idx.size && info.ModTime().Equal(idx.modTime) {
+		return nil
+	}
+	want := sqlIndexMeta{Path: idx.path, Fields: idx.fields, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	var stored string
+	err = idx.db.QueryRow(fmt.Sprintf("SELECT meta FROM %s", quoteIdent(idx.table+"_meta", SQLiteDialect))).Scan(&stored)
+	if current, _ := json.Marshal(want); err != nil || stored != string(current) {
+		if err := idx.build(dm, want); err != nil {
+			return err
+		}
+	}
+	idx.size, idx.modTime = info.Size(), info.ModTime()
+	return nil
+}
+
+// build recreates the index table from the file
+func (idx *sqlIndex) build(dm *DataManager, meta sqlIndexMeta) (err error) {
+	started := time.Now()
+	f, err := os.Open(idx.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := dm.chunkReader(f)
+	defer dm.releaseChunkReader(br)
+	if head, _ := br.Peek(2); bytes.Equal(head, []byte{0x1f, 0x8b}) {
+		return fmt.Errorf("%s is compressed; SQL indexes need uncompressed newline-delimited JSON", idx.path)
+	}
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	table, metaTable := quoteIdent(idx.table, SQLiteDialect), quoteIdent(idx.table+"_meta", SQLiteDialect)
+	columns := make([]string, len(idx.fields))
+	for i, field := range idx.fields {
+		columns[i] = quoteIdent(field, SQLiteDialect)
+	}
+	statements := []string{
+		"DROP TABLE IF EXISTS " + table,
+		"DROP TABLE IF EXISTS " + metaTable,
+		// Untyped columns keep each value's storage class, so numbers and text compare like filters do
+		fmt.Sprintf("CREATE TABLE %s (_offset INTEGER PRIMARY KEY, %s)", table, strings.Join(columns, ", ")),
+		fmt.Sprintf("CREATE TABLE %s (meta TEXT)", metaTable),
+	}
+	for i, column := range columns {
+		statements = append(statements, fmt.Sprintf("CREATE INDEX %s ON %s (%s)",
+			quoteIdent(fmt.Sprintf("%s_%d", idx.table, i), SQLiteDialect), table, column))
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)+1), ", ")
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (_offset, %s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	wanted := make(map[string]bool, len(idx.fields))
+	for _, field := range idx.fields {
+		wanted[pathHead(field)] = true
+	}
+	var buf []byte
+	var pos int64
+	rows := 0
+	args := make([]interface{}, len(columns)+1)
+	for {
+		line, n, _, readErr := readLine(br, buf[:0], dm.recordLimit)
+		buf = line
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if pos == 0 && trimmed[0] == '[' {
+				return fmt.Errorf("%s holds a JSON array; SQL indexes need newline-delimited JSON", idx.path)
+			}
+			values := make(map[string]interface{}, len(wanted))
+			if line, perr := dm.preprocessLine(line); perr == nil && extractFields(line, wanted, values) == nil {
+				args[0] = pos
+				for i, field := range idx.fields {
+					value, _ := resolvePath(values, field)
+					args[i+1] = sqlValue(value)
+				}
+				if _, err := insert.Exec(args...); err != nil {
+					return err
+				}
+				rows++
+			}
+		}
+		pos += int64(n)
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	stored, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (meta) VALUES (?)", metaTable), string(stored)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if dm.logger != nil {
+		dm.logger.Info("SQL index built", "source", idx.path, "fields", strings.Join(idx.fields, ","), "entries", rows, "duration", time.Since(started))
+	}
+	return nil
+}
+
+// offsets returns the sorted line offsets of the rows matching where
+func (idx *sqlIndex) offsets(where string, args []interface{}) ([]int64, error) {
+	rows, err := idx.db.Query(fmt.Sprintf("SELECT _offset FROM %s WHERE %s", quoteIdent(idx.table, SQLiteDialect), where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var offsets []int64
+	for rows.Next() {
+		var offset int64
+		if err := rows.Scan(&offset); err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, offset)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets, nil
+}
+
+// translate builds a WHERE clause from the conditions SQLite can evaluate
+// exactly like the filters do, returning "" when there are none. Date
+// conditions are left out when extra date layouts are configured, since
+// SQLite compares dates as text.
+func (idx *sqlIndex) translate(conditions []FilterCondition, extraDateLayouts bool) (string, []interface{}) {
+	indexed := make(map[string]bool, len(idx.fields))
+	for _, field := range idx.fields {
+		indexed[field] = true
+	}
+	var clauses []string
+	var args []interface{}
+	for _, c := range conditions {
+		if !indexed[c.Key] || c.Collation != BinaryCollation {
+			continue
+		}
+		switch c.ValueType {
+		case "int", "string", "bool":
+		case "date", "datetime":
+			if extraDateLayouts {
+				continue
+			}
+		default:
+			continue
+		}
+		column := quoteIdent(c.Key, SQLiteDialect)
+		switch c.Operator {
+		case ">", ">=", "<", "<=":
+			if c.ValueType == "bool" {
+				continue
+			}
+			clauses = append(clauses, column+" "+c.Operator+" ?")
+		case "==":
+			clauses = append(clauses, column+" = ?")
+		case "contains":
+			if c.ValueType != "string" {
+				continue
+			}
+			clauses = append(clauses, "instr("+column+", ?) > 0")
+		default:
+			continue
+		}
+		args = append(args, c.Value)
+	}
+	return strings.Join(clauses, " AND "), args
+}
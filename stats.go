@@ -0,0 +1,369 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// NumericStats summarizes the numeric values of a field
+type NumericStats struct {
+	Field   string  `json:"field"`
+	Count   int     `json:"count"`   // Records holding a number in the field
+	Missing int     `json:"missing"` // Records lacking the field or holding another type
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"` // Population standard deviation
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+	digest  *tdigest
+	m2      float64 // Sum of squared deviations from the running mean
+}
+
+// newNumericStats returns empty statistics for field
+func newNumericStats(field string) *NumericStats {
+	return &NumericStats{Field: field, digest: newTDigest(100)}
+}
+
+// observeValue adds v if it is a number and counts it as missing otherwise
+func (s *NumericStats) observeValue(v interface{}) {
+	if x, ok := numericValue(v); ok {
+		s.observe(x)
+	} else {
+		s.Missing++
+	}
+}
+
+// observe adds one number, using Welford's online update to keep the
+// variance numerically stable
+func (s *NumericStats) observe(x float64) {
+	s.Count++
+	delta := x - s.Mean
+	s.Mean += delta / float64(s.Count)
+	s.m2 += delta * (x - s.Mean)
+	if s.Count == 1 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 1 || x > s.Max {
+		s.Max = x
+	}
+	s.digest.add(x)
+}
+
+// finish derives the standard deviation and percentiles from the observed values
+func (s *NumericStats) finish() {
+	if s.Count == 0 {
+		return
+	}
+	s.StdDev = math.Sqrt(s.m2 / float64(s.Count))
+	s.P50 = s.Percentile(50)
+	s.P90 = s.Percentile(90)
+	s.P95 = s.Percentile(95)
+	s.P99 = s.Percentile(99)
+}
+
+// Percentile returns the approximate value below which p percent of the values fall
+func (s *NumericStats) Percentile(p float64) float64 {
+	if s.digest == nil {
+		return math.NaN()
+	}
+	return s.digest.quantile(p / 100)
+}
+
+// ValueCount is a value together with how often it occurs
+type ValueCount struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+	Error int         `json:"error,omitempty"` // Upper bound on the overcount when the value set was too large to count exactly
+}
+
+// numericValue returns v as a float64 if it is a number
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// Stats computes count, min, max, mean, standard deviation and approximate
+// percentiles of field over the records of filePath in one streaming pass.
+// Percentiles come from a t-digest, so memory stays constant.
+func (dm *DataManager) Stats(filePath, field string) (*NumericStats, error) {
+	reader, closer, err := dm.openRecords(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	stats := newNumericStats(field)
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		stats.observeValue(record[field])
+	}
+	stats.finish()
+	return stats, nil
+}
+
+// TopK returns the k most frequent values of field in filePath, most
+// frequent first, in one streaming pass. Counts are exact while the field has
+// at most max(100*k, 10000) distinct values; beyond that the Space-Saving
+// algorithm bounds memory and ValueCount.Error bounds each overcount.
+func (dm *DataManager) TopK(filePath, field string, k int) ([]ValueCount, error) {
+	if k <= 0 {
+		return nil, errors.New("TopK requires k > 0")
+	}
+	reader, closer, err := dm.openRecords(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	capacity := 100 * k
+	if capacity < 10000 {
+		capacity = 10000
+	}
+	counters := newSpaceSaving(capacity)
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		value, exists := record[field]
+		if !exists || value == nil {
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		counters.add(string(encoded))
+	}
+	return counters.top(k)
+}
+
+// spaceSaving approximates the most frequent items with a fixed number of
+// counters kept in a min-heap, so the least frequent one is evicted cheaply
+type spaceSaving struct {
+	capacity int
+	items    map[string]*ssCounter
+	heap     ssHeap
+}
+
+// ssCounter counts one item; err is the count it inherited on eviction
+type ssCounter struct {
+	item  string
+	count int
+	err   int
+	index int
+}
+
+// ssHeap orders counters by ascending count
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// newSpaceSaving returns a summary tracking at most capacity items
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, items: make(map[string]*ssCounter)}
+}
+
+// add counts one occurrence of item, replacing the least frequent item when full
+func (s *spaceSaving) add(item string) {
+	if c, ok := s.items[item]; ok {
+		c.count++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+	if len(s.items) < s.capacity {
+		c := &ssCounter{item: item, count: 1}
+		s.items[item] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+	c := s.heap[0]
+	delete(s.items, c.item)
+	c.item, c.err = item, c.count
+	c.count++
+	s.items[item] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// top returns the k highest counts with their values decoded
+func (s *spaceSaving) top(k int) ([]ValueCount, error) {
+	counters := append([]*ssCounter{}, s.heap...)
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].count != counters[j].count {
+			return counters[i].count > counters[j].count
+		}
+		return counters[i].item < counters[j].item
+	})
+	if len(counters) > k {
+		counters = counters[:k]
+	}
+
+	result := make([]ValueCount, len(counters))
+	for i, c := range counters {
+		result[i] = ValueCount{Count: c.count, Error: c.err}
+		if err := json.Unmarshal([]byte(c.item), &result[i].Value); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// centroid is a cluster of values in a t-digest
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tdigest is a merging t-digest (Dunning & Ertl) estimating quantiles of a
+// stream in constant memory, most accurately near the tails
+type tdigest struct {
+	compression float64
+	centroids   []centroid // Merged clusters, sorted by mean
+	buffer      []centroid // Values added since the last merge
+	count       float64
+	min, max    float64
+}
+
+// newTDigest returns an empty digest; higher compression trades memory for accuracy
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{compression: compression}
+}
+
+// add records one value
+func (t *tdigest) add(x float64) {
+	if t.count == 0 || x < t.min {
+		t.min = x
+	}
+	if t.count == 0 || x > t.max {
+		t.max = x
+	}
+	t.count++
+	t.buffer = append(t.buffer, centroid{mean: x, weight: 1})
+	if len(t.buffer) >= int(10*t.compression) {
+		t.compress()
+	}
+}
+
+// scale maps a quantile to the k1 scale, which keeps clusters small at the tails
+func (t *tdigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// inverseScale maps a k1 scale value back to a quantile
+func (t *tdigest) inverseScale(k float64) float64 {
+	if k >= t.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/t.compression) + 1) / 2
+}
+
+// compress merges the buffered values into the centroids
+func (t *tdigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	current := all[0]
+	before := 0.0
+	limit := t.count * t.inverseScale(t.scale(0)+1)
+	for _, c := range all[1:] {
+		if before+current.weight+c.weight <= limit {
+			current.weight += c.weight
+			current.mean += (c.mean - current.mean) * c.weight / current.weight
+			continue
+		}
+		before += current.weight
+		merged = append(merged, current)
+		current = c
+		limit = t.count * t.inverseScale(t.scale(before/t.count)+1)
+	}
+	t.centroids = append(merged, current)
+	t.buffer = t.buffer[:0]
+}
+
+// quantile estimates the value at quantile q (0..1) by interpolating
+// between centroid centers
+func (t *tdigest) quantile(q float64) float64 {
+	t.compress()
+	if t.count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	index := q * t.count
+	first := t.centroids[0]
+	if index < first.weight/2 {
+		return t.min + (first.mean-t.min)*index/(first.weight/2)
+	}
+	cumulative := first.weight / 2 // Weight up to the center of centroid i
+	for i := 0; i < len(t.centroids)-1; i++ {
+		left, right := t.centroids[i], t.centroids[i+1]
+		gap := (left.weight + right.weight) / 2
+		if index < cumulative+gap {
+			return left.mean + (right.mean-left.mean)*(index-cumulative)/gap
+		}
+		cumulative += gap
+	}
+	last := t.centroids[len(t.centroids)-1]
+	if last.weight/2 == 0 {
+		return t.max
+	}
+	return last.mean + (t.max-last.mean)*(index-cumulative)/(last.weight/2)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StorageEngine persists records by key behind the Split-mode reads and
+// writes of a DataManager (see OpenStorage). The default engine keeps them
+// in an NDJSON file; other engines, such as BoltDB, Badger or segment files,
+// implement the same interface and plug in without changes to queries.
+type StorageEngine interface {
+	// Open attaches the engine to location, keying records by keyName
+	Open(location string, keyName string) error
+	// ScanRange calls fn with every record whose key is in [start, end), in
+	// key order; an empty end leaves the range open. An error from fn stops
+	// the scan and is returned.
+	ScanRange(start, end string, fn func(key string, record map[string]interface{}) error) error
+	// Get returns the record stored under key, or nil when there is none
+	Get(key string) (map[string]interface{}, error)
+	// Put stores record under key, replacing any previous one
+	Put(key string, record map[string]interface{}) error
+	// Delete removes the record under key, reporting whether it existed
+	Delete(key string) (bool, error)
+	// Snapshot writes a consistent copy of every record to w as NDJSON
+	Snapshot(w io.Writer) error
+	// Close flushes pending changes and releases the engine
+	Close() error
+}
+
+// OpenStorage opens engine at location, keyed by keyName, and routes Get,
+// GetMany, Exists, Put, Insert, Update, Delete, Query and SaveSnapshot in
+// Split mode through it. A nil engine selects the NDJSON file engine, which
+// indexes the line of every key of the file and appends puts to it, the last
+// line of a key winning. Deletes reach the file when the engine is closed,
+// which rewrites it without deleted and replaced records, so call
+// CloseStorage when done.
+func (dm *DataManager) OpenStorage(engine StorageEngine, location string, keyName string) error {
+	if dm.mode != SplitMode {
+		return ErrInvalidMode
+	}
+	if engine == nil {
+		engine = &ndjsonEngine{dm: dm}
+	}
+	if err := engine.Open(location, keyName); err != nil {
+		return err
+	}
+
+	dm.mu.Lock()
+	previous := dm.storage
+	dm.storage = engine
+	dm.keyName = keyName
+	dm.mu.Unlock()
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// CloseStorage closes the engine opened by OpenStorage
+func (dm *DataManager) CloseStorage() error {
+	dm.mu.Lock()
+	engine := dm.storage
+	dm.storage = nil
+	dm.mu.Unlock()
+	if engine == nil {
+		return nil
+	}
+	return engine.Close()
+}
+
+// storageEngine returns the engine opened by OpenStorage, if any
+func (dm *DataManager) storageEngine() StorageEngine {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.storage
+}
+
+// ScanRange returns the records of the storage engine whose key is in
+// [start, end), in key order, that match all conditions; an empty end
+// leaves the range open
+func (dm *DataManager) ScanRange(start, end string, conditions []FilterCondition) (_ []map[string]interface{}, err error) {
+	engine := dm.storageEngine()
+	if engine == nil || dm.mode != SplitMode {
+		return nil, ErrInvalidMode
+	}
+
+	defer dm.timeOperation("query")()
+	var results []map[string]interface{}
+	err = engine.ScanRange(start, end, func(_ string, record map[string]interface{}) error {
+		if dm.matchConditions(record, conditions) {
+			results = append(results, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// writeStorage applies a Split-mode write to the storage engine after check
+// approves it, given the record it replaces
+func (dm *DataManager) writeStorage(engine StorageEngine, record map[string]interface{}, check func(old map[string]interface{}, exists bool) error) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.assignSurrogateKey(record, dm.keyName, nil)
+	key, ok := recordKey(record, dm.keyName)
+	if !ok {
+		return fmt.Errorf("Record is missing key field %q", dm.keyName)
+	}
+	old, err := engine.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := check(old, old != nil); err != nil {
+		return err
+	}
+	if err := dm.checkSchema(record); err != nil {
+		return err
+	}
+	return engine.Put(key, record)
+}
+
+// deleteStorage removes a record from the storage engine if check, when
+// set, approves it
+func (dm *DataManager) deleteStorage(engine StorageEngine, key string, check func(old map[string]interface{}) error) (bool, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if check != nil {
+		old, err := engine.Get(key)
+		if err != nil || old == nil {
+			return false, err
+		}
+		if err := check(old); err != nil {
+			return false, err
+		}
+	}
+	return engine.Delete(key)
+}
+
+// storageGetMany returns the records engine stores under keys
+func storageGetMany(engine StorageEngine, keys []string) (map[string]map[string]interface{}, error) {
+	records := make(map[string]map[string]interface{}, len(keys))
+	for _, key := range keys {
+		record, err := engine.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			records[key] = record
+		}
+	}
+	return records, nil
+}
+
+// saveStorageSnapshot writes the engine's records to path atomically
+func (dm *DataManager) saveStorageSnapshot(path string, engine StorageEngine) error {
+	return replaceFile(path, dm.encryption, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if !strings.HasSuffix(strings.ToLower(path), ".gz") {
+			if err := engine.Snapshot(bw); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		gz := gzip.NewWriter(bw)
+		if err := engine.Snapshot(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
+
+// Keys whose lines ndjsonEngine.ScanRange reads at a time
+const storageScanBatch = 1024
+
+// ndjsonEngine is the default StorageEngine: records live in an NDJSON file
+// found through a key index, puts are appended to it, and the file is
+// rewritten without stale lines when closed
+type ndjsonEngine struct {
+	dm    *DataManager
+	mu    sync.RWMutex
+	index *keyOffsetIndex // Line of the latest record of every key
+	file  *os.File        // The file, opened for appending
+	stale int             // Lines no longer referenced by the index
+}
+
+func (e *ndjsonEngine) Open(location string, keyName string) error {
+	file, err := os.OpenFile(location, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// Appended records must start on a line of their own
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	index, err := e.dm.buildKeyOffsets(location, keyName)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.index, e.file, e.stale = index, file, 0
+	return nil
+}
+
+func (e *ndjsonEngine) Get(key string) (map[string]interface{}, error) {
+	e.mu.RLock()
+	offset, ok := e.index.offsets[key]
+	path := e.index.path
+	e.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	var record map[string]interface{}
+	err := e.dm.readLinesAt(path, []int64{offset}, func(_ int, r map[string]interface{}, _ int) error {
+		record = r
+		return nil
+	})
+	return record, err
+}
+
+func (e *ndjsonEngine) Put(key string, record map[string]interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if _, exists := e.index.offsets[key]; exists {
+		e.stale++
+	}
+	e.index.offsets[key] = e.index.size
+	e.index.size += int64(len(line) + 1)
+	return nil
+}
+
+func (e *ndjsonEngine) Delete(key string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.index.offsets[key]; !exists {
+		return false, nil
+	}
+	delete(e.index.offsets, key)
+	e.stale++
+	return true, nil
+}
+
+func (e *ndjsonEngine) ScanRange(start, end string, fn func(key string, record map[string]interface{}) error) error {
+	type entry struct {
+		key    string
+		offset int64
+	}
+	e.mu.RLock()
+	path := e.index.path
+	var entries []entry
+	for key, offset := range e.index.offsets {
+		if key >= start && (end == "" || key < end) {
+			entries = append(entries, entry{key, offset})
+		}
+	}
+	e.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	// Read each batch of keys in file order, then hand it out in key order
+	for len(entries) > 0 {
+		batch := entries[:min(storageScanBatch, len(entries))]
+		entries = entries[len(batch):]
+		order := make([]int, len(batch))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool { return batch[order[i]].offset < batch[order[j]].offset })
+		offsets := make([]int64, len(batch))
+		for i, o := range order {
+			offsets[i] = batch[o].offset
+		}
+		records := make([]map[string]interface{}, len(batch))
+		err := e.dm.readLinesAt(path, offsets, func(i int, record map[string]interface{}, _ int) error {
+			records[order[i]] = record
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			if err := fn(batch[i].key, record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *ndjsonEngine) Snapshot(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return e.ScanRange("", "", func(_ string, record map[string]interface{}) error {
+		return encoder.Encode(record)
+	})
+}
+
+func (e *ndjsonEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return errors.New("Storage engine is not open")
+	}
+	err := e.file.Close()
+	e.file = nil
+	if err == nil && e.stale > 0 {
+		err = e.compactLocked()
+	}
+	return err
+}
+
+// compactLocked rewrites the file with only the latest line of every live
+// key, in their original order; the caller holds e.mu
+func (e *ndjsonEngine) compactLocked() error {
+	offsets := make([]int64, 0, len(e.index.offsets))
+	for _, offset := range e.index.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	f, err := os.Open(e.index.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := e.dm.chunkReader(f)
+	defer e.dm.releaseChunkReader(br)
+	return replaceFile(e.index.path, nil, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		var buf []byte
+		for _, offset := range offsets {
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			br.Reset(f)
+			line, _, _, err := readLine(br, buf[:0], 0)
+			buf = line
+			if err != nil && err != io.EOF {
+				return err
+			}
+			bw.Write(line)
+			bw.WriteByte('\n')
+		}
+		return bw.Flush()
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Put inserts or replaces a record in memory, or in the storage engine in
+// Split mode (see OpenStorage), keyed by the key field of the loaded data
+func (dm *DataManager) Put(record map[string]interface{}) error {
+	return dm.write(record, func(map[string]interface{}, bool) error { return nil })
+}
+
+// Insert adds a record, failing if a record with the same key already exists
+func (dm *DataManager) Insert(record map[string]interface{}) error {
+	return dm.write(record, func(_ map[string]interface{}, exists bool) error {
+		if exists {
+			key, _ := recordKey(record, dm.keyName)
+			return &RecordError{Key: key, Err: ErrRecordExists}
+		}
+		return nil
+	})
+}
+
+// Update replaces an existing record, failing if no record has its key
+func (dm *DataManager) Update(record map[string]interface{}) error {
+	return dm.write(record, func(_ map[string]interface{}, exists bool) error {
+		if !exists {
+			key, _ := recordKey(record, dm.keyName)
+			return &RecordError{Key: key, Err: ErrRecordNotFound}
+		}
+		return nil
+	})
+}
+
+// write logs and applies a record write after check approves it, given the
+// record it replaces
+func (dm *DataManager) write(record map[string]interface{}, check func(old map[string]interface{}, exists bool) error) error {
+	if engine := dm.storageEngine(); engine != nil && dm.mode == SplitMode {
+		return dm.writeStorage(engine, record, check)
+	}
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.keyName == "" {
+		return fmt.Errorf("%w; load data before writing", ErrNoKeyField)
+	}
+	dm.assignSurrogateKey(record, dm.keyName, nil)
+	key, ok := recordKey(record, dm.keyName)
+	if !ok {
+		return fmt.Errorf("Record is missing key field %q", dm.keyName)
+	}
+	old, exists := dm.current.get(key)
+	if err := check(old, exists); err != nil {
+		return err
+	}
+	if err := dm.checkSchema(record); err != nil {
+		return err
+	}
+
+	if err := dm.logWrite(walEntry{Op: walPut, Key: key, Record: record}); err != nil {
+		return err
+	}
+	dm.putLocked(key, record)
+	return nil
+}
+
+// putLocked stores a record and maintains the indexes; the caller holds dm.mu
+func (dm *DataManager) putLocked(key string, record map[string]interface{}) {
+	old, _ := dm.writable().put(key, record)
+	dm.recordVersionLocked(key, old, record)
+	dm.notifyLocked(key, old, record)
+}
+
+// Delete removes the record with key from memory, or from the storage
+// engine in Split mode, reporting whether it existed
+func (dm *DataManager) Delete(key string) (bool, error) {
+	return dm.deleteIf(key, nil)
+}
+
+// deleteIf removes the record with key if check, when set, approves it
+func (dm *DataManager) deleteIf(key string, check func(old map[string]interface{}) error) (bool, error) {
+	if engine := dm.storageEngine(); engine != nil && dm.mode == SplitMode {
+		return dm.deleteStorage(engine, key, check)
+	}
+	if dm.mode != InMemoryMode {
+		return false, ErrInvalidMode
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	old, exists := dm.current.get(key)
+	if !exists {
+		return false, nil
+	}
+	if check != nil {
+		if err := check(old); err != nil {
+			return false, err
+		}
+	}
+	if err := dm.logWrite(walEntry{Op: walDelete, Key: key}); err != nil {
+		return false, err
+	}
+	dm.deleteLocked(key)
+	return true, nil
+}
+
+// deleteLocked removes a record and its index entries; the caller holds dm.mu
+func (dm *DataManager) deleteLocked(key string) {
+	if _, exists := dm.current.get(key); !exists {
+		return
+	}
+	old, _ := dm.writable().remove(key)
+	dm.recordVersionLocked(key, old, nil)
+	dm.notifyLocked(key, old, nil)
+}
+
+// lookup returns the in-memory record stored under key
+func (dm *DataManager) lookup(key string) (map[string]interface{}, bool) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	record, exists := dm.current.get(key)
+	if exists && !dm.expiry.live(record, time.Now()) {
+		return nil, false
+	}
+	return record, exists
+}
+
+// SetKeyField sets the key field used by Put when no data has been loaded yet
+func (dm *DataManager) SetKeyField(keyName string) {
+	dm.mu.Lock()
+	dm.keyName = keyName
+	dm.mu.Unlock()
+}
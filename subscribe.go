@@ -0,0 +1,145 @@
+package main
+
+import "sync"
+
+// ChangeType describes how a write changed a subscription's matching set
+type ChangeType int
+
+const (
+	RecordAdded   ChangeType = iota // A record started matching (inserted, or updated into the set)
+	RecordUpdated                   // A matching record was replaced and still matches
+	RecordRemoved                   // A matching record was deleted or updated out of the set
+)
+
+// String returns the name of the change type
+func (t ChangeType) String() string {
+	switch t {
+	case RecordAdded:
+		return "added"
+	case RecordUpdated:
+		return "updated"
+	case RecordRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeEvent reports a change to the records matching a subscription
+type ChangeEvent struct {
+	Type     ChangeType
+	Key      string
+	Record   map[string]interface{} // New version (nil when deleted)
+	Previous map[string]interface{} // Old version (nil when inserted)
+}
+
+// Subscription delivers change events for the records matching its conditions
+type Subscription struct {
+	C <-chan ChangeEvent // Events in commit order; closed by Unsubscribe
+
+	dm         *DataManager
+	conditions []FilterCondition
+	out        chan ChangeEvent
+	mu         sync.Mutex
+	queue      []ChangeEvent
+	wake       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+// Subscribe registers conditions and returns a subscription that receives an
+// event whenever a write, transaction or watched-file append adds a record to,
+// changes a record in, or removes a record from the matching set. Events are
+// queued, so a slow consumer never blocks writers. Reloads do not emit events.
+func (dm *DataManager) Subscribe(conditions []FilterCondition) *Subscription {
+	sub := &Subscription{
+		dm:         dm,
+		conditions: conditions,
+		out:        make(chan ChangeEvent),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	sub.C = sub.out
+	go sub.deliver()
+
+	dm.mu.Lock()
+	if dm.subscribers == nil {
+		dm.subscribers = make(map[*Subscription]struct{})
+	}
+	dm.subscribers[sub] = struct{}{}
+	dm.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe stops delivery and closes C; pending events are discarded
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.dm.mu.Lock()
+		delete(s.dm.subscribers, s)
+		s.dm.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// deliver forwards queued events to C until Unsubscribe
+func (s *Subscription) deliver() {
+	defer close(s.out)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+
+		s.mu.Lock()
+		pending := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, event := range pending {
+			select {
+			case s.out <- event:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// enqueue adds an event without blocking
+func (s *Subscription) enqueue(event ChangeEvent) {
+	s.mu.Lock()
+	s.queue = append(s.queue, event)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLocked reports a change of key from old to record (either may be nil)
+// to every subscription whose matching set it affects, to the materialized
+// views and to the statistics catalog; the caller holds dm.mu
+func (dm *DataManager) notifyLocked(key string, old, record map[string]interface{}) {
+	dm.updateViewsLocked(key, old, record)
+	if stats := dm.current.stats; stats != nil {
+		stats.change(old, record)
+	}
+	for sub := range dm.subscribers {
+		wasMatch := old != nil && dm.matchConditions(old, sub.conditions)
+		isMatch := record != nil && dm.matchConditions(record, sub.conditions)
+
+		event := ChangeEvent{Key: key, Record: record, Previous: old}
+		switch {
+		case !wasMatch && isMatch:
+			event.Type = RecordAdded
+		case wasMatch && isMatch:
+			event.Type = RecordUpdated
+		case wasMatch && !isMatch:
+			event.Type = RecordRemoved
+		default:
+			continue
+		}
+		sub.enqueue(event)
+	}
+}
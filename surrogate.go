@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// SurrogateKeyField holds the keys generated for datasets without a natural key
+const SurrogateKeyField = "_id"
+
+// SurrogateKeys selects how keys are generated for records without one
+type SurrogateKeys string
+
+const (
+	NoSurrogateKeys SurrogateKeys = ""     // Records need a natural key
+	LineNumberKeys  SurrogateKeys = "line" // The line of the record: "3", or "events.json:3" in multi-file loads
+	UUIDKeys        SurrogateKeys = "uuid" // A random version 4 UUID
+)
+
+// WithSurrogateKeys generates keys for records without one (see SetSurrogateKeys)
+func WithSurrogateKeys(kind SurrogateKeys) Option {
+	return func(dm *DataManager) { dm.surrogate = kind }
+}
+
+// SetSurrogateKeys keys datasets without a natural key by generated values,
+// stored in the SurrogateKeyField ("_id") of each record, so Get, Update,
+// Delete and indexes work on them. Loads given an empty key name, or "_id",
+// assign them to the records that do not hold one yet, and so do Put,
+// Insert, bulk writes, transactions and watched files while the data is
+// keyed by "_id"; writes set the field on the record passed in.
+// LineNumberKeys uses the line of the record in its input (the record's
+// number in JSON arrays and binary formats), so reloading an unchanged file
+// yields the same keys; written records continue after the highest line.
+// UUIDKeys generates random UUIDs. NoSurrogateKeys turns generation off.
+func (dm *DataManager) SetSurrogateKeys(kind SurrogateKeys) error {
+	if err := kind.validate(); err != nil {
+		return err
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.surrogate = kind
+	if kind != NoSurrogateKeys && dm.keyName == "" {
+		dm.keyName = SurrogateKeyField
+	}
+	return nil
+}
+
+// validate checks that kind is known
+func (kind SurrogateKeys) validate() error {
+	switch kind {
+	case NoSurrogateKeys, LineNumberKeys, UUIDKeys:
+		return nil
+	}
+	return fmt.Errorf("Unknown surrogate key kind %q", kind)
+}
+
+// surrogateKeyName returns the key name a load uses for keyName
+func (dm *DataManager) surrogateKeyName(keyName string) string {
+	if keyName == "" && dm.surrogate != NoSurrogateKeys {
+		return SurrogateKeyField
+	}
+	return keyName
+}
+
+// assignSurrogateKey stores a generated key in record when the data is
+// keyed by SurrogateKeyField and record holds none; position, when set,
+// locates the record in the input being loaded
+func (dm *DataManager) assignSurrogateKey(record map[string]interface{}, keyName string, position func() RecordPosition) {
+	if dm.surrogate == NoSurrogateKeys || keyName != SurrogateKeyField {
+		return
+	}
+	if _, exists := record[SurrogateKeyField]; exists {
+		return
+	}
+	if dm.surrogate == UUIDKeys {
+		record[SurrogateKeyField] = newUUID()
+		return
+	}
+	if position == nil {
+		record[SurrogateKeyField] = strconv.FormatInt(atomic.AddInt64(&dm.keySequence, 1), 10)
+		return
+	}
+	p := position()
+	line := p.Line
+	if line == 0 {
+		line = p.Record
+	}
+	for {
+		highest := atomic.LoadInt64(&dm.keySequence)
+		if int64(line) <= highest || atomic.CompareAndSwapInt64(&dm.keySequence, highest, int64(line)) {
+			break
+		}
+	}
+	key := strconv.Itoa(line)
+	if p.File != "" {
+		key = p.File + ":" + key
+	}
+	record[SurrogateKeyField] = key
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
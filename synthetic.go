@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyntheticOptions shapes the records written by GenerateSynthetic
+type SyntheticOptions struct {
+	Records int                 // Records to write (default 1000)
+	Seed    int64               // Seed of the random values; the same seed writes the same data
+	Fakes   map[string]FakeKind // Fake kinds of string fields by name, overriding those guessed from field names
+}
+
+// categoricalShare is the share of a field's values its top values must
+// cover for GenerateSynthetic to draw from them instead of generating values
+const categoricalShare = 0.9
+
+// syntheticField is a profiled field prepared for generation
+type syntheticField struct {
+	*FieldProfile
+	parent, name string   // Enclosing object ("" at the top level) and field name within it
+	fake         FakeKind // Fake kind of strings (FakeText generates random words)
+	weights      []int    // Cumulative counts of TopValues when drawn from them
+	start, end   time.Time
+	layout       string // Layout of generated dates and datetimes
+}
+
+// GenerateSynthetic writes opts.Records synthetic NDJSON records shaped
+// like the dataset profile describes, such as one made by Profile or loaded
+// from its JSON output. Each field appears as often as it was filled and
+// holds values of the types observed: numbers follow the profiled
+// percentiles, string lengths and array sizes the profiled lengths, dates
+// fall within the profiled range, and fields whose top values cover nine
+// tenths of their values, such as a country or a status, draw from them in
+// the same proportions. Strings of fields named like personal data, such as
+// "email" or "last_name" (see GuessFakeKind), get realistic fakes rather than
+// profiled values, so no production value leaks into the fixture. Nested
+// objects are generated from their dotted fields. Use SchemaProfile to
+// generate from an inferred Schema instead.
+func GenerateSynthetic(w io.Writer, profile *DataProfile, opts SyntheticOptions) error {
+	if opts.Records <= 0 {
+		opts.Records = 1000
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	fields := make([]*syntheticField, 0, len(profile.Fields))
+	for _, f := range profile.Fields {
+		fields = append(fields, prepareSyntheticField(f, opts.Fakes))
+	}
+	// Objects come before their fields
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	for i := 0; i < opts.Records; i++ {
+		record := make(map[string]interface{})
+		objects := map[string]map[string]interface{}{"": record}
+		for _, f := range fields {
+			parent, ok := objects[f.parent]
+			if !ok {
+				continue // The enclosing object is missing or null
+			}
+			if profile.Records > 0 && rng.Float64() >= f.FillRate {
+				if absent := f.Nulls + f.Missing; absent > 0 && rng.Intn(absent) < f.Nulls {
+					parent[f.name] = nil
+				}
+				continue
+			}
+			value := f.generate(rng)
+			if object, ok := value.(map[string]interface{}); ok {
+				objects[f.Field] = object
+			}
+			parent[f.name] = value
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// SchemaProfile returns a profile holding what schema knows of its fields,
+// their types and how often they were filled, for GenerateSynthetic
+func SchemaProfile(schema *Schema) *DataProfile {
+	profile := &DataProfile{Records: schema.Sampled, Generated: time.Now()}
+	for name, fs := range schema.Fields {
+		f := &FieldProfile{Field: name, Type: fs.Type, Types: fs.Types, Present: fs.Present, Nulls: fs.Nulls, Distinct: fs.Cardinality}
+		if schema.Sampled > 0 {
+			f.FillRate = float64(fs.Present) / float64(schema.Sampled)
+		}
+		profile.Fields = append(profile.Fields, f)
+	}
+	sort.Slice(profile.Fields, func(i, j int) bool { return profile.Fields[i].Field < profile.Fields[j].Field })
+	return profile
+}
+
+// prepareSyntheticField works out how to generate the values of f
+func prepareSyntheticField(f *FieldProfile, fakes map[string]FakeKind) *syntheticField {
+	s := &syntheticField{FieldProfile: f, name: f.Field}
+	if i := strings.LastIndex(f.Field, "."); i >= 0 {
+		s.parent, s.name = f.Field[:i], f.Field[i+1:]
+	}
+	s.fake = fakes[f.Field]
+	if s.fake == "" {
+		s.fake = GuessFakeKind(f.Field)
+	}
+
+	covered := 0
+	for _, top := range f.TopValues {
+		covered += top.Count
+		s.weights = append(s.weights, covered)
+	}
+	if covered == 0 || float64(covered) < categoricalShare*float64(f.Present) {
+		s.weights = nil
+	}
+
+	s.start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.end = s.start.AddDate(5, 0, 0)
+	s.layout = "2006-01-02"
+	if f.Types["datetime"] > f.Types["date"] {
+		s.layout = "2006-01-02 15:04:05"
+	}
+	if f.Dates != nil {
+		start, okStart := exprTime(f.Dates.Earliest)
+		end, okEnd := exprTime(f.Dates.Latest)
+		if okStart && okEnd {
+			s.start, s.end = start, end
+		}
+		for _, layout := range exprTimeLayouts {
+			if _, err := time.Parse(layout, f.Dates.Earliest); err == nil {
+				s.layout = layout
+				break
+			}
+		}
+	}
+	return s
+}
+
+// generate returns a value for the field
+func (f *syntheticField) generate(rng *rand.Rand) interface{} {
+	kind := f.Type
+	if kind == "mixed" || kind == "" {
+		kind = pickType(rng, f.Types)
+	}
+	if kind == "string" && f.fake != FakeText {
+		return fakeValue(rng, f.fake, "")
+	}
+	if f.weights != nil && kind != "object" && kind != "array" {
+		n := rng.Intn(f.weights[len(f.weights)-1])
+		i := sort.SearchInts(f.weights, n+1)
+		return f.TopValues[i].Value
+	}
+
+	switch kind {
+	case "int":
+		return int64(math.Round(sampleNumber(rng, f.Numbers, 0, 1000)))
+	case "float":
+		return math.Round(sampleNumber(rng, f.Numbers, 0, 1000)*100) / 100
+	case "bool":
+		return rng.Intn(2) == 0
+	case "date", "datetime":
+		span := f.end.Sub(f.start)
+		t := f.start
+		if span > 0 {
+			t = t.Add(time.Duration(rng.Int63n(int64(span) + 1)))
+		}
+		if kind == "date" {
+			return t.Format("2006-01-02")
+		}
+		return t.Format(f.layout)
+	case "array":
+		items := make([]interface{}, int(math.Round(sampleNumber(rng, f.Items, 0, 5))))
+		for i := range items {
+			items[i] = benchText(rng, 3+rng.Intn(6))
+		}
+		return items
+	case "object":
+		return make(map[string]interface{})
+	case "string":
+		return benchText(rng, max(int(math.Round(sampleNumber(rng, f.Lengths, 4, 16))), 1))
+	}
+	return nil
+}
+
+// pickType draws a type in proportion to how often it was observed
+func pickType(rng *rand.Rand, types map[string]int) string {
+	kinds := make([]string, 0, len(types))
+	total := 0
+	for kind, n := range types {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(kinds) // The same seed picks the same types
+	n := rng.Intn(total)
+	for _, kind := range kinds {
+		if n -= types[kind]; n < 0 {
+			return kind
+		}
+	}
+	return kinds[len(kinds)-1]
+}
+
+// sampleNumber draws a number following the percentiles of stats, linearly
+// between them, or uniformly in [low, high] without statistics
+func sampleNumber(rng *rand.Rand, stats *NumericStats, low, high float64) float64 {
+	u := rng.Float64()
+	if stats == nil || stats.Count == 0 {
+		return low + u*(high-low)
+	}
+	points := [...]struct{ q, v float64 }{
+		{0, stats.Min}, {0.5, stats.P50}, {0.9, stats.P90}, {0.95, stats.P95}, {0.99, stats.P99}, {1, stats.Max},
+	}
+	for i := 1; i < len(points); i++ {
+		if u <= points[i].q {
+			lo, hi := points[i-1], points[i]
+			return lo.v + (u-lo.q)/(hi.q-lo.q)*(hi.v-lo.v)
+		}
+	}
+	return stats.Max
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ThrottleOptions limits the throughput of loads and scans. Zero fields are
+// unlimited.
+type ThrottleOptions struct {
+	BytesPerSecond   int64 // Record bytes read per second
+	RecordsPerSecond int64 // Records read per second
+	BurstBytes       int64 // Bytes that may be read at once after an idle period (default: one second's worth)
+	BurstRecords     int64 // Records that may be read at once after an idle period (default: one second's worth)
+}
+
+// throttle paces loads and scans with a token bucket per limit, shared by
+// every goroutine of a parallel scan
+type throttle struct {
+	mu      sync.Mutex
+	bytes   tokenBucket
+	records tokenBucket
+}
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// SetThrottle caps how fast loads, Split-mode scans, counts and imports read
+// records, so background jobs leave disk and network capacity to
+// latency-sensitive work. Reading pauses whenever a limit is reached, and the
+// parallel workers of a scan share the limits. Call it before starting the
+// operations it should apply to; ThrottleOptions{} removes the limits.
+func (dm *DataManager) SetThrottle(opts ThrottleOptions) {
+	if opts.BytesPerSecond <= 0 && opts.RecordsPerSecond <= 0 {
+		dm.throttle = nil
+		return
+	}
+	now := time.Now()
+	dm.throttle = &throttle{
+		bytes:   newTokenBucket(opts.BytesPerSecond, opts.BurstBytes, now),
+		records: newTokenBucket(opts.RecordsPerSecond, opts.BurstRecords, now),
+	}
+}
+
+// WithThrottle limits the throughput of loads and scans (see SetThrottle)
+func WithThrottle(opts ThrottleOptions) Option {
+	return func(dm *DataManager) { dm.SetThrottle(opts) }
+}
+
+// newTokenBucket returns a full bucket; a rate of 0 or less never limits
+func newTokenBucket(rate, burst int64, now time.Time) tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// the caller must wait for the debt to be repaid
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until a record of n bytes fits within the limits
+func (t *throttle) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	delay := max(t.bytes.reserve(float64(n), now), t.records.reserve(1, now))
+	t.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ExpiryOptions configures record expiration
+type ExpiryOptions struct {
+	Field         string        // Field holding each record's expiry time ("" uses "_expires_at")
+	SweepInterval time.Duration // Evict expired records in the background this often (0 disables)
+}
+
+// defaultExpiryField is the expiry field used when ExpiryOptions.Field is empty
+const defaultExpiryField = "_expires_at"
+
+// expiryState is the active expiration configuration
+type expiryState struct {
+	field string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// EnableExpiry makes records expire at the time held in opts.Field: an
+// RFC 3339 or "2006-01-02 15:04:05" (UTC) string, or a number of seconds
+// since the Unix epoch. Records without a valid expiry never expire. Expired
+// records are never returned by Query, Search or key lookups, and are evicted
+// from memory and indexes by Sweep or the background sweeper.
+func (dm *DataManager) EnableExpiry(opts ExpiryOptions) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if opts.Field == "" {
+		opts.Field = defaultExpiryField
+	}
+
+	exp := &expiryState{field: opts.Field}
+	dm.mu.Lock()
+	if dm.expiry != nil {
+		dm.mu.Unlock()
+		return errors.New("Expiry is already enabled")
+	}
+	dm.expiry = exp
+	dm.mu.Unlock()
+
+	if opts.SweepInterval > 0 {
+		exp.stop = make(chan struct{})
+		exp.done = make(chan struct{})
+		go dm.sweepPeriodically(exp, opts.SweepInterval)
+	}
+	return nil
+}
+
+// DisableExpiry stops the background sweeper; records no longer expire
+func (dm *DataManager) DisableExpiry() {
+	dm.mu.Lock()
+	exp := dm.expiry
+	dm.expiry = nil
+	dm.mu.Unlock()
+	if exp != nil && exp.stop != nil {
+		close(exp.stop)
+		<-exp.done
+	}
+}
+
+// PutWithTTL upserts a copy of record that expires after ttl, enabling
+// expiry with default options if needed
+func (dm *DataManager) PutWithTTL(record map[string]interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("Invalid TTL %s", ttl)
+	}
+	exp := dm.expiryState()
+	if exp == nil {
+		// A concurrent EnableExpiry may win; either way expiry ends up enabled
+		dm.EnableExpiry(ExpiryOptions{})
+		if exp = dm.expiryState(); exp == nil {
+			return ErrInvalidMode
+		}
+	}
+
+	stamped := make(map[string]interface{}, len(record)+1)
+	for field, value := range record {
+		stamped[field] = value
+	}
+	stamped[exp.field] = time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+	return dm.Put(stamped)
+}
+
+// Sweep evicts every expired record from memory and indexes, returning how
+// many were removed. Evictions are logged like deletes when the WAL is enabled.
+func (dm *DataManager) Sweep() (int, error) {
+	exp := dm.expiryState()
+	if exp == nil {
+		return 0, nil
+	}
+
+	// Find candidates without the lock, then recheck them against the current version
+	now := time.Now()
+	var keys []string
+	for key, record := range dm.snapshot().all() {
+		if exp.expired(record, now) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	evicted := 0
+	for _, key := range keys {
+		record, exists := dm.current.get(key)
+		if !exists || !exp.expired(record, now) {
+			continue
+		}
+		if err := dm.logWrite(walEntry{Op: walDelete, Key: key}); err != nil {
+			return evicted, err
+		}
+		dm.deleteLocked(key)
+		evicted++
+	}
+	return evicted, nil
+}
+
+// sweepPeriodically runs Sweep on every tick until DisableExpiry
+func (dm *DataManager) sweepPeriodically(exp *expiryState, interval time.Duration) {
+	defer close(exp.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exp.stop:
+			return
+		case <-ticker.C:
+			dm.Sweep()
+		}
+	}
+}
+
+// expiryState returns the active expiry configuration, or nil
+func (dm *DataManager) expiryState() *expiryState {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.expiry
+}
+
+// live reports whether record has not expired at now; every record is live
+// when expiry is disabled (exp is nil)
+func (exp *expiryState) live(record map[string]interface{}, now time.Time) bool {
+	return exp == nil || !exp.expired(record, now)
+}
+
+// expired reports whether record's expiry time is at or before now
+func (exp *expiryState) expired(record map[string]interface{}, now time.Time) bool {
+	at, ok := expiryTime(record[exp.field])
+	return ok && !at.After(now)
+}
+
+// expiryTime parses an expiry field value
+func expiryTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", v); err == nil {
+			return t, true
+		}
+	case float64:
+		sec := int64(v)
+		return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+	case int:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the work given to one chunk of a parallel scan, as time at the
+// observed throughput: shorter chunks cost more to start than they save,
+// longer ones leave workers idle at the end of a scan
+const (
+	minChunkTime = 10 * time.Millisecond
+	maxChunkTime = 250 * time.Millisecond
+)
+
+// Chunks handed to each worker of a parallel scan when the file allows, so
+// workers finishing early take over the work of slower ones
+const chunksPerWorker = 4
+
+// Bounds of the chunk size in bytes, whatever the throughput
+const (
+	minChunkSize = 256 * 1024
+	maxChunkSize = 256 * 1024 * 1024
+)
+
+// Throughput assumed before any chunk has been timed, in bytes per second
+// per worker
+const initialThroughput = 64 * 1024 * 1024
+
+// ScanTuning describes how the latest parallel scan was divided
+type ScanTuning struct {
+	Workers    int     `json:"workers"`    // Goroutines scanning chunks
+	Chunks     int     `json:"chunks"`     // Chunks the file was divided into
+	ChunkSize  int64   `json:"chunk_size"` // Bytes per chunk
+	Throughput float64 `json:"throughput"` // Observed bytes decoded per second by one worker
+	Pinned     bool    `json:"pinned"`     // Whether workers were pinned to CPUs
+}
+
+// scanTuner learns the decode throughput of a manager's parallel scans
+type scanTuner struct {
+	mu         sync.Mutex
+	throughput float64 // Moving average in bytes per second per worker (0 before any chunk)
+	latest     ScanTuning
+}
+
+// WithChunkSize sets the bytes per chunk of parallel scans (see SetChunkSize)
+func WithChunkSize(bytes int64) Option {
+	return func(dm *DataManager) { dm.chunkSize = bytes }
+}
+
+// WithPinnedWorkers pins the workers of parallel scans to CPUs (see SetPinnedWorkers)
+func WithPinnedWorkers() Option {
+	return func(dm *DataManager) { dm.pinWorkers = true }
+}
+
+// SetChunkSize sets the bytes per chunk of parallel Split-mode scans. With
+// 0, the default, the chunk size is tuned from the decode throughput
+// observed by earlier chunks, so each chunk takes between 10ms and 250ms of
+// a worker's time and every worker gets about four chunks, letting workers
+// that finish early take over the rest. The worker count, unless set with
+// WithWorkers, follows the same measure: no more workers start than the
+// file keeps busy for 10ms each, than there are CPUs Go schedules on, or
+// than the memory left under the limit (and GOMEMLIMIT) has room for the
+// read buffers of.
+func (dm *DataManager) SetChunkSize(bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("Invalid chunk size %d", bytes)
+	}
+	dm.chunkSize = bytes
+	return nil
+}
+
+// SetPinnedWorkers locks each worker of parallel scans to an OS thread bound
+// to a CPU of its own, which keeps its caches warm and, on machines with
+// several NUMA nodes, its buffers in the memory of the node it runs on.
+// Workers take the CPUs the process may run on in turn across nodes, so a
+// scan using fewer workers than CPUs spreads over the memory bandwidth of
+// every node. CPU binding is supported on Linux; elsewhere workers are only
+// locked to their threads. Pinning pays off on dedicated machines and hurts
+// when other processes compete for the same CPUs.
+func (dm *DataManager) SetPinnedWorkers(enabled bool) {
+	dm.pinWorkers = enabled
+}
+
+// ScanTuning returns how the latest parallel scan was divided and the
+// throughput observed so far
+func (dm *DataManager) ScanTuning() ScanTuning {
+	t := dm.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tuning := t.latest
+	tuning.Throughput = t.throughput
+	return tuning
+}
+
+// planScan returns the workers and chunk size of a parallel scan of size
+// bytes
+func (dm *DataManager) planScan(size int64) (int, int64) {
+	t := dm.tuner
+	t.mu.Lock()
+	throughput := t.throughput
+	t.mu.Unlock()
+	if throughput == 0 {
+		throughput = initialThroughput
+	}
+	minChunk := chunkSizeFor(throughput, minChunkTime)
+	maxChunk := chunkSizeFor(throughput, maxChunkTime)
+
+	workers := dm.workers
+	if workers <= 0 {
+		workers = min(runtime.GOMAXPROCS(0), dm.bufferRoom(), int(max(size/minChunk, 1)))
+	}
+	chunkSize := dm.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = min(max(size/int64(workers*chunksPerWorker), minChunk), maxChunk)
+	}
+	return workers, chunkSize
+}
+
+// bufferRoom returns how many chunk readers fit in a quarter of the memory
+// left under the manager's limit and the runtime's soft limit
+func (dm *DataManager) bufferRoom() int {
+	limit := dm.maxRAMUsage
+	if soft := debug.SetMemoryLimit(-1); soft < limit {
+		limit = soft
+	}
+	buffer := int64(dm.bufferSize)
+	if buffer <= 0 {
+		buffer = defaultChunkBuffer
+	}
+	left := limit - atomic.LoadInt64(dm.currentUsage)
+	return int(max(left/4/buffer, 1))
+}
+
+// chunkSizeFor returns the bytes a worker decodes in d at throughput,
+// within [minChunkSize, maxChunkSize]
+func chunkSizeFor(throughput float64, d time.Duration) int64 {
+	return int64(min(max(throughput*d.Seconds(), minChunkSize), maxChunkSize))
+}
+
+// observe folds the time a worker took over a chunk into the throughput
+func (t *scanTuner) observe(bytes int64, elapsed time.Duration) {
+	if bytes < minChunkSize || elapsed <= 0 {
+		return // Too little work to time reliably
+	}
+	rate := float64(bytes) / elapsed.Seconds()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.throughput == 0 {
+		t.throughput = rate
+	} else {
+		t.throughput = 0.7*t.throughput + 0.3*rate
+	}
+}
+
+// record keeps the division of the latest scan for ScanTuning
+func (t *scanTuner) record(tuning ScanTuning) {
+	t.mu.Lock()
+	t.latest = tuning
+	t.mu.Unlock()
+}
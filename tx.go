@@ -0,0 +1,147 @@
+package main
+
+import "fmt"
+
+// Tx buffers writes and applies them to the in-memory data, indexes and
+// write-ahead log all at once on Commit. Readers never observe a partially
+// applied transaction.
+type Tx struct {
+	dm      *DataManager
+	ops     []txOp
+	pending map[string]map[string]interface{} // Key -> record written by this transaction (nil when deleted)
+	done    bool
+}
+
+// txOp is a single buffered write
+type txOp struct {
+	kind   string // "put", "insert", "update" or "delete"
+	key    string
+	record map[string]interface{}
+}
+
+// Begin starts a transaction
+func (dm *DataManager) Begin() (*Tx, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+	return &Tx{dm: dm, pending: make(map[string]map[string]interface{})}, nil
+}
+
+// Put buffers an insert-or-replace
+func (tx *Tx) Put(record map[string]interface{}) error {
+	return tx.buffer("put", record)
+}
+
+// Insert buffers an insert; Commit fails if the key already exists
+func (tx *Tx) Insert(record map[string]interface{}) error {
+	return tx.buffer("insert", record)
+}
+
+// Update buffers a replacement; Commit fails if the key does not exist
+func (tx *Tx) Update(record map[string]interface{}) error {
+	return tx.buffer("update", record)
+}
+
+// Delete buffers the removal of key
+func (tx *Tx) Delete(key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.ops = append(tx.ops, txOp{kind: "delete", key: key})
+	tx.pending[key] = nil
+	return nil
+}
+
+// Get returns the record under key as this transaction sees it, including its own writes
+func (tx *Tx) Get(key string) (map[string]interface{}, bool) {
+	if record, written := tx.pending[key]; written {
+		return record, record != nil
+	}
+	return tx.dm.lookup(key)
+}
+
+// buffer validates a record write and queues it
+func (tx *Tx) buffer(kind string, record map[string]interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.dm.mu.RLock()
+	keyName := tx.dm.keyName
+	tx.dm.mu.RUnlock()
+	if keyName == "" {
+		return fmt.Errorf("%w; load data before writing", ErrNoKeyField)
+	}
+	tx.dm.assignSurrogateKey(record, keyName, nil)
+	key, ok := recordKey(record, keyName)
+	if !ok {
+		return fmt.Errorf("Record is missing key field %q", keyName)
+	}
+	if err := tx.dm.checkSchema(record); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, txOp{kind: kind, key: key, record: record})
+	tx.pending[key] = record
+	return nil
+}
+
+// Commit checks every buffered write against the current data and applies
+// them together, or none of them if any check fails
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	dm := tx.dm
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	exists := make(map[string]bool)
+	present := func(key string) bool {
+		if e, seen := exists[key]; seen {
+			return e
+		}
+		_, e := dm.current.get(key)
+		return e
+	}
+
+	var entries []walEntry
+	for _, op := range tx.ops {
+		switch op.kind {
+		case "insert":
+			if present(op.key) {
+				return &RecordError{Key: op.key, Err: ErrRecordExists}
+			}
+		case "update":
+			if !present(op.key) {
+				return &RecordError{Key: op.key, Err: ErrRecordNotFound}
+			}
+		case "delete":
+			if !present(op.key) {
+				continue
+			}
+			entries = append(entries, walEntry{Op: walDelete, Key: op.key})
+			exists[op.key] = false
+			continue
+		}
+		entries = append(entries, walEntry{Op: walPut, Key: op.key, Record: op.record})
+		exists[op.key] = true
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	batch := walEntry{Op: walBatch, Batch: entries}
+	if err := dm.logWrite(batch); err != nil {
+		return err
+	}
+	dm.applyLocked(batch)
+	return nil
+}
+
+// Rollback discards the buffered writes
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.ops = nil
+	tx.pending = nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// LoadTyped decodes every record of filePath into a T, typically a struct
+// with json tags. JSON input is unmarshalled straight into T without an
+// intermediate map unless a validator is set; other formats are decoded as
+// records and mapped onto T's fields. Malformed records follow the error
+// policy (see SetErrorPolicy).
+func LoadTyped[T any](dm *DataManager, filePath string) ([]T, error) {
+	dm.parseErrors.reset()
+	if dm.formatFor(filePath) == "json" && dm.validator == nil && !isGlob(filePath) {
+		src, err := dm.resolveSource(filePath)
+		if err != nil {
+			return nil, err
+		}
+		input, err := src.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer input.Close()
+		return decodeTyped[T](dm, input)
+	}
+
+	var reader recordReader
+	if isGlob(filePath) {
+		paths, err := expandGlob(filePath)
+		if err != nil {
+			return nil, err
+		}
+		multi := &multiFileReader{dm: dm, paths: paths}
+		defer multi.close()
+		reader = multi
+	} else {
+		single, closer, err := dm.openRecords(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		reader = single
+	}
+
+	var results []T
+	for {
+		record, _, err := reader.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			if err = dm.tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		valid, err := dm.conforms(record)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			continue
+		}
+		var value T
+		if err := DecodeRecord(record, &value); err != nil {
+			return nil, err
+		}
+		results = append(results, value)
+	}
+}
+
+// decodeTyped unmarshals NDJSON lines or the elements of a JSON array directly into T
+func decodeTyped[T any](dm *DataManager, r io.Reader) ([]T, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var results []T
+	if first == '[' {
+		decoder := json.NewDecoder(br)
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		for decoder.More() {
+			var value T
+			if err := decoder.Decode(&value); err != nil {
+				return nil, err
+			}
+			results = append(results, value)
+		}
+		return results, nil
+	}
+
+	var buf []byte
+	var lineNo int
+	var offset int64
+	for {
+		line, n, tooLong, err := readLine(br, buf[:0], dm.recordLimit)
+		buf = line[:0]
+		if n == 0 && err == io.EOF {
+			return results, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		lineNo++
+		start := offset
+		offset += int64(n)
+		if len(bytes.TrimSpace(line)) == 0 && !tooLong {
+			continue
+		}
+
+		var parseErr error
+		var value T
+		if tooLong {
+			parseErr = fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, dm.recordLimit)
+		} else if line, parseErr = dm.preprocessLine(line); parseErr == nil {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			parseErr = json.Unmarshal(line, &value)
+		}
+		if parseErr != nil {
+			err := dm.tolerate(&ParseError{Line: lineNo, Offset: start, Snippet: snippet(line), Err: parseErr})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		results = append(results, value)
+	}
+}
+
+// QueryTyped runs Query and decodes the matching in-memory records into T
+func QueryTyped[T any](dm *DataManager, conditions []FilterCondition) ([]T, error) {
+	records, err := dm.Query(conditions)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords[T](records)
+}
+
+// FilterTyped runs LoadDataInSplitMode and decodes the matching records into T
+func FilterTyped[T any](dm *DataManager, filePath string, conditions []FilterCondition) ([]T, error) {
+	records, err := dm.LoadDataInSplitMode(filePath, conditions)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords[T](records)
+}
+
+// decodeRecords maps each record onto a new T
+func decodeRecords[T any](records []map[string]interface{}) ([]T, error) {
+	results := make([]T, len(records))
+	for i, record := range records {
+		if err := DecodeRecord(record, &results[i]); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// DecodeRecord stores a decoded record in the value pointed to by out,
+// following encoding/json's rules for field names and tags. Struct fields are
+// assigned directly where the types allow, avoiding a JSON round trip.
+func DecodeRecord(record map[string]interface{}, out interface{}) error {
+	target := reflect.ValueOf(out)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("DecodeRecord needs a non-nil pointer, got %T", out)
+	}
+	target = target.Elem()
+	fields, ok := structFieldsOf(target.Type())
+	if !ok {
+		return decodeViaJSON(record, out)
+	}
+
+	for name, value := range record {
+		index, ok := fields.exact[name]
+		if !ok {
+			if index, ok = fields.folded[strings.ToLower(name)]; !ok {
+				continue
+			}
+		}
+		if err := assignValue(target.FieldByIndex(index), value); err != nil {
+			return fmt.Errorf("field %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// typedFields maps JSON field names to struct field indexes
+type typedFields struct {
+	exact  map[string][]int
+	folded map[string][]int // Lower-cased names, for encoding/json's case-insensitive match
+}
+
+// structFieldCache holds the typedFields of each struct type seen
+var structFieldCache sync.Map
+
+// structFieldsOf returns the field mapping of t, or false when t is not a
+// struct that can be filled field by field
+func structFieldsOf(t reflect.Type) (*typedFields, bool) {
+	if cached, ok := structFieldCache.Load(t); ok {
+		fields := cached.(*typedFields)
+		return fields, fields != nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	var fields *typedFields
+	simple := true
+	candidate := &typedFields{exact: make(map[string][]int), folded: make(map[string][]int)}
+	for _, field := range reflect.VisibleFields(t) {
+		if field.Anonymous {
+			if field.Type.Kind() == reflect.Pointer || field.Tag.Get("json") != "" {
+				// Embedded pointers need allocating and tagged embeddings are
+				// not promoted; leave both to encoding/json
+				simple = false
+				break
+			}
+			if field.Type.Kind() == reflect.Struct {
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		tagName, options, _ := strings.Cut(tag, ",")
+		if strings.Contains(options, "string") {
+			simple = false
+			break
+		}
+		if tagName != "" {
+			name = tagName
+		}
+		if _, taken := candidate.exact[name]; !taken {
+			candidate.exact[name] = field.Index
+		}
+		if _, taken := candidate.folded[strings.ToLower(name)]; !taken {
+			candidate.folded[strings.ToLower(name)] = field.Index
+		}
+	}
+	if simple {
+		fields = candidate
+	}
+	structFieldCache.Store(t, fields)
+	return fields, fields != nil
+}
+
+// assignValue stores a decoded JSON value in dst, converting numbers to the
+// field's kind and falling back to encoding/json for anything else
+func assignValue(dst reflect.Value, value interface{}) error {
+	if value == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	src := reflect.ValueOf(value)
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	if f, ok := numericValue(value); ok {
+		switch dst.Kind() {
+		case reflect.Float32, reflect.Float64:
+			dst.SetFloat(f)
+			return nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if f != math.Trunc(f) || dst.OverflowInt(int64(f)) {
+				return fmt.Errorf("cannot store %v in %s", f, dst.Type())
+			}
+			dst.SetInt(int64(f))
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if f < 0 || f != math.Trunc(f) || dst.OverflowUint(uint64(f)) {
+				return fmt.Errorf("cannot store %v in %s", f, dst.Type())
+			}
+			dst.SetUint(uint64(f))
+			return nil
+		}
+	}
+	if s, ok := value.(string); ok && dst.Kind() == reflect.String {
+		dst.SetString(s)
+		return nil
+	}
+	return decodeViaJSON(value, dst.Addr().Interface())
+}
+
+// decodeViaJSON converts value into out by encoding and decoding it
+func decodeViaJSON(value interface{}, out interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, out)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UpdateFields changes individual fields of the record stored under key and
+// returns the updated record. update holds MongoDB-style operators, each
+// mapping dotted field paths (e.g. "address.city") to operands:
+//
+//	$set    store the operand
+//	$unset  remove the field (the operand is ignored)
+//	$inc    add the numeric operand; a missing field starts at zero
+//	$push   append the operand to a list, or each element of {"$each": [...]};
+//	        a missing field starts as an empty list
+//
+// The operators apply atomically: either all of them take effect, in the
+// order above, or the record is left unchanged. The key field cannot be
+// changed, and the result is validated, logged and indexed like a Put.
+func (dm *DataManager) UpdateFields(key string, update map[string]interface{}) (map[string]interface{}, error) {
+	return dm.updateFields(key, update, nil)
+}
+
+// updateFields applies update if check, when set, approves the change from
+// old to record
+func (dm *DataManager) updateFields(key string, update map[string]interface{}, check func(old, record map[string]interface{}) error) (map[string]interface{}, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+	ops, err := parseUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.keyName == "" {
+		return nil, fmt.Errorf("%w; load data before writing", ErrNoKeyField)
+	}
+	old, exists := dm.current.get(key)
+	if !exists || !dm.expiry.live(old, time.Now()) {
+		return nil, &RecordError{Key: key, Err: ErrRecordNotFound}
+	}
+
+	record := make(map[string]interface{}, len(old)+1)
+	for field, value := range old {
+		record[field] = value
+	}
+	for _, op := range ops {
+		if field, ok := op.touchesKey(dm.keyName); ok {
+			return nil, fmt.Errorf("Cannot %s the key field %q", op.name, field)
+		}
+		if err := op.apply(record); err != nil {
+			return nil, err
+		}
+	}
+	if check != nil {
+		if err := check(old, record); err != nil {
+			return nil, err
+		}
+	}
+	if err := dm.checkSchema(record); err != nil {
+		return nil, err
+	}
+
+	if err := dm.logWrite(walEntry{Op: walPut, Key: key, Record: record}); err != nil {
+		return nil, err
+	}
+	dm.putLocked(key, record)
+	return record, nil
+}
+
+// updateOp is one operator applied to one field path
+type updateOp struct {
+	name    string // "$set", "$unset", "$inc" or "$push"
+	path    []string
+	operand interface{}
+}
+
+// touchesKey returns the field of keyName, a single or composite key of
+// dotted paths, that the operation would change: one its path leads to or
+// passes through
+func (op updateOp) touchesKey(keyName string) (string, bool) {
+	for _, field := range keyFieldNames(keyName) {
+		keyPath := strings.Split(field, ".")
+		overlap := true
+		for i := 0; i < len(keyPath) && i < len(op.path); i++ {
+			overlap = overlap && keyPath[i] == op.path[i]
+		}
+		if overlap {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// updateOrder is the order operators of one update are applied in
+var updateOrder = []string{"$set", "$unset", "$inc", "$push"}
+
+// parseUpdate validates an update document and flattens it into operations
+func parseUpdate(update map[string]interface{}) ([]updateOp, error) {
+	for name := range update {
+		if !containsString(updateOrder, name) {
+			return nil, fmt.Errorf("Unknown update operator %q (want $set, $unset, $inc or $push)", name)
+		}
+	}
+
+	var ops []updateOp
+	for _, name := range updateOrder {
+		arg, ok := update[name]
+		if !ok {
+			continue
+		}
+		fields, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s takes an object of field paths, got %T", name, arg)
+		}
+		paths := make([]string, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			operand := fields[path]
+			if name == "$inc" {
+				if _, ok := numericValue(operand); !ok {
+					return nil, fmt.Errorf("$inc of %q needs a number, got %T", path, operand)
+				}
+			}
+			ops = append(ops, updateOp{name: name, path: strings.Split(path, "."), operand: operand})
+		}
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("Update has no operators")
+	}
+	return ops, nil
+}
+
+// apply performs the operation on record, copying the nested objects it
+// changes so that earlier versions of the record are never modified
+func (op updateOp) apply(record map[string]interface{}) error {
+	parent := record
+	for i, field := range op.path[:len(op.path)-1] {
+		child, exists := parent[field]
+		if !exists || child == nil {
+			if op.name == "$unset" {
+				return nil
+			}
+			child = map[string]interface{}{}
+		}
+		object, ok := child.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Cannot %s %q: %q is not an object", op.name, strings.Join(op.path, "."), strings.Join(op.path[:i+1], "."))
+		}
+		copied := make(map[string]interface{}, len(object)+1)
+		for k, v := range object {
+			copied[k] = v
+		}
+		parent[field] = copied
+		parent = copied
+	}
+
+	field := op.path[len(op.path)-1]
+	current, exists := parent[field]
+	switch op.name {
+	case "$set":
+		parent[field] = op.operand
+	case "$unset":
+		delete(parent, field)
+	case "$inc":
+		sum, err := increment(current, exists, op.operand)
+		if err != nil {
+			return fmt.Errorf("Cannot $inc %q: %w", strings.Join(op.path, "."), err)
+		}
+		parent[field] = sum
+	case "$push":
+		var list []interface{}
+		if exists && current != nil {
+			existing, ok := current.([]interface{})
+			if !ok {
+				return fmt.Errorf("Cannot $push to %q: it holds %T, not a list", strings.Join(op.path, "."), current)
+			}
+			list = append(list, existing...)
+		}
+		if each, ok := op.operand.(map[string]interface{}); ok && len(each) == 1 && each["$each"] != nil {
+			items, ok := each["$each"].([]interface{})
+			if !ok {
+				return fmt.Errorf("$each of %q needs a list, got %T", strings.Join(op.path, "."), each["$each"])
+			}
+			list = append(list, items...)
+		} else {
+			list = append(list, op.operand)
+		}
+		parent[field] = list
+	}
+	return nil
+}
+
+// increment adds amount to a field value, keeping integers integral
+func increment(current interface{}, exists bool, amount interface{}) (interface{}, error) {
+	if !exists || current == nil {
+		return amount, nil
+	}
+	if a, ok := current.(int); ok {
+		if b, ok := amount.(int); ok {
+			return a + b, nil
+		}
+	}
+	if a, ok := current.(int64); ok {
+		if b, ok := amount.(int64); ok {
+			return a + b, nil
+		}
+	}
+	a, ok := numericValue(current)
+	if !ok {
+		return nil, fmt.Errorf("it holds %T, not a number", current)
+	}
+	b, _ := numericValue(amount)
+	return a + b, nil
+}
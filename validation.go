@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RecordValidator checks a record, returning its violations or nil if it is valid.
+// *Schema and *JSONSchema implement it.
+type RecordValidator interface {
+	Validate(record map[string]interface{}) []string
+}
+
+// ValidationMode selects what happens to records that fail validation
+type ValidationMode int
+
+const (
+	ValidationSkip     ValidationMode = iota // Leave invalid records out and count them
+	ValidationFailFast                       // Abort the load or scan at the first invalid record
+)
+
+// ValidationOptions configures record validation
+type ValidationOptions struct {
+	Mode    ValidationMode
+	Rejects io.Writer // Receives each invalid record as a JSON line {"record": ..., "errors": [...]}
+}
+
+// recordValidation enforces a validator on the records a manager reads and writes
+type recordValidation struct {
+	validator RecordValidator
+	opts      ValidationOptions
+	mu        sync.Mutex
+	rejects   *json.Encoder // nil when invalid records are only counted
+	rejected  int64
+}
+
+// SetValidator validates every record loaded, scanned, watched or written
+// from now on. Invalid records are skipped or abort the operation according
+// to opts.Mode; writes always fail. A nil validator turns validation off.
+// Parquet files are typed by their own schema and are not re-validated.
+func (dm *DataManager) SetValidator(validator RecordValidator, opts ValidationOptions) {
+	if validator == nil {
+		dm.validator = nil
+		return
+	}
+	v := &recordValidation{validator: validator, opts: opts}
+	if opts.Rejects != nil {
+		v.rejects = json.NewEncoder(opts.Rejects)
+	}
+	dm.validator = v
+}
+
+// ValidateAgainstSchema enforces schema, skipping records that do not conform
+// and writing them to rejects (if non-nil) with their violations. A nil schema
+// turns validation off.
+func (dm *DataManager) ValidateAgainstSchema(schema *Schema, rejects io.Writer) {
+	if schema == nil {
+		dm.SetValidator(nil, ValidationOptions{})
+		return
+	}
+	dm.SetValidator(schema, ValidationOptions{Rejects: rejects})
+}
+
+// SchemaRejects returns how many records failed validation so far
+func (dm *DataManager) SchemaRejects() int64 {
+	if dm.validator == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&dm.validator.rejected)
+}
+
+// conforms validates record, routing it to the rejects writer when it is
+// invalid; in fail-fast mode an invalid record is returned as an error
+func (dm *DataManager) conforms(record map[string]interface{}) (bool, error) {
+	v := dm.validator
+	if v == nil {
+		return true, nil
+	}
+	problems := v.validator.Validate(record)
+	if problems == nil {
+		return true, nil
+	}
+	atomic.AddInt64(&v.rejected, 1)
+	if v.rejects != nil {
+		v.mu.Lock()
+		v.rejects.Encode(map[string]interface{}{"record": record, "errors": problems})
+		v.mu.Unlock()
+	}
+	if v.opts.Mode == ValidationFailFast {
+		return false, fmt.Errorf("Record failed validation: %s", strings.Join(problems, "; "))
+	}
+	return false, nil
+}
+
+// checkSchema returns an error describing why record is invalid
+func (dm *DataManager) checkSchema(record map[string]interface{}) error {
+	v := dm.validator
+	if v == nil {
+		return nil
+	}
+	if problems := v.validator.Validate(record); problems != nil {
+		return fmt.Errorf("Record failed validation: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
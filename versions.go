@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// VersionOptions configures record version history
+type VersionOptions struct {
+	MaxVersions int           // Past versions kept per key (0 keeps every one)
+	MaxAge      time.Duration // Past versions superseded longer ago than this are dropped (0 keeps them)
+}
+
+// RecordVersion is one state of a record and the time it was current
+type RecordVersion struct {
+	Record    map[string]interface{} `json:"record"`
+	ValidFrom time.Time              `json:"valid_from"` // Zero when the record predates versioning
+	ValidTo   time.Time              `json:"valid_to"`   // Zero for the current version
+}
+
+// versionStore holds the past versions of records; it is guarded by dm.mu
+type versionStore struct {
+	opts  VersionOptions
+	since map[string]time.Time       // When each current record was written
+	past  map[string][]RecordVersion // Superseded and deleted versions, oldest first
+}
+
+// EnableVersioning keeps the previous versions of records as Put, Update,
+// Delete and transactions replace them, so History and GetAsOf can show what
+// a record looked like at an earlier time. Versions are kept in memory only;
+// enable versioning after EnableWAL so replaying the log does not count as
+// new writes. Loading new data clears the history.
+func (dm *DataManager) EnableVersioning(opts VersionOptions) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if opts.MaxVersions < 0 || opts.MaxAge < 0 {
+		return errors.New("Version limits cannot be negative")
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.versions = newVersionStore(opts)
+	return nil
+}
+
+// WithVersioning keeps record version history (see EnableVersioning)
+func WithVersioning(opts VersionOptions) Option {
+	return func(dm *DataManager) { dm.versions = newVersionStore(opts) }
+}
+
+// newVersionStore creates an empty history
+func newVersionStore(opts VersionOptions) *versionStore {
+	return &versionStore{
+		opts:  opts,
+		since: make(map[string]time.Time),
+		past:  make(map[string][]RecordVersion),
+	}
+}
+
+// recordVersionLocked notes that the record under key changed from old to
+// record (nil when deleted); the caller holds dm.mu
+func (dm *DataManager) recordVersionLocked(key string, old, record map[string]interface{}) {
+	vs := dm.versions
+	if vs == nil {
+		return
+	}
+	now := time.Now()
+	if old != nil {
+		vs.past[key] = append(vs.past[key], RecordVersion{Record: old, ValidFrom: vs.since[key], ValidTo: now})
+	}
+	if record != nil {
+		vs.since[key] = now
+	} else {
+		delete(vs.since, key)
+	}
+	vs.prune(key, now)
+}
+
+// prune drops the versions of key beyond the configured depth and age
+func (vs *versionStore) prune(key string, now time.Time) {
+	versions := vs.past[key]
+	if vs.opts.MaxAge > 0 {
+		cutoff := now.Add(-vs.opts.MaxAge)
+		i := sort.Search(len(versions), func(i int) bool { return versions[i].ValidTo.After(cutoff) })
+		versions = versions[i:]
+	}
+	if vs.opts.MaxVersions > 0 && len(versions) > vs.opts.MaxVersions {
+		versions = versions[len(versions)-vs.opts.MaxVersions:]
+	}
+	if len(versions) == 0 {
+		delete(vs.past, key)
+		return
+	}
+	// Copy when trimming so the dropped versions can be freed
+	if len(versions) < len(vs.past[key]) {
+		versions = append([]RecordVersion(nil), versions...)
+	}
+	vs.past[key] = versions
+}
+
+// History returns the known versions of the record under key, oldest first,
+// ending with the current one if the record still exists
+func (dm *DataManager) History(key string) ([]RecordVersion, error) {
+	if dm.mode != InMemoryMode {
+		return nil, ErrInvalidMode
+	}
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	vs := dm.versions
+	if vs == nil {
+		return nil, errors.New("Versioning is not enabled")
+	}
+	var history []RecordVersion
+	cutoff := time.Now().Add(-vs.opts.MaxAge)
+	for _, v := range vs.past[key] {
+		if vs.opts.MaxAge == 0 || v.ValidTo.After(cutoff) {
+			history = append(history, v)
+		}
+	}
+	if record, exists := dm.current.get(key); exists {
+		history = append(history, RecordVersion{Record: record, ValidFrom: vs.since[key]})
+	}
+	if len(history) == 0 {
+		return nil, &RecordError{Key: key, Err: ErrRecordNotFound}
+	}
+	return history, nil
+}
+
+// GetAsOf returns the record under key as it was at t. It fails with
+// ErrRecordNotFound when the record did not exist then, or when that version
+// is older than the history kept.
+func (dm *DataManager) GetAsOf(key string, t time.Time) (map[string]interface{}, error) {
+	history, err := dm.History(key)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		v := history[i]
+		if !v.ValidFrom.After(t) && (v.ValidTo.IsZero() || t.Before(v.ValidTo)) {
+			return v.Record, nil
+		}
+	}
+	return nil, &RecordError{Key: key, Err: ErrRecordNotFound}
+}
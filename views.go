@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ViewDefinition describes the contents of a materialized view: the records
+// matching Conditions, or, when GroupBy or Aggregates are set, one row per
+// group of them holding the group's values and aggregates
+type ViewDefinition struct {
+	Conditions []FilterCondition // Records the view covers
+	GroupBy    []string          // Fields whose values form the groups (none puts every record in one group)
+	Aggregates []ViewAggregate   // Values computed over each group
+}
+
+// ViewAggregate is a value computed over the records of a group
+type ViewAggregate struct {
+	Name  string // Field of the row holding the value (default: Func, or Func_Field)
+	Func  string // "count", "sum", "avg", "min" or "max"
+	Field string // Numeric field aggregated; records without a number in it are ignored (unused by count)
+}
+
+// MaterializedView holds the results of a ViewDefinition and updates them
+// in place as records are written, deleted or appended to a watched file
+type MaterializedView struct {
+	name    string
+	def     ViewDefinition
+	dm      *DataManager
+	mu      sync.RWMutex
+	records map[string]map[string]interface{} // Matching records by key (views without groups)
+	groups  map[string]*viewGroup             // Groups by encoded GroupBy values
+	unkeyed int                               // Records added without a key
+}
+
+// viewGroup holds the aggregates of one group
+type viewGroup struct {
+	values []interface{} // GroupBy values
+	count  int
+	aggs   []viewAccumulator
+}
+
+// viewAccumulator maintains one aggregate of a group under additions and
+// removals
+type viewAccumulator struct {
+	n      int // Numbers observed
+	sum    float64
+	values map[float64]int // Multiset of the numbers (min and max only)
+}
+
+// CreateView defines the materialized view name and fills it from the
+// in-memory data, or from the most recently loaded or scanned input in Split
+// mode. From then on, writes, deletes, transactions and watched-file appends
+// update the view as they commit, so its rows are read without scanning the
+// source. Reloads rebuild it. In Split mode appended records have no previous
+// version, so a record appended again under the same key is counted twice by
+// aggregates.
+func (dm *DataManager) CreateView(name string, def ViewDefinition) (*MaterializedView, error) {
+	def.Aggregates = append([]ViewAggregate(nil), def.Aggregates...)
+	for i, agg := range def.Aggregates {
+		switch agg.Func {
+		case "count":
+		case "sum", "avg", "min", "max":
+			if agg.Field == "" {
+				return nil, fmt.Errorf("View %q: %s aggregate needs a field", name, agg.Func)
+			}
+		default:
+			return nil, fmt.Errorf("View %q: unknown aggregate %q", name, agg.Func)
+		}
+		if agg.Name == "" {
+			def.Aggregates[i].Name = agg.Func
+			if agg.Field != "" {
+				def.Aggregates[i].Name = agg.Func + "_" + agg.Field
+			}
+		}
+	}
+	v := &MaterializedView{name: name, def: def, dm: dm}
+
+	if dm.mode == InMemoryMode {
+		dm.mu.Lock()
+		defer dm.mu.Unlock()
+		if _, exists := dm.views[name]; exists {
+			return nil, fmt.Errorf("View %q already exists", name)
+		}
+		v.fill(dm.current.records())
+		dm.registerViewLocked(v)
+		return v, nil
+	}
+
+	v.fill(nil)
+	if source := dm.loadedPath(); source != "" {
+		err := dm.Pipeline().From(source).ForEach(func(record map[string]interface{}) error {
+			key, _ := recordKey(record, dm.keyName)
+			v.apply(key, nil, record)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, exists := dm.views[name]; exists {
+		return nil, fmt.Errorf("View %q already exists", name)
+	}
+	dm.registerViewLocked(v)
+	return v, nil
+}
+
+// View returns the materialized view called name, or nil
+func (dm *DataManager) View(name string) *MaterializedView {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.views[name]
+}
+
+// DropView removes the materialized view called name, reporting whether it
+// existed
+func (dm *DataManager) DropView(name string) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, exists := dm.views[name]; !exists {
+		return false
+	}
+	delete(dm.views, name)
+	return true
+}
+
+// registerViewLocked adds v to the views; the caller holds dm.mu
+func (dm *DataManager) registerViewLocked(v *MaterializedView) {
+	if dm.views == nil {
+		dm.views = make(map[string]*MaterializedView)
+	}
+	dm.views[v.name] = v
+}
+
+// updateViewsLocked applies a change of key from old to record (either may
+// be nil) to every view; the caller holds dm.mu
+func (dm *DataManager) updateViewsLocked(key string, old, record map[string]interface{}) {
+	for _, v := range dm.views {
+		v.apply(key, old, record)
+	}
+}
+
+// refillViewsLocked rebuilds every view from data after a reload; the
+// caller holds dm.mu
+func (dm *DataManager) refillViewsLocked(data map[string]map[string]interface{}) {
+	for _, v := range dm.views {
+		v.fill(data)
+	}
+}
+
+// Name returns the name the view was created with
+func (v *MaterializedView) Name() string {
+	return v.name
+}
+
+// Len returns the number of rows of the view
+func (v *MaterializedView) Len() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.grouped() {
+		return len(v.groups)
+	}
+	return len(v.records)
+}
+
+// Rows returns the rows of the view: the matching records in key order, or
+// one row per group holding its GroupBy fields and aggregates, in group
+// order. Records are shared with the manager and must not be modified.
+func (v *MaterializedView) Rows() []map[string]interface{} {
+	return v.Query(nil)
+}
+
+// Query returns the rows of the view matching all conditions
+func (v *MaterializedView) Query(conditions []FilterCondition) []map[string]interface{} {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var rows []map[string]interface{}
+	if !v.grouped() {
+		keys := make([]string, 0, len(v.records))
+		for key := range v.records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if record := v.records[key]; v.dm.matchConditions(record, conditions) {
+				rows = append(rows, record)
+			}
+		}
+		return rows
+	}
+
+	keys := make([]string, 0, len(v.groups))
+	for key := range v.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if row := v.row(v.groups[key]); v.dm.matchConditions(row, conditions) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// grouped reports whether the view holds groups rather than records
+func (v *MaterializedView) grouped() bool {
+	return len(v.def.GroupBy) > 0 || len(v.def.Aggregates) > 0
+}
+
+// fill empties the view and adds the matching records of data
+func (v *MaterializedView) fill(data map[string]map[string]interface{}) {
+	v.mu.Lock()
+	v.records = make(map[string]map[string]interface{})
+	v.groups = make(map[string]*viewGroup)
+	v.unkeyed = 0
+	v.mu.Unlock()
+	for key, record := range data {
+		v.apply(key, nil, record)
+	}
+}
+
+// apply updates the view for a change of key from old to record
+func (v *MaterializedView) apply(key string, old, record map[string]interface{}) {
+	wasMatch := old != nil && v.dm.matchConditions(old, v.def.Conditions)
+	isMatch := record != nil && v.dm.matchConditions(record, v.def.Conditions)
+	if !wasMatch && !isMatch {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.grouped() {
+		if key == "" {
+			v.unkeyed++
+			key = "#" + strconv.Itoa(v.unkeyed)
+		}
+		if isMatch {
+			v.records[key] = record
+		} else {
+			delete(v.records, key)
+		}
+		return
+	}
+	if wasMatch {
+		v.remove(old)
+	}
+	if isMatch {
+		v.add(record)
+	}
+}
+
+// groupOf returns the encoded GroupBy values of record and the values
+func (v *MaterializedView) groupOf(record map[string]interface{}) (string, []interface{}) {
+	values := make([]interface{}, len(v.def.GroupBy))
+	for i, field := range v.def.GroupBy {
+		values[i], _ = resolvePath(record, field)
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded), values
+}
+
+// add counts record in its group; the caller holds v.mu
+func (v *MaterializedView) add(record map[string]interface{}) {
+	key, values := v.groupOf(record)
+	g := v.groups[key]
+	if g == nil {
+		g = &viewGroup{values: values, aggs: make([]viewAccumulator, len(v.def.Aggregates))}
+		v.groups[key] = g
+	}
+	g.count++
+	for i, agg := range v.def.Aggregates {
+		x, ok := v.number(record, agg)
+		if !ok {
+			continue
+		}
+		acc := &g.aggs[i]
+		acc.n++
+		acc.sum += x
+		if agg.Func == "min" || agg.Func == "max" {
+			if acc.values == nil {
+				acc.values = make(map[float64]int)
+			}
+			acc.values[x]++
+		}
+	}
+}
+
+// remove takes record out of its group; the caller holds v.mu
+func (v *MaterializedView) remove(record map[string]interface{}) {
+	key, _ := v.groupOf(record)
+	g := v.groups[key]
+	if g == nil {
+		return
+	}
+	if g.count--; g.count == 0 {
+		delete(v.groups, key)
+		return
+	}
+	for i, agg := range v.def.Aggregates {
+		x, ok := v.number(record, agg)
+		if !ok {
+			continue
+		}
+		acc := &g.aggs[i]
+		acc.n--
+		acc.sum -= x
+		if acc.values != nil {
+			if acc.values[x]--; acc.values[x] <= 0 {
+				delete(acc.values, x)
+			}
+		}
+	}
+}
+
+// number returns the value of record aggregated by agg
+func (v *MaterializedView) number(record map[string]interface{}, agg ViewAggregate) (float64, bool) {
+	if agg.Func == "count" {
+		return 0, false
+	}
+	value, ok := resolvePath(record, agg.Field)
+	if !ok {
+		return 0, false
+	}
+	return numericValue(value)
+}
+
+// row returns the row of a group
+func (v *MaterializedView) row(g *viewGroup) map[string]interface{} {
+	row := make(map[string]interface{}, len(v.def.GroupBy)+len(v.def.Aggregates))
+	for i, field := range v.def.GroupBy {
+		row[field] = g.values[i]
+	}
+	for i, agg := range v.def.Aggregates {
+		acc := g.aggs[i]
+		switch {
+		case agg.Func == "count":
+			row[agg.Name] = g.count
+		case acc.n == 0:
+			row[agg.Name] = nil
+		case agg.Func == "sum":
+			row[agg.Name] = acc.sum
+		case agg.Func == "avg":
+			row[agg.Name] = acc.sum / float64(acc.n)
+		case agg.Func == "min":
+			m := math.Inf(1)
+			for x := range acc.values {
+				m = math.Min(m, x)
+			}
+			row[agg.Name] = m
+		case agg.Func == "max":
+			m := math.Inf(-1)
+			for x := range acc.values {
+				m = math.Max(m, x)
+			}
+			row[agg.Name] = m
+		}
+	}
+	return row
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WALOptions configures the write-ahead log
+type WALOptions struct {
+	SnapshotPath    string        // NDJSON snapshot the log is compacted into ("" disables compaction)
+	CompactAfter    int           // Compact once the log holds this many entries (0 disables)
+	CompactInterval time.Duration // Compact periodically in the background (0 disables)
+	NoSync          bool          // Skip fsync after each write; faster, but a power loss may drop recent writes
+}
+
+const (
+	walPut    = "put"
+	walDelete = "delete"
+	walBatch  = "batch" // A committed transaction, logged as one line so it replays all-or-nothing
+)
+
+// walEntry is a single logged write, stored as one JSON line
+type walEntry struct {
+	Op     string                 `json:"op"`
+	Key    string                 `json:"key"`
+	Record map[string]interface{} `json:"record,omitempty"`
+	Batch  []walEntry             `json:"batch,omitempty"`
+}
+
+// writeAheadLog is the append-only log backing InMemory writes
+type writeAheadLog struct {
+	file       *os.File
+	path       string
+	opts       WALOptions
+	entries    int
+	err        error // Last background compaction failure
+	stop       chan struct{}
+	done       chan struct{}
+	compactMu  sync.Mutex     // Serializes compactions
+	compacting bool           // A compaction is running or about to start
+	background sync.WaitGroup // Compactions started by CompactAfter
+}
+
+// compactionSegment is where a compaction moves the log while it writes the
+// snapshot; it is removed once the snapshot covers it
+func compactionSegment(path string) string {
+	return path + ".compacting"
+}
+
+// EnableWAL makes Put, Insert, Update and Delete durable by appending them to
+// the log at path before applying them. On startup the snapshot at
+// opts.SnapshotPath (if present) replaces the in-memory data and the log is
+// replayed on top of it. The key field must be set by a load or SetKeyField.
+func (dm *DataManager) EnableWAL(path string, opts WALOptions) error {
+	if dm.mode != InMemoryMode {
+		return ErrInvalidMode
+	}
+	if dm.wal != nil {
+		return ErrWALEnabled
+	}
+	if dm.keyName == "" {
+		return fmt.Errorf("%w; load data or call SetKeyField before enabling the WAL", ErrNoKeyField)
+	}
+	if (opts.CompactAfter > 0 || opts.CompactInterval > 0) && opts.SnapshotPath == "" {
+		return errors.New("WAL compaction requires a SnapshotPath")
+	}
+
+	if opts.SnapshotPath != "" {
+		err := dm.LoadSnapshot(opts.SnapshotPath, dm.keyName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Loading snapshot %s: %w", opts.SnapshotPath, err)
+		}
+	}
+
+	// A compaction interrupted by a crash leaves the log it was folding in
+	// next to the new one; its writes come first
+	var entries []walEntry
+	if segment, err := os.OpenFile(compactionSegment(path), os.O_RDWR, 0); err == nil {
+		entries, err = readWAL(segment, dm.encryption)
+		segment.Close()
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	logged, err := readWAL(file, dm.encryption)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	wal := &writeAheadLog{file: file, path: path, opts: opts, entries: len(logged)}
+
+	dm.mu.Lock()
+	for _, entry := range append(entries, logged...) {
+		dm.applyLocked(entry)
+	}
+	dm.wal = wal
+	dm.mu.Unlock()
+
+	if opts.CompactInterval > 0 {
+		wal.stop = make(chan struct{})
+		wal.done = make(chan struct{})
+		go dm.compactPeriodically(wal)
+	}
+	return nil
+}
+
+// readWAL decodes every complete entry in the log, decrypting them with c,
+// and truncates a torn final entry left behind by a crash mid-write
+func readWAL(file *os.File, c *fileCipher) ([]walEntry, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var entries []walEntry
+	var valid int64
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(raw)) > 0 {
+				// Incomplete last write: drop it
+				if err := file.Truncate(valid); err != nil {
+					return nil, err
+				}
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(raw)) > 0 {
+			plain, err := c.openLine(raw)
+			if err != nil {
+				return nil, fmt.Errorf("Write-ahead log entry at line %d: %w", line, err)
+			}
+			var entry walEntry
+			if err := json.Unmarshal(plain, &entry); err != nil || (entry.Op != walPut && entry.Op != walDelete && entry.Op != walBatch) {
+				return nil, fmt.Errorf("Corrupt write-ahead log entry at line %d", line)
+			}
+			entries = append(entries, entry)
+		}
+		valid += int64(len(raw))
+	}
+}
+
+// applyLocked applies a logged write to the in-memory data; the caller holds dm.mu
+func (dm *DataManager) applyLocked(entry walEntry) {
+	switch entry.Op {
+	case walPut:
+		dm.putLocked(entry.Key, entry.Record)
+	case walDelete:
+		dm.deleteLocked(entry.Key)
+	case walBatch:
+		for _, op := range entry.Batch {
+			dm.applyLocked(op)
+		}
+	}
+}
+
+// logWrite appends entry to the log, if enabled; the caller holds dm.mu
+func (dm *DataManager) logWrite(entry walEntry) error {
+	wal := dm.wal
+	if wal == nil {
+		return nil
+	}
+	if wal.opts.CompactAfter > 0 && wal.entries >= wal.opts.CompactAfter && !wal.compacting {
+		wal.compacting = true // Claimed here so later writes do not start another
+		wal.background.Add(1)
+		go func() {
+			defer wal.background.Done()
+			if err := dm.compact(wal); err != nil {
+				dm.mu.Lock()
+				wal.err = err
+				dm.mu.Unlock()
+			}
+		}()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if line, err = dm.encryption.sealLine(line); err != nil {
+		return err
+	}
+	if _, err := wal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if !wal.opts.NoSync {
+		if err := wal.file.Sync(); err != nil {
+			return err
+		}
+	}
+	wal.entries++
+	return nil
+}
+
+// Compact folds the log into the WAL snapshot. The current records, without
+// the deleted and overwritten versions the log still holds, are written to a
+// new snapshot that atomically replaces the old one, and the log restarts
+// empty. Queries and writes continue meanwhile: writes go to a fresh log that
+// is replayed on top of the new snapshot. If nothing changed during the
+// rewrite, the in-memory data is also swapped for a compacted generation with
+// freshly built indexes, releasing the memory deleted records held; readers
+// of the previous generation are unaffected.
+func (dm *DataManager) Compact() error {
+	dm.mu.Lock()
+	wal := dm.wal
+	dm.mu.Unlock()
+	if wal == nil {
+		return ErrWALNotEnabled
+	}
+	if wal.opts.SnapshotPath == "" {
+		return errors.New("WAL compaction requires a SnapshotPath")
+	}
+	return dm.compact(wal)
+}
+
+// compact rotates the log, writes the snapshot and swaps in a compacted
+// dataset. A crash at any point is harmless because replaying the log
+// segments on top of either snapshot is idempotent.
+func (dm *DataManager) compact(wal *writeAheadLog) error {
+	wal.compactMu.Lock()
+	defer wal.compactMu.Unlock()
+
+	dm.mu.Lock()
+	if dm.wal != wal {
+		dm.mu.Unlock()
+		return ErrWALNotEnabled
+	}
+	if err := wal.rotate(); err != nil {
+		wal.compacting = false
+		dm.mu.Unlock()
+		return err
+	}
+	// Writes and reloads replace the shared generation instead of changing it
+	ds := dm.current
+	ds.shared.Store(true)
+	wal.compacting = true
+	dm.mu.Unlock()
+
+	err := writeSnapshotFile(wal.opts.SnapshotPath, ds.records(), dm.encryption)
+	var compacted *dataset
+	if err == nil {
+		compacted = ds.compacted()
+	}
+
+	dm.mu.Lock()
+	if compacted != nil && dm.current == ds {
+		dm.current = compacted
+	}
+	wal.compacting = false
+	dm.mu.Unlock()
+	if err != nil {
+		return err // The segment stays and is folded in by the next compaction
+	}
+	return os.Remove(compactionSegment(wal.path))
+}
+
+// rotate moves the logged writes to the compaction segment and empties the
+// log; the caller holds dm.mu
+func (wal *writeAheadLog) rotate() error {
+	segment := compactionSegment(wal.path)
+	if _, err := os.Stat(segment); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(wal.path, segment); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(wal.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		wal.file.Close()
+		wal.file = file
+		wal.entries = 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// A failed compaction left its segment behind: add the log to it
+	out, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, wal.file); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	wal.entries = 0
+	return wal.file.Sync()
+}
+
+// compactPeriodically compacts the log on every tick until CloseWAL
+func (dm *DataManager) compactPeriodically(wal *writeAheadLog) {
+	defer close(wal.done)
+	ticker := time.NewTicker(wal.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wal.stop:
+			return
+		case <-ticker.C:
+			dm.mu.Lock()
+			idle := wal.entries == 0
+			dm.mu.Unlock()
+			if idle {
+				continue
+			}
+			if err := dm.compact(wal); err != nil {
+				dm.mu.Lock()
+				wal.err = err
+				dm.mu.Unlock()
+			}
+		}
+	}
+}
+
+// CloseWAL stops background compaction and closes the log, returning the
+// last background compaction error, if any
+func (dm *DataManager) CloseWAL() error {
+	dm.mu.Lock()
+	wal := dm.wal
+	dm.mu.Unlock()
+	if wal == nil {
+		return nil
+	}
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.done
+	}
+	wal.background.Wait()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.wal = nil
+	if err := wal.file.Sync(); err != nil {
+		wal.file.Close()
+		return err
+	}
+	if err := wal.file.Close(); err != nil {
+		return err
+	}
+	return wal.err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// WatchOptions configures Watch
+type WatchOptions struct {
+	Conditions   []FilterCondition // Only records matching every condition reach the handler
+	PollInterval time.Duration     // How often to check the file for appended data (default 500ms)
+	FromStart    bool              // Process the existing content first instead of starting at the end
+}
+
+// Watch follows an append-only NDJSON file like tail -f, calling handler for
+// every appended record that matches opts.Conditions. In InMemory mode with a
+// key field set, appended records are also upserted into the in-memory data
+// and indexes. A truncated or replaced file is followed from its beginning.
+// Watch blocks until ctx is cancelled.
+func (dm *DataManager) Watch(ctx context.Context, filePath string, opts WatchOptions, handler func(record map[string]interface{})) error {
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	var offset int64
+	if !opts.FromStart {
+		if offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var partial []byte
+	for {
+		// Reopen when the file was rotated, restart when it was truncated
+		if info, err := os.Stat(filePath); err == nil {
+			current, _ := file.Stat()
+			if !os.SameFile(info, current) {
+				if replacement, err := os.Open(filePath); err == nil {
+					file.Close()
+					file, offset, partial = replacement, 0, nil
+				}
+			} else if info.Size() < offset {
+				offset, partial = 0, nil
+			}
+		}
+
+		read, err := dm.readAppended(file, offset, &partial, opts.Conditions, handler)
+		offset += read
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readAppended processes the complete lines written after offset, keeping a
+// trailing incomplete line in partial, and returns the bytes consumed
+func (dm *DataManager) readAppended(file *os.File, offset int64, partial *[]byte, conditions []FilterCondition, handler func(map[string]interface{})) (int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var read int64
+	reader := bufio.NewReader(file)
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		read += int64(len(chunk))
+		if err == io.EOF {
+			*partial = append(*partial, chunk...)
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+
+		line := append(*partial, chunk...)
+		*partial = nil
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if dm.recordLimit > 0 && len(line) > dm.recordLimit {
+			parseErr := &ParseError{
+				Offset:  offset + read - int64(len(line)),
+				Snippet: snippet(line),
+				Err:     fmt.Errorf("record of %d bytes exceeds the %d byte limit", len(line), dm.recordLimit),
+			}
+			if err := dm.tolerate(parseErr); err != nil {
+				return read, err
+			}
+			continue
+		}
+		start := offset + read - int64(len(line))
+		raw := line
+		if line, err = dm.preprocessLine(bytes.TrimRight(raw, "\r\n")); err != nil {
+			if err := dm.tolerate(&ParseError{Offset: start, Snippet: snippet(raw), Err: err}); err != nil {
+				return read, err
+			}
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		record, err := dm.decodeRecord(line)
+		if err != nil {
+			parseErr := &ParseError{Offset: start, Snippet: snippet(line), Err: err}
+			if err := dm.tolerate(parseErr); err != nil {
+				return read, err
+			}
+			continue
+		}
+		dm.derive(record)
+		valid, err := dm.conforms(record)
+		if err != nil {
+			return read, err
+		}
+		if !valid {
+			continue
+		}
+		record = dm.intern(record, dm.keyName)
+		dm.applyWatched(record)
+		if dm.matchConditions(record, conditions) {
+			handler(record)
+		}
+	}
+}
+
+// applyWatched upserts an appended record into the in-memory data; in Split
+// mode, where no previous version is kept, subscribers see it as added
+func (dm *DataManager) applyWatched(record map[string]interface{}) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.assignSurrogateKey(record, dm.keyName, nil)
+	key, ok := recordKey(record, dm.keyName)
+	if dm.mode != InMemoryMode || dm.keyName == "" || !ok {
+		dm.notifyLocked(key, nil, record)
+		return
+	}
+	dm.putLocked(key, record)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// ZoneMapSuffix is appended to the path of a file to name its zone maps
+const ZoneMapSuffix = ".zones"
+
+// Default number of lines summarized by one zone
+const defaultZoneBlockLines = 64 * 1024
+
+// A zone map file starts with the magic and the size and modification time
+// (Unix nanoseconds) of the summarized file, then the number of fields
+// (uint16) and each field name's length (uint16) and bytes. One entry
+// follows per block: its start and end offsets (uint64) and lines (uint32),
+// then per field a flags byte and the minimum and maximum number (float64
+// bits) and time (Unix nanoseconds), all little-endian.
+var zoneMapMagic = [8]byte{'J', 'D', 'M', 'Z', 'O', 'N', '1', 0}
+
+// Flags of a field's zone in a block
+const (
+	zoneNumbers byte = 1 << iota // Holds numbers
+	zoneTimes                    // Holds strings parsed as times
+	zoneOther                    // Holds strings that are not times
+)
+
+// Bytes of a field's zone in a block entry
+const fieldZoneSize = 1 + 4*8
+
+// ZoneMapOptions configures BuildZoneMaps
+type ZoneMapOptions struct {
+	Fields     []string // Numeric or date fields to summarize; dotted paths reach nested fields
+	BlockLines int      // Lines per block (default 65536)
+}
+
+// ZoneMaps holds the minimum and maximum values of chosen fields within each
+// block of lines of an NDJSON file, as written by BuildZoneMaps
+type ZoneMaps struct {
+	Path    string      // Summarized file
+	Size    int64       // File size when summarized
+	ModTime time.Time   // File modification time when summarized
+	Fields  []string    // Summarized fields
+	Blocks  []ZoneBlock // Blocks in file order
+}
+
+// ZoneBlock summarizes the lines starting within [Start, End) of a file
+type ZoneBlock struct {
+	Start, End int64
+	Lines      int         // Non-blank lines of the block
+	Zones      []FieldZone // One per field of the zone maps
+}
+
+// FieldZone holds the range of a field's values within a block. Records
+// lacking the field, and values that are neither numbers nor strings, are
+// not counted.
+type FieldZone struct {
+	Numbers              bool // Whether the block holds numbers in the field
+	MinNumber, MaxNumber float64
+	Times                bool // Whether the block holds strings parsed as times in the field
+	MinTime, MaxTime     time.Time
+	Other                bool // Whether the block holds strings that are not times in the field
+}
+
+// BuildZoneMaps reads the NDJSON file at filePath and writes zone maps next
+// to it, named with ZoneMapSuffix: for each block of opts.BlockLines lines,
+// its byte range and the smallest and largest numbers and times held by
+// each of opts.Fields. Times are strings in a date or datetime layout, in
+// RFC 3339, or in one of the extra date layouts. Split-mode scans of the
+// unchanged file then skip the blocks whose ranges rule out an int
+// condition (<, <=, >, >= or ==) or a date or datetime condition on one of
+// these fields, reading the others in parallel, so a time-range query over
+// an append-ordered log reads only the blocks of that period. Blocks
+// holding a string in the field that is not a time are never skipped on
+// date conditions. Zones are computed from records as scans read them,
+// after coercion and computed fields. The zone map file is encrypted under
+// SetEncryption, since the ranges reveal values of the records, and an
+// existing one is replaced.
+func (dm *DataManager) BuildZoneMaps(filePath string, opts ZoneMapOptions) (*ZoneMaps, error) {
+	if len(opts.Fields) == 0 {
+		return nil, fmt.Errorf("Name the fields of the zone maps")
+	}
+	if len(opts.Fields) > math.MaxUint16 {
+		return nil, fmt.Errorf("Zone maps hold at most %d fields", math.MaxUint16)
+	}
+	blockLines := opts.BlockLines
+	if blockLines == 0 {
+		blockLines = defaultZoneBlockLines
+	}
+	if blockLines < 0 {
+		return nil, fmt.Errorf("Invalid block size %d lines", blockLines)
+	}
+	started := time.Now()
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	br := dm.chunkReader(f)
+	defer dm.releaseChunkReader(br)
+	if head, _ := br.Peek(2); bytes.Equal(head, []byte{0x1f, 0x8b}) {
+		return nil, fmt.Errorf("%s is compressed; zone maps need uncompressed newline-delimited JSON", filePath)
+	}
+	if sample, _ := br.Peek(charsetSampleSize); !dm.plainUTF8(sample) {
+		return nil, fmt.Errorf("%s is not UTF-8; zone maps need UTF-8 input", filePath)
+	}
+	if first, err := peekNonSpace(br); err == nil && first == '[' {
+		return nil, fmt.Errorf("%s holds a JSON array; zone maps need newline-delimited JSON", filePath)
+	}
+
+	zm := &ZoneMaps{Path: filePath, Size: info.Size(), ModTime: info.ModTime(), Fields: opts.Fields}
+	layouts := append(append([]string(nil), exprTimeLayouts...), dm.dateLayouts...)
+	block := ZoneBlock{Zones: make([]FieldZone, len(opts.Fields))}
+	var pos int64
+	for {
+		lineStart := pos
+		line, n, tooLong, err := readLine(br, nil, dm.recordLimit)
+		pos += int64(n)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n > 0 {
+			dm.track(n)
+		}
+
+		if tooLong {
+			parseErr := &ParseError{File: filePath, Offset: lineStart, Snippet: snippet(line), Err: fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, dm.recordLimit)}
+			if err := dm.tolerate(parseErr); err != nil {
+				return nil, err
+			}
+			block.Lines++
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			if err := dm.addToZones(&block, line, lineStart, zm.Fields, layouts); err != nil {
+				return nil, fmt.Errorf("%s: %w", filePath, err)
+			}
+			block.Lines++
+		}
+		if block.Lines == blockLines || (err == io.EOF && block.Lines > 0) {
+			block.End = pos
+			zm.Blocks = append(zm.Blocks, block)
+			block = ZoneBlock{Start: pos, Zones: make([]FieldZone, len(opts.Fields))}
+		}
+		if err == io.EOF {
+			if n := len(zm.Blocks); n > 0 {
+				zm.Blocks[n-1].End = pos // Trailing blank lines
+			}
+			break
+		}
+	}
+
+	if err := replaceFile(filePath+ZoneMapSuffix, dm.encryption, zm.encode); err != nil {
+		return nil, err
+	}
+	if dm.logger != nil {
+		dm.logger.Info("zone maps built", "source", filePath, "blocks", len(zm.Blocks), "duration", time.Since(started))
+	}
+	return zm, nil
+}
+
+// addToZones widens the zones of block with the records of a line
+func (dm *DataManager) addToZones(block *ZoneBlock, raw []byte, offset int64, fields, layouts []string) error {
+	line, err := dm.preprocessLine(raw)
+	if err != nil {
+		return dm.tolerate(&ParseError{Offset: offset, Snippet: snippet(raw), Err: err})
+	}
+	records, err := dm.decodeRecords(line)
+	if err != nil {
+		return dm.tolerate(&ParseError{Offset: offset, Snippet: snippet(line), Err: err})
+	}
+	for _, record := range records {
+		dm.derive(record)
+		for i, field := range fields {
+			if value, ok := resolvePath(record, field); ok {
+				block.Zones[i].add(value, layouts)
+			}
+		}
+	}
+	return nil
+}
+
+// add widens the zone with a value
+func (z *FieldZone) add(value interface{}, layouts []string) {
+	switch v := value.(type) {
+	case float64:
+		if !z.Numbers || v < z.MinNumber {
+			z.MinNumber = v
+		}
+		if !z.Numbers || v > z.MaxNumber {
+			z.MaxNumber = v
+		}
+		z.Numbers = true
+	case string:
+		t, ok := zoneTime(v, layouts)
+		if !ok {
+			z.Other = true
+			return
+		}
+		if !z.Times || t.Before(z.MinTime) {
+			z.MinTime = t
+		}
+		if !z.Times || t.After(z.MaxTime) {
+			z.MaxTime = t
+		}
+		z.Times = true
+	}
+}
+
+// zoneTime parses a string as a time for the zone maps with the first of
+// layouts that fits, which include every layout a date or datetime
+// condition may parse it with, within the range of Unix nanoseconds
+func zoneTime(s string, layouts []string) (time.Time, bool) {
+	t, ok := parseTime(s, layouts[0], layouts[1:])
+	if !ok || t.Year() < 1678 || t.Year() > 2261 {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// encode writes the zone maps in their file layout
+func (zm *ZoneMaps) encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	b := append([]byte(nil), zoneMapMagic[:]...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(zm.Size))
+	b = binary.LittleEndian.AppendUint64(b, uint64(zm.ModTime.UnixNano()))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(zm.Fields)))
+	for _, field := range zm.Fields {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(field)))
+		b = append(b, field...)
+	}
+	bw.Write(b)
+	for _, block := range zm.Blocks {
+		b = binary.LittleEndian.AppendUint64(b[:0], uint64(block.Start))
+		b = binary.LittleEndian.AppendUint64(b, uint64(block.End))
+		b = binary.LittleEndian.AppendUint32(b, uint32(block.Lines))
+		for _, z := range block.Zones {
+			var flags byte
+			if z.Numbers {
+				flags |= zoneNumbers
+			}
+			if z.Times {
+				flags |= zoneTimes
+			}
+			if z.Other {
+				flags |= zoneOther
+			}
+			b = append(b, flags)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(z.MinNumber))
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(z.MaxNumber))
+			b = binary.LittleEndian.AppendUint64(b, uint64(z.MinTime.UnixNano()))
+			b = binary.LittleEndian.AppendUint64(b, uint64(z.MaxTime.UnixNano()))
+		}
+		bw.Write(b)
+	}
+	return bw.Flush()
+}
+
+// ReadZoneMaps reads the zone maps of the NDJSON file at filePath written by
+// BuildZoneMaps. It fails with ErrStaleIndex when the file has changed
+// since, and with an error matching os.ErrNotExist when it has none.
+// Zone maps written under SetEncryption are read with the manager's
+// ReadZoneMaps.
+func ReadZoneMaps(filePath string) (*ZoneMaps, error) {
+	return readZoneMaps(filePath, nil)
+}
+
+// ReadZoneMaps reads the zone maps of the NDJSON file at filePath like the
+// package's ReadZoneMaps, decrypting them under SetEncryption
+func (dm *DataManager) ReadZoneMaps(filePath string) (*ZoneMaps, error) {
+	return readZoneMaps(filePath, dm.encryption)
+}
+
+// readZoneMaps reads the zone maps of filePath, decrypting them with c
+func readZoneMaps(filePath string, c *fileCipher) (*ZoneMaps, error) {
+	data, err := c.readFile(filePath + ZoneMapSuffix)
+	if err != nil {
+		return nil, err
+	}
+	invalid := fmt.Errorf("%s is not a zone map file", filePath+ZoneMapSuffix)
+	if len(data) < 26 || !bytes.Equal(data[:8], zoneMapMagic[:]) {
+		return nil, invalid
+	}
+	zm := &ZoneMaps{
+		Path:    filePath,
+		Size:    int64(binary.LittleEndian.Uint64(data[8:])),
+		ModTime: time.Unix(0, int64(binary.LittleEndian.Uint64(data[16:]))),
+	}
+	fields := int(binary.LittleEndian.Uint16(data[24:]))
+	rest := data[26:]
+	for i := 0; i < fields; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(binary.LittleEndian.Uint16(rest)) {
+			return nil, invalid
+		}
+		n := int(binary.LittleEndian.Uint16(rest))
+		zm.Fields = append(zm.Fields, string(rest[2:2+n]))
+		rest = rest[2+n:]
+	}
+	entrySize := 20 + fields*fieldZoneSize
+	if len(rest)%entrySize != 0 {
+		return nil, invalid
+	}
+	for ; len(rest) > 0; rest = rest[entrySize:] {
+		block := ZoneBlock{
+			Start: int64(binary.LittleEndian.Uint64(rest)),
+			End:   int64(binary.LittleEndian.Uint64(rest[8:])),
+			Lines: int(binary.LittleEndian.Uint32(rest[16:])),
+			Zones: make([]FieldZone, fields),
+		}
+		for i := range block.Zones {
+			b := rest[20+i*fieldZoneSize:]
+			block.Zones[i] = FieldZone{
+				Numbers:   b[0]&zoneNumbers != 0,
+				MinNumber: math.Float64frombits(binary.LittleEndian.Uint64(b[1:])),
+				MaxNumber: math.Float64frombits(binary.LittleEndian.Uint64(b[9:])),
+				Times:     b[0]&zoneTimes != 0,
+				MinTime:   time.Unix(0, int64(binary.LittleEndian.Uint64(b[17:]))).UTC(),
+				MaxTime:   time.Unix(0, int64(binary.LittleEndian.Uint64(b[25:]))).UTC(),
+				Other:     b[0]&zoneOther != 0,
+			}
+		}
+		zm.Blocks = append(zm.Blocks, block)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != zm.Size || !info.ModTime().Equal(zm.ModTime) {
+		return nil, fmt.Errorf("%w: %s changed since its zone maps were built", ErrStaleIndex, filePath)
+	}
+	return zm, nil
+}
+
+// mayMatch reports whether records of the block may match conditions; false
+// is certain
+func (dm *DataManager) mayMatch(zm *ZoneMaps, block ZoneBlock, conditions []FilterCondition) bool {
+	for _, condition := range conditions {
+		if dm.isComputed(condition.Key) {
+			continue
+		}
+		for i, field := range zm.Fields {
+			if field == condition.Key && !dm.zoneMayMatch(block.Zones[i], condition) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// zoneMayMatch reports whether a value within the zone may match condition
+func (dm *DataManager) zoneMayMatch(z FieldZone, condition FilterCondition) bool {
+	switch condition.ValueType {
+	case "int":
+		value, ok := condition.Value.(int)
+		if !ok {
+			return true
+		}
+		return z.Numbers && rangeMayMatch(condition.Operator, float64(value), z.MinNumber, z.MaxNumber)
+	case "date", "datetime":
+		layout := "2006-01-02"
+		if condition.ValueType == "datetime" {
+			layout = "2006-01-02 15:04:05"
+		}
+		value, ok := parseTime(condition.Value, layout, dm.dateLayouts)
+		if !ok || z.Other {
+			return true
+		}
+		return z.Times && rangeMayMatch(condition.Operator, value.UTC().Format(zoneTimeLayout), z.MinTime.Format(zoneTimeLayout), z.MaxTime.Format(zoneTimeLayout))
+	}
+	return true
+}
+
+// Layout of times compared by rangeMayMatch, which sorts them
+// lexicographically in chronological order
+const zoneTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// scanZones scans only the blocks of a local file whose zone maps leave
+// room for a match, reporting false when the file has no fresh zone maps
+// or they rule out no block
+func (dm *DataManager) scanZones(src Source, conditions []FilterCondition, budget *scanBudget) ([]map[string]interface{}, bool, error) {
+	fs, ok := src.(*fileSource)
+	if !ok || len(conditions) == 0 || dm.formatFor(fs.path) != "json" {
+		return nil, false, nil
+	}
+	zm, err := dm.ReadZoneMaps(fs.path)
+	if err != nil || len(zm.Blocks) == 0 {
+		return nil, false, nil
+	}
+	if lineDelimited, err := dm.isLineDelimited(fs); err != nil || !lineDelimited {
+		return nil, false, nil
+	}
+
+	// Adjacent blocks are read as one range
+	var ranges [][2]int64
+	for _, block := range zm.Blocks {
+		if !dm.mayMatch(zm, block, conditions) {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == block.Start {
+			ranges[n-1][1] = block.End
+		} else {
+			ranges = append(ranges, [2]int64{block.Start, block.End})
+		}
+	}
+	if len(ranges) == 1 && ranges[0] == [2]int64{0, zm.Size} {
+		return nil, false, nil
+	}
+	if dm.logger != nil {
+		dm.logger.Info("zone maps pruned blocks", "source", fs.path, "ranges", len(ranges), "blocks", len(zm.Blocks))
+	}
+
+	results := make([][]map[string]interface{}, len(ranges))
+	errs := make([]error, len(ranges))
+	sem := make(chan struct{}, dm.parallelism())
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, start, end int64) {
+			defer func() { <-sem; wg.Done() }()
+			results[i], errs[i] = dm.scanChunk(fs, start, end, conditions, budget)
+		}(i, r[0], r[1])
+	}
+	wg.Wait()
+
+	var filteredData []map[string]interface{}
+	for i := range results {
+		if errs[i] != nil {
+			return nil, true, errs[i]
+		}
+		filteredData = append(filteredData, results[i]...)
+	}
+	return filteredData, true, nil
+}